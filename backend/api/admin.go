@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"encoding/json"
 	"html/template"
-	"log"
 	"net/http"
 )
 
@@ -17,15 +16,7 @@ func AdminDashboard(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
-	query := "SELECT COUNT(*) FROM users WHERE id = ? and user_type = 1;"
-	var count int
-	db, err := sql.Open("sqlite3", DATABASEPATH)
-	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, "Database error")
-		return
-	}
-	db.QueryRow(query, userID).Scan(&count)
-	if count <= 0 {
+	if _, isAdmin := ValidateAdmin(w, r); !isAdmin {
 		HandleError(w, r, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
@@ -47,9 +38,9 @@ func AdminDashboard(w http.ResponseWriter, r *http.Request) {
 
 // Admin Stats API
 func AdminStats(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
 		return
 	}
 	defer db.Close()
@@ -63,68 +54,71 @@ func AdminStats(w http.ResponseWriter, r *http.Request) {
 		TotalRevenue  float64 `json:"total_revenue"`
 	}
 
-	// Count stores
-	db.QueryRow("SELECT COUNT(*) FROM stores").Scan(&stats.TotalStores)
-
-	// Count users
-	db.QueryRow("SELECT COUNT(*) FROM users").Scan(&stats.TotalUsers)
-
-	// Count products
-	db.QueryRow("SELECT COUNT(*) FROM products").Scan(&stats.TotalProducts)
-
-	// Count orders
-	db.QueryRow("SELECT COUNT(*) FROM orders").Scan(&stats.TotalOrders)
-
-	// Count pending orders
-	db.QueryRow("SELECT COUNT(*) FROM orders WHERE status != 'completed'").Scan(&stats.PendingOrders)
-
-	// Get total revenue
-	db.QueryRow("SELECT COALESCE(SUM(total_amount), 0) FROM orders WHERE status = 'completed'").Scan(&stats.TotalRevenue)
+	counts := []struct {
+		name  string
+		query string
+		dest  interface{}
+	}{
+		{"stores", "SELECT COUNT(*) FROM stores", &stats.TotalStores},
+		{"users", "SELECT COUNT(*) FROM users", &stats.TotalUsers},
+		{"products", "SELECT COUNT(*) FROM products", &stats.TotalProducts},
+		{"orders", "SELECT COUNT(*) FROM orders", &stats.TotalOrders},
+		{"pending_orders", "SELECT COUNT(*) FROM orders WHERE status != 'completed'", &stats.PendingOrders},
+		{"revenue", "SELECT COALESCE(SUM(total_amount), 0) FROM orders WHERE status = 'completed'", &stats.TotalRevenue},
+	}
+	for _, c := range counts {
+		if err := db.QueryRow(c.query).Scan(c.dest); err != nil {
+			Logger(r).Error("admin stats query failed", "stat", c.name, "error", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+			return
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 }
 
+// adminStoreListSpec is what GET /api/admin/stores filters and sorts by
+var adminStoreListSpec = ListSpec{
+	Key:  "s.id",
+	Sort: "-id",
+	Fields: map[string]ListField{
+		"id":            {Expr: "s.id", Kind: listInt, Filter: true, Sort: true},
+		"name":          {Expr: "s.name", Kind: listText, Sort: true, Search: true},
+		"template":      {Expr: "s.template", Kind: listText, Filter: true, Sort: true, Facet: true},
+		"owner":         {Expr: "u.first_name || ' ' || u.last_name", Kind: listText, Sort: true, Search: true},
+		"owner_id":      {Expr: "s.owner_id", Kind: listInt, Filter: true},
+		"product_count": {Expr: "(SELECT COUNT(*) FROM products p WHERE p.store_id = s.id)", Kind: listInt, Filter: true, Sort: true},
+	},
+}
+
 // Admin Stores API
 func AdminStores(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	w.Header().Set("Content-Type", "application/json")
+	list, err := adminStoreListSpec.Parse(r.URL.Query())
 	if err != nil {
-		http.Error(w, `[]`, http.StatusInternalServerError)
+		writeListError(w, r, "stores", err)
 		return
 	}
-	defer db.Close()
-
-	rows, err := db.Query(`
-		SELECT s.id, s.name, s.template, u.first_name || ' ' || u.last_name, COUNT(p.id) as product_count
-		FROM stores s
-		LEFT JOIN users u ON s.owner_id = u.id
-		LEFT JOIN products p ON s.id = p.store_id
-		GROUP BY s.id
-		ORDER BY s.id DESC
-	`)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		log.Println("Error querying stores:", err)
-		http.Error(w, `[]`, http.StatusInternalServerError)
+		writeListError(w, r, "stores", err)
 		return
 	}
-	defer rows.Close()
+	defer db.Close()
 
-	var stores []map[string]interface{}
-	for rows.Next() {
+	stores := []map[string]interface{}{}
+	page, err := list.Run(db, listSource{
+		Columns: "s.id, s.name, s.template, COALESCE(u.first_name || ' ' || u.last_name, ''), (SELECT COUNT(*) FROM products p WHERE p.store_id = s.id)",
+		From:    "stores s LEFT JOIN users u ON s.owner_id = u.id",
+		Where:   "1 = 1",
+	}, func(scan func(dest ...interface{}) error) error {
 		var id int
 		var name, template, owner string
 		var productCount int
-
-		if err := rows.Scan(&id, &name, &template, &owner, &productCount); err != nil {
-			continue
-		}
-
-		// Fetch store and set cookie
-		store, err := GetStoreByID(id)
-		if err == nil && store.ID != 0 {
-			SetStoreCookie(w, int(store.OwnerID), store.Name)
+		if err := scan(&id, &name, &template, &owner, &productCount); err != nil {
+			return err
 		}
-
 		stores = append(stores, map[string]interface{}{
 			"id":            id,
 			"name":          name,
@@ -132,48 +126,66 @@ func AdminStores(w http.ResponseWriter, r *http.Request) {
 			"owner":         owner,
 			"product_count": productCount,
 		})
+		return nil
+	})
+	if err != nil {
+		writeListError(w, r, "stores", err)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if stores == nil {
-		stores = []map[string]interface{}{}
+	// Fetch each store and set its cookie, once the listing no longer holds
+	// the database
+	for _, s := range stores {
+		store, err := GetStoreByID(s["id"].(int))
+		if err == nil && store.ID != 0 {
+			SetStoreCookie(w, r, int(store.OwnerID), store.Name)
+		}
 	}
-	json.NewEncoder(w).Encode(stores)
+	page.Data = stores
+	json.NewEncoder(w).Encode(page)
+}
+
+// adminUserListSpec is what GET /api/admin/users filters and sorts by
+var adminUserListSpec = ListSpec{
+	Key:  "u.id",
+	Sort: "-created_at",
+	Fields: map[string]ListField{
+		"id":          {Expr: "u.id", Kind: listInt, Filter: true, Sort: true},
+		"name":        {Expr: "u.first_name || ' ' || u.last_name", Kind: listText, Sort: true, Search: true},
+		"email":       {Expr: "u.email", Kind: listText, Sort: true, Search: true},
+		"created_at":  {Expr: "u.created_at", Kind: listTime, Filter: true, Sort: true},
+		"store_count": {Expr: "(SELECT COUNT(*) FROM stores s WHERE s.owner_id = u.id)", Kind: listInt, Filter: true, Sort: true},
+		"has_store":   {Expr: "EXISTS (SELECT 1 FROM stores s WHERE s.owner_id = u.id)", Kind: listBool, Filter: true, Facet: true},
+	},
 }
 
 // Admin Users API
 func AdminUsers(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	w.Header().Set("Content-Type", "application/json")
+	list, err := adminUserListSpec.Parse(r.URL.Query())
 	if err != nil {
-		http.Error(w, `[]`, http.StatusInternalServerError)
+		writeListError(w, r, "users", err)
 		return
 	}
-	defer db.Close()
-
-	rows, err := db.Query(`
-		SELECT u.id,  u.first_name || ' ' || u.last_name, u.email, u.created_at, COUNT(s.id) as store_count
-		FROM users u
-		LEFT JOIN stores s ON u.id = s.owner_id
-		GROUP BY u.id
-		ORDER BY u.created_at DESC
-	`)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		log.Println("Error querying users:", err)
-		http.Error(w, `[]`, http.StatusInternalServerError)
+		writeListError(w, r, "users", err)
 		return
 	}
-	defer rows.Close()
+	defer db.Close()
 
-	var users []map[string]interface{}
-	for rows.Next() {
+	users := []map[string]interface{}{}
+	page, err := list.Run(db, listSource{
+		Columns: "u.id, COALESCE(u.first_name || ' ' || u.last_name, ''), u.email, u.created_at, (SELECT COUNT(*) FROM stores s WHERE s.owner_id = u.id)",
+		From:    "users u",
+		Where:   "1 = 1",
+	}, func(scan func(dest ...interface{}) error) error {
 		var id int
 		var name, email, createdAt string
 		var storeCount int
-
-		if err := rows.Scan(&id, &name, &email, &createdAt, &storeCount); err != nil {
-			continue
+		if err := scan(&id, &name, &email, &createdAt, &storeCount); err != nil {
+			return err
 		}
-
 		users = append(users, map[string]interface{}{
 			"id":          id,
 			"name":        name,
@@ -181,49 +193,59 @@ func AdminUsers(w http.ResponseWriter, r *http.Request) {
 			"created_at":  createdAt,
 			"store_count": storeCount,
 		})
+		return nil
+	})
+	if err != nil {
+		writeListError(w, r, "users", err)
+		return
 	}
+	page.Data = users
+	json.NewEncoder(w).Encode(page)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if users == nil {
-		users = []map[string]interface{}{}
-	}
-	json.NewEncoder(w).Encode(users)
+// adminOrderListSpec is what GET /api/admin/orders filters and sorts by
+var adminOrderListSpec = ListSpec{
+	Key:  "o.id",
+	Sort: "-created_at",
+	Fields: map[string]ListField{
+		"id":         {Expr: "o.id", Kind: listInt, Filter: true, Sort: true},
+		"status":     {Expr: "o.status", Kind: listText, Values: orderStatuses, Filter: true, Sort: true, Facet: true},
+		"store_id":   {Expr: "o.store_id", Kind: listInt, Filter: true, Facet: true, Label: "s.name"},
+		"store_name": {Expr: "s.name", Kind: listText, Sort: true, Search: true},
+		"customer":   {Expr: "u.first_name || ' ' || u.last_name", Kind: listText, Sort: true, Search: true},
+		"email":      {Expr: "u.email", Kind: listText, Search: true},
+		"created_at": {Expr: "o.created_at", Kind: listTime, Filter: true, Sort: true},
+		"total":      {Expr: "o.total_amount", Kind: listNumber, Filter: true, Sort: true},
+	},
 }
 
 // Admin Orders API
 func AdminOrders(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	w.Header().Set("Content-Type", "application/json")
+	list, err := adminOrderListSpec.Parse(r.URL.Query())
 	if err != nil {
-		http.Error(w, `[]`, http.StatusInternalServerError)
+		writeListError(w, r, "orders", err)
 		return
 	}
-	defer db.Close()
-
-	rows, err := db.Query(`
-		SELECT o.id, o.created_at, o.total_amount, o.status, s.name, COALESCE(u.first_name || ' ' || u.last_name, u.email, 'Guest')
-		FROM orders o
-		LEFT JOIN stores s ON o.store_id = s.id
-		LEFT JOIN users u ON o.user_id = u.id
-		ORDER BY o.created_at DESC
-		LIMIT 100
-	`)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		log.Println("Error querying orders:", err)
-		http.Error(w, `[]`, http.StatusInternalServerError)
+		writeListError(w, r, "orders", err)
 		return
 	}
-	defer rows.Close()
+	defer db.Close()
 
-	var orders []map[string]interface{}
-	for rows.Next() {
+	orders := []map[string]interface{}{}
+	page, err := list.Run(db, listSource{
+		Columns: "o.id, o.created_at, o.total_amount, o.status, s.name, COALESCE(u.first_name || ' ' || u.last_name, u.email, 'Guest')",
+		From:    "orders o LEFT JOIN stores s ON o.store_id = s.id LEFT JOIN users u ON o.user_id = u.id",
+		Where:   "1 = 1",
+	}, func(scan func(dest ...interface{}) error) error {
 		var id int
 		var orderDate, status, customerName string
 		var totalAmount float64
 		var storeNamePtr *string
-
-		if err := rows.Scan(&id, &orderDate, &totalAmount, &status, &storeNamePtr, &customerName); err != nil {
-			log.Println("Error scanning order row:", err)
-			continue
+		if err := scan(&id, &orderDate, &totalAmount, &status, &storeNamePtr, &customerName); err != nil {
+			return err
 		}
 
 		storeNameVal := "N/A"
@@ -239,49 +261,60 @@ func AdminOrders(w http.ResponseWriter, r *http.Request) {
 			"store_name":    storeNameVal,
 			"customer_name": customerName,
 		})
+		return nil
+	})
+	if err != nil {
+		writeListError(w, r, "orders", err)
+		return
 	}
+	page.Data = orders
+	json.NewEncoder(w).Encode(page)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if orders == nil {
-		orders = []map[string]interface{}{}
-	}
-	json.NewEncoder(w).Encode(orders)
+// adminProductListSpec is what GET /api/admin/products filters and sorts by
+var adminProductListSpec = ListSpec{
+	Key:  "p.id",
+	Sort: "-id",
+	Fields: map[string]ListField{
+		"id":         {Expr: "p.id", Kind: listInt, Filter: true, Sort: true},
+		"name":       {Expr: "p.name", Kind: listText, Sort: true, Search: true},
+		"store_id":   {Expr: "p.store_id", Kind: listInt, Filter: true, Facet: true, Label: "s.name"},
+		"store_name": {Expr: "s.name", Kind: listText, Sort: true, Search: true},
+		"price":      {Expr: "p.price", Kind: listNumber, Filter: true, Sort: true},
+		"quantity":   {Expr: "p.quantity", Kind: listInt, Filter: true, Sort: true},
+		"in_stock":   {Expr: "p.quantity > 0", Kind: listBool, Filter: true, Facet: true},
+		"created_at": {Expr: "p.created_at", Kind: listTime, Filter: true, Sort: true},
+	},
 }
 
 // Admin Products API
 func AdminProducts(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	w.Header().Set("Content-Type", "application/json")
+	list, err := adminProductListSpec.Parse(r.URL.Query())
 	if err != nil {
-		http.Error(w, `[]`, http.StatusInternalServerError)
+		writeListError(w, r, "products", err)
 		return
 	}
-	defer db.Close()
-
-	rows, err := db.Query(`
-		SELECT p.id, p.name, p.price, p.quantity, s.name
-		FROM products p
-		LEFT JOIN stores s ON p.store_id = s.id
-		ORDER BY p.id DESC
-		LIMIT 100
-	`)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		log.Println("Error querying products:", err)
-		http.Error(w, `[]`, http.StatusInternalServerError)
+		writeListError(w, r, "products", err)
 		return
 	}
-	defer rows.Close()
+	defer db.Close()
 
-	var products []map[string]interface{}
-	for rows.Next() {
+	products := []map[string]interface{}{}
+	page, err := list.Run(db, listSource{
+		Columns: "p.id, p.name, p.price, p.quantity, COALESCE(s.name, '')",
+		From:    "products p LEFT JOIN stores s ON p.store_id = s.id",
+		Where:   "1 = 1",
+	}, func(scan func(dest ...interface{}) error) error {
 		var id int
 		var name, storeName string
 		var price float64
 		var quantity int
-
-		if err := rows.Scan(&id, &name, &price, &quantity, &storeName); err != nil {
-			continue
+		if err := scan(&id, &name, &price, &quantity, &storeName); err != nil {
+			return err
 		}
-
 		products = append(products, map[string]interface{}{
 			"id":         id,
 			"name":       name,
@@ -289,11 +322,12 @@ func AdminProducts(w http.ResponseWriter, r *http.Request) {
 			"quantity":   quantity,
 			"store_name": storeName,
 		})
+		return nil
+	})
+	if err != nil {
+		writeListError(w, r, "products", err)
+		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if products == nil {
-		products = []map[string]interface{}{}
-	}
-	json.NewEncoder(w).Encode(products)
+	page.Data = products
+	json.NewEncoder(w).Encode(page)
 }
@@ -0,0 +1,499 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store API keys let scripts call the v1 API for one store without a
+// browser session: "Authorization: Bearer ak_...". Only a key's SHA-256 is
+// stored, so a key is shown once, when it is created, and a lost key can
+// only be revoked. A key acts as the store's owner on that store alone, and
+// only on routes whose Scope it holds.
+
+// Scopes a key can hold. A write scope includes the matching read scope.
+const (
+	ScopeProductsRead  = "products:read"
+	ScopeProductsWrite = "products:write"
+	ScopeOrdersRead    = "orders:read"
+	ScopeOrdersWrite   = "orders:write"
+)
+
+var apiKeyScopes = []string{ScopeProductsRead, ScopeProductsWrite, ScopeOrdersRead, ScopeOrdersWrite}
+
+const (
+	apiKeyTokenPrefix = "ak_"
+	// apiKeyShownPrefix is how much of a key is kept in the clear, so
+	// owners can tell their keys apart
+	apiKeyShownPrefix = len(apiKeyTokenPrefix) + 8
+
+	defaultAPIKeyDays      = 90
+	maxAPIKeyDays          = 365
+	defaultAPIKeyRateLimit = 60
+	maxAPIKeyRateLimit     = 600
+	maxAPIKeysPerStore     = 20
+
+	// apiKeyTouchEvery is how stale last_used_at may get, so a busy key
+	// does not write on every request
+	apiKeyTouchEvery = time.Minute
+)
+
+// APIKey is a store API key as its owner sees it; the token itself is only
+// returned by CreateAPIKey
+type APIKey struct {
+	ID      int      `json:"id"`
+	StoreID int      `json:"store_id"`
+	Name    string   `json:"name"`
+	Prefix  string   `json:"prefix"`
+	Scopes  []string `json:"scopes"`
+	// RateLimit is the requests a minute the key may make
+	RateLimit  int    `json:"rate_limit"`
+	CreatedAt  string `json:"created_at"`
+	ExpiresAt  string `json:"expires_at"`
+	LastUsedAt string `json:"last_used_at,omitempty"`
+	RevokedAt  string `json:"revoked_at,omitempty"`
+
+	// ownerID is the store's owner, whom the key acts as
+	ownerID int
+}
+
+// allows reports whether the key holds scope, directly or through the
+// write scope of the same resource
+func (k *APIKey) allows(scope string) bool {
+	write := strings.TrimSuffix(scope, ":read") + ":write"
+	for _, s := range k.Scopes {
+		if s == scope || s == write {
+			return true
+		}
+	}
+	return false
+}
+
+// errInvalidAPIKey marks key requests that can never succeed as sent
+var errInvalidAPIKey = errors.New("invalid API key")
+
+func knownScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeScopes checks scopes against apiKeyScopes and sorts them
+func normalizeScopes(scopes []string) ([]string, error) {
+	seen := map[string]bool{}
+	var out []string
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if !knownScope(scope) {
+			return nil, fmt.Errorf("%w: unknown scope %q", errInvalidAPIKey, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			out = append(out, scope)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: a key needs at least one scope", errInvalidAPIKey)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func hashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKeyToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+const apiKeyColumns = `k.id, k.store_id, k.name, k.prefix, k.scopes, k.rate_limit, k.created_at,
+	k.expires_at, k.last_used_at, k.revoked_at, s.owner_id`
+
+func scanAPIKey(scan func(dest ...interface{}) error) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expiresAt, lastUsedAt, revokedAt sql.NullString
+	err := scan(&key.ID, &key.StoreID, &key.Name, &key.Prefix, &scopes, &key.RateLimit, &key.CreatedAt,
+		&expiresAt, &lastUsedAt, &revokedAt, &key.ownerID)
+	key.Scopes = strings.Split(scopes, ",")
+	key.ExpiresAt, key.LastUsedAt, key.RevokedAt = expiresAt.String, lastUsedAt.String, revokedAt.String
+	return key, err
+}
+
+// findAPIKey looks up a bearer token. Unknown, revoked and expired keys are
+// all errInvalidAPIKey; the message says which.
+func findAPIKey(db *sql.DB, token string) (*APIKey, error) {
+	if !strings.HasPrefix(token, apiKeyTokenPrefix) {
+		return nil, fmt.Errorf("%w: not an API key", errInvalidAPIKey)
+	}
+	// expiry is compared in SQL, where expires_at has the same format as
+	// datetime('now'); a NULL expires_at never expires
+	var expired bool
+	row := db.QueryRow(`
+		SELECT `+apiKeyColumns+`, k.expires_at IS NOT NULL AND k.expires_at <= datetime('now')
+		FROM api_keys k JOIN stores s ON s.id = k.store_id
+		WHERE k.key_hash = ?
+	`, hashAPIKey(token))
+	key, err := scanAPIKey(func(dest ...interface{}) error {
+		return row.Scan(append(dest, &expired)...)
+	})
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: unknown API key", errInvalidAPIKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != "" {
+		return nil, fmt.Errorf("%w: the API key was revoked", errInvalidAPIKey)
+	}
+	if expired {
+		return nil, fmt.Errorf("%w: the API key has expired", errInvalidAPIKey)
+	}
+	return &key, nil
+}
+
+func listAPIKeys(db *sql.DB, storeID int) ([]APIKey, error) {
+	rows, err := db.Query(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys k JOIN stores s ON s.id = k.store_id
+		WHERE k.store_id = ?
+		ORDER BY k.revoked_at IS NOT NULL, k.id DESC
+	`, storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+const apiKeyKey contextKey = requestInfoKey + 1
+
+// requestAPIKey is the key a v1 request authenticated with, if any
+func requestAPIKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyKey).(*APIKey)
+	return key
+}
+
+// bearerToken is the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// apiKeyLimiter counts each key's requests in fixed one-minute windows. The
+// counts are per process, like the metrics.
+type apiKeyLimiter struct {
+	mu      sync.Mutex
+	windows map[int]*apiKeyWindow
+}
+
+type apiKeyWindow struct {
+	start   time.Time
+	count   int
+	touched time.Time
+}
+
+var apiKeyLimits = &apiKeyLimiter{windows: map[int]*apiKeyWindow{}}
+
+// take counts a request of key. It returns the requests left in the window
+// and, when none were left, how long until the next window. touch reports
+// whether last_used_at is due for an update.
+func (l *apiKeyLimiter) take(key *APIKey, now time.Time) (remaining int, retryAfter time.Duration, touch bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	window := l.windows[key.ID]
+	if window == nil {
+		window = &apiKeyWindow{}
+		l.windows[key.ID] = window
+	}
+	if now.Sub(window.start) >= time.Minute {
+		window.start = now
+		window.count = 0
+	}
+	if window.count >= key.RateLimit {
+		return 0, window.start.Add(time.Minute).Sub(now), false
+	}
+	window.count++
+	if now.Sub(window.touched) >= apiKeyTouchEvery {
+		window.touched = now
+		touch = true
+	}
+	return key.RateLimit - window.count, 0, touch
+}
+
+// withAPIKey authenticates requests that carry a bearer token. The route
+// must have a scope and the key must hold it; a store_id in the query must
+// be the key's store. Requests without a token go straight through.
+func withAPIKey(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if scope == "" {
+			apiKeyRequestsTotal.Inc("forbidden")
+			writeAPIError(w, NewAPIError(http.StatusForbidden, "This endpoint cannot be called with an API key"))
+			return
+		}
+
+		db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+		if err != nil {
+			writeAPIError(w, NewAPIError(http.StatusInternalServerError, "Database error"))
+			return
+		}
+		defer db.Close()
+		key, err := findAPIKey(db, token)
+		if errors.Is(err, errInvalidAPIKey) {
+			apiKeyRequestsTotal.Inc("invalid")
+			e := NewAPIError(http.StatusUnauthorized, strings.TrimPrefix(err.Error(), errInvalidAPIKey.Error()+": "))
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeAPIError(w, e)
+			return
+		}
+		if err != nil {
+			Logger(r).Error("API key lookup failed", "error", err)
+			writeAPIError(w, NewAPIError(http.StatusInternalServerError, "Database error"))
+			return
+		}
+		setRequestUser(r, key.ownerID)
+		setRequestStore(r, key.StoreID)
+
+		if !key.allows(scope) {
+			apiKeyRequestsTotal.Inc("forbidden")
+			e := NewAPIError(http.StatusForbidden, "The API key does not have the "+scope+" scope")
+			e.Details = map[string]interface{}{"scope": scope}
+			writeAPIError(w, e)
+			return
+		}
+		if storeID := r.URL.Query().Get("store_id"); storeID != "" && storeID != strconv.Itoa(key.StoreID) {
+			apiKeyRequestsTotal.Inc("forbidden")
+			writeAPIError(w, NewAPIError(http.StatusForbidden, "The API key belongs to another store"))
+			return
+		}
+
+		remaining, retryAfter, touch := apiKeyLimits.take(key, time.Now())
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(key.RateLimit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if retryAfter > 0 {
+			apiKeyRequestsTotal.Inc("rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+			writeAPIError(w, NewAPIError(http.StatusTooManyRequests, "Rate limit of "+strconv.Itoa(key.RateLimit)+" requests a minute exceeded"))
+			return
+		}
+		if touch {
+			if _, err := db.Exec("UPDATE api_keys SET last_used_at = datetime('now') WHERE id = ?", key.ID); err != nil {
+				Logger(r).Warn("API key last use not recorded", "key_id", key.ID, "error", err)
+			}
+		}
+		apiKeyRequestsTotal.Inc("allowed")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyKey, key)))
+	})
+}
+
+// ListAPIKeys lists a store's API keys, revoked ones last:
+// GET /api/v1/stores/keys?store_id=
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
+		return
+	}
+	if _, ok := ValidateStoreOwner(w, r, storeID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+	keys, err := listAPIKeys(db, storeID)
+	if err != nil {
+		Logger(r).Error("API key list failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch API keys")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// createAPIKeyRequest is the body of CreateAPIKey
+type createAPIKeyRequest struct {
+	StoreID int      `json:"store_id"`
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+	// ExpiresInDays is 90 when zero, and at most 365
+	ExpiresInDays int `json:"expires_in_days"`
+	// RateLimit is requests a minute, 60 when zero, and at most 600
+	RateLimit int `json:"rate_limit"`
+}
+
+// CreateAPIKey issues an API key for a store: POST /api/v1/stores/keys/create
+// with {"store_id", "name", "scopes", "expires_in_days", "rate_limit"}. The
+// answer holds the token, which cannot be read again.
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	userID, ok := ValidateStoreOwner(w, r, req.StoreID)
+	if !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	key, token, err := createAPIKey(userID, req)
+	if errors.Is(err, errInvalidAPIKey) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, invalidMessage(err, errInvalidAPIKey))
+		return
+	}
+	if err != nil {
+		Logger(r).Error("API key creation failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create API key")
+		return
+	}
+	Logger(r).Info("API key created", "key_id", key.ID, "scopes", strings.Join(key.Scopes, ","))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": key, "token": token})
+}
+
+func createAPIKey(userID int, req createAPIKeyRequest) (*APIKey, string, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		return nil, "", fmt.Errorf("%w: a key needs a name of at most 64 characters", errInvalidAPIKey)
+	}
+	scopes, err := normalizeScopes(req.Scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultAPIKeyDays
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPIKeyDays {
+		return nil, "", fmt.Errorf("%w: a key expires in 1 to %d days", errInvalidAPIKey, maxAPIKeyDays)
+	}
+	if req.RateLimit == 0 {
+		req.RateLimit = defaultAPIKeyRateLimit
+	}
+	if req.RateLimit < 0 || req.RateLimit > maxAPIKeyRateLimit {
+		return nil, "", fmt.Errorf("%w: the rate limit is 1 to %d requests a minute", errInvalidAPIKey, maxAPIKeyRateLimit)
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+	var active int
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM api_keys
+		WHERE store_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > datetime('now'))
+	`, req.StoreID).Scan(&active); err != nil {
+		return nil, "", err
+	}
+	if active >= maxAPIKeysPerStore {
+		return nil, "", fmt.Errorf("%w: a store can have %d active keys; revoke one first", errInvalidAPIKey, maxAPIKeysPerStore)
+	}
+
+	token, err := newAPIKeyToken()
+	if err != nil {
+		return nil, "", err
+	}
+	expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+	result, err := db.Exec(`
+		INSERT INTO api_keys (store_id, name, prefix, key_hash, scopes, rate_limit, created_by, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.StoreID, req.Name, token[:apiKeyShownPrefix], hashAPIKey(token), strings.Join(scopes, ","),
+		req.RateLimit, userID, sqlTime(expiresAt))
+	if err != nil {
+		return nil, "", err
+	}
+	id, _ := result.LastInsertId()
+	key, err := scanAPIKey(db.QueryRow(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys k JOIN stores s ON s.id = k.store_id
+		WHERE k.id = ?
+	`, id).Scan)
+	if err != nil {
+		return nil, "", err
+	}
+	return &key, token, nil
+}
+
+// revokeAPIKeyRequest is the body of RevokeAPIKey
+type revokeAPIKeyRequest struct {
+	StoreID int `json:"store_id"`
+	ID      int `json:"id"`
+}
+
+// RevokeAPIKey stops a key working at once: POST /api/v1/stores/keys/revoke
+// with {"store_id", "id"}
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req revokeAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	if _, ok := ValidateStoreOwner(w, r, req.StoreID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+	result, err := db.Exec(`
+		UPDATE api_keys SET revoked_at = datetime('now')
+		WHERE id = ? AND store_id = ? AND revoked_at IS NULL
+	`, req.ID, req.StoreID)
+	if err != nil {
+		Logger(r).Error("API key revocation failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to revoke API key")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "API key not found")
+		return
+	}
+	Logger(r).Info("API key revoked", "key_id", req.ID)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFindAPIKeyExpiry(t *testing.T) {
+	db := openTestDB(t)
+	userID, storeID, _ := createTestStore(t, db)
+	newKey := func(expiresAt interface{}) string {
+		token, err := newAPIKeyToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustExec(t, db, `
+			INSERT INTO api_keys (store_id, name, prefix, key_hash, scopes, rate_limit, created_by, expires_at)
+			VALUES (?, 'test', ?, ?, ?, 60, ?, ?)
+		`, storeID, token[:apiKeyShownPrefix], hashAPIKey(token), ScopeOrdersRead, userID, expiresAt)
+		return token
+	}
+
+	for name, expiresAt := range map[string]interface{}{
+		"expires later": sqlTime(time.Now().Add(time.Hour)),
+		"never expires": nil,
+	} {
+		if _, err := findAPIKey(db, newKey(expiresAt)); err != nil {
+			t.Errorf("key that %s: %v", name, err)
+		}
+	}
+	// written by datetime(), as SQL and the admin tools do
+	expired := newKey(nil)
+	mustExec(t, db, "UPDATE api_keys SET expires_at = datetime('now', '-1 minute') WHERE key_hash = ?", hashAPIKey(expired))
+	for name, token := range map[string]string{
+		"expired by datetime()": expired,
+		"expired by sqlTime":    newKey(sqlTime(time.Now().Add(-time.Second))),
+	} {
+		if _, err := findAPIKey(db, token); !errors.Is(err, errInvalidAPIKey) {
+			t.Errorf("key %s: %v, want errInvalidAPIKey", name, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ErrorCode is the machine-readable kind of an API error. Clients branch on
+// the code; the message is for people and may change.
+type ErrorCode string
+
+const (
+	// codes a handler picks for what went wrong
+	CodeMalformedBody      ErrorCode = "malformed_body"
+	CodeMissingField       ErrorCode = "missing_field"
+	CodeInvalidField       ErrorCode = "invalid_field"
+	CodeInvalidCredentials ErrorCode = "invalid_credentials"
+	CodeInvalidCode        ErrorCode = "invalid_code"
+	CodeAlreadyExists      ErrorCode = "already_exists"
+	CodeOutOfStock         ErrorCode = "out_of_stock"
+	CodeInvalidState       ErrorCode = "invalid_state"
+	CodeVersionConflict    ErrorCode = "version_conflict"
+	CodeInvalidUpload      ErrorCode = "invalid_upload"
+
+	// codes that follow from the status alone
+	CodeInvalidRequest       ErrorCode = "invalid_request"
+	CodeUnauthorized         ErrorCode = "unauthorized"
+	CodeForbidden            ErrorCode = "forbidden"
+	CodeNotFound             ErrorCode = "not_found"
+	CodeMethodNotAllowed     ErrorCode = "method_not_allowed"
+	CodeConflict             ErrorCode = "conflict"
+	CodePayloadTooLarge      ErrorCode = "payload_too_large"
+	CodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	CodeRateLimited          ErrorCode = "rate_limited"
+	CodeInternal             ErrorCode = "internal_error"
+	CodeUnavailable          ErrorCode = "unavailable"
+)
+
+var errorCodes = []ErrorCode{
+	CodeMalformedBody, CodeMissingField, CodeInvalidField, CodeInvalidCredentials, CodeInvalidCode, CodeAlreadyExists,
+	CodeOutOfStock, CodeInvalidState, CodeVersionConflict, CodeInvalidUpload,
+	CodeInvalidRequest, CodeUnauthorized, CodeForbidden, CodeNotFound, CodeMethodNotAllowed, CodeConflict,
+	CodePayloadTooLarge, CodeUnsupportedMediaType, CodeRateLimited, CodeInternal, CodeUnavailable,
+}
+
+// APIError is the error body of every /api/v1 response:
+//
+//	{"error": {"code": "not_found", "message": "Order not found"}}
+//
+// Details carries whatever else the handler reported with the error, such as
+// the current state of a record that could not be changed.
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    ErrorCode              `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// errorEnvelope wraps an APIError under the "error" key
+type errorEnvelope struct {
+	Error *APIError `json:"error"`
+}
+
+// NewAPIError returns an error with the code of an HTTP status. An empty
+// message becomes the status text.
+func NewAPIError(status int, message string) *APIError {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return &APIError{Status: status, Code: errorCodeFor(status), Message: message}
+}
+
+// With adds a detail to the error
+func (e *APIError) With(key string, value interface{}) *APIError {
+	if e.Details == nil {
+		e.Details = map[string]interface{}{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+// errorCodeFor maps a status to its code; statuses without one of their own
+// fall back to the class of the status
+func errorCodeFor(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CodeUnavailable
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeInvalidRequest
+}
+
+// writeError answers r with an error whose code says what went wrong
+func writeError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	sendError(w, r, &APIError{Status: status, Code: code, Message: message})
+}
+
+// invalidMessage is the message of err without the sentinel it wraps
+func invalidMessage(err error, sentinel error) string {
+	return strings.TrimPrefix(err.Error(), sentinel.Error()+": ")
+}
+
+// sendError answers r with e: as an APIError on /api/v1, and on the
+// deprecated aliases as the {"error": "message", ...details} body they have
+// always had
+func sendError(w http.ResponseWriter, r *http.Request, e *APIError) {
+	if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		writeAPIError(w, e)
+		return
+	}
+	body := map[string]interface{}{}
+	for key, value := range e.Details {
+		body[key] = value
+	}
+	body["error"] = e.Message
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, e *APIError) {
+	// typed errors go past the apiErrors check untouched
+	if ew, ok := w.(*apiErrorWriter); ok {
+		ew.typed = true
+		w = ew.ResponseWriter
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(errorEnvelope{Error: e})
+}
+
+// apiErrorWriter holds back the body of an error response that was not
+// written as an APIError, so it cannot reach v1 clients in another shape;
+// other responses pass straight through
+type apiErrorWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	typed       bool
+	body        bytes.Buffer
+}
+
+func (w *apiErrorWriter) WriteHeader(status int) {
+	if w.wroteHeader || w.typed {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if status < 400 {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *apiErrorWriter) Write(p []byte) (int, error) {
+	if w.typed {
+		return len(p), nil
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.status >= 400 {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *apiErrorWriter) Flush() {
+	if w.status >= 400 || w.typed {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *apiErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish answers an untyped error with the bare code of its status. Every
+// v1 handler writes APIErrors, so this is a bug to be logged and fixed.
+func (w *apiErrorWriter) finish(r *http.Request) {
+	if w.typed || w.status < 400 {
+		return
+	}
+	Logger(r).Error("untyped API error", "path", r.URL.Path, "status", w.status, "body", w.body.String())
+	writeAPIError(w.ResponseWriter, NewAPIError(w.status, ""))
+}
+
+// apiErrors makes sure every error a v1 handler writes is an APIError
+func apiErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &apiErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		ew.finish(r)
+	})
+}
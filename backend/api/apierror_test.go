@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTypedErrorCodes(t *testing.T) {
+	mux := http.NewServeMux()
+	if err := RegisterAPIRoutes(mux); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t)
+	_, storeID, _ := createTestStore(t, db)
+	productID := createTestProduct(t, db, storeID, 1)
+	mustExec(t, db, "INSERT INTO product_variants (product_id, price, quantity) VALUES (?, 25, 1)", productID)
+	customerID := createTestUser(t, db)
+	token := "customer-" + strconv.Itoa(customerID)
+	mustExec(t, db, "INSERT INTO sessions (session_token, user_id) VALUES (?, ?)", token, customerID)
+	var storeName string
+	db.QueryRow("SELECT name FROM stores WHERE id = ?", storeID).Scan(&storeName)
+
+	send := func(path string, contentType string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Store-Name", "/"+storeName)
+		req.AddCookie(&http.Cookie{Name: "customer_token_" + strconv.Itoa(storeID), Value: token})
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range []struct {
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{`{"product_id": ` + strconv.Itoa(productID) + `, "quantity": 5}`, http.StatusBadRequest, CodeOutOfStock},
+		{`{"product_id": ` + strconv.Itoa(productID) + `, "quantity": -1}`, http.StatusBadRequest, CodeInvalidField},
+		{`{"product_id": "lamp"}`, http.StatusBadRequest, CodeMalformedBody},
+	} {
+		w := send("/api/v1/cart/items", "application/json", tc.body)
+		var got errorEnvelope
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got.Error == nil {
+			t.Errorf("%s: body is not an APIError: %v", tc.body, err)
+			continue
+		}
+		if w.Code != tc.status || got.Error.Code != tc.code {
+			t.Errorf("%s: %d %s, want %d %s", tc.body, w.Code, got.Error.Code, tc.status, tc.code)
+		}
+		if tc.code == CodeOutOfStock && got.Error.Details["available"] != 1.0 {
+			t.Errorf("out of stock details = %v", got.Error.Details)
+		}
+	}
+
+	// the deprecated alias keeps its flat body, details included
+	form := url.Values{"product_id": {strconv.Itoa(productID)}, "quantity": {"5"}}
+	w := send("/api/add-to-cart", "application/x-www-form-urlencoded", form.Encode())
+	var legacy map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&legacy)
+	if w.Code != http.StatusBadRequest || legacy["error"] != "Only 1 items available" || legacy["available"] != 1.0 {
+		t.Errorf("legacy out of stock = %d %v", w.Code, legacy)
+	}
+}
+
+func TestUntypedErrorsGetTheirStatusCode(t *testing.T) {
+	h := apiErrors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "Item is gone"}`, http.StatusConflict)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/items", nil))
+	var got errorEnvelope
+	json.NewDecoder(w.Body).Decode(&got)
+	if w.Code != http.StatusConflict || got.Error == nil || got.Error.Code != CodeConflict || got.Error.Message != "Conflict" {
+		t.Errorf("untyped error = %d %+v", w.Code, got.Error)
+	}
+}
@@ -0,0 +1,383 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobStore keeps uploaded files. Keys are slash separated paths mirroring
+// the local upload folders, e.g. "store_images/products/<file>", so both
+// implementations lay files out the same way. BLOB_STORE picks the
+// implementation: local (files under BLOB_LOCAL_ROOT, the working directory
+// by default) or s3 (any S3-compatible service, see s3StoreFromEnv).
+type BlobStore interface {
+	Name() string
+	Put(key string, data []byte, contentType string) error
+	// Get returns errBlobNotFound when the key does not exist
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (BlobInfo, error)
+	// Delete does not fail for keys that do not exist
+	Delete(key string) error
+	// List returns every key under prefix, including nested ones
+	List(prefix string) ([]BlobInfo, error)
+	// URL returns a signed link that downloads key until expiry has passed
+	URL(key string, expiry time.Duration) (string, error)
+}
+
+// BlobInfo describes a stored file
+type BlobInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobURLExpiry is how long the signed links handed to browsers stay valid
+const blobURLExpiry = time.Hour
+
+var (
+	blobStoreMu sync.Mutex
+	blobStore   BlobStore
+)
+
+// currentBlobStore builds the configured store on first use
+func currentBlobStore() BlobStore {
+	blobStoreMu.Lock()
+	defer blobStoreMu.Unlock()
+	if blobStore == nil {
+		store, err := blobStoreFromEnv()
+		if err != nil {
+			slog.Error("invalid blob store configuration, using local files", "error", err)
+			store = NewLocalBlobStore(".")
+		}
+		blobStore = store
+	}
+	return blobStore
+}
+
+// SetBlobStore replaces the blob store, e.g. with a fake S3 server in tests
+func SetBlobStore(store BlobStore) {
+	blobStoreMu.Lock()
+	defer blobStoreMu.Unlock()
+	blobStore = store
+}
+
+func blobStoreFromEnv() (BlobStore, error) {
+	switch strings.ToLower(envOr("BLOB_STORE", "local")) {
+	case "local":
+		return NewLocalBlobStore(envOr("BLOB_LOCAL_ROOT", ".")), nil
+	case "s3":
+		return s3StoreFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", os.Getenv("BLOB_STORE"))
+	}
+}
+
+// blobKey is the key of a file in one of the upload folders (the *Path
+// constants); name may contain a sub folder such as thumbs/
+func blobKey(dir string, name string) string {
+	return path.Join(filepath.ToSlash(dir), filepath.ToSlash(name))
+}
+
+// uploadKey is the key of a file requested from one of the upload folders.
+// The name comes from the URL, where an encoded "..%2f" survives routing, so
+// the key must still be inside dir once cleaned.
+func uploadKey(dir string, name string) (string, bool) {
+	key := blobKey(dir, name)
+	return key, validBlobKey(key) && strings.HasPrefix(key, path.Clean(filepath.ToSlash(dir))+"/")
+}
+
+// validBlobKey rejects keys that could escape the store
+func validBlobKey(key string) bool {
+	return key != "" && key != "." && !strings.HasPrefix(key, "/") && path.Clean(key) == key &&
+		key != ".." && !strings.HasPrefix(key, "../")
+}
+
+// blobContentType guesses the type a file is served with from its extension
+func blobContentType(key string) string {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".glb":
+		return "model/gltf-binary"
+	case ".gltf":
+		return "model/gltf+json"
+	case ".usdz":
+		return "model/vnd.pixar.usdz+zip"
+	}
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// putUpload stores an uploaded file in one of the upload folders
+func putUpload(dir string, name string, data []byte) error {
+	key := blobKey(dir, name)
+	return currentBlobStore().Put(key, data, blobContentType(key))
+}
+
+// removeUpload deletes an uploaded file, logging rather than failing since
+// callers are already cleaning up
+func removeUpload(dir string, name string) {
+	if err := currentBlobStore().Delete(blobKey(dir, name)); err != nil {
+		slog.Warn("failed to delete upload", "dir", dir, "file", name, "error", err)
+	}
+}
+
+// uploadExists reports whether an uploaded file is in the store
+func uploadExists(dir string, name string) bool {
+	_, err := currentBlobStore().Stat(blobKey(dir, name))
+	return err == nil
+}
+
+// serveBlob answers with a stored file of dir, or 404 for names outside it;
+// local files are served directly,
+// other stores redirect to a signed URL so the bytes never pass through here
+func serveBlob(w http.ResponseWriter, r *http.Request, dir string, name string) {
+	key, ok := uploadKey(dir, name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	store := currentBlobStore()
+	if local, ok := store.(*LocalBlobStore); ok {
+		file := local.path(key)
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, file)
+		return
+	}
+	link, err := store.URL(key, blobURLExpiry)
+	if err != nil {
+		Logger(r).Error("failed to sign blob URL", "key", key, "error", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	// the link expires, so browsers must come back for a new one
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	http.Redirect(w, r, link, http.StatusFound)
+}
+
+// ServeUploads serves the files of an upload folder from the blob store
+func ServeUploads(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveBlob(w, r, dir, r.URL.Path)
+	})
+}
+
+// LocalBlobStore keeps blobs as files under Root
+type LocalBlobStore struct {
+	Root string
+}
+
+// NewLocalBlobStore stores blobs under root
+func NewLocalBlobStore(root string) *LocalBlobStore {
+	return &LocalBlobStore{Root: root}
+}
+
+func (s *LocalBlobStore) Name() string { return "local" }
+
+func (s *LocalBlobStore) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(key))
+}
+
+// Put writes through a temporary file so readers never see half a file
+func (s *LocalBlobStore) Put(key string, data []byte, contentType string) error {
+	if !validBlobKey(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	file := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (s *LocalBlobStore) Get(key string) (io.ReadCloser, error) {
+	if !validBlobKey(key) {
+		return nil, errBlobNotFound
+	}
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Stat(key string) (BlobInfo, error) {
+	if !validBlobKey(key) {
+		return BlobInfo{}, errBlobNotFound
+	}
+	info, err := os.Stat(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+		return BlobInfo{}, errBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return nil
+	}
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalBlobStore) List(prefix string) ([]BlobInfo, error) {
+	// walk the deepest folder the prefix names, then filter on the rest
+	dir := prefix
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		dir = dir[:i]
+	} else {
+		dir = ""
+	}
+	var blobs []BlobInfo
+	err := filepath.WalkDir(s.path(dir), func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(file, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return blobs, err
+}
+
+// URL links to ServeSignedBlob with an expiry and an HMAC of both
+func (s *LocalBlobStore) URL(key string, expiry time.Duration) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	query := url.Values{
+		"expires":   {expires},
+		"signature": {signValue("blob_urls", key+"\n"+expires)},
+	}
+	return "/blobs/" + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+// ServeSignedBlob serves the links made by LocalBlobStore.URL:
+// GET /blobs/<key>?expires=<unix time>&signature=<hmac>
+func ServeSignedBlob(w http.ResponseWriter, r *http.Request) {
+	local, ok := currentBlobStore().(*LocalBlobStore)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	expires := r.URL.Query().Get("expires")
+	deadline, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !validBlobKey(key) || !verifySignature("blob_urls", key+"\n"+expires, r.URL.Query().Get("signature")) {
+		http.Error(w, "Invalid link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > deadline {
+		http.Error(w, "Link expired", http.StatusForbidden)
+		return
+	}
+	file := local.path(key)
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	http.ServeFile(w, r, file)
+}
+
+// MigrateLocalUploads copies the files in the local upload folders into the
+// configured store when that is not the local one. Keys already in the store
+// are skipped, so it is safe to run on every start and on every instance.
+func MigrateLocalUploads(ctx context.Context) error {
+	store := currentBlobStore()
+	if _, ok := store.(*LocalBlobStore); ok {
+		return nil
+	}
+	local := NewLocalBlobStore(".")
+	copied, skipped := 0, 0
+	for _, dir := range storageDirs {
+		blobs, err := local.List(blobKey(dir, "") + "/")
+		if err != nil {
+			return fmt.Errorf("list %s: %w", dir, err)
+		}
+		for _, blob := range blobs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if strings.HasPrefix(path.Base(blob.Key), ".readyz-") {
+				continue
+			}
+			if _, err := store.Stat(blob.Key); err == nil {
+				skipped++
+				continue
+			} else if !errors.Is(err, errBlobNotFound) {
+				return fmt.Errorf("stat %s: %w", blob.Key, err)
+			}
+			data, err := os.ReadFile(local.path(blob.Key))
+			if err != nil {
+				return err
+			}
+			if err := store.Put(blob.Key, data, blobContentType(blob.Key)); err != nil {
+				return fmt.Errorf("upload %s: %w", blob.Key, err)
+			}
+			copied++
+		}
+	}
+	slog.Info("migrated local uploads", "store", store.Name(), "copied", copied, "already_present", skipped)
+	return nil
+}
+
+// checkBlobStore writes, reads back and deletes a probe file
+func checkBlobStore(store BlobStore) error {
+	key := "readyz/probe-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := store.Put(key, []byte("ok"), "text/plain"); err != nil {
+		return err
+	}
+	if _, err := store.Stat(key); err != nil {
+		return err
+	}
+	return store.Delete(key)
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shipment statuses, in the order a parcel normally goes through them
+const (
+	ShipmentLabelCreated   = "label_created"
+	ShipmentInTransit      = "in_transit"
+	ShipmentOutForDelivery = "out_for_delivery"
+	ShipmentDelivered      = "delivered"
+	ShipmentException      = "exception"
+)
+
+// manualCarrier is the carrier of shipments the owner booked elsewhere and
+// only typed a tracking number in for. They get no label and are not polled.
+const manualCarrier = "manual"
+
+// Parcel is what a carrier needs to price and book a shipment
+type Parcel struct {
+	From  string
+	To    ShippingAddress
+	Items int
+}
+
+// ShippingRate is one service a carrier offers for a parcel
+type ShippingRate struct {
+	Carrier string  `json:"carrier"`
+	Service string  `json:"service"`
+	Amount  float64 `json:"amount"`
+	Days    int     `json:"days"`
+}
+
+// ShippingLabel is a booked parcel
+type ShippingLabel struct {
+	TrackingNumber string
+	LabelURL       string
+	Cost           float64
+	Days           int
+}
+
+// TrackingEvent is one scan of a parcel reported by its carrier
+type TrackingEvent struct {
+	Status      string    `json:"status"`
+	Description string    `json:"description"`
+	Location    string    `json:"location,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+// Carrier quotes, books and tracks parcels with one shipping company.
+// SHIPPING_CARRIERS lists the enabled carriers by name.
+type Carrier interface {
+	Name() string
+	Quote(p Parcel) ([]ShippingRate, error)
+	CreateLabel(p Parcel, service string) (ShippingLabel, error)
+	// Track returns every event so far, oldest first
+	Track(trackingNumber string) ([]TrackingEvent, error)
+}
+
+var errUnknownService = errors.New("unknown shipping service")
+
+var (
+	carriersMu sync.Mutex
+	carriers   map[string]Carrier
+)
+
+// currentCarriers builds the configured carriers on first use
+func currentCarriers() map[string]Carrier {
+	carriersMu.Lock()
+	defer carriersMu.Unlock()
+	if carriers == nil {
+		carriers = carriersFromEnv()
+	}
+	return carriers
+}
+
+// SetCarriers replaces the enabled carriers, e.g. with fakes in tests
+func SetCarriers(list ...Carrier) {
+	carriersMu.Lock()
+	defer carriersMu.Unlock()
+	carriers = map[string]Carrier{}
+	for _, c := range list {
+		carriers[c.Name()] = c
+	}
+}
+
+func carriersFromEnv() map[string]Carrier {
+	enabled := map[string]Carrier{}
+	for _, name := range strings.Split(envOr("SHIPPING_CARRIERS", "local"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "":
+		case "local":
+			enabled[name] = newLocalCarrier(localCarrierStep())
+		default:
+			slog.Warn("unknown shipping carrier", "carrier", name)
+		}
+	}
+	return enabled
+}
+
+func localCarrierStep() time.Duration {
+	step, err := time.ParseDuration(os.Getenv("LOCAL_CARRIER_STEP"))
+	if err != nil || step <= 0 {
+		return 6 * time.Hour
+	}
+	return step
+}
+
+// findCarrier returns an enabled carrier by name
+func findCarrier(name string) (Carrier, bool) {
+	c, ok := currentCarriers()[name]
+	return c, ok
+}
+
+// carrierNames lists the enabled carriers for diagnostics
+func carrierNames() []string {
+	var names []string
+	for name := range currentCarriers() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quoteAll asks every enabled carrier for rates, cheapest first. A carrier
+// that fails is logged and left out.
+func quoteAll(p Parcel) []ShippingRate {
+	rates := []ShippingRate{}
+	for name, c := range currentCarriers() {
+		quotes, err := c.Quote(p)
+		if err != nil {
+			slog.Warn("carrier quote failed", "carrier", name, "error", err)
+			continue
+		}
+		rates = append(rates, quotes...)
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Amount < rates[j].Amount })
+	return rates
+}
+
+// localCarrier is a pretend courier for development and tests. Its tracking
+// numbers encode when the label was made, and the parcel moves one status
+// further every step, so tracking needs no state and survives restarts.
+type localCarrier struct {
+	step time.Duration
+	now  func() time.Time
+}
+
+func newLocalCarrier(step time.Duration) *localCarrier {
+	return &localCarrier{step: step, now: time.Now}
+}
+
+var localServices = []struct {
+	name       string
+	base, each float64
+	days       int
+	viaHub     bool
+}{
+	{name: "standard", base: 1.5, each: 0.5, days: 3, viaHub: true},
+	{name: "express", base: 3, each: 0.75, days: 1},
+}
+
+func (c *localCarrier) Name() string { return "local" }
+
+func (c *localCarrier) Quote(p Parcel) ([]ShippingRate, error) {
+	if p.Items <= 0 {
+		return nil, errors.New("parcel is empty")
+	}
+	var rates []ShippingRate
+	for _, s := range localServices {
+		rates = append(rates, ShippingRate{
+			Carrier: c.Name(),
+			Service: s.name,
+			Amount:  math.Round((s.base+s.each*float64(p.Items))*1000) / 1000,
+			Days:    s.days,
+		})
+	}
+	return rates, nil
+}
+
+func (c *localCarrier) CreateLabel(p Parcel, service string) (ShippingLabel, error) {
+	rates, err := c.Quote(p)
+	if err != nil {
+		return ShippingLabel{}, err
+	}
+	for i, s := range localServices {
+		if s.name != service {
+			continue
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(1000))
+		if err != nil {
+			return ShippingLabel{}, err
+		}
+		// LC<service><unix seconds><3 random digits>
+		number := fmt.Sprintf("LC%d%d%03d", i, c.now().Unix(), n.Int64())
+		return ShippingLabel{
+			TrackingNumber: number,
+			LabelURL:       "/shipments/label?tracking=" + number,
+			Cost:           rates[i].Amount,
+			Days:           s.days,
+		}, nil
+	}
+	return ShippingLabel{}, errUnknownService
+}
+
+func (c *localCarrier) Track(trackingNumber string) ([]TrackingEvent, error) {
+	if len(trackingNumber) < 7 || !strings.HasPrefix(trackingNumber, "LC") {
+		return nil, fmt.Errorf("not a local tracking number: %q", trackingNumber)
+	}
+	service, err := strconv.Atoi(trackingNumber[2:3])
+	if err != nil || service >= len(localServices) {
+		return nil, fmt.Errorf("not a local tracking number: %q", trackingNumber)
+	}
+	created, err := strconv.ParseInt(trackingNumber[3:len(trackingNumber)-3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("not a local tracking number: %q", trackingNumber)
+	}
+
+	path := []TrackingEvent{
+		{Status: ShipmentLabelCreated, Description: "Label created", Location: "Sender"},
+		{Status: ShipmentInTransit, Description: "Picked up by courier", Location: "Manama depot"},
+		{Status: ShipmentInTransit, Description: "Arrived at sorting centre", Location: "Sitra hub"},
+		{Status: ShipmentOutForDelivery, Description: "Out for delivery", Location: "Local courier"},
+		{Status: ShipmentDelivered, Description: "Delivered", Location: "Recipient"},
+	}
+	if !localServices[service].viaHub {
+		path = append(path[:2], path[3:]...)
+	}
+
+	start := time.Unix(created, 0).UTC()
+	elapsed := c.now().Sub(start)
+	var events []TrackingEvent
+	for i, e := range path {
+		if i > 0 && elapsed < time.Duration(i)*c.step {
+			break
+		}
+		e.At = start.Add(time.Duration(i) * c.step)
+		events = append(events, e)
+	}
+	return events, nil
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLocalCarrier enables only the local carrier, on a clock the test moves
+func useLocalCarrier(t *testing.T) (*localCarrier, *time.Time) {
+	t.Helper()
+	clock := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	carrier := newLocalCarrier(time.Hour)
+	carrier.now = func() time.Time { return clock }
+	SetCarriers(carrier)
+	t.Cleanup(func() {
+		carriersMu.Lock()
+		carriers = nil
+		carriersMu.Unlock()
+	})
+	return carrier, &clock
+}
+
+func TestLocalCarrierQuote(t *testing.T) {
+	carrier, _ := useLocalCarrier(t)
+	rates, err := carrier.Quote(Parcel{Items: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ShippingRate{
+		{Carrier: "local", Service: "standard", Amount: 3, Days: 3},
+		{Carrier: "local", Service: "express", Amount: 5.25, Days: 1},
+	}
+	if len(rates) != len(want) {
+		t.Fatalf("rates = %+v", rates)
+	}
+	for i := range want {
+		if rates[i] != want[i] {
+			t.Errorf("rate %d = %+v, want %+v", i, rates[i], want[i])
+		}
+	}
+	if _, err := carrier.Quote(Parcel{}); err == nil {
+		t.Error("an empty parcel was quoted")
+	}
+}
+
+func TestLocalCarrierLabelAndTracking(t *testing.T) {
+	carrier, clock := useLocalCarrier(t)
+	start := *clock
+	if _, err := carrier.CreateLabel(Parcel{Items: 1}, "overnight"); !errors.Is(err, errUnknownService) {
+		t.Errorf("unknown service: %v, want errUnknownService", err)
+	}
+	label, err := carrier.CreateLabel(Parcel{Items: 2}, "standard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(label.TrackingNumber, "LC0") || label.Cost != 2.5 || label.Days != 3 {
+		t.Errorf("label = %+v", label)
+	}
+
+	// standard goes through the hub: five scans, one per step
+	for steps, want := range []string{ShipmentLabelCreated, ShipmentInTransit, ShipmentInTransit, ShipmentOutForDelivery, ShipmentDelivered} {
+		*clock = start.Add(time.Duration(steps) * carrier.step)
+		events, err := carrier.Track(label.TrackingNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != steps+1 || events[steps].Status != want {
+			t.Errorf("after %d steps: %+v, want %d events ending %s", steps, events, steps+1, want)
+		}
+	}
+	if _, err := carrier.Track("XX123"); err == nil {
+		t.Error("a foreign tracking number was tracked")
+	}
+}
+
+func TestShipmentTrackedThroughLocalCarrier(t *testing.T) {
+	carrier, clock := useLocalCarrier(t)
+	start := *clock
+	db := openTestDB(t)
+	_, storeID, token := createTestStore(t, db)
+	productID := createTestProduct(t, db, storeID, 10)
+	orderID := mustExec(t, db, "INSERT INTO orders (user_id, store_id, total_amount, status, shipping_info) VALUES (?, ?, 50, 'paid', '{}')",
+		createTestUser(t, db), storeID)
+	mustExec(t, db, "INSERT INTO order_products (order_id, product_id, quantity, price) VALUES (?, ?, 2, 25)", orderID, productID)
+	// the customer's shipped and delivered mails are not part of this test
+	t.Cleanup(func() { mustExec(t, db, "DELETE FROM jobs WHERE kind = ? AND status = ?", JobSendEmail, JobPending) })
+
+	post := func(handler http.HandlerFunc, body map[string]interface{}) *httptest.ResponseRecorder {
+		raw, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/api/shipments", bytes.NewReader(raw))
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := post(GetShippingRates, map[string]interface{}{"store_id": storeID, "order_id": orderID})
+	var quoted struct {
+		Rates []ShippingRate `json:"rates"`
+	}
+	json.NewDecoder(w.Body).Decode(&quoted)
+	if w.Code != http.StatusOK || len(quoted.Rates) != 2 || quoted.Rates[0].Service != "standard" || quoted.Rates[0].Amount != 2.5 {
+		t.Fatalf("rates = %d %+v", w.Code, quoted.Rates)
+	}
+
+	if w := post(CreateShipment, map[string]interface{}{"store_id": storeID, "order_id": orderID, "carrier": "local", "service": "overnight"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown service: %d %s", w.Code, w.Body)
+	}
+	w = post(CreateShipment, map[string]interface{}{"store_id": storeID, "order_id": orderID, "carrier": "local", "service": "express"})
+	var created struct {
+		ShipmentID int `json:"shipment_id"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if w.Code != http.StatusOK || created.ShipmentID == 0 {
+		t.Fatalf("create shipment = %d %s", w.Code, w.Body)
+	}
+
+	state := func() (shipment string, order string, events int) {
+		db.QueryRow("SELECT status FROM shipments WHERE id = ?", created.ShipmentID).Scan(&shipment)
+		db.QueryRow("SELECT status FROM orders WHERE id = ?", orderID).Scan(&order)
+		db.QueryRow("SELECT COUNT(*) FROM shipment_events WHERE shipment_id = ?", created.ShipmentID).Scan(&events)
+		return shipment, order, events
+	}
+	if shipment, order, events := state(); shipment != ShipmentLabelCreated || order != "shipped" || events != 1 {
+		t.Errorf("after booking: shipment %s, order %s, %d events", shipment, order, events)
+	}
+
+	// express skips the hub: picked up, out for delivery, delivered
+	for _, want := range []struct {
+		steps           int
+		shipment, order string
+	}{
+		{1, ShipmentInTransit, "shipped"},
+		{3, ShipmentDelivered, "delivered"},
+	} {
+		steps := want.steps
+		*clock = start.Add(time.Duration(steps) * carrier.step)
+		if err := pollShipmentsJob(t.Context(), nil); err != nil {
+			t.Fatal(err)
+		}
+		if shipment, order, events := state(); shipment != want.shipment || order != want.order || events != steps+1 {
+			t.Errorf("after %d steps: shipment %s, order %s, %d events; want %s, %s, %d",
+				steps, shipment, order, events, want.shipment, want.order, steps+1)
+		}
+	}
+}
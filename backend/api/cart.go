@@ -1,18 +1,39 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"time"
 )
 
+// addToCartRequest is the v1 JSON body of AddToCart
+type addToCartRequest struct {
+	ProductID int `json:"product_id"`
+	VariantID int `json:"variant_id,omitempty"`
+	Quantity  int `json:"quantity"`
+}
+
+func (req addToCartRequest) form() url.Values {
+	form := url.Values{"product_id": {strconv.Itoa(req.ProductID)}, "quantity": {strconv.Itoa(req.Quantity)}}
+	if req.VariantID != 0 {
+		form.Set("variant_id", strconv.Itoa(req.VariantID))
+	}
+	return form
+}
+
 func AddToCart(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -22,13 +43,13 @@ func AddToCart(w http.ResponseWriter, r *http.Request) {
 	quantity := r.FormValue("quantity")
 
 	if productID == "" || quantity == "" {
-		http.Error(w, `{"error": "Product ID and quantity required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Product ID and quantity required")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -37,66 +58,84 @@ func AddToCart(w http.ResponseWriter, r *http.Request) {
 	var requestedQty int
 	_, err = fmt.Sscanf(quantity, "%d", &requestedQty)
 	if err != nil || requestedQty <= 0 {
-		http.Error(w, `{"error": "Invalid quantity"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid quantity")
 		return
 	}
 
-	// Check product's available quantity
-	var availableQty int
-	err = db.QueryRow("SELECT quantity FROM products WHERE id = ?", productID).Scan(&availableQty)
+	// Find the variant being bought; products without options have just one
+	variantID, err := resolveVariant(db, productID, r.FormValue("variant_id"))
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error": "Product not found"}`, http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Product not found")
+		return
+	}
+	if errors.Is(err, errInvalidVariants) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, invalidMessage(err, errInvalidVariants))
 		return
 	}
 	if err != nil {
-		http.Error(w, `{"error": "Failed to check product availability"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to check product availability")
+		return
+	}
+
+	// Check the variant's available quantity
+	var availableQty, productQty int
+	err = db.QueryRow("SELECT v.quantity, p.quantity FROM product_variants v JOIN products p ON v.product_id = p.id WHERE v.id = ?",
+		variantID).Scan(&availableQty, &productQty)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to check product availability")
 		return
 	}
 
 	// Check if item already in cart and get current cart quantity
 	var existingID int
 	var currentCartQty int
-	err = db.QueryRow("SELECT id, quantity FROM cart WHERE user_id = ? AND product_id = ?", userID, productID).Scan(&existingID, &currentCartQty)
+	err = db.QueryRow("SELECT id, quantity FROM cart WHERE user_id = ? AND variant_id = ?", userID, variantID).Scan(&existingID, &currentCartQty)
 
 	var newTotalQty int
 	if err == sql.ErrNoRows {
 		// New item - check if requested quantity is available
 		newTotalQty = requestedQty
 		if newTotalQty > availableQty {
-			http.Error(w, fmt.Sprintf(`{"error": "Only %d items available"}`, availableQty), http.StatusBadRequest)
+			sendError(w, r, (&APIError{Status: http.StatusBadRequest, Code: CodeOutOfStock,
+				Message: fmt.Sprintf("Only %d items available", availableQty)}).With("available", availableQty))
 			return
 		}
 		// Insert new cart item
-		_, err = db.Exec("INSERT INTO cart (user_id, product_id, quantity) VALUES (?, ?, ?)", userID, productID, requestedQty)
+		_, err = db.Exec("INSERT INTO cart (user_id, product_id, variant_id, quantity, updated_at) VALUES (?, ?, ?, ?, datetime('now'))", userID, productID, variantID, requestedQty)
 		if err != nil {
-			http.Error(w, `{"error": "Failed to add to cart"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to add to cart")
 			return
 		}
-		// Decrease product quantity
-		_, err = db.Exec("UPDATE products SET quantity = quantity - ? WHERE id = ?", requestedQty, productID)
+		// Decrease variant quantity
+		err = adjustVariantStock(db, variantID, -requestedQty)
 	} else if err == nil {
 		// Update existing cart item - check if adding would exceed available quantity
 		newTotalQty = currentCartQty + requestedQty
 		if newTotalQty > availableQty {
-			http.Error(w, fmt.Sprintf(`{"error": "Only %d items available, you already have %d in cart"}`, availableQty, currentCartQty), http.StatusBadRequest)
+			sendError(w, r, (&APIError{Status: http.StatusBadRequest, Code: CodeOutOfStock,
+				Message: fmt.Sprintf("Only %d items available, you already have %d in cart", availableQty, currentCartQty)}).With("available", availableQty))
 			return
 		}
-		_, err = db.Exec("UPDATE cart SET quantity = ? WHERE id = ?", newTotalQty, existingID)
+		_, err = db.Exec("UPDATE cart SET quantity = ?, updated_at = datetime('now') WHERE id = ?", newTotalQty, existingID)
 		if err != nil {
-			http.Error(w, `{"error": "Failed to update cart"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update cart")
 			return
 		}
-		// Decrease product quantity by the additional amount
-		_, err = db.Exec("UPDATE products SET quantity = quantity - ? WHERE id = ?", requestedQty, productID)
+		// Decrease variant quantity by the additional amount
+		err = adjustVariantStock(db, variantID, -requestedQty)
 	} else {
-		http.Error(w, `{"error": "Failed to check cart"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to check cart")
 		return
 	}
 
 	if err != nil {
-		http.Error(w, `{"error": "Failed to update product quantity"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update product quantity")
 		return
 	}
+	if id, err := strconv.Atoi(productID); err == nil {
+		publishStockChange(db, id)
+		checkLowStock(r, id, productQty, productQty-requestedQty)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"success": true}`))
@@ -105,15 +144,15 @@ func AddToCart(w http.ResponseWriter, r *http.Request) {
 func GetCartTotal(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -122,14 +161,14 @@ func GetCartTotal(w http.ResponseWriter, r *http.Request) {
 	var totalPrice float64
 
 	err = db.QueryRow(`
-		SELECT COALESCE(SUM(c.quantity), 0), COALESCE(SUM(c.quantity * p.price), 0)
+		SELECT COALESCE(SUM(c.quantity), 0), COALESCE(SUM(c.quantity * v.price), 0)
 		FROM cart c
-		JOIN products p ON c.product_id = p.id
+		JOIN product_variants v ON c.variant_id = v.id
 		WHERE c.user_id = ?
 	`, userID).Scan(&totalItems, &totalPrice)
 
 	if err != nil && err != sql.ErrNoRows {
-		http.Error(w, `{"error": "Failed to fetch cart"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch cart")
 		return
 	}
 
@@ -153,21 +192,23 @@ func GetCart(w http.ResponseWriter, r *http.Request, store_id int) CartResponse
 func getCartData(w http.ResponseWriter, r *http.Request, store_id int) (CartResponse, error) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return CartResponse{}, nil
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return CartResponse{}, err
 	}
 	defer db.Close()
 
 	rows, err := db.Query(`
-		SELECT c.id, c.product_id, c.user_id, c.quantity,
-			   p.id, p.name, p.description, p.price, p.image, p.store_id
+		SELECT c.id, c.product_id, c.variant_id, c.user_id, c.quantity,
+			   p.id, p.name, p.description, v.price, COALESCE(NULLIF(v.image, ''), p.image), p.store_id,
+			   `+variantTitleColumn+`
 		FROM cart c
 		JOIN products p ON c.product_id = p.id
+		JOIN product_variants v ON c.variant_id = v.id
 		WHERE c.user_id = ? AND p.store_id = ?
 	`, userID, store_id)
 
@@ -181,12 +222,14 @@ func getCartData(w http.ResponseWriter, r *http.Request, store_id int) (CartResp
 	totalItems := 0
 
 	for rows.Next() {
-		var id, productID, userID, quantity, storeID int
+		var id, productID, variantID, userID, quantity, storeID int
 		var product Product
+		var variant string
 
-		err := rows.Scan(&id, &productID, &userID, &quantity,
-			&product.ID, &product.Name, &product.Description, &product.Price, &product.Image, &storeID)
+		err := rows.Scan(&id, &productID, &variantID, &userID, &quantity,
+			&product.ID, &product.Name, &product.Description, &product.Price, &product.Image, &storeID, &variant)
 		if err != nil {
+			Logger(r).Warn("cart row scan failed", "error", err)
 			continue
 		}
 
@@ -197,6 +240,8 @@ func getCartData(w http.ResponseWriter, r *http.Request, store_id int) (CartResp
 		items = append(items, CartItem{
 			ID:        id,
 			ProductID: productID,
+			VariantID: variantID,
+			Variant:   variant,
 			Quantity:  quantity,
 			Product:   product,
 			ItemTotal: itemTotal,
@@ -210,10 +255,20 @@ func getCartData(w http.ResponseWriter, r *http.Request, store_id int) (CartResp
 	}, nil
 }
 
+// updateCartRequest is the v1 JSON body of UpdateCartItem
+type updateCartRequest struct {
+	CartItemID int `json:"cart_item_id"`
+	Quantity   int `json:"quantity"`
+}
+
+func (req updateCartRequest) form() url.Values {
+	return url.Values{"cart_item_id": {strconv.Itoa(req.CartItemID)}, "quantity": {strconv.Itoa(req.Quantity)}}
+}
+
 func UpdateCartItem(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -223,13 +278,13 @@ func UpdateCartItem(w http.ResponseWriter, r *http.Request) {
 	quantity := r.FormValue("quantity")
 
 	if cartItemID == "" || quantity == "" {
-		http.Error(w, `{"error": "Cart item ID and quantity required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Cart item ID and quantity required")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -238,19 +293,19 @@ func UpdateCartItem(w http.ResponseWriter, r *http.Request) {
 	var newQty int
 	_, err = fmt.Sscanf(quantity, "%d", &newQty)
 	if err != nil || newQty <= 0 {
-		http.Error(w, `{"error": "Invalid quantity"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid quantity")
 		return
 	}
 
 	// Get current cart item details
-	var currentQty, productID int
-	err = db.QueryRow("SELECT quantity, product_id FROM cart WHERE id = ? AND user_id = ?", cartItemID, userID).Scan(&currentQty, &productID)
+	var currentQty, productID, variantID int
+	err = db.QueryRow("SELECT quantity, product_id, variant_id FROM cart WHERE id = ? AND user_id = ?", cartItemID, userID).Scan(&currentQty, &productID, &variantID)
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error": "Cart item not found"}`, http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Cart item not found")
 		return
 	}
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch cart item"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch cart item")
 		return
 	}
 
@@ -259,38 +314,42 @@ func UpdateCartItem(w http.ResponseWriter, r *http.Request) {
 
 	if qtyDifference > 0 {
 		// User wants to add more - check if available
-		var availableQty int
-		err = db.QueryRow("SELECT quantity FROM products WHERE id = ?", productID).Scan(&availableQty)
+		var availableQty, productQty int
+		err = db.QueryRow("SELECT v.quantity, p.quantity FROM product_variants v JOIN products p ON v.product_id = p.id WHERE v.id = ?",
+			variantID).Scan(&availableQty, &productQty)
 		if err != nil {
-			http.Error(w, `{"error": "Failed to check product availability"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to check product availability")
 			return
 		}
 
 		if qtyDifference > availableQty {
-			http.Error(w, fmt.Sprintf(`{"error": "Only %d more items available"}`, availableQty), http.StatusBadRequest)
+			sendError(w, r, (&APIError{Status: http.StatusBadRequest, Code: CodeOutOfStock,
+				Message: fmt.Sprintf("Only %d more items available", availableQty)}).With("available", availableQty))
 			return
 		}
 
-		// Decrease product quantity
-		_, err = db.Exec("UPDATE products SET quantity = quantity - ? WHERE id = ?", qtyDifference, productID)
+		// Decrease variant quantity
+		err = adjustVariantStock(db, variantID, -qtyDifference)
 		if err != nil {
-			http.Error(w, `{"error": "Failed to update product quantity"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update product quantity")
 			return
 		}
+		publishStockChange(db, productID)
+		checkLowStock(r, productID, productQty, productQty-qtyDifference)
 	} else if qtyDifference < 0 {
-		// User wants to decrease - restore product quantity
-		restoreQty := -qtyDifference
-		_, err = db.Exec("UPDATE products SET quantity = quantity + ? WHERE id = ?", restoreQty, productID)
+		// User wants to decrease - restore variant quantity
+		err = adjustVariantStock(db, variantID, -qtyDifference)
 		if err != nil {
-			http.Error(w, `{"error": "Failed to restore product quantity"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to restore product quantity")
 			return
 		}
+		publishStockChange(db, productID)
 	}
 
 	// Update cart
-	_, err = db.Exec("UPDATE cart SET quantity = ? WHERE id = ? AND user_id = ?", newQty, cartItemID, userID)
+	_, err = db.Exec("UPDATE cart SET quantity = ?, updated_at = datetime('now') WHERE id = ? AND user_id = ?", newQty, cartItemID, userID)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to update cart"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update cart")
 		return
 	}
 
@@ -298,10 +357,19 @@ func UpdateCartItem(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"success": true}`))
 }
 
+// removeFromCartRequest is the v1 JSON body of RemoveFromCart
+type removeFromCartRequest struct {
+	CartItemID int `json:"cart_item_id"`
+}
+
+func (req removeFromCartRequest) form() url.Values {
+	return url.Values{"cart_item_id": {strconv.Itoa(req.CartItemID)}}
+}
+
 func RemoveFromCart(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -310,48 +378,61 @@ func RemoveFromCart(w http.ResponseWriter, r *http.Request) {
 	cartItemID := r.FormValue("cart_item_id")
 
 	if cartItemID == "" {
-		http.Error(w, `{"error": "Cart item ID required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Cart item ID required")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
 
 	// Get the cart item details before deleting (to restore product quantity)
-	var productID int
+	var productID, variantID int
 	var quantity int
-	err = db.QueryRow("SELECT product_id, quantity FROM cart WHERE id = ? AND user_id = ?", cartItemID, userID).Scan(&productID, &quantity)
+	err = db.QueryRow("SELECT product_id, variant_id, quantity FROM cart WHERE id = ? AND user_id = ?", cartItemID, userID).Scan(&productID, &variantID, &quantity)
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error": "Cart item not found"}`, http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Cart item not found")
 		return
 	}
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch cart item"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch cart item")
 		return
 	}
 
 	// Delete from cart
 	_, err = db.Exec("DELETE FROM cart WHERE id = ? AND user_id = ?", cartItemID, userID)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to remove from cart"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to remove from cart")
 		return
 	}
 
-	// Restore product quantity
-	_, err = db.Exec("UPDATE products SET quantity = quantity + ? WHERE id = ?", quantity, productID)
+	// Restore variant quantity
+	err = adjustVariantStock(db, variantID, quantity)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to restore product quantity"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to restore product quantity")
 		return
 	}
+	publishStockChange(db, productID)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"success": true}`))
 }
 
+// publishStockChange tells the product's store about its new stock level
+func publishStockChange(db *sql.DB, productID int) {
+	var storeID, quantity int
+	if err := db.QueryRow("SELECT store_id, quantity FROM products WHERE id = ?", productID).Scan(&storeID, &quantity); err != nil {
+		return
+	}
+	PublishEvent(Event{Type: EventStockChanged, StoreID: storeID, Data: map[string]interface{}{
+		"product_id": productID,
+		"quantity":   quantity,
+	}})
+}
+
 func CheckoutPageForStore(w http.ResponseWriter, r *http.Request, storeID int, store Store) {
 	userID, validUser := ValidateStoreCustomer(w, r, strconv.Itoa(storeID))
 	if !validUser {
@@ -359,7 +440,7 @@ func CheckoutPageForStore(w http.ResponseWriter, r *http.Request, storeID int, s
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		HandleError(w, r, http.StatusInternalServerError, "Internal Server Error")
 		return
@@ -367,10 +448,12 @@ func CheckoutPageForStore(w http.ResponseWriter, r *http.Request, storeID int, s
 	defer db.Close()
 
 	rows, err := db.Query(`
-		SELECT c.id, c.product_id, c.user_id, c.quantity,
-			   p.id, p.name, p.description, p.price, p.image, p.store_id
+		SELECT c.id, c.product_id, c.variant_id, c.user_id, c.quantity,
+			   p.id, p.name, p.description, v.price, COALESCE(NULLIF(v.image, ''), p.image), p.store_id,
+			   `+variantTitleColumn+`
 		FROM cart c
 		JOIN products p ON c.product_id = p.id
+		JOIN product_variants v ON c.variant_id = v.id
 		WHERE c.user_id = ? AND p.store_id = ?
 	`, userID, storeID)
 
@@ -385,12 +468,14 @@ func CheckoutPageForStore(w http.ResponseWriter, r *http.Request, storeID int, s
 	totalItems := 0
 
 	for rows.Next() {
-		var id, productID, userID, quantity, storeID int
+		var id, productID, variantID, userID, quantity, storeID int
 		var product Product
+		var variant string
 
-		err := rows.Scan(&id, &productID, &userID, &quantity,
-			&product.ID, &product.Name, &product.Description, &product.Price, &product.Image, &storeID)
+		err := rows.Scan(&id, &productID, &variantID, &userID, &quantity,
+			&product.ID, &product.Name, &product.Description, &product.Price, &product.Image, &storeID, &variant)
 		if err != nil {
+			Logger(r).Warn("cart row scan failed", "error", err)
 			continue
 		}
 
@@ -401,6 +486,8 @@ func CheckoutPageForStore(w http.ResponseWriter, r *http.Request, storeID int, s
 		items = append(items, CartItem{
 			ID:        id,
 			ProductID: productID,
+			VariantID: variantID,
+			Variant:   variant,
 			Quantity:  quantity,
 			Product:   product,
 			ItemTotal: itemTotal,
@@ -425,3 +512,122 @@ func CheckoutPageForStore(w http.ResponseWriter, r *http.Request, storeID int, s
 		return
 	}
 }
+
+// cartReservationTTL is how long items sit in a cart, holding stock, before
+// expireCartReservationsJob releases them (CART_RESERVATION_MINUTES overrides it).
+func cartReservationTTL() time.Duration {
+	if minutes, err := strconv.Atoi(os.Getenv("CART_RESERVATION_MINUTES")); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return 2 * time.Hour
+}
+
+// expireCartReservationsJob removes cart items that have not been touched
+// within the reservation window and gives their stock back to the variant.
+// Carts with a pending order are left alone while the customer pays, so
+// pending orders older than the window are cancelled first: their stock is
+// released with the cart and ProcessPayment no longer accepts them.
+func expireCartReservationsJob(ctx context.Context, payload json.RawMessage) error {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cutoff := sqlTime(time.Now().Add(-cartReservationTTL()))
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cancelled, err := cancelStalePendingOrders(tx, cutoff)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT c.id, c.user_id, c.product_id, c.variant_id, c.quantity
+		FROM cart c
+		JOIN products p ON c.product_id = p.id
+		WHERE COALESCE(c.updated_at, c.created_at) < ?
+		AND NOT EXISTS (
+			SELECT 1 FROM orders o
+			WHERE o.user_id = c.user_id AND o.store_id = p.store_id AND o.status = 'pending'
+		)
+	`, cutoff)
+	if err != nil {
+		return err
+	}
+	type reservation struct {
+		id, userID, productID, variantID, quantity int
+	}
+	var expired []reservation
+	for rows.Next() {
+		var res reservation
+		if err := rows.Scan(&res.id, &res.userID, &res.productID, &res.variantID, &res.quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, res)
+	}
+	rows.Close()
+	if len(expired) == 0 {
+		return tx.Commit()
+	}
+
+	users := map[int]bool{}
+	for _, res := range expired {
+		if _, err := tx.Exec("DELETE FROM cart WHERE id = ?", res.id); err != nil {
+			return err
+		}
+		if err := adjustVariantStock(tx, res.variantID, res.quantity); err != nil {
+			return err
+		}
+		users[res.userID] = true
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	products := map[int]bool{}
+	for _, res := range expired {
+		if !products[res.productID] {
+			products[res.productID] = true
+			publishStockChange(db, res.productID)
+		}
+	}
+	cartsAbandonedTotal.Add(float64(len(users)))
+	slog.Info("released expired cart reservations", "items", len(expired), "carts", len(users), "orders_cancelled", cancelled)
+	return nil
+}
+
+// cancelStalePendingOrders cancels orders left unpaid since before cutoff
+func cancelStalePendingOrders(tx *sql.Tx, cutoff string) (int, error) {
+	rows, err := tx.Query("SELECT id FROM orders WHERE status = 'pending' AND created_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if _, err := tx.Exec(`
+			UPDATE orders SET status = 'cancelled', version = version + 1, updated_at = datetime('now')
+			WHERE id = ? AND status = 'pending'
+		`, id); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("INSERT INTO order_status_history (order_id, status) VALUES (?, 'cancelled')", id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), rows.Err()
+}
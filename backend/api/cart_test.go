@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireCartReservationsCancelsStalePendingOrders(t *testing.T) {
+	db := openTestDB(t)
+	_, storeID, _ := createTestStore(t, db)
+	productID := createTestProduct(t, db, storeID, 0)
+	variantID := mustExec(t, db, "INSERT INTO product_variants (product_id, price, quantity) VALUES (?, 25, 5)", productID)
+	longAgo := sqlTime(time.Now().Add(-cartReservationTTL() - time.Hour))
+
+	// one customer checked out long ago and never paid; the other checked
+	// out just now from a cart filled long ago
+	stale, paying := createTestUser(t, db), createTestUser(t, db)
+	staleOrder := mustExec(t, db, "INSERT INTO orders (user_id, store_id, total_amount, status, shipping_info, created_at) VALUES (?, ?, 50, 'pending', '{}', ?)",
+		stale, storeID, longAgo)
+	payingOrder := mustExec(t, db, "INSERT INTO orders (user_id, store_id, total_amount, status, shipping_info) VALUES (?, ?, 25, 'pending', '{}')",
+		paying, storeID)
+	for user, quantity := range map[int]int{stale: 2, paying: 1} {
+		mustExec(t, db, "INSERT INTO cart (user_id, product_id, variant_id, quantity, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			user, productID, variantID, quantity, longAgo, longAgo)
+	}
+
+	if err := expireCartReservationsJob(t.Context(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(orderID int) string {
+		var status string
+		db.QueryRow("SELECT status FROM orders WHERE id = ?", orderID).Scan(&status)
+		return status
+	}
+	if got := status(staleOrder); got != "cancelled" {
+		t.Errorf("stale pending order is %s, want cancelled", got)
+	}
+	if got := status(payingOrder); got != "pending" {
+		t.Errorf("recent pending order is %s, want pending", got)
+	}
+	var staleItems, payingItems, stock int
+	db.QueryRow("SELECT COUNT(*) FROM cart WHERE user_id = ?", stale).Scan(&staleItems)
+	db.QueryRow("SELECT COUNT(*) FROM cart WHERE user_id = ?", paying).Scan(&payingItems)
+	db.QueryRow("SELECT quantity FROM product_variants WHERE id = ?", variantID).Scan(&stock)
+	if staleItems != 0 || payingItems != 1 || stock != 7 {
+		t.Errorf("cart items = %d stale, %d paying; stock = %d, want 0, 1 and 7", staleItems, payingItems, stock)
+	}
+	var history int
+	db.QueryRow("SELECT COUNT(*) FROM order_status_history WHERE order_id = ? AND status = 'cancelled'", staleOrder).Scan(&history)
+	if history != 1 {
+		t.Errorf("cancellation recorded %d times", history)
+	}
+}
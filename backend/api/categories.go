@@ -0,0 +1,419 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxCategoryDepth caps how deeply categories nest
+const maxCategoryDepth = 4
+
+// maxProductTags caps the tags on one product
+const maxProductTags = 20
+
+// Category is a node in a store's category tree. Lists of categories are flat,
+// depth-first, with Depth and Path saying where each one sits.
+type Category struct {
+	ID       int    `json:"id"`
+	ParentID int    `json:"parent_id,omitempty"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	Position int    `json:"position"`
+	Depth    int    `json:"depth"`
+	Path     string `json:"path"`
+	// Descendants holds this category's id and the ids of every category below
+	// it, which is what filtering by it matches
+	Descendants []int `json:"descendants"`
+	Products    int   `json:"products"`
+}
+
+// slugify turns a name into the lowercase, dash-separated form used in URLs
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// uniqueSlug finds a free slug for name in table within the store, leaving
+// the row being renamed (id) out of the check
+func uniqueSlug(db *sql.DB, table string, storeID int, name string, id int) (string, error) {
+	base := slugify(name)
+	if base == "" {
+		base = strings.TrimSuffix(table, "s")
+	}
+	slug := base
+	for i := 2; ; i++ {
+		var taken int
+		err := db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE store_id = ? AND slug = ? AND id != ?", storeID, slug, id).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if taken == 0 {
+			return slug, nil
+		}
+		slug = base + "-" + strconv.Itoa(i)
+	}
+}
+
+// loadCategories returns the store's categories depth-first with product
+// counts that include subcategories
+func loadCategories(db *sql.DB, storeID int) ([]Category, error) {
+	rows, err := db.Query(`
+		SELECT c.id, COALESCE(c.parent_id, 0), c.name, c.slug, c.position,
+			(SELECT COUNT(*) FROM products p WHERE p.category_id = c.id)
+		FROM categories c
+		WHERE c.store_id = ?
+		ORDER BY c.position, c.name
+	`, storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var all []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.ParentID, &c.Name, &c.Slug, &c.Position, &c.Products); err != nil {
+			return nil, err
+		}
+		all = append(all, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	known := map[int]bool{}
+	for _, c := range all {
+		known[c.ID] = true
+	}
+	children := map[int][]Category{}
+	for _, c := range all {
+		parent := c.ParentID
+		if !known[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], c)
+	}
+
+	list := []Category{}
+	var walk func(parent int, depth int, path string) ([]int, int)
+	walk = func(parent int, depth int, path string) ([]int, int) {
+		var ids []int
+		total := 0
+		for _, c := range children[parent] {
+			c.Depth = depth
+			c.Path = c.Name
+			if path != "" {
+				c.Path = path + " › " + c.Name
+			}
+			index := len(list)
+			list = append(list, c)
+			below, count := walk(c.ID, depth+1, c.Path)
+			list[index].Descendants = append([]int{c.ID}, below...)
+			list[index].Products += count
+			ids = append(ids, list[index].Descendants...)
+			total += list[index].Products
+		}
+		return ids, total
+	}
+	walk(0, 0, "")
+	return list, nil
+}
+
+// findCategory looks a category up by id or slug
+func findCategory(categories []Category, ref string) (Category, bool) {
+	for _, c := range categories {
+		if strconv.Itoa(c.ID) == ref || c.Slug == ref {
+			return c, true
+		}
+	}
+	return Category{}, false
+}
+
+// normalizeTags lowercases and trims tags, dropping blanks and repeats
+func normalizeTags(tags []string) []string {
+	out := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if tag != "" && !containsString(out, tag) && len(out) < maxProductTags {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// setProductTags replaces a product's tags
+func setProductTags(ex execer, productID int, tags []string) error {
+	if _, err := ex.Exec("DELETE FROM product_tags WHERE product_id = ?", productID); err != nil {
+		return err
+	}
+	for _, tag := range normalizeTags(tags) {
+		if _, err := ex.Exec("INSERT INTO product_tags (product_id, tag) VALUES (?, ?)", productID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadProductTags returns the tags of the store's products keyed by product id
+func loadProductTags(db *sql.DB, storeID int) (map[int][]string, error) {
+	rows, err := db.Query(`
+		SELECT t.product_id, t.tag FROM product_tags t JOIN products p ON t.product_id = p.id
+		WHERE p.store_id = ? ORDER BY t.tag
+	`, storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := map[int][]string{}
+	for rows.Next() {
+		var productID int
+		var tag string
+		if err := rows.Scan(&productID, &tag); err != nil {
+			return nil, err
+		}
+		tags[productID] = append(tags[productID], tag)
+	}
+	return tags, rows.Err()
+}
+
+// storeTags lists every tag used by the store's products
+func storeTags(products []Product) []string {
+	tags := []string{}
+	for _, p := range products {
+		for _, tag := range p.Tags {
+			if !containsString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// validCategory reports whether categoryID is one of the store's categories
+func validCategory(db *sql.DB, storeID int, categoryID int) bool {
+	var id int
+	return db.QueryRow("SELECT id FROM categories WHERE id = ? AND store_id = ?", categoryID, storeID).Scan(&id) == nil
+}
+
+// GetCategories lists a store's categories: GET /api/categories?store_id=
+func GetCategories(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store_id")
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+	categories, err := loadCategories(db, storeID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load categories")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"categories": categories})
+}
+
+// saveCategoryRequest is the body of SaveCategory
+type saveCategoryRequest struct {
+	StoreID  int    `json:"store_id"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID int    `json:"parent_id"`
+	Position int    `json:"position"`
+}
+
+// SaveCategory creates or updates a category: POST /api/categories/save with
+// {"store_id", "id", "name", "parent_id", "position"}. Without an id a new
+// category is created.
+func SaveCategory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req saveCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	if _, ok := ValidateStoreOwner(w, r, req.StoreID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Category name is required")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+
+	categories, err := loadCategories(db, req.StoreID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load categories")
+		return
+	}
+	if req.ID != 0 {
+		if _, ok := findCategory(categories, strconv.Itoa(req.ID)); !ok {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Category not found")
+			return
+		}
+	}
+	if req.ParentID != 0 {
+		parent, ok := findCategory(categories, strconv.Itoa(req.ParentID))
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Parent category not found")
+			return
+		}
+		if req.ID != 0 && containsInt(categoryByID(categories, req.ID).Descendants, parent.ID) {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "A category cannot be moved inside itself")
+			return
+		}
+		if parent.Depth+1+subtreeHeight(categories, req.ID) >= maxCategoryDepth {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, fmt.Sprintf("Categories can only be nested %d levels deep", maxCategoryDepth))
+			return
+		}
+	}
+
+	slug, err := uniqueSlug(db, "categories", req.StoreID, req.Name, req.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save category")
+		return
+	}
+	var parent interface{}
+	if req.ParentID != 0 {
+		parent = req.ParentID
+	}
+	if req.ID == 0 {
+		_, err = db.Exec("INSERT INTO categories (store_id, parent_id, name, slug, position) VALUES (?, ?, ?, ?, ?)",
+			req.StoreID, parent, req.Name, slug, req.Position)
+	} else {
+		_, err = db.Exec("UPDATE categories SET parent_id = ?, name = ?, slug = ?, position = ? WHERE id = ? AND store_id = ?",
+			parent, req.Name, slug, req.Position, req.ID, req.StoreID)
+	}
+	if err != nil {
+		Logger(r).Error("saving category failed", "store_id", req.StoreID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save category")
+		return
+	}
+	categories, _ = loadCategories(db, req.StoreID)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "categories": categories})
+}
+
+// deleteCategoryRequest is the body of DeleteCategory
+type deleteCategoryRequest struct {
+	StoreID int `json:"store_id"`
+	ID      int `json:"id"`
+}
+
+// DeleteCategory removes a category: POST /api/categories/delete with
+// {"store_id", "id"}. Its subcategories and products move up to its parent.
+func DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req deleteCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	if _, ok := ValidateStoreOwner(w, r, req.StoreID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+
+	var parent sql.NullInt64
+	if err := db.QueryRow("SELECT parent_id FROM categories WHERE id = ? AND store_id = ?", req.ID, req.StoreID).Scan(&parent); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Category not found")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		"UPDATE categories SET parent_id = ? WHERE parent_id = ?",
+		"UPDATE products SET category_id = ? WHERE category_id = ?",
+	} {
+		if _, err := tx.Exec(query, parent, req.ID); err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete category")
+			return
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM categories WHERE id = ?", req.ID); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete category")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete category")
+		return
+	}
+	categories, _ := loadCategories(db, req.StoreID)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "categories": categories})
+}
+
+func categoryByID(categories []Category, id int) Category {
+	c, _ := findCategory(categories, strconv.Itoa(id))
+	return c
+}
+
+// subtreeHeight is how many levels sit below the category (0 for a leaf or
+// a category that does not exist yet)
+func subtreeHeight(categories []Category, id int) int {
+	if id == 0 {
+		return 0
+	}
+	root := categoryByID(categories, id)
+	height := 0
+	for _, c := range categories {
+		if containsInt(root.Descendants, c.ID) && c.Depth-root.Depth > height {
+			height = c.Depth - root.Depth
+		}
+	}
+	return height
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
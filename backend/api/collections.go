@@ -0,0 +1,363 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Collection kinds: manual collections list hand-picked products in order,
+// rule collections hold whatever products match their rules right now
+const (
+	CollectionManual = "manual"
+	CollectionRule   = "rule"
+)
+
+// CollectionRules picks products for a rule collection. Every rule that is set
+// must match.
+type CollectionRules struct {
+	CategoryID int      `json:"category_id,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	// MatchAllTags requires every tag instead of any one of them
+	MatchAllTags bool    `json:"match_all_tags,omitempty"`
+	MinPrice     float64 `json:"min_price,omitempty"`
+	MaxPrice     float64 `json:"max_price,omitempty"`
+	InStock      bool    `json:"in_stock,omitempty"`
+}
+
+func (rules CollectionRules) empty() bool {
+	return rules.CategoryID == 0 && len(rules.Tags) == 0 && rules.MinPrice == 0 && rules.MaxPrice == 0 && !rules.InStock
+}
+
+// matches reports whether the product satisfies every rule
+func (rules CollectionRules) matches(p Product, categories []Category) bool {
+	if rules.CategoryID != 0 && !containsInt(categoryByID(categories, rules.CategoryID).Descendants, p.CategoryID) {
+		return false
+	}
+	if len(rules.Tags) > 0 {
+		found := 0
+		for _, tag := range rules.Tags {
+			if containsString(p.Tags, tag) {
+				found++
+			}
+		}
+		if found == 0 || (rules.MatchAllTags && found < len(rules.Tags)) {
+			return false
+		}
+	}
+	if rules.MinPrice > 0 && p.Price < rules.MinPrice {
+		return false
+	}
+	if rules.MaxPrice > 0 && p.Price > rules.MaxPrice {
+		return false
+	}
+	return !rules.InStock || p.Quantity > 0
+}
+
+// Collection is a named group of a store's products shown together
+type Collection struct {
+	ID          int              `json:"id"`
+	Name        string           `json:"name"`
+	Slug        string           `json:"slug"`
+	Description string           `json:"description"`
+	Kind        string           `json:"kind"`
+	Rules       *CollectionRules `json:"rules,omitempty"`
+	Position    int              `json:"position"`
+	ProductIDs  []int            `json:"product_ids"`
+}
+
+// loadCollections returns the store's collections with the ids of the
+// products in each, evaluating rule collections against products
+func loadCollections(db *sql.DB, storeID int, products []Product, categories []Category) ([]Collection, error) {
+	rows, err := db.Query(`
+		SELECT id, name, slug, description, kind, rules, position
+		FROM collections WHERE store_id = ?
+		ORDER BY position, name
+	`, storeID)
+	if err != nil {
+		return nil, err
+	}
+	collections := []Collection{}
+	for rows.Next() {
+		var c Collection
+		var rules string
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &c.Kind, &rules, &c.Position); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c.Kind == CollectionRule {
+			c.Rules = &CollectionRules{}
+			json.Unmarshal([]byte(rules), c.Rules)
+		}
+		c.ProductIDs = []int{}
+		collections = append(collections, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	inStore := map[int]bool{}
+	for _, p := range products {
+		inStore[int(p.ID)] = true
+	}
+	for i := range collections {
+		c := &collections[i]
+		if c.Kind == CollectionRule {
+			for _, p := range products {
+				if c.Rules.matches(p, categories) {
+					c.ProductIDs = append(c.ProductIDs, int(p.ID))
+				}
+			}
+			continue
+		}
+		rows, err := db.Query("SELECT product_id FROM collection_products WHERE collection_id = ? ORDER BY position", c.ID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if inStore[id] {
+				c.ProductIDs = append(c.ProductIDs, id)
+			}
+		}
+		rows.Close()
+	}
+	return collections, nil
+}
+
+// findCollection looks a collection up by id or slug
+func findCollection(collections []Collection, ref string) (Collection, bool) {
+	for _, c := range collections {
+		if strconv.Itoa(c.ID) == ref || c.Slug == ref {
+			return c, true
+		}
+	}
+	return Collection{}, false
+}
+
+// storeCatalog loads the categories, tags and collections shown alongside a
+// store's products
+func storeCatalog(storeID int, products []Product) ([]Category, []string, []Collection, error) {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer db.Close()
+	categories, err := loadCategories(db, storeID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	collections, err := loadCollections(db, storeID, products, categories)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return categories, storeTags(products), collections, nil
+}
+
+// GetCollections lists a store's collections: GET /api/collections?store_id=
+func GetCollections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store_id")
+		return
+	}
+	products, err := GetProductsByStoreID(uint(storeID))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load products")
+		return
+	}
+	_, _, collections, err := storeCatalog(storeID, products)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load collections")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"collections": collections})
+}
+
+// saveCollectionRequest is the body of SaveCollection
+type saveCollectionRequest struct {
+	StoreID     int              `json:"store_id"`
+	ID          int              `json:"id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Kind        string           `json:"kind"`
+	Position    int              `json:"position"`
+	ProductIDs  []int            `json:"product_ids"`
+	Rules       *CollectionRules `json:"rules"`
+}
+
+// SaveCollection creates or updates a collection: POST /api/collections/save
+// with {"store_id", "id", "name", "description", "kind", "position",
+// "product_ids"} for manual collections or "rules" for rule collections
+func SaveCollection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req saveCollectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	if _, ok := ValidateStoreOwner(w, r, req.StoreID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Collection name is required")
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = CollectionManual
+	}
+	if req.Kind != CollectionManual && req.Kind != CollectionRule {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Collection kind must be manual or rule")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+
+	if req.ID != 0 {
+		var id int
+		if err := db.QueryRow("SELECT id FROM collections WHERE id = ? AND store_id = ?", req.ID, req.StoreID).Scan(&id); err != nil {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Collection not found")
+			return
+		}
+	}
+	rules := "{}"
+	if req.Kind == CollectionRule {
+		if req.Rules == nil || req.Rules.empty() {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "A rule collection needs at least one rule")
+			return
+		}
+		req.Rules.Tags = normalizeTags(req.Rules.Tags)
+		if req.Rules.CategoryID != 0 && !validCategory(db, req.StoreID, req.Rules.CategoryID) {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Category not found")
+			return
+		}
+		if req.Rules.MaxPrice > 0 && req.Rules.MinPrice > req.Rules.MaxPrice {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Minimum price is above the maximum")
+			return
+		}
+		encoded, _ := json.Marshal(req.Rules)
+		rules = string(encoded)
+	}
+
+	slug, err := uniqueSlug(db, "collections", req.StoreID, req.Name, req.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save collection")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer tx.Rollback()
+	collectionID := int64(req.ID)
+	if req.ID == 0 {
+		var result sql.Result
+		result, err = tx.Exec("INSERT INTO collections (store_id, name, slug, description, kind, rules, position) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			req.StoreID, req.Name, slug, strings.TrimSpace(req.Description), req.Kind, rules, req.Position)
+		if err == nil {
+			collectionID, _ = result.LastInsertId()
+		}
+	} else {
+		_, err = tx.Exec("UPDATE collections SET name = ?, slug = ?, description = ?, kind = ?, rules = ?, position = ? WHERE id = ?",
+			req.Name, slug, strings.TrimSpace(req.Description), req.Kind, rules, req.Position, req.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM collection_products WHERE collection_id = ?", collectionID)
+	}
+	if err == nil && req.Kind == CollectionManual {
+		for i, productID := range req.ProductIDs {
+			// only the store's own products can be added
+			_, err = tx.Exec(`
+				INSERT OR IGNORE INTO collection_products (collection_id, product_id, position)
+				SELECT ?, id, ? FROM products WHERE id = ? AND store_id = ?
+			`, collectionID, i, productID, req.StoreID)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		Logger(r).Error("saving collection failed", "store_id", req.StoreID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save collection")
+		return
+	}
+
+	products, err := GetProductsByStoreID(uint(req.StoreID))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load products")
+		return
+	}
+	_, _, collections, err := storeCatalog(req.StoreID, products)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load collections")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": collectionID, "collections": collections})
+}
+
+// deleteCollectionRequest is the body of DeleteCollection
+type deleteCollectionRequest struct {
+	StoreID int `json:"store_id"`
+	ID      int `json:"id"`
+}
+
+// DeleteCollection removes a collection: POST /api/collections/delete with
+// {"store_id", "id"}. Its products are not touched.
+func DeleteCollection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req deleteCollectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	if _, ok := ValidateStoreOwner(w, r, req.StoreID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM collections WHERE id = ? AND store_id = ?", req.ID, req.StoreID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete collection")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Collection not found")
+		return
+	}
+	db.Exec("DELETE FROM collection_products WHERE collection_id = ?", req.ID)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -9,28 +9,28 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func SetCookie(w http.ResponseWriter, id int, name string) {
+func SetCookie(w http.ResponseWriter, r *http.Request, id int, name string) {
 	sessionID, err := uuid.NewV4()
 	if err != nil {
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
 	query := "INSERT INTO sessions (session_token, user_id) VALUES (?, ?)"
 	deleteExisting := "DELETE FROM sessions WHERE user_id = ?"
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
 	defer db.Close()
 	_, err = db.Exec(deleteExisting, id)
 	if err != nil {
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
 	_, err = db.Exec(query, sessionID.String(), id)
 	if err != nil {
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
 	http.SetCookie(w, &http.Cookie{
@@ -45,15 +45,15 @@ func SetCookie(w http.ResponseWriter, id int, name string) {
 }
 
 // SetStoreCookie sets a cookie for a specific store path
-func SetStoreCookie(w http.ResponseWriter, storeID int, storeName string) {
+func SetStoreCookie(w http.ResponseWriter, r *http.Request, storeID int, storeName string) {
 	sessionID, err := uuid.NewV4()
 	if err != nil {
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
 	defer db.Close()
@@ -62,7 +62,7 @@ func SetStoreCookie(w http.ResponseWriter, storeID int, storeName string) {
 	query := "INSERT INTO sessions (session_token, user_id) VALUES (?, ?)"
 	_, err = db.Exec(query, sessionID.String(), storeID)
 	if err != nil {
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
 
@@ -2,16 +2,18 @@ package api
 
 import (
 	"database/sql"
-	"log"
+	"log/slog"
+	"os"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func CreateDatabase() {
 	// Implementation for creating the database if it doesn't exist
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("failed to open database", "path", DATABASEPATH, "error", err)
+		os.Exit(1)
 	}
 	defer db.Close()
 
@@ -170,6 +172,12 @@ func CreateDatabase() {
 
 	_, err = db.Exec(sqlStmt)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("failed to create database schema", "error", err)
+		os.Exit(1)
+	}
+
+	if err := runMigrations(db); err != nil {
+		slog.Error("failed to migrate database", "error", err)
+		os.Exit(1)
 	}
 }
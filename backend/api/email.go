@@ -1,12 +1,14 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net/http"
-	"net/smtp"
-	"os"
+	"net/url"
 	"strconv"
 )
 
@@ -18,43 +20,82 @@ func GenerateEmailCode() string {
 	return code
 }
 
+// SendEmail sends a plain-text email
 func SendEmail(to string, subject string, body string) error {
-	gmailKey := os.Getenv("GMAIL_KEY")
-	auth := smtp.PlainAuth("", "astropify@gmail.com", gmailKey, "smtp.gmail.com")
-
-	// List of providers to try
-	providers := map[string]string{
-		"gmail":   "smtp.gmail.com:587",
-		"yahoo":   "smtp.mail.yahoo.com:587",
-		"outlook": "smtp.office365.com:587",
-		"hotmail": "smtp.live.com:587",
+	return SendEmailMessage(to, EmailMessage{Subject: subject, Text: body})
+}
+
+// SendEmailMessage encodes a rendered email and hands it to the configured mailer
+func SendEmailMessage(to string, msg EmailMessage) error {
+	from := emailFrom()
+	err := currentMailer().Send(from, []string{to}, msg.MIME(from, emailReplyTo(), to))
+	if err != nil {
+		emailsSentTotal.Inc("failure")
+		slog.Warn("email delivery failed", "transport", mailTransport(), "to", to, "error", err)
+		return fmt.Errorf("failed to send email to %s: %w", to, err)
 	}
+	emailsSentTotal.Inc("success")
+	return nil
+}
 
-	for _, server := range providers {
-		err := smtp.SendMail(server, auth, "astropify@gmail.com", []string{to}, []byte("Subject: "+subject+"\n\n"+body))
-		if err != nil {
-			continue
-		}
-		return nil // Exit after a successful send
+type emailJob struct {
+	To      string       `json:"to"`
+	Message EmailMessage `json:"message"`
+}
+
+// queueEmail hands an email to the job queue so a failed delivery is retried
+// instead of lost. If the queue cannot be written it falls back to sending now.
+func queueEmail(r *http.Request, to string, msg EmailMessage) {
+	id, err := EnqueueJob(JobSendEmail, emailJob{To: to, Message: msg})
+	if err != nil {
+		logger := Logger(r)
+		logger.Error("failed to queue email, sending directly", "to", to, "error", err)
+		go func() {
+			if err := SendEmailMessage(to, msg); err != nil {
+				logger.Error("email delivery failed", "to", to, "subject", msg.Subject, "error", err)
+			}
+		}()
+		return
+	}
+	Logger(r).Debug("email queued", "job_id", id, "to", to, "subject", msg.Subject)
+}
+
+func sendEmailJob(ctx context.Context, payload json.RawMessage) error {
+	var job emailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
 	}
-	return fmt.Errorf("failed to send email to %s: all SMTP providers failed", to)
+	return SendEmailMessage(job.To, job.Message)
+}
+
+// verifyCodeRequest is the v1 JSON body of TwoFactorAuth
+type verifyCodeRequest struct {
+	UserID int    `json:"user_id"`
+	Code   string `json:"code"`
+}
+
+func (req verifyCodeRequest) form() url.Values {
+	return url.Values{"user_id": {strconv.Itoa(req.UserID)}, "code": {req.Code}}
 }
 
 func TwoFactorAuth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	userID := r.FormValue("user_id")
 	code := r.FormValue("code")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database connection error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database connection error")
 		return
 	}
-	_, _ = db.Exec("DELETE FROM verification_codes WHERE expires_at <= datetime('now')")
+	defer db.Close()
+	if _, err := db.Exec("DELETE FROM verification_codes WHERE expires_at <= datetime('now')"); err != nil {
+		Logger(r).Warn("failed to purge expired verification codes", "error", err)
+	}
 	var userIDInt int
 	query := "SELECT id,user_id FROM verification_codes WHERE user_id = ? AND code = ? AND expires_at > datetime('now')"
 	row := db.QueryRow(query, userID, code)
@@ -62,29 +103,40 @@ func TwoFactorAuth(w http.ResponseWriter, r *http.Request) {
 	var id int
 	if err := row.Scan(&id, &userIDInt); err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, `{"error": "Invalid or expired code"}`, http.StatusUnauthorized)
+			writeError(w, r, http.StatusUnauthorized, CodeInvalidCode, "Invalid or expired code")
 		} else {
-			http.Error(w, `{"error": "Database query error"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database query error")
 		}
 		return
 	}
-	_, _ = db.Exec("DELETE FROM verification_codes WHERE user_id = ? AND (code = ? OR expires_at <= datetime('now'))", userIDInt, code)
-	SetCookie(w, userIDInt, "session_token")
+	if _, err := db.Exec("DELETE FROM verification_codes WHERE user_id = ? AND (code = ? OR expires_at <= datetime('now'))", userIDInt, code); err != nil {
+		Logger(r).Warn("failed to delete used verification code", "user_id", userIDInt, "error", err)
+	}
+	SetCookie(w, r, userIDInt, "session_token")
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"message": "Login successful"}`))
 }
 
+// resendCodeRequest is the v1 JSON body of Resend2FAHandler
+type resendCodeRequest struct {
+	UserID int `json:"user_id"`
+}
+
+func (req resendCodeRequest) form() url.Values {
+	return url.Values{"user_id": {strconv.Itoa(req.UserID)}}
+}
+
 func Resend2FAHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 	userID := r.FormValue("user_id")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database connection error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database connection error")
 		return
 	}
 	defer db.Close()
@@ -94,12 +146,14 @@ func Resend2FAHandler(w http.ResponseWriter, r *http.Request) {
 
 	var existingCode string
 	if err := row.Scan(&email, &existingCode); err == nil {
-		err = SendEmail(email, "Your 2FA Code", "Your verification code is: "+existingCode)
+		err = sendTemplatedEmail(email, EmailVerification, 0, map[string]interface{}{
+			"Code": existingCode, "Intro": "Here is your verification code again.",
+		})
 		if err != nil {
-			http.Error(w, `{"error": "Failed to send email"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to send email")
 			return
 		}
-		http.Error(w, `{"error": "A valid code has already been sent. Please check your email."}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, "A valid code has already been sent. Please check your email.")
 		return
 	} else {
 		token := GenerateEmailCode()
@@ -107,12 +161,14 @@ func Resend2FAHandler(w http.ResponseWriter, r *http.Request) {
 		query = "INSERT INTO verification_codes (user_id, code, expires_at) VALUES (?, ?, datetime('now', '+5 minutes'))"
 		_, err = db.Exec(query, userID, token)
 		if err != nil {
-			http.Error(w, `{"error": "Failed to generate new code"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to generate new code")
 			return
 		}
-		err = SendEmail(email, "Your 2FA Code", "Your verification code is: "+token)
+		err = sendTemplatedEmail(email, EmailVerification, 0, map[string]interface{}{
+			"Code": token, "Intro": "Here is your new verification code.",
+		})
 		if err != nil {
-			http.Error(w, `{"error": "Failed to send email"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to send email")
 			return
 		}
 		w.WriteHeader(http.StatusOK)
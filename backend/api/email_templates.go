@@ -0,0 +1,300 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Email message types. Each has <type>.html and <type>.txt in
+// FrontendEmailDir, defining "subject" and "content" for the shared layouts.
+const (
+	EmailVerification = "verification"
+	EmailOrder        = "order"
+	EmailPayment      = "payment"
+	EmailStatus       = "status"
+	EmailRefund       = "refund"
+	EmailNotification = "notification"
+)
+
+var emailTypes = []string{EmailVerification, EmailOrder, EmailPayment, EmailStatus, EmailRefund, EmailNotification}
+
+// EmailBranding is the look of an email: the platform's by default, or a
+// store's name, logo and colour scheme for mail sent on its behalf.
+type EmailBranding struct {
+	Name       string `json:"name"`
+	LogoURL    string `json:"logo_url"`
+	Primary    string `json:"primary"`
+	Accent     string `json:"accent"`
+	Background string `json:"background"`
+	Text       string `json:"text"`
+}
+
+// EmailMessage is a rendered email with HTML and plain-text bodies.
+// Unsubscribe, when set, is advertised in the List-Unsubscribe header.
+type EmailMessage struct {
+	Subject     string `json:"subject"`
+	HTML        string `json:"html,omitempty"`
+	Text        string `json:"text"`
+	Unsubscribe string `json:"unsubscribe,omitempty"`
+}
+
+type emailView struct {
+	Brand EmailBranding
+	Data  map[string]interface{}
+}
+
+var emailFuncs = map[string]interface{}{
+	"money": func(v interface{}) string { return fmt.Sprintf("%.2f", v) },
+}
+
+func defaultBranding() EmailBranding {
+	return EmailBranding{
+		Name:       "Astropify",
+		Primary:    "#2c3e50",
+		Accent:     "#f5f5f5",
+		Background: "#ffffff",
+		Text:       "#333333",
+	}
+}
+
+// storeBranding builds the branding for a store, keeping the platform
+// defaults for anything the store has not set. storeID 0 means the platform.
+func storeBranding(storeID int) EmailBranding {
+	branding := defaultBranding()
+	if storeID == 0 {
+		return branding
+	}
+	store, err := GetStoreByID(storeID)
+	if err != nil || store.ID == 0 {
+		return branding
+	}
+	branding.Name = store.Name
+	if store.Logo != "" {
+		branding.LogoURL = publicBaseURL() + "/logos/" + store.Logo
+	}
+	if isHexColor(store.ColorScheme.Primary) {
+		branding.Primary = store.ColorScheme.Primary
+	}
+	if isHexColor(store.ColorScheme.Background) {
+		branding.Accent = store.ColorScheme.Background
+	}
+	return branding
+}
+
+func isHexColor(s string) bool {
+	s = strings.TrimSpace(s)
+	if len(s) != 4 && len(s) != 7 || s[0] != '#' {
+		return false
+	}
+	_, err := strconv.ParseUint(s[1:], 16, 32)
+	return err == nil
+}
+
+// RenderEmail renders an email type with the given branding and data
+func RenderEmail(kind string, branding EmailBranding, data map[string]interface{}) (EmailMessage, error) {
+	view := emailView{Brand: branding, Data: data}
+
+	textTmpl, err := texttemplate.New("").Funcs(emailFuncs).ParseFiles(
+		filepath.Join(FrontendEmailDir, "layout.txt"), filepath.Join(FrontendEmailDir, kind+".txt"))
+	if err != nil {
+		return EmailMessage{}, err
+	}
+	htmlTmpl, err := htmltemplate.New("").Funcs(emailFuncs).ParseFiles(
+		filepath.Join(FrontendEmailDir, "layout.html"), filepath.Join(FrontendEmailDir, kind+".html"))
+	if err != nil {
+		return EmailMessage{}, err
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := textTmpl.ExecuteTemplate(&subject, "subject", view); err != nil {
+		return EmailMessage{}, err
+	}
+	if err := textTmpl.ExecuteTemplate(&text, "layout", view); err != nil {
+		return EmailMessage{}, err
+	}
+	if err := htmlTmpl.ExecuteTemplate(&html, "layout", view); err != nil {
+		return EmailMessage{}, err
+	}
+	return EmailMessage{
+		Subject: strings.TrimSpace(subject.String()),
+		HTML:    html.String(),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+	}, nil
+}
+
+// MIME encodes the message for SMTP: multipart/alternative with the plain
+// text first, or a single text/plain part when there is no HTML body.
+// replyTo may be empty.
+func (m EmailMessage) MIME(from string, replyTo string, to string) []byte {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		buf.WriteString(key + ": " + value + "\r\n")
+	}
+	header("From", from)
+	header("To", to)
+	if replyTo != "" {
+		header("Reply-To", replyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+newMessageID()+">")
+	header("MIME-Version", "1.0")
+	if m.Unsubscribe != "" {
+		header("List-Unsubscribe", "<"+m.Unsubscribe+">")
+		header("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+
+	if m.HTML == "" {
+		header("Content-Type", "text/plain; charset=UTF-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		writeQuotedPrintable(&buf, m.Text)
+		return buf.Bytes()
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", m.Text},
+		{"text/html; charset=UTF-8", m.HTML},
+	} {
+		w, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeQuotedPrintable(w, part.body)
+	}
+	mw.Close()
+	return buf.Bytes()
+}
+
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, body string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(body))
+	qp.Close()
+}
+
+func newMessageID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b) + "@astropify"
+}
+
+// sendTemplatedEmail renders and sends an email right away, for messages the
+// user is waiting on such as verification codes.
+func sendTemplatedEmail(to string, kind string, storeID int, data map[string]interface{}) error {
+	msg, err := RenderEmail(kind, storeBranding(storeID), data)
+	if err != nil {
+		return err
+	}
+	return SendEmailMessage(to, msg)
+}
+
+// queueTemplatedEmail renders an email and hands it to the job queue
+func queueTemplatedEmail(r *http.Request, to string, kind string, storeID int, data map[string]interface{}) {
+	msg, err := RenderEmail(kind, storeBranding(storeID), data)
+	if err != nil {
+		Logger(r).Error("failed to render email", "type", kind, "error", err)
+		return
+	}
+	queueEmail(r, to, msg)
+}
+
+// sampleEmailData is the placeholder content used by the preview endpoint
+func sampleEmailData(kind string) map[string]interface{} {
+	switch kind {
+	case EmailVerification:
+		return map[string]interface{}{"Code": "123456", "Intro": "Welcome! Use this code to verify your email address."}
+	case EmailOrder:
+		return map[string]interface{}{"OrderID": 1042, "Total": 57.5, "ShippingAddress": "Building 123, Road 45, Manama"}
+	case EmailPayment:
+		return map[string]interface{}{"OrderID": 1042, "Amount": 57.5, "PaymentMethod": "Credit Card", "Date": getFormattedDate()}
+	case EmailStatus:
+		return map[string]interface{}{"OrderID": 1042, "CustomerName": "Sara", "Status": "shipped",
+			"Message": orderStatusMessage("shipped"), "Total": 57.5,
+			"TrackingNumber": "TRK123456789", "TrackingURL": absoluteLink("/demo/orders/1042")}
+	case EmailRefund:
+		return map[string]interface{}{"OrderID": 1042, "CustomerName": "Sara", "Amount": 19.9, "Reason": "Item arrived damaged"}
+	case EmailNotification:
+		return map[string]interface{}{"Title": "Low stock: Desk Lamp", "Body": "Only 3 left in stock.",
+			"Link": publicBaseURL() + "/dashboard", "UnsubscribeURL": publicBaseURL() + "/notifications/unsubscribe"}
+	}
+	return nil
+}
+
+// PreviewEmail renders an email type with sample data so owners can see their
+// branding and admins can check templates. Query parameters: type, store_id
+// and format (html, text or eml). Without a type it lists the available types.
+func PreviewEmail(w http.ResponseWriter, r *http.Request) {
+	userID, validUser := ValidateUser(w, r)
+	if !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	storeID := 0
+	if s := r.URL.Query().Get("store_id"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
+			return
+		}
+		store, err := GetStoreByID(id)
+		if err != nil || store.ID == 0 {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Store not found")
+			return
+		}
+		if int(store.OwnerID) != userID {
+			if _, isAdmin := ValidateAdmin(w, r); !isAdmin {
+				writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized to preview emails for this store")
+				return
+			}
+		}
+		storeID = id
+	}
+
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"types": ["%s"]}`, strings.Join(emailTypes, `", "`))
+		return
+	}
+	data := sampleEmailData(kind)
+	if data == nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Unknown email type")
+		return
+	}
+
+	msg, err := RenderEmail(kind, storeBranding(storeID), data)
+	if err != nil {
+		Logger(r).Error("failed to render email preview", "type", kind, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to render email")
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("Subject: " + msg.Subject + "\n\n" + msg.Text))
+	case "eml":
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Write(msg.MIME(emailFrom(), emailReplyTo(), "customer@example.com"))
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(msg.HTML))
+	}
+}
@@ -30,4 +30,18 @@ func LoadEnv() {
             os.Setenv(key, value)
         }
     }
-}
\ No newline at end of file
+}
+
+// envOr returns the environment variable key, or fallback when it is unset
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// publicBaseURL is the address customers reach the server at, used for
+// absolute links in emails (PUBLIC_BASE_URL, without a trailing slash)
+func publicBaseURL() string {
+	return strings.TrimSuffix(envOr("PUBLIC_BASE_URL", "https://localhost"), "/")
+}
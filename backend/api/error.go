@@ -3,20 +3,24 @@ package api
 import (
 	"html/template"
 	"net/http"
+	"strings"
 )
 
+// HandleError reports an error with the code of its status: JSON for API
+// requests and the error page for everything else
 func HandleError(w http.ResponseWriter, r *http.Request, errNbr int, err string) {
+	apiErr := NewAPIError(errNbr, err)
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		sendError(w, r, apiErr)
+		return
+	}
 	tmpl, tmplErr := template.ParseFiles(FrontendErrorHTML)
 	if tmplErr != nil {
 		http.Error(w, "Failed to load template", http.StatusInternalServerError)
 		return
 	}
-	errorData := ErrorResponse{
-		ErrorNbr: errNbr,
-		ErrorMsg: err,
-	}
 	w.WriteHeader(errNbr)
-	if execErr := tmpl.Execute(w, errorData); execErr != nil {
+	if execErr := tmpl.Execute(w, apiErr); execErr != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		return
 	}
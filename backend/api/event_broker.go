@@ -0,0 +1,210 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsBroker relays events through a NATS server using its plain text
+// protocol (CONNECT, PUB, SUB, MSG, PING/PONG), so instances behind a load
+// balancer see each other's changes. Events published while the connection
+// is down are only delivered locally.
+type natsBroker struct {
+	addr     string
+	user     string
+	password string
+	subject  string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newNATSBroker(rawURL string, subject string) (*natsBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EVENT_BROKER_URL: %w", err)
+	}
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("unsupported event broker scheme %q (expected nats://)", u.Scheme)
+	}
+	if strings.ContainsAny(subject, " \t\r\n") || subject == "" {
+		return nil, fmt.Errorf("invalid event broker subject %q", subject)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	b := &natsBroker{addr: addr, subject: subject}
+	if u.User != nil {
+		b.user = u.User.Username()
+		b.password, _ = u.User.Password()
+	}
+	return b, nil
+}
+
+func (b *natsBroker) Name() string {
+	return "nats://" + b.addr
+}
+
+func (b *natsBroker) Connected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn != nil
+}
+
+func (b *natsBroker) Publish(e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return errors.New("not connected")
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(b.conn, "PUB %s %d\r\n%s\r\n", b.subject, len(payload), payload)
+	return err
+}
+
+// Run keeps a connection open, reconnecting with backoff, until ctx is done
+func (b *natsBroker) Run(ctx context.Context, deliver func(Event)) {
+	logger := Logger(nil).With("broker", b.Name())
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := b.session(ctx, deliver)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		logger.Warn("event broker disconnected", "error", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (b *natsBroker) session(ctx context.Context, deliver func(Event)) error {
+	conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := readProtoLine(reader)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting %q", line)
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "astropify-" + instanceID, "lang": "go"}
+	if b.user != "" {
+		options["user"] = b.user
+		options["pass"] = b.password
+	}
+	connect, _ := json.Marshal(options)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s 1\r\nPING\r\n", connect, b.subject); err != nil {
+		return err
+	}
+
+	connected := false
+	defer func() {
+		b.mu.Lock()
+		if b.conn == conn {
+			b.conn = nil
+		}
+		b.mu.Unlock()
+	}()
+
+	for {
+		// the server pings every couple of minutes, so silence means it's gone
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := readProtoLine(reader)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			payload, err := readProtoPayload(reader, line)
+			if err != nil {
+				return err
+			}
+			var e Event
+			if err := json.Unmarshal(payload, &e); err != nil {
+				Logger(nil).Warn("ignoring malformed broker event", "error", err)
+				continue
+			}
+			deliver(e)
+		case line == "PING":
+			b.mu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, err := io.WriteString(conn, "PONG\r\n")
+			b.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		case line == "PONG":
+			// answer to our PING after CONNECT: the subscription is live
+			if !connected {
+				connected = true
+				b.mu.Lock()
+				b.conn = conn
+				b.mu.Unlock()
+				Logger(nil).Info("event broker connected", "broker", b.Name())
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("broker error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func readProtoLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readProtoPayload reads the body of "MSG <subject> <sid> [reply-to] <#bytes>"
+func readProtoPayload(r *bufio.Reader, header string) ([]byte, error) {
+	fields := strings.Fields(header)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("malformed MSG line %q", header)
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("malformed MSG size in %q", header)
+	}
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload[:size], nil
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Event types published on the bus. Store events carry StoreID so dashboards
+// can follow one store; user events carry UserID.
+const (
+	EventOrderCreated        = "order.created"
+	EventOrderPaid           = "order.paid"
+	EventOrderStatusChanged  = "order.status_changed"
+	EventOrderClaimed        = "order.claimed"
+	EventShipmentUpdated     = "shipment.updated"
+	EventReturnUpdated       = "return.updated"
+	EventProductCreated      = "product.created"
+	EventProductUpdated      = "product.updated"
+	EventProductDeleted      = "product.deleted"
+	EventStockChanged        = "product.stock_changed"
+	EventLowStock            = "product.low_stock"
+	EventReviewCreated       = "review.created"
+	EventNotificationCreated = "notification.created"
+	EventNotificationsRead   = "notification.read"
+)
+
+// Event is a change that already happened. Data holds a small summary for
+// subscribers; anything larger is read back from the database.
+type Event struct {
+	Type    string                 `json:"type"`
+	StoreID int                    `json:"store_id,omitempty"`
+	UserID  int                    `json:"user_id,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+	Time    time.Time              `json:"time"`
+	Origin  string                 `json:"origin,omitempty"`
+}
+
+// EventFilter selects events for a subscription. Zero fields match anything.
+type EventFilter struct {
+	StoreID int
+	UserID  int
+	Types   []string
+}
+
+func (f EventFilter) match(e Event) bool {
+	if f.StoreID != 0 && f.StoreID != e.StoreID {
+		return false
+	}
+	if f.UserID != 0 && f.UserID != e.UserID {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Int reads a numeric Data field. Events that came through the broker were
+// decoded from JSON, so numbers arrive as float64.
+func (e Event) Int(key string) int {
+	switch v := e.Data[key].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case uint:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// Subscription receives matching events on C until Close is called
+type Subscription struct {
+	C      <-chan Event
+	ch     chan Event
+	filter EventFilter
+	bus    *EventBus
+}
+
+// Close stops delivery; C is not closed so readers never see a zero Event
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	delete(s.bus.subs, s)
+}
+
+// EventBroker forwards events between instances. Run delivers events
+// published elsewhere until ctx is done.
+type EventBroker interface {
+	Name() string
+	Publish(e Event) error
+	Run(ctx context.Context, deliver func(Event))
+	Connected() bool
+}
+
+// EventBus fans events out to in-process subscribers and, when a broker is
+// attached, to every other instance behind the load balancer.
+type EventBus struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	broker EventBroker
+}
+
+// NewEventBus returns a bus with no broker
+func NewEventBus() *EventBus {
+	return &EventBus{subs: map[*Subscription]struct{}{}}
+}
+
+var (
+	events = NewEventBus()
+
+	// instanceID tags events published here so the broker echo is ignored
+	instanceID = newInstanceID()
+)
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Subscribe returns a subscription for events matching filter. Slow
+// subscribers drop events rather than block publishers.
+func (b *EventBus) Subscribe(filter EventFilter) *Subscription {
+	ch := make(chan Event, 32)
+	s := &Subscription{C: ch, ch: ch, filter: filter, bus: b}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Publish delivers e locally and hands it to the broker, if any
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Origin == "" {
+		e.Origin = instanceID
+	}
+	eventsPublishedTotal.Inc(e.Type)
+	b.deliver(e)
+
+	b.mu.Lock()
+	broker := b.broker
+	b.mu.Unlock()
+	if broker != nil {
+		if err := broker.Publish(e); err != nil {
+			Logger(nil).Warn("failed to forward event to broker", "broker", broker.Name(), "event", e.Type, "error", err)
+		}
+	}
+}
+
+func (b *EventBus) deliver(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if !s.filter.match(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			eventsDroppedTotal.Inc(e.Type)
+		}
+	}
+}
+
+// receive delivers an event from the broker, skipping our own echoes
+func (b *EventBus) receive(e Event) {
+	if e.Origin == instanceID {
+		return
+	}
+	b.deliver(e)
+}
+
+// SetBroker attaches a broker and starts relaying events from it
+func (b *EventBus) SetBroker(ctx context.Context, broker EventBroker) {
+	b.mu.Lock()
+	b.broker = broker
+	b.mu.Unlock()
+	go broker.Run(ctx, b.receive)
+}
+
+func (b *EventBus) currentBroker() EventBroker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.broker
+}
+
+// PublishEvent publishes on the process-wide bus
+func PublishEvent(e Event) {
+	events.Publish(e)
+}
+
+// StartEventBroker connects the bus to the broker in EVENT_BROKER_URL, if
+// set. Without one the bus only reaches connections on this instance.
+func StartEventBroker(ctx context.Context) error {
+	url := envOr("EVENT_BROKER_URL", "")
+	if url == "" {
+		return nil
+	}
+	broker, err := newNATSBroker(url, envOr("EVENT_BROKER_SUBJECT", "astropify.events"))
+	if err != nil {
+		return err
+	}
+	events.SetBroker(ctx, broker)
+	Logger(nil).Info("event broker configured", "broker", broker.Name(), "subject", broker.subject)
+	return nil
+}
+
+// eventBrokerSummary describes the broker for diagnostics
+func eventBrokerSummary() string {
+	broker := events.currentBroker()
+	if broker == nil {
+		return "in-process"
+	}
+	if !broker.Connected() {
+		return broker.Name() + " (disconnected)"
+	}
+	return broker.Name() + " (connected)"
+}
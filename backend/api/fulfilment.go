@@ -0,0 +1,520 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// orderStatuses are the statuses an order can be moved to
+var orderStatuses = []string{"pending", "paid", "processing", "shipped", "delivered", "completed", "cancelled"}
+
+// boardStatuses are the orders the fulfilment board shows by default:
+// paid and waiting to be packed, or on their way
+var boardStatuses = []string{"paid", "processing", "shipped"}
+
+func validOrderStatus(status string) bool {
+	for _, s := range orderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// StoreOrder is an order as the store's staff see it. Version changes on every
+// update; writers send the version they loaded and get a 409 if it is stale.
+type StoreOrder struct {
+	ID            int    `json:"id"`
+	CustomerName  string `json:"customer_name"`
+	ProductCount  int    `json:"product_count"`
+	TotalAmount   string `json:"total_amount"`
+	Status        string `json:"status"`
+	CreatedAt     string `json:"created_at"`
+	Version       int    `json:"version"`
+	ClaimedBy     int    `json:"claimed_by,omitempty"`
+	ClaimedByName string `json:"claimed_by_name,omitempty"`
+	ClaimedAt     string `json:"claimed_at,omitempty"`
+	PaidAt        string `json:"paid_at,omitempty"`
+	ShipBy        string `json:"ship_by,omitempty"`
+	Overdue       bool   `json:"overdue"`
+	OpenReturns   int    `json:"open_returns,omitempty"`
+}
+
+// ShippingAddress is the pipe-separated shipping_info of an order
+type ShippingAddress struct {
+	FullName string
+	Phone    string
+	Address  string
+	City     string
+	State    string
+	ZipCode  string
+	Country  string
+}
+
+func parseShippingInfo(info string) ShippingAddress {
+	parts := strings.Split(info, "|")
+	for len(parts) < 7 {
+		parts = append(parts, "")
+	}
+	return ShippingAddress{
+		FullName: parts[0],
+		Phone:    parts[1],
+		Address:  parts[2],
+		City:     parts[3],
+		State:    parts[4],
+		ZipCode:  parts[5],
+		Country:  parts[6],
+	}
+}
+
+// parseStatusFilter reads a comma-separated ?status= list
+func parseStatusFilter(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var statuses []string
+	for _, status := range strings.Split(value, ",") {
+		status = strings.TrimSpace(status)
+		if !validOrderStatus(status) {
+			return nil, fmt.Errorf("unknown order status %q", status)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// storeOrderColumns and storeOrderFrom are how store orders are read;
+// scanStoreOrder reads a row of them
+const (
+	storeOrderColumns = `
+		o.id,
+		o.total_amount,
+		o.status,
+		o.created_at,
+		o.version,
+		o.claimed_by,
+		c.first_name,
+		o.claimed_at,
+		o.paid_at,
+		u.first_name,
+		COUNT(op.id) as product_count,
+		(SELECT COUNT(*) FROM returns r WHERE r.order_id = o.id AND r.status IN ('requested', 'approved', 'received')) as open_returns`
+	storeOrderFrom = `orders o
+		LEFT JOIN order_products op ON o.id = op.order_id
+		LEFT JOIN users u ON o.user_id = u.id
+		LEFT JOIN users c ON o.claimed_by = c.id`
+)
+
+// storeOrderListSpec is what GET /api/orders filters and sorts by
+var storeOrderListSpec = ListSpec{
+	Key:  "o.id",
+	Sort: "-created_at",
+	Fields: map[string]ListField{
+		"id":         {Expr: "o.id", Kind: listInt, Filter: true, Sort: true},
+		"status":     {Expr: "o.status", Kind: listText, Values: orderStatuses, Filter: true, Sort: true, Facet: true},
+		"created_at": {Expr: "o.created_at", Kind: listTime, Filter: true, Sort: true},
+		"paid_at":    {Expr: "o.paid_at", Kind: listTime, Filter: true, Sort: true},
+		"total":      {Expr: "o.total_amount", Kind: listNumber, Filter: true, Sort: true},
+		"claimed":    {Expr: "o.claimed_by IS NOT NULL", Kind: listBool, Filter: true, Facet: true},
+		"customer":   {Expr: "u.first_name || ' ' || u.last_name", Kind: listText, Sort: true, Search: true},
+		"email":      {Expr: "u.email", Kind: listText, Search: true},
+	},
+}
+
+func scanStoreOrder(scan func(dest ...interface{}) error, estimatedShipping int) (StoreOrder, error) {
+	var order StoreOrder
+	var claimedBy sql.NullInt64
+	var claimedByName, customerName sql.NullString
+	var claimedAt, paidAt sql.NullTime
+	if err := scan(&order.ID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.Version,
+		&claimedBy, &claimedByName, &claimedAt, &paidAt, &customerName, &order.ProductCount, &order.OpenReturns); err != nil {
+		return order, err
+	}
+	order.CustomerName = "Guest"
+	if customerName.Valid {
+		order.CustomerName = customerName.String
+	}
+	if claimedBy.Valid {
+		order.ClaimedBy = int(claimedBy.Int64)
+		order.ClaimedByName = claimedByName.String
+	}
+	if claimedAt.Valid {
+		order.ClaimedAt = claimedAt.Time.UTC().Format(time.RFC3339)
+	}
+	if paidAt.Valid {
+		order.PaidAt = paidAt.Time.UTC().Format(time.RFC3339)
+		// the store promises to ship within estimated_shipping days of payment
+		if estimatedShipping > 0 {
+			shipBy := paidAt.Time.Add(time.Duration(estimatedShipping) * 24 * time.Hour)
+			order.ShipBy = shipBy.UTC().Format(time.RFC3339)
+			order.Overdue = (order.Status == "paid" || order.Status == "processing") && time.Now().After(shipBy)
+		}
+	}
+	return order, nil
+}
+
+func storeEstimatedShipping(db *sql.DB, storeID int) (int, error) {
+	var estimatedShipping int
+	err := db.QueryRow("SELECT COALESCE(estimated_shipping, 0) FROM stores WHERE id = ?", storeID).Scan(&estimatedShipping)
+	return estimatedShipping, err
+}
+
+// loadStoreOrders returns the store's orders, newest first, limited to the
+// given statuses and, when orderID is set, to that one order
+func loadStoreOrders(db *sql.DB, storeID int, statuses []string, orderID int) ([]StoreOrder, error) {
+	estimatedShipping, err := storeEstimatedShipping(db, storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + storeOrderColumns + " FROM " + storeOrderFrom + " WHERE o.store_id = ?"
+	args := []interface{}{storeID}
+	if len(statuses) > 0 {
+		query += " AND o.status IN (?" + strings.Repeat(", ?", len(statuses)-1) + ")"
+		for _, status := range statuses {
+			args = append(args, status)
+		}
+	}
+	if orderID != 0 {
+		query += " AND o.id = ?"
+		args = append(args, orderID)
+	}
+	query += " GROUP BY o.id ORDER BY o.created_at DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []StoreOrder{}
+	for rows.Next() {
+		order, err := scanStoreOrder(rows.Scan, estimatedShipping)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// listStoreOrders returns one page of the store's orders
+func listStoreOrders(db *sql.DB, storeID int, list *ListQuery) (ListPage, error) {
+	estimatedShipping, err := storeEstimatedShipping(db, storeID)
+	if err != nil {
+		return ListPage{}, err
+	}
+	orders := []StoreOrder{}
+	page, err := list.Run(db, listSource{
+		Columns: storeOrderColumns,
+		From:    storeOrderFrom,
+		Where:   "o.store_id = ?",
+		Args:    []interface{}{storeID},
+		GroupBy: "o.id",
+	}, func(scan func(dest ...interface{}) error) error {
+		order, err := scanStoreOrder(scan, estimatedShipping)
+		if err != nil {
+			return err
+		}
+		orders = append(orders, order)
+		return nil
+	})
+	page.Data = orders
+	return page, err
+}
+
+// loadStoreOrder returns one order of the store, or sql.ErrNoRows
+func loadStoreOrder(db *sql.DB, storeID int, orderID int) (StoreOrder, error) {
+	orders, err := loadStoreOrders(db, storeID, nil, orderID)
+	if err != nil {
+		return StoreOrder{}, err
+	}
+	if len(orders) == 0 {
+		return StoreOrder{}, sql.ErrNoRows
+	}
+	return orders[0], nil
+}
+
+// writeOrderConflict answers a write made against a stale version with 409
+// and the order as it is now, so the client can refresh and retry
+func writeOrderConflict(w http.ResponseWriter, r *http.Request, db *sql.DB, storeID int, orderID int, message string) {
+	current, err := loadStoreOrder(db, storeID, orderID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load order")
+		return
+	}
+	sendError(w, r, (&APIError{Status: http.StatusConflict, Code: CodeVersionConflict, Message: message}).With("order", current))
+}
+
+// claimOrderRequest is the body of ClaimOrder
+type claimOrderRequest struct {
+	OrderID int  `json:"order_id"`
+	StoreID int  `json:"store_id"`
+	Version int  `json:"version"`
+	Release bool `json:"release"`
+}
+
+// ClaimOrder marks an order as being packed by the caller. It takes
+// {"order_id", "store_id", "version"}; {"release": true} gives the order back.
+// A stale version or someone else's claim returns 409 with the current order.
+func ClaimOrder(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req claimOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrderID == 0 || req.Version == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Order ID and version are required")
+		return
+	}
+	userID, isOwner := ValidateStoreOwner(w, r, req.StoreID)
+	if !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized to update this order")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	var result sql.Result
+	if req.Release {
+		result, err = db.Exec(`
+			UPDATE orders SET claimed_by = NULL, claimed_at = NULL, version = version + 1, updated_at = datetime('now')
+			WHERE id = ? AND store_id = ? AND version = ? AND claimed_by = ?
+		`, req.OrderID, req.StoreID, req.Version, userID)
+	} else {
+		result, err = db.Exec(`
+			UPDATE orders SET claimed_by = ?, claimed_at = datetime('now'), version = version + 1, updated_at = datetime('now')
+			WHERE id = ? AND store_id = ? AND version = ? AND (claimed_by IS NULL OR claimed_by = ?)
+		`, userID, req.OrderID, req.StoreID, req.Version, userID)
+	}
+	if err != nil {
+		Logger(r).Error("failed to claim order", "order_id", req.OrderID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update order")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeOrderConflict(w, r, db, req.StoreID, req.OrderID, "Order was changed by someone else")
+		return
+	}
+
+	order, err := loadStoreOrder(db, req.StoreID, req.OrderID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load order")
+		return
+	}
+	PublishEvent(Event{Type: EventOrderClaimed, StoreID: req.StoreID, Data: map[string]interface{}{
+		"order_id":   req.OrderID,
+		"claimed_by": order.ClaimedBy,
+	}})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"order":   order,
+	})
+}
+
+type packingSlipItem struct {
+	Name     string
+	Quantity int
+}
+
+// PackingSlip renders a printable packing slip for one order of the store
+func PackingSlip(w http.ResponseWriter, r *http.Request) {
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, "Invalid store ID")
+		return
+	}
+	orderID, err := strconv.Atoi(r.URL.Query().Get("order_id"))
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, storeID); !isOwner {
+		HandleError(w, r, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer db.Close()
+
+	var shippingInfo string
+	var createdAt time.Time
+	err = db.QueryRow("SELECT shipping_info, created_at FROM orders WHERE id = ? AND store_id = ?", orderID, storeID).
+		Scan(&shippingInfo, &createdAt)
+	if err == sql.ErrNoRows {
+		HandleError(w, r, http.StatusNotFound, "Order not found")
+		return
+	} else if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load order")
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+orderLineName+` AS name, op.quantity
+		FROM order_products op
+		JOIN products p ON op.product_id = p.id
+		WHERE op.order_id = ?
+		ORDER BY name
+	`, orderID)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load order items")
+		return
+	}
+	defer rows.Close()
+	var items []packingSlipItem
+	totalItems := 0
+	for rows.Next() {
+		var item packingSlipItem
+		if err := rows.Scan(&item.Name, &item.Quantity); err != nil {
+			HandleError(w, r, http.StatusInternalServerError, "Failed to load order items")
+			return
+		}
+		totalItems += item.Quantity
+		items = append(items, item)
+	}
+
+	store, err := GetStoreByID(storeID)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load store")
+		return
+	}
+
+	tmpl, err := template.ParseFiles(FrontendPackingSlipHTML)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load template")
+		return
+	}
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Store":      store,
+		"OrderID":    orderID,
+		"OrderDate":  createdAt.Format("January 2, 2006"),
+		"ShipTo":     parseShippingInfo(shippingInfo),
+		"Items":      items,
+		"TotalItems": totalItems,
+		"AutoPrint":  r.URL.Query().Get("print") == "1",
+	})
+	if err != nil {
+		Logger(r).Error("failed to render packing slip", "order_id", orderID, "error", err)
+	}
+}
+
+// OrdersWebSocketHandler is the live feed behind the fulfilment board. It
+// sends {"type": "snapshot", "orders": [...]} for ?status= (paid, processing
+// and shipped by default), then {"type": "order", "event": ..., "order": ...}
+// whenever one of the store's orders is created, paid, claimed, moved or one
+// of its shipments changes.
+func OrdersWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		http.Error(w, "Invalid store ID", http.StatusBadRequest)
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, storeID); !isOwner {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	statuses, err := parseStatusFilter(r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if statuses == nil {
+		statuses = boardStatuses
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	websocketConnections.Inc("orders")
+	defer websocketConnections.Dec("orders")
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	updates := events.Subscribe(EventFilter{StoreID: storeID, Types: []string{
+		EventOrderCreated, EventOrderPaid, EventOrderStatusChanged, EventOrderClaimed, EventShipmentUpdated, EventReturnUpdated,
+	}})
+	defer updates.Close()
+
+	orders, err := loadStoreOrders(db, storeID, statuses, 0)
+	if err != nil {
+		Logger(r).Error("fulfilment board query failed", "error", err)
+		return
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": "snapshot", "statuses": statuses, "orders": orders}); err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	pingTicker := time.NewTicker(30 * time.Second)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-updates.C:
+			order, err := loadStoreOrder(db, storeID, e.Int("order_id"))
+			if err != nil {
+				continue
+			}
+			onBoard := false
+			for _, status := range statuses {
+				onBoard = onBoard || status == order.Status
+			}
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(map[string]interface{}{
+				"type":     "order",
+				"event":    e.Type,
+				"order":    order,
+				"on_board": onBoard,
+			}); err != nil {
+				return
+			}
+		case <-pingTicker.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// certExpiryWarning is how close to expiry the TLS certificate may get
+// before /readyz reports the server as not ready (CERT_EXPIRY_DAYS overrides it).
+const certExpiryWarning = 7 * 24 * time.Hour
+
+// storageDirs are the upload directories the server must be able to write to
+var storageDirs = []string{StoreLogosPath, StoreBannersPath, StoreProductsPath, StoreReturnsPath, AvatarsPath, Store3DPath}
+
+type checkResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type readinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// readinessCheck is one check as /readyz shows it. The endpoint is public,
+// so the details stay in the log and the admin diagnostics.
+type readinessCheck struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+}
+
+// EnsureStorageDirs creates any missing upload directory at startup
+func EnsureStorageDirs() error {
+	for _, dir := range storageDirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("create %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// HealthzHandler reports that the process is up and serving requests
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(`{"status": "ok"}`))
+}
+
+// ReadyzHandler reports whether the server can take traffic: the database
+// answers, uploads can be written, templates parse and TLS is not expiring.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := runReadinessChecks(r.Context())
+	checks := []readinessCheck{}
+	for name, check := range report.Checks {
+		if !check.OK {
+			Logger(r).Warn("readiness check failed", "check", name, "detail", check.Detail)
+		}
+		checks = append(checks, readinessCheck{Name: name, OK: check.OK})
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": report.Status, "checks": checks})
+}
+
+func runReadinessChecks(ctx context.Context) readinessReport {
+	report := readinessReport{Status: "ready", Checks: map[string]checkResult{}}
+	add := func(name string, err error, detail string) {
+		if err != nil {
+			report.Status = "not_ready"
+			report.Checks[name] = checkResult{OK: false, Detail: err.Error()}
+			return
+		}
+		report.Checks[name] = checkResult{OK: true, Detail: detail}
+	}
+
+	add("database", checkDatabase(ctx), "")
+	if store := currentBlobStore(); store.Name() == "local" {
+		for _, dir := range storageDirs {
+			add("storage:"+filepath.Base(dir), checkWritable(dir), "")
+		}
+	} else {
+		add("storage:"+store.Name(), checkBlobStore(store), "")
+	}
+	add("templates", checkTemplates(), "")
+	add("email_templates", checkEmailTemplates(), "")
+	expiry, err := checkCertificate()
+	detail := ""
+	if err == nil {
+		detail = "expires " + expiry.Format(time.RFC3339)
+	}
+	add("tls_certificate", err, detail)
+	return report
+}
+
+func checkDatabase(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < latestMigration() {
+		return fmt.Errorf("schema at version %d, expected %d", version, latestMigration())
+	}
+	return nil
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func checkTemplates() error {
+	files, err := filepath.Glob(filepath.Join(FrontendTemplateDir, "*.html"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no templates found in %s", FrontendTemplateDir)
+	}
+	for _, file := range files {
+		if _, err := template.ParseFiles(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkEmailTemplates() error {
+	for _, kind := range emailTypes {
+		if _, err := RenderEmail(kind, defaultBranding(), sampleEmailData(kind)); err != nil {
+			return fmt.Errorf("%s: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+func checkCertificate() (time.Time, error) {
+	data, err := os.ReadFile(CertFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("%s does not contain a PEM certificate", CertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	warning := certExpiryWarning
+	if days, err := strconv.Atoi(os.Getenv("CERT_EXPIRY_DAYS")); err == nil && days > 0 {
+		warning = time.Duration(days) * 24 * time.Hour
+	}
+	if time.Until(cert.NotAfter) < warning {
+		return cert.NotAfter, fmt.Errorf("certificate expires %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return cert.NotAfter, nil
+}
+
+type diagnostics struct {
+	Build         map[string]string `json:"build"`
+	Config        map[string]string `json:"config"`
+	SchemaVersion int               `json:"schema_version"`
+	LatestVersion int               `json:"latest_version"`
+	Uptime        string            `json:"uptime"`
+	Goroutines    int               `json:"goroutines"`
+	Readiness     readinessReport   `json:"readiness"`
+}
+
+func collectDiagnostics(ctx context.Context) diagnostics {
+	d := diagnostics{
+		Build:         map[string]string{"go_version": runtime.Version()},
+		Config:        configSummary(),
+		LatestVersion: latestMigration(),
+		Uptime:        time.Since(processStart).Round(time.Second).String(),
+		Goroutines:    runtime.NumGoroutine(),
+		Readiness:     runReadinessChecks(ctx),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		d.Build["module"] = info.Main.Path
+		d.Build["version"] = info.Main.Version
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified", "GOOS", "GOARCH":
+				d.Build[setting.Key] = setting.Value
+			}
+		}
+	}
+	if version, err := SchemaVersion(); err == nil {
+		d.SchemaVersion = version
+	}
+	return d
+}
+
+// configSummary lists effective settings; secrets only show whether they are set
+func configSummary() map[string]string {
+	config := map[string]string{
+		"database_path":    DATABASEPATH,
+		"template_dir":     FrontendTemplateDir,
+		"tls_cert":         CertFile,
+		"log_level":        envOr("LOG_LEVEL", "info"),
+		"log_format":       envOr("LOG_FORMAT", "text"),
+		"metrics_addr":     envOr("METRICS_ADDR", "(main listener, admin only)"),
+		"cert_expiry_days": envOr("CERT_EXPIRY_DAYS", strconv.Itoa(int(certExpiryWarning.Hours()/24))),
+		"job_workers":      envOr("JOB_WORKERS", "2"),
+		"cart_reservation": cartReservationTTL().String(),
+		"mail_transport":   mailTransport(),
+		"mail_from":        emailFrom(),
+		"mail_reply_to":    emailReplyTo(),
+		"event_broker":     eventBrokerSummary(),
+		"carriers":         strings.Join(carrierNames(), ","),
+		"blob_store":       currentBlobStore().Name(),
+	}
+	for _, secret := range []string{"GMAIL_KEY", "MAIL_PASSWORD", "S3_SECRET_ACCESS_KEY"} {
+		if os.Getenv(secret) != "" {
+			config[secret] = "set"
+		} else {
+			config[secret] = "not set"
+		}
+	}
+	return config
+}
+
+// AdminDiagnostics renders build, configuration, schema and readiness details
+// for admins. ?format=json returns the same data as JSON.
+func AdminDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if _, isAdmin := ValidateAdmin(w, r); !isAdmin {
+		HandleError(w, r, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	d := collectDiagnostics(r.Context())
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+		return
+	}
+
+	tmpl, err := template.ParseFiles(FrontendDiagnosticsHTML)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load template")
+		return
+	}
+	if err := tmpl.Execute(w, d); err != nil {
+		Logger(r).Error("failed to render diagnostics", "error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The test directory has no certificate, so /readyz fails on it without
+// saying where it looked
+func TestReadyzHidesCheckDetails(t *testing.T) {
+	w := httptest.NewRecorder()
+	ReadyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+	body := w.Body.String()
+	for _, leak := range []string{CertFile, "store_images", "detail", "no such file"} {
+		if strings.Contains(body, leak) {
+			t.Errorf("response mentions %q: %s", leak, body)
+		}
+	}
+
+	var report struct {
+		Status string           `json:"status"`
+		Checks []readinessCheck `json:"checks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	ok := map[string]bool{}
+	for _, check := range report.Checks {
+		ok[check.Name] = check.OK
+	}
+	if report.Status != "not_ready" || !ok["database"] || !ok["storage:products"] || ok["tls_certificate"] {
+		t.Errorf("report = %+v", report)
+	}
+}
@@ -0,0 +1,556 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Image formats recognised from the file contents
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+	FormatBMP  = "bmp"
+	FormatICO  = "ico"
+)
+
+// maxImagePixels refuses images that would take too much memory to decode
+const maxImagePixels = 40_000_000
+
+// maxImageEdge is the longest edge kept on upload; bigger images are scaled
+// down before they are stored
+const maxImageEdge = 2048
+
+// jpegQuality is used whenever a JPEG is re-encoded
+const jpegQuality = 85
+
+// imageSizes are the extra sizes generated for every stored image and served
+// with ?size=; "thumb" is the existing thumbnail
+var imageSizes = map[string]int{
+	"thumb":  thumbnailSize,
+	"small":  480,
+	"medium": 800,
+	"large":  1280,
+}
+
+var errNotImage = errors.New("Image should be either 'png', 'jpg', 'webp', 'bmp', 'ico', or 'gif'")
+
+// sniffImage detects the image format from its first bytes, ignoring whatever
+// type the upload claimed to be. It returns "" for anything else.
+func sniffImage(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return FormatGIF
+	case len(data) >= 30 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return FormatWebP
+	case len(data) >= 54 && string(data[0:2]) == "BM":
+		return FormatBMP
+	case len(data) >= 22 && bytes.HasPrefix(data, []byte{0, 0, 1, 0}) && binary.LittleEndian.Uint16(data[4:]) > 0:
+		return FormatICO
+	}
+	return ""
+}
+
+// processImage checks an uploaded image and prepares it for storage: the
+// format comes from the bytes, metadata such as EXIF and GPS is dropped by
+// re-encoding (WebP is rewritten without its metadata chunks since it cannot
+// be decoded here), JPEGs are turned upright and anything larger than
+// maxImageEdge is scaled down. It returns the file extension to store the
+// result under.
+func processImage(data []byte) (string, []byte, error) {
+	format := sniffImage(data)
+	switch format {
+	case FormatWebP:
+		w, h, err := webpSize(data)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := checkImageSize(w, h); err != nil {
+			return "", nil, err
+		}
+		if w > maxImageEdge || h > maxImageEdge {
+			return "", nil, fmt.Errorf("WebP images can be at most %d pixels wide and high", maxImageEdge)
+		}
+		out, err := stripWebPMetadata(data)
+		return ".webp", out, err
+	case FormatICO:
+		// icons are at most 256 pixels and carry no camera metadata
+		return ".ico", data, nil
+	case FormatGIF:
+		return processGIF(data)
+	case FormatPNG, FormatJPEG, FormatBMP:
+	default:
+		return "", nil, errNotImage
+	}
+
+	var img image.Image
+	var err error
+	if format == FormatBMP {
+		img, err = decodeBMP(data)
+	} else {
+		var config image.Config
+		if config, _, err = image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			if err = checkImageSize(config.Width, config.Height); err != nil {
+				return "", nil, err
+			}
+			img, _, err = image.Decode(bytes.NewReader(data))
+		}
+	}
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "Image") {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("Image could not be read: %v", err)
+	}
+
+	img = scaleToFit(img, maxImageEdge)
+	var buf bytes.Buffer
+	if format == FormatJPEG {
+		img = applyOrientation(img, jpegOrientation(data))
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		return ".jpg", buf.Bytes(), err
+	}
+	// BMPs are stored as PNG
+	err = png.Encode(&buf, img)
+	return ".png", buf.Bytes(), err
+}
+
+func checkImageSize(w int, h int) error {
+	if w <= 0 || h <= 0 {
+		return errors.New("Image has no pixels")
+	}
+	if w*h > maxImagePixels {
+		return fmt.Errorf("Image dimensions are too large (%dx%d)", w, h)
+	}
+	return nil
+}
+
+// processGIF re-encodes a GIF to drop comments and application data.
+// Animations keep every frame and must already fit maxImageEdge; a single
+// frame that is too large is scaled and stored as PNG. The frames are
+// counted before any is decoded, since together they may need far more
+// memory than the screen size suggests.
+func processGIF(data []byte) (string, []byte, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("Image could not be read: %v", err)
+	}
+	if err := checkImageSize(config.Width, config.Height); err != nil {
+		return "", nil, err
+	}
+	frames, pixels, err := gifFrames(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("Image could not be read: %v", err)
+	}
+	if pixels > maxImagePixels {
+		return "", nil, fmt.Errorf("Animated GIF is too large (%d frames)", frames)
+	}
+	var buf bytes.Buffer
+	if config.Width > maxImageEdge || config.Height > maxImageEdge {
+		if frames > 1 {
+			return "", nil, fmt.Errorf("Animated GIFs can be at most %d pixels wide and high", maxImageEdge)
+		}
+		img, err := gif.Decode(bytes.NewReader(data))
+		if err != nil {
+			return "", nil, fmt.Errorf("Image could not be read: %v", err)
+		}
+		err = png.Encode(&buf, scaleToFit(img, maxImageEdge))
+		return ".png", buf.Bytes(), err
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("Image could not be read: %v", err)
+	}
+	err = gif.EncodeAll(&buf, &gif.GIF{
+		Image:           anim.Image,
+		Delay:           anim.Delay,
+		LoopCount:       anim.LoopCount,
+		Disposal:        anim.Disposal,
+		Config:          anim.Config,
+		BackgroundIndex: anim.BackgroundIndex,
+	})
+	return ".gif", buf.Bytes(), err
+}
+
+// gifFrames walks a GIF's blocks without decoding them and returns how many
+// frames it has and how many pixels they add up to
+func gifFrames(data []byte) (frames int, pixels int, err error) {
+	errTruncated := errors.New("GIF is truncated")
+	if len(data) < 13 {
+		return 0, 0, errTruncated
+	}
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	// skipSubBlocks moves i past a chain of data sub-blocks
+	skipSubBlocks := func() error {
+		for {
+			if i >= len(data) {
+				return errTruncated
+			}
+			size := int(data[i])
+			i += 1 + size
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+	for {
+		if i >= len(data) {
+			return 0, 0, errTruncated
+		}
+		switch data[i] {
+		case 0x21: // extension: label, then sub-blocks
+			i += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+		case 0x2C: // image descriptor, local colour table, LZW code size, data
+			if i+10 > len(data) {
+				return 0, 0, errTruncated
+			}
+			w := int(binary.LittleEndian.Uint16(data[i+5:]))
+			h := int(binary.LittleEndian.Uint16(data[i+7:]))
+			frames++
+			pixels += w * h
+			packed := data[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				i += 3 << (packed&0x07 + 1)
+			}
+			i++
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+		case 0x3B: // trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, fmt.Errorf("unknown GIF block 0x%02x", data[i])
+		}
+	}
+}
+
+// jpegOrientation reads the EXIF orientation tag (1 to 8) of a JPEG, or
+// returns 1 when there is none
+func jpegOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// image data starts; no more metadata
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation turns an image the way its EXIF orientation says it
+// should be displayed, since the orientation tag is dropped with the rest of
+// the metadata
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// webpSize reads the canvas size from a WebP's first chunk
+func webpSize(data []byte) (int, int, error) {
+	chunk, body := string(data[12:16]), data[20:]
+	switch {
+	case chunk == "VP8X" && len(body) >= 10:
+		w := int(body[4]) | int(body[5])<<8 | int(body[6])<<16
+		h := int(body[7]) | int(body[8])<<8 | int(body[9])<<16
+		return w + 1, h + 1, nil
+	case chunk == "VP8 " && len(body) >= 10 && bytes.Equal(body[3:6], []byte{0x9D, 0x01, 0x2A}):
+		w := int(binary.LittleEndian.Uint16(body[6:]) & 0x3FFF)
+		h := int(binary.LittleEndian.Uint16(body[8:]) & 0x3FFF)
+		return w, h, nil
+	case chunk == "VP8L" && len(body) >= 5 && body[0] == 0x2F:
+		bits := binary.LittleEndian.Uint32(body[1:])
+		return int(bits&0x3FFF) + 1, int(bits>>14&0x3FFF) + 1, nil
+	}
+	return 0, 0, errors.New("Image could not be read: malformed WebP")
+}
+
+// stripWebPMetadata rewrites a WebP without its EXIF and XMP chunks
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("Image could not be read: malformed WebP")
+		}
+		id := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if i+8+size > len(data) {
+			return nil, errors.New("Image could not be read: malformed WebP")
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		switch id {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) > 8 {
+				// clear the EXIF and XMP flags
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+	return result, nil
+}
+
+// decodeBMP decodes uncompressed Windows bitmaps: 1, 4 and 8 bit paletted,
+// 16 bit (555 or bit fields), 24 and 32 bit
+func decodeBMP(data []byte) (image.Image, error) {
+	le := binary.LittleEndian
+	pixelOffset := int(le.Uint32(data[10:]))
+	headerSize := int(le.Uint32(data[14:]))
+	if headerSize < 40 || 14+headerSize > len(data) {
+		return nil, errors.New("Image could not be read: unsupported BMP header")
+	}
+	width := int(int32(le.Uint32(data[18:])))
+	height := int(int32(le.Uint32(data[22:])))
+	bpp := int(le.Uint16(data[28:]))
+	compression := le.Uint32(data[30:])
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if err := checkImageSize(width, height); err != nil {
+		return nil, err
+	}
+
+	masks := [3]uint32{0x7C00, 0x03E0, 0x001F}
+	if bpp == 32 {
+		masks = [3]uint32{0xFF0000, 0xFF00, 0xFF}
+	}
+	var alphaMask uint32
+	switch compression {
+	case 0: // BI_RGB
+	case 3, 6: // BI_BITFIELDS, BI_ALPHABITFIELDS
+		if len(data) < 70 {
+			return nil, errors.New("Image could not be read: truncated BMP")
+		}
+		for i := range masks {
+			masks[i] = le.Uint32(data[14+40+4*i:])
+		}
+		if headerSize >= 56 || compression == 6 {
+			alphaMask = le.Uint32(data[14+40+12:])
+		}
+	default:
+		return nil, errors.New("Compressed BMP images are not supported")
+	}
+
+	var palette color.Palette
+	if bpp <= 8 {
+		colors := int(le.Uint32(data[46:]))
+		if colors == 0 || colors > 1<<bpp {
+			colors = 1 << bpp
+		}
+		start := 14 + headerSize
+		if start+4*colors > len(data) {
+			return nil, errors.New("Image could not be read: truncated BMP")
+		}
+		for c := 0; c < colors; c++ {
+			p := data[start+4*c:]
+			palette = append(palette, color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xFF})
+		}
+	}
+
+	switch bpp {
+	case 1, 4, 8, 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("Image could not be read: %d bit BMPs are not supported", bpp)
+	}
+	stride := (width*bpp + 31) / 32 * 4
+	if pixelOffset < 0 || pixelOffset+stride*height > len(data) {
+		return nil, errors.New("Image could not be read: truncated BMP")
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for row := 0; row < height; row++ {
+		y := height - 1 - row
+		if topDown {
+			y = row
+		}
+		line := data[pixelOffset+row*stride:]
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 1, 4, 8:
+				bit := x * bpp
+				index := int(line[bit/8]>>(8-bpp-bit%8)) & (1<<bpp - 1)
+				if index < len(palette) {
+					c = palette[index].(color.NRGBA)
+				}
+			case 16:
+				v := uint32(le.Uint16(line[2*x:]))
+				c = color.NRGBA{maskChannel(v, masks[0]), maskChannel(v, masks[1]), maskChannel(v, masks[2]), 0xFF}
+			case 24:
+				c = color.NRGBA{line[3*x+2], line[3*x+1], line[3*x], 0xFF}
+			case 32:
+				v := le.Uint32(line[4*x:])
+				c = color.NRGBA{maskChannel(v, masks[0]), maskChannel(v, masks[1]), maskChannel(v, masks[2]), 0xFF}
+				if alphaMask != 0 {
+					c.A = maskChannel(v, alphaMask)
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// maskChannel extracts the bits of mask from v and scales them to 0-255
+func maskChannel(v uint32, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := 0
+	for mask>>shift&1 == 0 {
+		shift++
+	}
+	max := mask >> shift
+	return uint8((v & mask >> shift) * 255 / max)
+}
+
+// sizedImageName is where the named size of an image is stored, relative
+// to the original's folder: thumbnails keep their thumbs/ folder, other
+// sizes go to sizes/. JPEGs stay JPEG and everything else becomes PNG.
+func sizedImageName(file string, size string) string {
+	ext := strings.ToLower(filepath.Ext(file))
+	base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	if size == "thumb" {
+		return "thumbs/" + base + ".png"
+	}
+	if ext != ".jpg" && ext != ".jpeg" {
+		ext = ".png"
+	}
+	return "sizes/" + base + "-" + size + ext
+}
+
+// removeImageFiles deletes an image with all its generated sizes
+func removeImageFiles(dir string, file string) {
+	file = filepath.Base(file)
+	removeUpload(dir, file)
+	for size := range imageSizes {
+		removeUpload(dir, sizedImageName(file, size))
+	}
+}
+
+// ServeImages serves the uploaded images in dir. ?size=thumb, small, medium
+// or large picks a generated size when there is one; otherwise, and for
+// images smaller than the size asked for, the original is served.
+func ServeImages(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := r.URL.Query().Get("size")
+		if _, known := imageSizes[size]; known && !strings.Contains(r.URL.Path, "/") {
+			name := sizedImageName(r.URL.Path, size)
+			if uploadExists(dir, name) {
+				w.Header().Set("Cache-Control", "public, max-age=86400")
+				serveBlob(w, r, dir, name)
+				return
+			}
+		}
+		serveBlob(w, r, dir, r.URL.Path)
+	})
+}
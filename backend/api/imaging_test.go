@@ -0,0 +1,101 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func testGIF(t *testing.T, w int, h int, frames int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White})
+		frame.SetColorIndex(i%w, 0, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// bombGIF declares frames of w×h pixels whose data is a single code, so the
+// file stays tiny while decoding it would not
+func bombGIF(w int, h int, frames int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("GIF89a")
+	binary.Write(&buf, binary.LittleEndian, [2]uint16{uint16(w), uint16(h)})
+	buf.Write([]byte{0x80, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF})
+	for i := 0; i < frames; i++ {
+		buf.Write([]byte{0x21, 0xF9, 4, 0, 10, 0, 0, 0})
+		buf.WriteByte(0x2C)
+		binary.Write(&buf, binary.LittleEndian, [4]uint16{0, 0, uint16(w), uint16(h)})
+		buf.Write([]byte{0, 2, 2, 0x4C, 0x01, 0})
+	}
+	buf.WriteByte(0x3B)
+	return buf.Bytes()
+}
+
+func TestProcessGIF(t *testing.T) {
+	ext, out, err := processGIF(testGIF(t, 40, 30, 3))
+	if err != nil || ext != ".gif" {
+		t.Fatalf("small animation = %q, %v", ext, err)
+	}
+	if anim, err := gif.DecodeAll(bytes.NewReader(out)); err != nil || len(anim.Image) != 3 {
+		t.Errorf("the animation lost frames: %v", err)
+	}
+
+	ext, out, err = processGIF(testGIF(t, 3000, 200, 1))
+	if err != nil || ext != ".png" {
+		t.Fatalf("large still = %q, %v", ext, err)
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || config.Width != maxImageEdge {
+		t.Errorf("large still is %dx%d, want %d wide", config.Width, config.Height, maxImageEdge)
+	}
+
+	if _, _, err := processGIF(testGIF(t, 3000, 200, 2)); err == nil || !strings.Contains(err.Error(), "Animated GIFs") {
+		t.Errorf("large animation = %v", err)
+	}
+}
+
+func TestGIFFrames(t *testing.T) {
+	frames, pixels, err := gifFrames(testGIF(t, 40, 30, 3))
+	if err != nil || frames != 3 || pixels != 3*40*30 {
+		t.Errorf("gifFrames = %d frames, %d pixels, %v", frames, pixels, err)
+	}
+	data := bombGIF(100, 100, 2)
+	if _, _, err := gifFrames(data[:len(data)-5]); err == nil {
+		t.Error("a truncated GIF was accepted")
+	}
+}
+
+// Ten 6000×6000 frames fit the screen-size check but would need gigabytes
+// to decode; they have to be refused before any frame is
+func TestProcessGIFRefusesFrameBombs(t *testing.T) {
+	for _, bomb := range []struct {
+		name         string
+		w, h, frames int
+	}{
+		{"over the edge", 6000, 6000, 10},
+		{"within the edge", 2000, 2000, 20},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, _, err := processGIF(bombGIF(bomb.w, bomb.h, bomb.frames))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%s: accepted", bomb.name)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8<<20 {
+			t.Errorf("%s: allocated %d MB before refusing", bomb.name, allocated>>20)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Jobs are stored in the jobs table and picked up by StartJobWorkers.
+// A failing job is retried with exponential backoff until max_attempts,
+// after which it is parked in the dead state for an admin to retry.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobDead      = "dead"
+)
+
+const (
+	defaultJobAttempts = 5
+	jobPollInterval    = time.Second
+	jobBackoffBase     = 30 * time.Second
+	jobBackoffMax      = time.Hour
+	// jobStaleAfter is the lease of a running job: a handler gets no longer
+	// than this, and a job still running after it was lost by its worker
+	jobStaleAfter = 10 * time.Minute
+)
+
+// Job kinds handled by the workers
+const (
+	JobSendEmail          = "email.send"
+	JobGenerateThumbnail  = "image.thumbnail"
+	JobExpireReservations = "cart.expire_reservations"
+	JobDailyReport        = "report.daily"
+	JobPollShipments      = "shipments.poll"
+	JobCollectUploads     = "uploads.gc"
+	JobModelPreview       = "model.preview"
+	JobDeliverWebhook     = "webhook.deliver"
+)
+
+// JobHandler runs one job. Returning an error schedules a retry.
+type JobHandler func(ctx context.Context, payload json.RawMessage) error
+
+type Job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       string          `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   string          `json:"created_at"`
+	UpdatedAt   string          `json:"updated_at"`
+}
+
+var (
+	jobHandlersMu sync.RWMutex
+	jobHandlers   = map[string]JobHandler{}
+)
+
+// RegisterJobHandler sets the function that runs jobs of the given kind
+func RegisterJobHandler(kind string, handler JobHandler) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[kind] = handler
+}
+
+func jobHandler(kind string) (JobHandler, bool) {
+	jobHandlersMu.RLock()
+	defer jobHandlersMu.RUnlock()
+	h, ok := jobHandlers[kind]
+	return h, ok
+}
+
+// EnqueueJob stores a job to run as soon as a worker is free
+func EnqueueJob(kind string, payload interface{}) (int64, error) {
+	return EnqueueJobAt(kind, payload, time.Now())
+}
+
+// EnqueueJobAt stores a job that becomes runnable at runAt
+func EnqueueJobAt(kind string, payload interface{}, runAt time.Time) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	result, err := db.Exec(`
+		INSERT INTO jobs (kind, payload, status, max_attempts, run_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, kind, string(data), JobPending, defaultJobAttempts, sqlTime(runAt))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// sqlTime formats t the way SQLite's datetime('now') does, so comparisons work
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// ScheduleJob registers a recurring job. The next run time is kept in the
+// scheduled_jobs table so restarts do not reset the schedule.
+func ScheduleJob(kind string, every time.Duration) error {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		INSERT INTO scheduled_jobs (kind, interval_seconds, next_run_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(kind) DO UPDATE SET interval_seconds = excluded.interval_seconds
+	`, kind, int(every.Seconds()), sqlTime(time.Now().Add(every)))
+	return err
+}
+
+func registerJobHandlers() {
+	RegisterJobHandler(JobSendEmail, sendEmailJob)
+	RegisterJobHandler(JobGenerateThumbnail, generateThumbnailJob)
+	RegisterJobHandler(JobExpireReservations, expireCartReservationsJob)
+	RegisterJobHandler(JobDailyReport, dailyReportJob)
+	RegisterJobHandler(JobPollShipments, pollShipmentsJob)
+	RegisterJobHandler(JobCollectUploads, collectUploadsJob)
+	RegisterJobHandler(JobModelPreview, renderModelPreviewsJob)
+	RegisterJobHandler(JobDeliverWebhook, deliverWebhookJob)
+}
+
+// StartJobWorkers runs the scheduler and n workers until ctx is cancelled.
+func StartJobWorkers(ctx context.Context, n int) {
+	registerJobHandlers()
+	if err := ScheduleJob(JobExpireReservations, 5*time.Minute); err != nil {
+		slog.Error("failed to schedule job", "kind", JobExpireReservations, "error", err)
+	}
+	if err := ScheduleJob(JobDailyReport, 24*time.Hour); err != nil {
+		slog.Error("failed to schedule job", "kind", JobDailyReport, "error", err)
+	}
+	if err := ScheduleJob(JobPollShipments, 15*time.Minute); err != nil {
+		slog.Error("failed to schedule job", "kind", JobPollShipments, "error", err)
+	}
+	if err := ScheduleJob(JobCollectUploads, 24*time.Hour); err != nil {
+		slog.Error("failed to schedule job", "kind", JobCollectUploads, "error", err)
+	}
+	if err := ScheduleJob(JobModelPreview, time.Hour); err != nil {
+		slog.Error("failed to schedule job", "kind", JobModelPreview, "error", err)
+	}
+	go runScheduler(ctx)
+	for i := 0; i < n; i++ {
+		go runWorker(ctx, i)
+	}
+	slog.Info("job workers started", "workers", n)
+}
+
+// requeueStaleJobs recovers jobs whose lease ran out, because their worker
+// or its whole process died. A job that has used its attempts goes dead, so
+// one that keeps killing its worker does not run forever.
+func requeueStaleJobs() error {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	result, err := db.Exec(`
+		UPDATE jobs SET status = CASE WHEN attempts >= max_attempts THEN ? ELSE ? END,
+			last_error = 'lease expired', locked_at = NULL, updated_at = datetime('now')
+		WHERE status = ? AND locked_at < ?
+	`, JobDead, JobPending, JobRunning, sqlTime(time.Now().Add(-jobStaleAfter)))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		slog.Warn("requeued jobs whose lease expired", "jobs", n)
+	}
+	return nil
+}
+
+func runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := requeueStaleJobs(); err != nil {
+			slog.Error("failed to requeue stale jobs", "error", err)
+		}
+		if err := enqueueDueSchedules(); err != nil {
+			slog.Error("job scheduler failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func enqueueDueSchedules() error {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT kind, interval_seconds FROM scheduled_jobs WHERE next_run_at <= ?", sqlTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	type due struct {
+		kind     string
+		interval int
+	}
+	var dueJobs []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.kind, &d.interval); err != nil {
+			rows.Close()
+			return err
+		}
+		dueJobs = append(dueJobs, d)
+	}
+	rows.Close()
+
+	for _, d := range dueJobs {
+		next := time.Now().Add(time.Duration(d.interval) * time.Second)
+		result, err := db.Exec("UPDATE scheduled_jobs SET next_run_at = ? WHERE kind = ? AND next_run_at <= ?",
+			sqlTime(next), d.kind, sqlTime(time.Now()))
+		if err != nil {
+			return err
+		}
+		// another instance may have claimed this run already
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		if _, err := EnqueueJob(d.kind, map[string]string{"scheduled_at": sqlTime(time.Now())}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runWorker(ctx context.Context, id int) {
+	logger := slog.With("worker", id)
+	for {
+		job, err := claimJob()
+		if err != nil {
+			logger.Error("failed to claim job", "error", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		runJob(ctx, logger, job)
+	}
+}
+
+// claimJob marks the oldest runnable job as running. The status check in the
+// UPDATE makes the claim safe when several workers race for the same row.
+func claimJob() (*Job, error) {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	for {
+		var job Job
+		var payload string
+		err := db.QueryRow(`
+			SELECT id, kind, payload, attempts, max_attempts
+			FROM jobs
+			WHERE status = ? AND run_at <= ?
+			ORDER BY run_at, id
+			LIMIT 1
+		`, JobPending, sqlTime(time.Now())).Scan(&job.ID, &job.Kind, &payload, &job.Attempts, &job.MaxAttempts)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		result, err := db.Exec(`
+			UPDATE jobs SET status = ?, attempts = attempts + 1, locked_at = datetime('now'), updated_at = datetime('now')
+			WHERE id = ? AND status = ?
+		`, JobRunning, job.ID, JobPending)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		job.Attempts++
+		job.Payload = json.RawMessage(payload)
+		job.Status = JobRunning
+		return &job, nil
+	}
+}
+
+func runJob(ctx context.Context, logger *slog.Logger, job *Job) {
+	logger = logger.With("job_id", job.ID, "kind", job.Kind, "attempt", job.Attempts)
+	handler, ok := jobHandler(job.Kind)
+	var err error
+	if !ok {
+		err = fmt.Errorf("no handler registered for job kind %q", job.Kind)
+	} else {
+		// a handler that outlives its lease would run twice once requeued
+		leased, cancel := context.WithTimeout(ctx, jobStaleAfter)
+		err = safeRun(leased, handler, job.Payload)
+		cancel()
+	}
+
+	if err == nil {
+		jobsProcessedTotal.Inc(job.Kind, "completed")
+		if err := finishJob(job.ID, JobCompleted, "", time.Now()); err != nil {
+			logger.Error("failed to mark job completed", "error", err)
+		}
+		return
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		jobsProcessedTotal.Inc(job.Kind, "dead")
+		logger.Error("job failed permanently", "error", err)
+		if err := finishJob(job.ID, JobDead, err.Error(), time.Now()); err != nil {
+			logger.Error("failed to mark job dead", "error", err)
+		}
+		return
+	}
+
+	delay := jobBackoff(job.Attempts)
+	jobsProcessedTotal.Inc(job.Kind, "retry")
+	logger.Warn("job failed, will retry", "error", err, "retry_in", delay.String())
+	if err := finishJob(job.ID, JobPending, err.Error(), time.Now().Add(delay)); err != nil {
+		logger.Error("failed to reschedule job", "error", err)
+	}
+}
+
+// safeRun turns a panicking handler into a job failure instead of a crash
+func safeRun(ctx context.Context, handler JobHandler, payload json.RawMessage) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return handler(ctx, payload)
+}
+
+// jobBackoff doubles the delay for each attempt with up to 20% jitter
+func jobBackoff(attempt int) time.Duration {
+	delay := jobBackoffBase << (attempt - 1)
+	if delay > jobBackoffMax || delay <= 0 {
+		delay = jobBackoffMax
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+func finishJob(id int64, status string, lastError string, runAt time.Time) error {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		UPDATE jobs SET status = ?, last_error = ?, run_at = ?, locked_at = NULL, updated_at = datetime('now')
+		WHERE id = ?
+	`, status, lastError, sqlTime(runAt), id)
+	return err
+}
+
+// AdminJobs lists jobs by status (dead by default, or pending with errors
+// when status=failed) so admins can see what did not go through.
+func AdminJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, isAdmin := ValidateAdmin(w, r); !isAdmin {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	query := `
+		SELECT id, kind, payload, status, attempts, max_attempts, run_at, COALESCE(last_error, ''), created_at, updated_at
+		FROM jobs WHERE status = ? ORDER BY updated_at DESC LIMIT 200`
+	switch status {
+	case "", JobDead:
+		status = JobDead
+	case "failed":
+		query = `
+		SELECT id, kind, payload, status, attempts, max_attempts, run_at, COALESCE(last_error, ''), created_at, updated_at
+		FROM jobs WHERE status = ? AND last_error != '' ORDER BY updated_at DESC LIMIT 200`
+		status = JobPending
+	case JobPending, JobRunning, JobCompleted:
+	default:
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Unknown job status")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, status)
+	if err != nil {
+		Logger(r).Error("admin jobs query failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch jobs")
+		return
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var job Job
+		var payload string
+		if err := rows.Scan(&job.ID, &job.Kind, &payload, &job.Status, &job.Attempts, &job.MaxAttempts,
+			&job.RunAt, &job.LastError, &job.CreatedAt, &job.UpdatedAt); err != nil {
+			Logger(r).Warn("admin jobs scan failed", "error", err)
+			continue
+		}
+		job.Payload = json.RawMessage(payload)
+		jobs = append(jobs, job)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jobs": jobs,
+	})
+}
+
+// retryJobRequest is the body of AdminRetryJob
+type retryJobRequest struct {
+	ID  int64 `json:"id"`
+	All bool  `json:"all"`
+}
+
+// AdminRetryJob puts a dead or failing job back in the queue with a fresh
+// attempt budget. {"all": true} retries every dead job.
+func AdminRetryJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if _, isAdmin := ValidateAdmin(w, r); !isAdmin {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req retryJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.ID == 0 && !req.All) {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Job ID is required")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+
+	var result sql.Result
+	if req.All {
+		result, err = db.Exec(`
+			UPDATE jobs SET status = ?, attempts = 0, run_at = datetime('now'), updated_at = datetime('now')
+			WHERE status = ?
+		`, JobPending, JobDead)
+	} else {
+		result, err = db.Exec(`
+			UPDATE jobs SET status = ?, attempts = 0, run_at = datetime('now'), updated_at = datetime('now')
+			WHERE id = ? AND status IN (?, ?)
+		`, JobPending, req.ID, JobDead, JobPending)
+	}
+	if err != nil {
+		Logger(r).Error("failed to retry job", "job_id", req.ID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to retry job")
+		return
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 && !req.All {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Job not found or not retryable")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"retried": n,
+		"message": "Requeued " + strconv.FormatInt(n, 10) + " job(s)",
+	})
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequeueStaleJobs(t *testing.T) {
+	db := openTestDB(t)
+	stale := sqlTime(time.Now().Add(-jobStaleAfter - time.Minute))
+	lost := mustExec(t, db, "INSERT INTO jobs (kind, status, attempts, locked_at) VALUES ('test.lost', ?, 1, ?)", JobRunning, stale)
+	spent := mustExec(t, db, "INSERT INTO jobs (kind, status, attempts, locked_at) VALUES ('test.spent', ?, 5, ?)", JobRunning, stale)
+	running := mustExec(t, db, "INSERT INTO jobs (kind, status, attempts, locked_at) VALUES ('test.running', ?, 1, ?)",
+		JobRunning, sqlTime(time.Now()))
+
+	if err := requeueStaleJobs(); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int]string{lost: JobPending, spent: JobDead, running: JobRunning} {
+		var status string
+		db.QueryRow("SELECT status FROM jobs WHERE id = ?", id).Scan(&status)
+		if status != want {
+			t.Errorf("job %d is %s, want %s", id, status, want)
+		}
+	}
+	mustExec(t, db, "DELETE FROM jobs WHERE kind LIKE 'test.%'")
+}
@@ -0,0 +1,511 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listing endpoints share one query language:
+//
+//	?status=paid,shipped      a whitelisted field equal to any of the values
+//	?min_total=10&max_total=  a range on a number or date field
+//	?q=smith                  a substring of any searchable field
+//	?sort=-created_at,total   sort fields, "-" for descending
+//	?limit=50&cursor=         page size and the cursor of the previous page
+//	?facets=status,store_id   counts per value of the named fields
+//
+// and one envelope, ListPage. Pages are cut with keyset pagination: the
+// cursor holds the sort values of the last row, so rows added or removed
+// meanwhile do not shift the next page.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+var errInvalidList = errors.New("Invalid list query")
+
+func listError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{errInvalidList}, args...)...)
+}
+
+// listKind is how a field's values are parsed and compared
+type listKind int
+
+const (
+	listText listKind = iota
+	listInt
+	listNumber
+	listTime
+	listBool
+)
+
+// ListField is a column a listing can be filtered, sorted, faceted or
+// searched by
+type ListField struct {
+	// Expr is the SQL expression of the field
+	Expr string
+	Kind listKind
+	// Values, when set, are the only values a text filter accepts
+	Values []string
+	// Label names a facet value, e.g. the store name of a store_id facet
+	Label  string
+	Filter bool
+	Sort   bool
+	Facet  bool
+	Search bool
+}
+
+// ListSpec is what one listing endpoint allows
+type ListSpec struct {
+	Fields map[string]ListField
+	// Key is a unique expression that breaks ties between equal sort values
+	Key string
+	// Sort is the default sort
+	Sort string
+}
+
+// With returns a copy of the spec with another field
+func (s ListSpec) With(name string, field ListField) ListSpec {
+	fields := make(map[string]ListField, len(s.Fields)+1)
+	for n, f := range s.Fields {
+		fields[n] = f
+	}
+	fields[name] = field
+	s.Fields = fields
+	return s
+}
+
+type listCondition struct {
+	sql  string
+	args []interface{}
+}
+
+type listSort struct {
+	expr string
+	desc bool
+}
+
+// ListQuery is a parsed listing request
+type ListQuery struct {
+	spec       ListSpec
+	conditions map[string][]listCondition
+	sortParam  string
+	sort       []listSort
+	limit      int
+	after      []interface{}
+	facets     []string
+}
+
+// ListPage is the response of every listing endpoint
+type ListPage struct {
+	Data       interface{}             `json:"data"`
+	Pagination ListPagination          `json:"pagination"`
+	Facets     map[string][]FacetCount `json:"facets,omitempty"`
+}
+
+// ListPagination describes the page; NextCursor is empty on the last one
+type ListPagination struct {
+	Limit      int    `json:"limit"`
+	Sort       string `json:"sort"`
+	Total      int    `json:"total"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// FacetCount is how many rows have one value of a faceted field, counting
+// every filter but the one on that field
+type FacetCount struct {
+	Value interface{} `json:"value"`
+	Label string      `json:"label,omitempty"`
+	Count int         `json:"count"`
+}
+
+// listCursor is the decoded form of a cursor
+type listCursor struct {
+	Sort string        `json:"s"`
+	Keys []interface{} `json:"k"`
+}
+
+// sortExpr is the field as it is sorted and compared: never NULL, and text
+// without regard to case
+func (f ListField) sortExpr() string {
+	switch f.Kind {
+	case listText:
+		return "(COALESCE(" + f.Expr + ", '') COLLATE NOCASE)"
+	case listTime:
+		return "COALESCE(datetime(" + f.Expr + "), '')"
+	}
+	return "COALESCE(" + f.Expr + ", 0)"
+}
+
+// parseListTime reads a date or an RFC 3339 time as SQLite's datetime()
+// writes it. A date given as the upper end of a range includes its day.
+func parseListTime(value string, upper bool) (string, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if upper {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		return t.Format("2006-01-02 15:04:05"), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format("2006-01-02 15:04:05"), nil
+}
+
+// parseValue converts one filter value to the field's kind
+func (f ListField) parseValue(name string, value string, upper bool) (interface{}, error) {
+	switch f.Kind {
+	case listInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, listError("%s must be a whole number", name)
+		}
+		return n, nil
+	case listNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, listError("%s must be a number", name)
+		}
+		return n, nil
+	case listTime:
+		t, err := parseListTime(value, upper)
+		if err != nil {
+			return nil, listError("%s must be a date (YYYY-MM-DD) or an RFC 3339 time", name)
+		}
+		return t, nil
+	case listBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, listError("%s must be true or false", name)
+		}
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	if len(f.Values) > 0 && !containsString(f.Values, value) {
+		return nil, listError("%s must be one of %s", name, strings.Join(f.Values, ", "))
+	}
+	return value, nil
+}
+
+// Parse reads the filters, sort, page and facets of a request. Parameters
+// that are not fields of the spec are left to the handler.
+func (s ListSpec) Parse(params url.Values) (*ListQuery, error) {
+	q := &ListQuery{spec: s, conditions: map[string][]listCondition{}, limit: defaultListLimit}
+
+	for name, field := range s.Fields {
+		if !field.Filter {
+			continue
+		}
+		var values []interface{}
+		for _, param := range params[name] {
+			for _, value := range strings.Split(param, ",") {
+				if value = strings.TrimSpace(value); value == "" {
+					continue
+				}
+				v, err := field.parseValue(name, value, false)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			q.conditions[name] = append(q.conditions[name], listCondition{
+				sql:  field.sortExpr() + " IN (?" + strings.Repeat(", ?", len(values)-1) + ")",
+				args: values,
+			})
+		}
+		if field.Kind != listInt && field.Kind != listNumber && field.Kind != listTime {
+			continue
+		}
+		for _, bound := range []struct {
+			param string
+			op    string
+		}{{"min_" + name, ">="}, {"max_" + name, "<="}} {
+			value := strings.TrimSpace(params.Get(bound.param))
+			if value == "" {
+				continue
+			}
+			v, err := field.parseValue(bound.param, value, bound.op == "<=")
+			if err != nil {
+				return nil, err
+			}
+			q.conditions[name] = append(q.conditions[name], listCondition{sql: field.sortExpr() + " " + bound.op + " ?", args: []interface{}{v}})
+		}
+	}
+
+	if text := strings.TrimSpace(params.Get("q")); text != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%"
+		var matches []string
+		var args []interface{}
+		for _, field := range s.Fields {
+			if field.Search {
+				matches = append(matches, "COALESCE("+field.Expr+", '') LIKE ? ESCAPE '\\'")
+				args = append(args, pattern)
+			}
+		}
+		if len(matches) > 0 {
+			q.conditions["q"] = []listCondition{{sql: "(" + strings.Join(matches, " OR ") + ")", args: args}}
+		}
+	}
+
+	q.sortParam = strings.TrimSpace(params.Get("sort"))
+	if q.sortParam == "" {
+		q.sortParam = s.Sort
+	}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(q.sortParam, ",") {
+		name = strings.TrimSpace(name)
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		field, ok := s.Fields[name]
+		if !ok || !field.Sort {
+			return nil, listError("Cannot sort by %q", name)
+		}
+		if seen[name] {
+			return nil, listError("%s is sorted on twice", name)
+		}
+		seen[name] = true
+		q.sort = append(q.sort, listSort{expr: field.sortExpr(), desc: desc})
+	}
+	// the key makes the order total, in the direction of the first field
+	q.sort = append(q.sort, listSort{expr: s.Key, desc: q.sort[0].desc})
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, listError("limit must be between 1 and %d", maxListLimit)
+		}
+		q.limit = limit
+	}
+
+	if value := params.Get("cursor"); value != "" {
+		var cursor listCursor
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || json.Unmarshal(data, &cursor) != nil || len(cursor.Keys) != len(q.sort) {
+			return nil, listError("Invalid cursor")
+		}
+		if cursor.Sort != q.sortParam {
+			return nil, listError("The cursor was made for sort=%s", cursor.Sort)
+		}
+		q.after = cursor.Keys
+	}
+
+	for _, param := range params["facets"] {
+		for _, name := range strings.Split(param, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if field, ok := s.Fields[name]; !ok || !field.Facet {
+				return nil, listError("No facet %q", name)
+			}
+			if !containsString(q.facets, name) {
+				q.facets = append(q.facets, name)
+			}
+		}
+	}
+	return q, nil
+}
+
+// Where adds a condition the handler works out itself, such as a category
+// and its subcategories. Like a field filter it is left out of the counts
+// of a facet with the same name.
+func (q *ListQuery) Where(name string, condition string, args ...interface{}) {
+	q.conditions[name] = append(q.conditions[name], listCondition{sql: condition, args: args})
+}
+
+// filter is the conjunction of every condition but those of skip
+func (q *ListQuery) filter(skip string) (string, []interface{}) {
+	parts := []string{}
+	var args []interface{}
+	for name, conditions := range q.conditions {
+		if name == skip {
+			continue
+		}
+		for _, c := range conditions {
+			parts = append(parts, c.sql)
+			args = append(args, c.args...)
+		}
+	}
+	if len(parts) == 0 {
+		return "1 = 1", nil
+	}
+	return strings.Join(parts, " AND "), args
+}
+
+// seek is the condition for rows after the cursor: greater on the first
+// sort field, or equal on it and greater on the next, and so on
+func (q *ListQuery) seek() (string, []interface{}) {
+	if q.after == nil {
+		return "1 = 1", nil
+	}
+	var alternatives []string
+	var args []interface{}
+	for i, s := range q.sort {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, q.sort[j].expr+" = ?")
+			args = append(args, q.after[j])
+		}
+		op := " > ?"
+		if s.desc {
+			op = " < ?"
+		}
+		parts = append(parts, s.expr+op)
+		args = append(args, q.after[i])
+		alternatives = append(alternatives, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// listSource is the query a listing pages through. Columns are what the
+// scan function reads; Where and Args scope the rows to the caller.
+type listSource struct {
+	Columns string
+	From    string
+	Where   string
+	Args    []interface{}
+	GroupBy string
+}
+
+func (src listSource) where(q *ListQuery, skip string, seek bool) (string, []interface{}) {
+	filter, filterArgs := q.filter(skip)
+	where := src.Where + " AND " + filter
+	args := append(append([]interface{}{}, src.Args...), filterArgs...)
+	if seek {
+		after, afterArgs := q.seek()
+		where += " AND " + after
+		args = append(args, afterArgs...)
+	}
+	return where, args
+}
+
+// Run reads one page, calling scan for each row with a function that scans
+// the row's Columns, and counts the rows and facets of the whole listing.
+// The caller sets the page's Data.
+func (q *ListQuery) Run(db *sql.DB, src listSource, scan func(scan func(dest ...interface{}) error) error) (ListPage, error) {
+	page := ListPage{Pagination: ListPagination{Limit: q.limit, Sort: q.sortParam}}
+
+	keys := make([]string, len(q.sort))
+	order := make([]string, len(q.sort))
+	for i, s := range q.sort {
+		keys[i] = s.expr
+		order[i] = s.expr
+		if s.desc {
+			order[i] += " DESC"
+		}
+	}
+	where, args := src.where(q, "", true)
+	query := "SELECT " + src.Columns + ", " + strings.Join(keys, ", ") + " FROM " + src.From + " WHERE " + where
+	if src.GroupBy != "" {
+		query += " GROUP BY " + src.GroupBy
+	}
+	query += " ORDER BY " + strings.Join(order, ", ") + " LIMIT ?"
+	rows, err := db.Query(query, append(args, q.limit+1)...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	last := make([]interface{}, len(keys))
+	read := 0
+	for rows.Next() {
+		if read == q.limit {
+			page.Pagination.HasMore = true
+			break
+		}
+		keyDest := make([]interface{}, len(keys))
+		for i := range keyDest {
+			keyDest[i] = &last[i]
+		}
+		if err := scan(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, keyDest...)...)
+		}); err != nil {
+			return page, err
+		}
+		read++
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	rows.Close()
+	if page.Pagination.HasMore {
+		for i, v := range last {
+			if b, ok := v.([]byte); ok {
+				last[i] = string(b)
+			}
+		}
+		data, err := json.Marshal(listCursor{Sort: q.sortParam, Keys: last})
+		if err != nil {
+			return page, err
+		}
+		page.Pagination.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	where, args = src.where(q, "", false)
+	if err := db.QueryRow("SELECT COUNT(DISTINCT "+q.spec.Key+") FROM "+src.From+" WHERE "+where, args...).Scan(&page.Pagination.Total); err != nil {
+		return page, err
+	}
+
+	for _, name := range q.facets {
+		field := q.spec.Fields[name]
+		label := "NULL"
+		if field.Label != "" {
+			label = "MAX(" + field.Label + ")"
+		}
+		where, args := src.where(q, name, false)
+		rows, err := db.Query("SELECT "+field.sortExpr()+", "+label+", COUNT(DISTINCT "+q.spec.Key+") FROM "+src.From+
+			" WHERE "+where+" GROUP BY 1 ORDER BY 3 DESC, 1", args...)
+		if err != nil {
+			return page, err
+		}
+		counts := []FacetCount{}
+		for rows.Next() {
+			var count FacetCount
+			var label sql.NullString
+			if err := rows.Scan(&count.Value, &label, &count.Count); err != nil {
+				rows.Close()
+				return page, err
+			}
+			if b, ok := count.Value.([]byte); ok {
+				count.Value = string(b)
+			}
+			if field.Kind == listBool {
+				count.Value = count.Value != int64(0)
+			}
+			count.Label = label.String
+			counts = append(counts, count)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return page, err
+		}
+		if page.Facets == nil {
+			page.Facets = map[string][]FacetCount{}
+		}
+		page.Facets[name] = counts
+	}
+	return page, nil
+}
+
+// writeListError answers a listing request that failed
+func writeListError(w http.ResponseWriter, r *http.Request, what string, err error) {
+	if errors.Is(err, errInvalidList) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, invalidMessage(err, errInvalidList))
+		return
+	}
+	Logger(r).Error("listing failed", "list", what, "error", err)
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch "+what)
+}
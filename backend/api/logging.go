@@ -0,0 +1,195 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestInfo carries per-request values that handlers fill in as they
+// authenticate the caller, so the access log can report them afterwards.
+type requestInfo struct {
+	ID      string
+	UserID  int
+	StoreID int
+}
+
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// InitLogger configures the default slog logger from LOG_LEVEL
+// (debug, info, warn, error) and LOG_FORMAT (json or text).
+func InitLogger() {
+	level := slog.LevelInfo
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// RequestLogger assigns every request an ID (reusing an incoming
+// X-Request-ID when present) and writes one access log line per request.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 64 {
+			requestID = newRequestID()
+		}
+		info := &requestInfo{ID: requestID}
+		if storeID, err := strconv.Atoi(r.URL.Query().Get("store_id")); err == nil {
+			info.StoreID = storeID
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), requestInfoKey, info)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		attrs := []any{
+			"request_id", info.ID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"remote", r.RemoteAddr,
+		}
+		if info.UserID != 0 {
+			attrs = append(attrs, "user_id", info.UserID)
+		}
+		if info.StoreID != 0 {
+			attrs = append(attrs, "store_id", info.StoreID)
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		} else if rec.status >= 400 {
+			level = slog.LevelWarn
+		}
+		slog.Log(r.Context(), level, "http request", attrs...)
+	})
+}
+
+// Logger returns the default logger annotated with the request ID and,
+// once known, the user and store the request is acting for.
+func Logger(r *http.Request) *slog.Logger {
+	info := getRequestInfo(r)
+	if info == nil {
+		return slog.Default()
+	}
+	logger := slog.Default().With("request_id", info.ID)
+	if info.UserID != 0 {
+		logger = logger.With("user_id", info.UserID)
+	}
+	if info.StoreID != 0 {
+		logger = logger.With("store_id", info.StoreID)
+	}
+	return logger
+}
+
+// RequestID returns the ID assigned to the request by RequestLogger.
+func RequestID(r *http.Request) string {
+	if info := getRequestInfo(r); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+func getRequestInfo(r *http.Request) *requestInfo {
+	if r == nil {
+		return nil
+	}
+	info, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// setRequestUser records the authenticated user for the access log
+func setRequestUser(r *http.Request, userID int) {
+	if info := getRequestInfo(r); info != nil {
+		info.UserID = userID
+	}
+}
+
+// setRequestStore records the store a request operates on for the access log
+func setRequestStore(r *http.Request, storeID int) {
+	if info := getRequestInfo(r); info != nil && storeID != 0 {
+		info.StoreID = storeID
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder captures the status code and body size written by a handler.
+// It keeps websocket upgrades working by passing Hijack through.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status = code
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,428 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers an encoded MIME message. MAIL_TRANSPORT picks the
+// implementation: smtp, outbox (.eml files in MAIL_OUTBOX_DIR), memory or
+// none.
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// capturingMailer is a mailer that keeps what it sends for the dev mail page
+type capturingMailer interface {
+	Mailer
+	Captured() ([]CapturedMail, error)
+}
+
+// CapturedMail is a message held by the outbox or memory mailer
+type CapturedMail struct {
+	ID      string
+	From    string
+	To      string
+	ReplyTo string
+	Subject string
+	Date    time.Time
+	Text    string
+	HTML    string
+	Raw     []byte
+}
+
+var (
+	mailerMu sync.Mutex
+	mailer   Mailer
+)
+
+// currentMailer builds the configured mailer on first use
+func currentMailer() Mailer {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	if mailer == nil {
+		mailer = mailerFromEnv()
+	}
+	return mailer
+}
+
+// SetMailer replaces the mailer, e.g. with a MemoryMailer in tests
+func SetMailer(m Mailer) {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	mailer = m
+}
+
+func mailTransport() string {
+	if transport := os.Getenv("MAIL_TRANSPORT"); transport != "" {
+		return strings.ToLower(transport)
+	}
+	// without credentials nothing can be delivered. Capturing the mail
+	// instead must be asked for, since the dev page would publish it.
+	if os.Getenv("MAIL_PASSWORD") == "" && os.Getenv("GMAIL_KEY") == "" {
+		return "none"
+	}
+	return "smtp"
+}
+
+var errMailNotConfigured = errors.New("no mail transport is configured")
+
+// disabledMailer refuses every message
+type disabledMailer struct{}
+
+func (disabledMailer) Send(from string, to []string, msg []byte) error {
+	return errMailNotConfigured
+}
+
+func mailerFromEnv() Mailer {
+	switch transport := mailTransport(); transport {
+	case "memory":
+		return NewMemoryMailer(200)
+	case "outbox":
+		return &OutboxMailer{Dir: envOr("MAIL_OUTBOX_DIR", "./outbox")}
+	case "none":
+		if os.Getenv("MAIL_TRANSPORT") == "" {
+			slog.Error("no mail credentials, emails will not be sent; set MAIL_PASSWORD, or MAIL_TRANSPORT=outbox for development")
+		}
+		return disabledMailer{}
+	default:
+		if transport != "smtp" {
+			slog.Warn("unknown MAIL_TRANSPORT, using smtp", "transport", transport)
+		}
+		port, err := strconv.Atoi(envOr("MAIL_PORT", "587"))
+		if err != nil {
+			port = 587
+		}
+		from, _ := mail.ParseAddress(emailFrom())
+		username := envOr("MAIL_USERNAME", "")
+		if username == "" && from != nil {
+			username = from.Address
+		}
+		return &SMTPMailer{
+			Host:     envOr("MAIL_HOST", "smtp.gmail.com"),
+			Port:     port,
+			Username: username,
+			Password: envOr("MAIL_PASSWORD", os.Getenv("GMAIL_KEY")),
+			Security: strings.ToLower(envOr("MAIL_SECURITY", "starttls")),
+		}
+	}
+}
+
+// emailFrom is the From header on outgoing mail (MAIL_FROM)
+func emailFrom() string {
+	return envOr("MAIL_FROM", "Astropify <astropify@gmail.com>")
+}
+
+// emailReplyTo is the optional Reply-To header (MAIL_REPLY_TO)
+func emailReplyTo() string {
+	return os.Getenv("MAIL_REPLY_TO")
+}
+
+// envelopeAddress strips the display name for the SMTP MAIL FROM command
+func envelopeAddress(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		return parsed.Address
+	}
+	return addr
+}
+
+// SMTPMailer sends through an SMTP server. Security is "starttls" (upgrade
+// a plain connection, required), "tls" (implicit TLS, usually port 465) or
+// "none" for local relays.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Security string
+	Timeout  time.Duration
+}
+
+func (m *SMTPMailer) Send(from string, to []string, msg []byte) error {
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var conn net.Conn
+	var err error
+	if m.Security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.Security == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp server %s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(envelopeAddress(from)); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(envelopeAddress(rcpt)); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// OutboxMailer writes each message to Dir as an .eml file instead of sending it
+type OutboxMailer struct {
+	Dir string
+}
+
+func (m *OutboxMailer) Send(from string, to []string, msg []byte) error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + newRequestID() + ".eml"
+	return os.WriteFile(filepath.Join(m.Dir, name), msg, 0644)
+}
+
+func (m *OutboxMailer) Captured() ([]CapturedMail, error) {
+	files, err := filepath.Glob(filepath.Join(m.Dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	var captured []CapturedMail
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		captured = append(captured, parseCapturedMail(strings.TrimSuffix(filepath.Base(file), ".eml"), raw))
+	}
+	return captured, nil
+}
+
+// MemoryMailer keeps the most recent messages in memory, for tests and
+// local development.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	limit    int
+	next     int
+	messages []CapturedMail
+}
+
+func NewMemoryMailer(limit int) *MemoryMailer {
+	return &MemoryMailer{limit: limit}
+}
+
+func (m *MemoryMailer) Send(from string, to []string, msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	raw := append([]byte(nil), msg...)
+	m.messages = append(m.messages, parseCapturedMail(strconv.Itoa(m.next), raw))
+	if m.limit > 0 && len(m.messages) > m.limit {
+		m.messages = m.messages[len(m.messages)-m.limit:]
+	}
+	return nil
+}
+
+// Captured returns the held messages, newest first
+func (m *MemoryMailer) Captured() ([]CapturedMail, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	captured := make([]CapturedMail, len(m.messages))
+	for i, msg := range m.messages {
+		captured[len(m.messages)-1-i] = msg
+	}
+	return captured, nil
+}
+
+// Reset drops all held messages
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
+
+// parseCapturedMail pulls the headers and text/HTML bodies out of a message
+// written by EmailMessage.MIME. Anything it cannot parse is left empty.
+func parseCapturedMail(id string, raw []byte) CapturedMail {
+	captured := CapturedMail{ID: id, Raw: raw}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return captured
+	}
+	dec := new(mime.WordDecoder)
+	decode := func(key string) string {
+		v, err := dec.DecodeHeader(msg.Header.Get(key))
+		if err != nil {
+			return msg.Header.Get(key)
+		}
+		return v
+	}
+	captured.From = decode("From")
+	captured.To = decode("To")
+	captured.ReplyTo = decode("Reply-To")
+	captured.Subject = decode("Subject")
+	captured.Date, _ = msg.Header.Date()
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return captured
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		captured.Text = readPartBody(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+		return captured
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		// NextPart already decodes quoted-printable bodies
+		body, _ := io.ReadAll(part)
+		switch {
+		case strings.HasPrefix(part.Header.Get("Content-Type"), "text/html"):
+			captured.HTML = string(body)
+		case strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain"):
+			captured.Text = string(body)
+		}
+	}
+	return captured
+}
+
+func readPartBody(r io.Reader, encoding string) string {
+	if strings.EqualFold(encoding, "quoted-printable") {
+		r = quotedprintable.NewReader(r)
+	}
+	body, _ := io.ReadAll(r)
+	return string(body)
+}
+
+// DevMailPageEnabled reports whether /dev/mail is served (MAIL_DEV_PAGE=true)
+func DevMailPageEnabled() bool {
+	return os.Getenv("MAIL_DEV_PAGE") == "true"
+}
+
+// localRequest reports whether r comes straight from this machine rather
+// than from a client or through a proxy
+func localRequest(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("X-Real-IP") != "" || r.Header.Get("Forwarded") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// DevMailPage lists the messages held by the outbox or memory mailer so
+// verification codes and order emails can be read during development.
+// The messages let anyone sign in as their recipients, so the page has to
+// be enabled with MAIL_DEV_PAGE and answers only admins and requests from
+// this machine.
+func DevMailPage(w http.ResponseWriter, r *http.Request) {
+	capture, ok := currentMailer().(capturingMailer)
+	if !ok || !DevMailPageEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	if !localRequest(r) {
+		if _, isAdmin := ValidateAdmin(w, r); !isAdmin {
+			HandleError(w, r, http.StatusForbidden, "Forbidden")
+			return
+		}
+	}
+	messages, err := capture.Captured()
+	if err != nil {
+		Logger(r).Error("failed to read captured mail", "error", err)
+		HandleError(w, r, http.StatusInternalServerError, "Failed to read captured mail")
+		return
+	}
+
+	var selected *CapturedMail
+	if id := r.URL.Query().Get("id"); id != "" {
+		for i := range messages {
+			if messages[i].ID == id {
+				selected = &messages[i]
+				break
+			}
+		}
+		if selected == nil {
+			HandleError(w, r, http.StatusNotFound, "Message not found")
+			return
+		}
+		if r.URL.Query().Get("format") == "eml" {
+			w.Header().Set("Content-Type", "message/rfc822")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+selected.ID+`.eml"`)
+			w.Write(selected.Raw)
+			return
+		}
+	}
+
+	tmpl, err := template.ParseFiles(FrontendDevMailHTML)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load template")
+		return
+	}
+	data := struct {
+		Transport string
+		Messages  []CapturedMail
+		Selected  *CapturedMail
+	}{mailTransport(), messages, selected}
+	if err := tmpl.Execute(w, data); err != nil {
+		Logger(r).Error("failed to render dev mail page", "error", err)
+	}
+}
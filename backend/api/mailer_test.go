@@ -0,0 +1,176 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// useMemoryMailer swaps in a MemoryMailer for the test
+func useMemoryMailer(t *testing.T) *MemoryMailer {
+	t.Helper()
+	m := NewMemoryMailer(10)
+	SetMailer(m)
+	t.Cleanup(func() { SetMailer(nil) })
+	return m
+}
+
+func onlyMail(t *testing.T, m *MemoryMailer) CapturedMail {
+	t.Helper()
+	captured, err := m.Captured()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captured) != 1 {
+		t.Fatalf("captured %d messages, want 1", len(captured))
+	}
+	return captured[0]
+}
+
+func TestVerificationMailIsRecorded(t *testing.T) {
+	m := useMemoryMailer(t)
+	t.Setenv("MAIL_FROM", "Astropify <no-reply@example.com>")
+	err := sendTemplatedEmail("customer@example.com", EmailVerification, 0, map[string]interface{}{
+		"Code": "482915", "Intro": "Use this code to verify your email address.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := onlyMail(t, m)
+	if mail.To != "customer@example.com" || !strings.Contains(mail.From, "no-reply@example.com") || mail.Subject == "" {
+		t.Errorf("headers = from %q, to %q, subject %q", mail.From, mail.To, mail.Subject)
+	}
+	if !strings.Contains(mail.Text, "482915") || !strings.Contains(mail.HTML, "482915") {
+		t.Errorf("the code is missing from the text or HTML body:\n%s", mail.Text)
+	}
+}
+
+func TestQueuedOrderMailIsRecorded(t *testing.T) {
+	m := useMemoryMailer(t)
+	_, storeID, _ := createTestStore(t, openTestDB(t))
+	queueTemplatedEmail(nil, "buyer@example.com", EmailOrder, storeID, map[string]interface{}{
+		"OrderID": 7731, "Total": 42.5, "ShippingAddress": "Road 45, Manama",
+	})
+	if captured, _ := m.Captured(); len(captured) != 0 {
+		t.Fatal("the order mail was sent before its job ran")
+	}
+	runDueJobs(t, JobSendEmail)
+
+	mail := onlyMail(t, m)
+	if mail.To != "buyer@example.com" || !strings.Contains(mail.Subject, "Order Confirmation") || !strings.Contains(mail.Text, "7731") {
+		t.Errorf("headers = to %q, subject %q", mail.To, mail.Subject)
+	}
+	if !strings.Contains(mail.Text, "Road 45, Manama") {
+		t.Errorf("the shipping address is missing from the body:\n%s", mail.Text)
+	}
+}
+
+// countingSMTP points MAIL_HOST and MAIL_PORT at a listener that counts
+// connections, and clears the mail credentials
+func countingSMTP(t *testing.T) *atomic.Int32 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	connections := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	t.Setenv("MAIL_HOST", host)
+	t.Setenv("MAIL_PORT", port)
+	t.Setenv("MAIL_PASSWORD", "")
+	t.Setenv("GMAIL_KEY", "")
+	SetMailer(nil)
+	t.Cleanup(func() { SetMailer(nil) })
+	return connections
+}
+
+// In dev mode mail goes to .eml files and the SMTP server is never contacted
+func TestDevModeWritesOutbox(t *testing.T) {
+	connections := countingSMTP(t)
+	outbox := t.TempDir()
+	t.Setenv("MAIL_TRANSPORT", "outbox")
+	t.Setenv("MAIL_OUTBOX_DIR", outbox)
+
+	if _, ok := currentMailer().(*OutboxMailer); !ok {
+		t.Fatalf("mailer is %T, want *OutboxMailer", currentMailer())
+	}
+	if err := SendEmail("dev@example.com", "Your code", "Code: 111222"); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(outbox, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("outbox has %d .eml files, want 1", len(files))
+	}
+	raw, _ := os.ReadFile(files[0])
+	if mail := parseCapturedMail("1", raw); mail.Subject != "Your code" || !strings.Contains(mail.Text, "111222") {
+		t.Errorf("outbox message = %q: %q", mail.Subject, mail.Text)
+	}
+	if n := connections.Load(); n != 0 {
+		t.Errorf("the SMTP server was contacted %d times", n)
+	}
+}
+
+// Losing the credentials must not turn on the outbox and its public page
+func TestMissingCredentialsSendNothing(t *testing.T) {
+	connections := countingSMTP(t)
+	outbox := t.TempDir()
+	t.Setenv("MAIL_TRANSPORT", "")
+	t.Setenv("MAIL_OUTBOX_DIR", outbox)
+
+	if err := SendEmail("user@example.com", "Your code", "Code: 333444"); !errors.Is(err, errMailNotConfigured) {
+		t.Errorf("send = %v, want errMailNotConfigured", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(outbox, "*.eml")); len(files) != 0 || connections.Load() != 0 {
+		t.Errorf("the mail went somewhere: %d files, %d connections", len(files), connections.Load())
+	}
+}
+
+func TestDevMailPageAccess(t *testing.T) {
+	useMemoryMailer(t)
+	get := func(remote string, header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/dev/mail", nil)
+		req.RemoteAddr = remote
+		if header != "" {
+			req.Header.Set("X-Forwarded-For", header)
+		}
+		w := httptest.NewRecorder()
+		DevMailPage(w, req)
+		return w.Code
+	}
+
+	t.Setenv("MAIL_DEV_PAGE", "")
+	if code := get("127.0.0.1:50000", ""); code != http.StatusNotFound {
+		t.Errorf("page without MAIL_DEV_PAGE = %d, want 404", code)
+	}
+	t.Setenv("MAIL_DEV_PAGE", "true")
+	for name, want := range map[string]struct {
+		remote, forwarded string
+		code              int
+	}{
+		"local":         {"127.0.0.1:50000", "", http.StatusOK},
+		"local IPv6":    {"[::1]:50000", "", http.StatusOK},
+		"remote":        {"203.0.113.7:50000", "", http.StatusForbidden},
+		"through proxy": {"127.0.0.1:50000", "203.0.113.7", http.StatusForbidden},
+	} {
+		if code := get(want.remote, want.forwarded); code != want.code {
+			t.Errorf("%s request = %d, want %d", name, code, want.code)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain runs the tests in a scratch directory with a fresh database,
+// since DATABASEPATH and the upload folders are relative paths. The
+// templates under frontend/ are linked in from the source tree.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "api-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	frontend, _ := filepath.Abs("../frontend")
+	if err := os.Symlink(frontend, filepath.Join(dir, "frontend")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Mkdir("database", 0755)
+	CreateDatabase()
+	if err := EnsureStorageDirs(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	registerJobHandlers()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func mustExec(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	t.Helper()
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+func createTestUser(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	return mustExec(t, db, "INSERT INTO users (email, password, first_name, user_type) VALUES (?, 'x', 'Test', 2)",
+		fmt.Sprintf("user%d@example.com", time.Now().UnixNano()))
+}
+
+// createTestStore adds a store owner with a session and their store
+func createTestStore(t *testing.T, db *sql.DB) (userID int, storeID int, sessionToken string) {
+	t.Helper()
+	userID = createTestUser(t, db)
+	storeID = mustExec(t, db, `
+		INSERT INTO stores (name, description, template, color_scheme, logo, banner, owner_id, phone, address,
+			payment_methods, iban_number, shipping_info)
+		VALUES (?, '', 'luxury', '#000000', '', '', ?, '', '', 'card', 'NL00TEST0123456789', '')
+	`, fmt.Sprintf("Store %d", userID), userID)
+	sessionToken = fmt.Sprintf("session-%d", userID)
+	mustExec(t, db, "INSERT INTO sessions (user_id, session_token) VALUES (?, ?)", userID, sessionToken)
+	return userID, storeID, sessionToken
+}
+
+func createTestProduct(t *testing.T, db *sql.DB, storeID int, quantity int) int {
+	t.Helper()
+	return mustExec(t, db, "INSERT INTO products (store_id, name, description, price, image, quantity) VALUES (?, 'Lamp', '', 25, '', ?)",
+		storeID, quantity)
+}
+
+// runDueJobs runs queued jobs of kind until none is due, making retries
+// due at once instead of after their backoff
+func runDueJobs(t *testing.T, kind string) {
+	t.Helper()
+	db := openTestDB(t)
+	for i := 0; i < 100; i++ {
+		mustExec(t, db, "UPDATE jobs SET run_at = ? WHERE status = ? AND kind = ?", sqlTime(time.Now().Add(-time.Second)), JobPending, kind)
+		mustExec(t, db, "UPDATE jobs SET run_at = ? WHERE status = ? AND kind != ?", sqlTime(time.Now().Add(time.Hour)), JobPending, kind)
+		job, err := claimJob()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil {
+			return
+		}
+		runJob(t.Context(), slog.Default(), job)
+	}
+	t.Fatal("jobs kept being queued")
+}
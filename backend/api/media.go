@@ -0,0 +1,539 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// Kinds of gallery item. Images and videos are rows in product_media; the 3D
+// model linked in product_models is added when the gallery is loaded.
+const (
+	MediaImage = "image"
+	MediaVideo = "video"
+	MediaModel = "model"
+)
+
+// maxVideoSize caps uploaded product videos
+const maxVideoSize = 20 << 20
+
+var errInvalidMedia = errors.New("invalid media")
+
+// ProductMedia is one item of a product's gallery. Main marks the image shown
+// on product cards, which is also kept in products.image.
+type ProductMedia struct {
+	ID       int    `json:"id"`
+	Kind     string `json:"kind"`
+	File     string `json:"file"`
+	URL      string `json:"url"`
+	Alt      string `json:"alt"`
+	Position int    `json:"position"`
+	Main     bool   `json:"main,omitempty"`
+	// Preview is a rendered image of the 3D model
+	Preview string `json:"preview,omitempty"`
+}
+
+func mediaURL(kind string, file string) string {
+	if kind == MediaModel {
+		return modelViewerURL(file)
+	}
+	return "/products_image/" + file
+}
+
+// loadProductMedia returns the galleries of the products matching where
+// (on products p), keyed by product id
+func loadProductMedia(db *sql.DB, where string, args ...interface{}) (map[int][]ProductMedia, error) {
+	rows, err := db.Query(`
+		SELECT m.id, m.product_id, m.kind, m.file, m.alt, m.position, p.image
+		FROM product_media m JOIN products p ON p.id = m.product_id
+		WHERE `+where+`
+		ORDER BY m.product_id, m.position, m.id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	media := map[int][]ProductMedia{}
+	for rows.Next() {
+		var m ProductMedia
+		var productID int
+		var image string
+		if err := rows.Scan(&m.ID, &productID, &m.Kind, &m.File, &m.Alt, &m.Position, &image); err != nil {
+			return nil, err
+		}
+		m.URL = mediaURL(m.Kind, m.File)
+		m.Main = m.Kind == MediaImage && m.File == image
+		media[productID] = append(media[productID], m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	models, err := db.Query(`
+		SELECT pm.product_id, pm.file, pm.preview, p.name
+		FROM product_models pm JOIN products p ON p.id = pm.product_id
+		WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer models.Close()
+	for models.Next() {
+		var productID int
+		var model, preview, name string
+		if err := models.Scan(&productID, &model, &preview, &name); err != nil {
+			return nil, err
+		}
+		position := 0
+		if items := media[productID]; len(items) > 0 {
+			position = items[len(items)-1].Position + 1
+		}
+		item := ProductMedia{
+			Kind:     MediaModel,
+			File:     model,
+			URL:      mediaURL(MediaModel, model),
+			Alt:      name + " in 3D",
+			Position: position,
+		}
+		if preview != "" {
+			item.Preview = modelURL(preview)
+		}
+		media[productID] = append(media[productID], item)
+	}
+	if err := models.Err(); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+// saveProductVideo stores an uploaded MP4 or WebM video given as a data URL
+// and returns its file name
+func saveProductVideo(dataURL string) (string, error) {
+	var ext string
+	switch {
+	case strings.HasPrefix(dataURL, "data:video/mp4;base64,"):
+		ext = ".mp4"
+	case strings.HasPrefix(dataURL, "data:video/webm;base64,"):
+		ext = ".webm"
+	default:
+		return "", fmt.Errorf("%w: Video should be either 'mp4' or 'webm'", errInvalidMedia)
+	}
+	data, err := base64.StdEncoding.DecodeString(dataURL[strings.Index(dataURL, ",")+1:])
+	if err != nil {
+		return "", fmt.Errorf("%w: Error decoding Base64", errInvalidMedia)
+	}
+	if len(data) > maxVideoSize {
+		return "", fmt.Errorf("%w: Video size should not exceed %d MB", errInvalidMedia, maxVideoSize>>20)
+	}
+	// check the container rather than trusting the declared type
+	isMP4 := len(data) > 12 && string(data[4:8]) == "ftyp"
+	isWebM := bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3})
+	if (ext == ".mp4" && !isMP4) || (ext == ".webm" && !isWebM) {
+		return "", fmt.Errorf("%w: The file is not a valid %s video", errInvalidMedia, strings.TrimPrefix(ext, "."))
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	name := id.String() + ext
+	if err := putUpload(StoreProductsPath, name, data); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// removeMediaFile deletes an uploaded file and its sizes unless a product
+// or variant still uses it
+func removeMediaFile(db *sql.DB, file string) {
+	var used int
+	db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM product_media WHERE file = ?)
+			+ (SELECT COUNT(*) FROM products WHERE image = ?)
+			+ (SELECT COUNT(*) FROM product_variants WHERE image = ?)
+	`, file, file, file).Scan(&used)
+	if used > 0 {
+		return
+	}
+	removeImageFiles(StoreProductsPath, file)
+}
+
+// setMainImage makes the gallery image the one shown on product cards
+func setMainImage(ex execer, productID int, mediaID int) error {
+	result, err := ex.Exec(`
+		UPDATE products SET image = (SELECT file FROM product_media WHERE id = ? AND product_id = ? AND kind = 'image')
+		WHERE id = ? AND EXISTS (SELECT 1 FROM product_media WHERE id = ? AND product_id = ? AND kind = 'image')
+	`, mediaID, productID, productID, mediaID, productID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: Only images can be the main image", errInvalidMedia)
+	}
+	return nil
+}
+
+// mediaProduct loads the product a media request is about and checks the
+// caller owns its store, writing the error response if not
+func mediaProduct(w http.ResponseWriter, r *http.Request, db *sql.DB, productID int) (int, bool) {
+	var storeID int
+	if err := db.QueryRow("SELECT store_id FROM products WHERE id = ?", productID).Scan(&storeID); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Product not found")
+		return 0, false
+	}
+	if _, ok := ValidateStoreOwner(w, r, storeID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return 0, false
+	}
+	return storeID, true
+}
+
+// writeMedia answers with the product's gallery after a change
+func writeMedia(w http.ResponseWriter, r *http.Request, db *sql.DB, storeID int, productID int) {
+	media, err := loadProductMedia(db, "p.id = ?", productID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load media")
+		return
+	}
+	var image string
+	db.QueryRow("SELECT image FROM products WHERE id = ?", productID).Scan(&image)
+	PublishEvent(Event{Type: EventProductUpdated, StoreID: storeID, Data: map[string]interface{}{
+		"product_id": productID,
+		"image":      image,
+	}})
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "media": nonNilMedia(media[productID])})
+}
+
+func nonNilMedia(media []ProductMedia) []ProductMedia {
+	if media == nil {
+		return []ProductMedia{}
+	}
+	return media
+}
+
+// writeMediaError answers 400 for invalid media and 500 for anything else
+func writeMediaError(w http.ResponseWriter, r *http.Request, productID int, err error) {
+	if errors.Is(err, errInvalidMedia) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, invalidMessage(err, errInvalidMedia))
+		return
+	}
+	Logger(r).Error("saving product media failed", "product_id", productID, "error", err)
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save media")
+}
+
+// GetProductMedia lists a product's gallery: GET /api/products/media?product_id=
+func GetProductMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	productID, err := strconv.Atoi(r.URL.Query().Get("product_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid product_id")
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+	media, err := loadProductMedia(db, "p.id = ?", productID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load media")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"media": nonNilMedia(media[productID])})
+}
+
+// addMediaRequest is the body of AddProductMedia; Data is a data URL
+type addMediaRequest struct {
+	ProductID int    `json:"product_id"`
+	Data      string `json:"data"`
+	Alt       string `json:"alt"`
+	Main      bool   `json:"main"`
+}
+
+// AddProductMedia uploads an image or video to the end of a product's
+// gallery: POST /api/products/media/add with {"product_id", "data" (a data
+// URL), "alt", "main"}
+func AddProductMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxVideoSize)
+	var req addMediaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+	storeID, ok := mediaProduct(w, r, db, req.ProductID)
+	if !ok {
+		return
+	}
+
+	kind := MediaImage
+	var file string
+	if strings.HasPrefix(req.Data, "data:video/") {
+		kind = MediaVideo
+		file, err = saveProductVideo(req.Data)
+	} else if valid, result := ValidateImage(StoreProductsPath, req.Data); valid {
+		file = result
+	} else {
+		err = fmt.Errorf("%w: %s", errInvalidMedia, result)
+	}
+	if err != nil {
+		writeMediaError(w, r, req.ProductID, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		removeUpload(StoreProductsPath, file)
+		writeMediaError(w, r, req.ProductID, err)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`
+		INSERT INTO product_media (product_id, kind, file, alt, position)
+		VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM product_media WHERE product_id = ?))
+	`, req.ProductID, kind, file, strings.TrimSpace(req.Alt), req.ProductID)
+	if err == nil && kind == MediaImage {
+		// a product without an image takes the first one uploaded
+		var image string
+		tx.QueryRow("SELECT image FROM products WHERE id = ?", req.ProductID).Scan(&image)
+		if req.Main || image == "" {
+			mediaID, _ := result.LastInsertId()
+			err = setMainImage(tx, req.ProductID, int(mediaID))
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		removeUpload(StoreProductsPath, file)
+		writeMediaError(w, r, req.ProductID, err)
+		return
+	}
+	if kind == MediaImage {
+		if err := queueThumbnail(StoreProductsPath, file); err != nil {
+			Logger(r).Warn("failed to queue product thumbnail", "image", file, "error", err)
+		}
+	}
+	writeMedia(w, r, db, storeID, req.ProductID)
+}
+
+// updateMediaRequest is the body of UpdateProductMedia
+type updateMediaRequest struct {
+	ProductID int     `json:"product_id"`
+	ID        int     `json:"id"`
+	Alt       *string `json:"alt"`
+	Main      bool    `json:"main"`
+}
+
+// UpdateProductMedia changes an item's alt text or makes it the main image:
+// POST /api/products/media/update with {"product_id", "id", "alt", "main"}
+func UpdateProductMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req updateMediaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+	storeID, ok := mediaProduct(w, r, db, req.ProductID)
+	if !ok {
+		return
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM product_media WHERE id = ? AND product_id = ?", req.ID, req.ProductID).Scan(&id); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Media not found")
+		return
+	}
+
+	if req.Alt != nil {
+		if _, err := db.Exec("UPDATE product_media SET alt = ? WHERE id = ?", strings.TrimSpace(*req.Alt), req.ID); err != nil {
+			writeMediaError(w, r, req.ProductID, err)
+			return
+		}
+	}
+	if req.Main {
+		if err := setMainImage(db, req.ProductID, req.ID); err != nil {
+			writeMediaError(w, r, req.ProductID, err)
+			return
+		}
+	}
+	writeMedia(w, r, db, storeID, req.ProductID)
+}
+
+// reorderMediaRequest is the body of ReorderProductMedia
+type reorderMediaRequest struct {
+	ProductID int   `json:"product_id"`
+	IDs       []int `json:"ids"`
+}
+
+// ReorderProductMedia sets the gallery order after a drag: POST
+// /api/products/media/reorder with {"product_id", "ids"} listing every image
+// and video of the product once
+func ReorderProductMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req reorderMediaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+	storeID, ok := mediaProduct(w, r, db, req.ProductID)
+	if !ok {
+		return
+	}
+
+	var existing []int
+	rows, err := db.Query("SELECT id FROM product_media WHERE product_id = ?", req.ProductID)
+	if err != nil {
+		writeMediaError(w, r, req.ProductID, err)
+		return
+	}
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		existing = append(existing, id)
+	}
+	rows.Close()
+	seen := map[int]bool{}
+	for _, id := range req.IDs {
+		if !containsInt(existing, id) || seen[id] {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "The order must list each of the product's media once")
+			return
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(existing) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "The order must list each of the product's media once")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeMediaError(w, r, req.ProductID, err)
+		return
+	}
+	defer tx.Rollback()
+	for position, id := range req.IDs {
+		if _, err := tx.Exec("UPDATE product_media SET position = ? WHERE id = ?", position, id); err != nil {
+			writeMediaError(w, r, req.ProductID, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeMediaError(w, r, req.ProductID, err)
+		return
+	}
+	writeMedia(w, r, db, storeID, req.ProductID)
+}
+
+// deleteMediaRequest is the body of DeleteProductMedia
+type deleteMediaRequest struct {
+	ProductID int `json:"product_id"`
+	ID        int `json:"id"`
+}
+
+// DeleteProductMedia removes an item from the gallery and deletes its file:
+// POST /api/products/media/delete with {"product_id", "id"}. The last image
+// cannot be removed; removing the main image promotes the next one.
+func DeleteProductMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req deleteMediaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+	storeID, ok := mediaProduct(w, r, db, req.ProductID)
+	if !ok {
+		return
+	}
+
+	var kind, file, image string
+	err = db.QueryRow(`
+		SELECT m.kind, m.file, p.image FROM product_media m JOIN products p ON p.id = m.product_id
+		WHERE m.id = ? AND m.product_id = ?
+	`, req.ID, req.ProductID).Scan(&kind, &file, &image)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Media not found")
+		return
+	}
+	if kind == MediaImage {
+		var images int
+		db.QueryRow("SELECT COUNT(*) FROM product_media WHERE product_id = ? AND kind = 'image'", req.ProductID).Scan(&images)
+		if images <= 1 {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "A product needs at least one image")
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeMediaError(w, r, req.ProductID, err)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM product_media WHERE id = ?", req.ID)
+	if err == nil && kind == MediaImage && file == image {
+		var next int
+		err = tx.QueryRow("SELECT id FROM product_media WHERE product_id = ? AND kind = 'image' ORDER BY position, id LIMIT 1", req.ProductID).Scan(&next)
+		if err == nil {
+			err = setMainImage(tx, req.ProductID, next)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeMediaError(w, r, req.ProductID, err)
+		return
+	}
+	removeMediaFile(db, file)
+	writeMedia(w, r, db, storeID, req.ProductID)
+}
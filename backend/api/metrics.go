@@ -0,0 +1,377 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Metrics are kept in-process and rendered in the Prometheus text
+// exposition format by MetricsHandler.
+
+var (
+	httpRequestsTotal = newCounterVec("http_requests_total",
+		"HTTP requests handled, by route, method and status code.", "route", "method", "status")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request latency in seconds, by route and method.", defaultBuckets, "route", "method")
+	dbQueryDuration = newHistogramVec("db_query_duration_seconds",
+		"Database statement latency in seconds, by operation.", dbBuckets, "operation")
+	websocketConnections = newGaugeVec("websocket_connections",
+		"Open websocket connections, by endpoint.", "endpoint")
+	emailsSentTotal = newCounterVec("emails_sent_total",
+		"Emails handed to the mail transport, by result.", "result")
+	ordersCreatedTotal = newCounterVec("orders_created_total",
+		"Orders created at checkout.")
+	paymentsTotal = newCounterVec("payments_total",
+		"Payment attempts, by result (succeeded or failed).", "result")
+	cartsAbandonedTotal = newCounterVec("carts_abandoned_total",
+		"Carts abandoned before payment.")
+	jobsProcessedTotal = newCounterVec("jobs_processed_total",
+		"Background jobs run, by kind and result (completed, retry or dead).", "kind", "result")
+	eventsPublishedTotal = newCounterVec("events_published_total",
+		"Events published on the event bus, by type.", "type")
+	eventsDroppedTotal = newCounterVec("events_dropped_total",
+		"Events dropped because a subscriber was not keeping up, by type.", "type")
+	apiLegacyRequestsTotal = newCounterVec("api_legacy_requests_total",
+		"Requests to deprecated pre-v1 API paths, by path.", "path")
+	apiKeyRequestsTotal = newCounterVec("api_key_requests_total",
+		"Requests authenticated with a store API key, by result (allowed, invalid, forbidden or rate_limited).", "result")
+	webhookDeliveriesTotal = newCounterVec("webhook_deliveries_total",
+		"Webhook delivery attempts, by event and result (succeeded or retrying).", "event", "result")
+
+	processStart = time.Now()
+)
+
+var (
+	defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	dbBuckets      = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+)
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []collector
+}
+
+type collector interface {
+	write(sb *strings.Builder)
+}
+
+var registry = &metricsRegistry{}
+
+func (reg *metricsRegistry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.metrics = append(reg.metrics, c)
+}
+
+// labelKey joins label values into a map key; \xff never appears in our labels.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// counterVec is a monotonically increasing value per label combination
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	registry.register(c)
+	return c
+}
+
+func (c *counterVec) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	c.values[labelKey(labelValues)] += delta
+	c.mu.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) write(sb *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(sb, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(sb, "%s%s %s\n", c.name, formatLabels(c.labels, key), formatFloat(c.values[key]))
+	}
+}
+
+// gaugeVec is a value per label combination that can go up and down
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	registry.register(g)
+	return g
+}
+
+func (g *gaugeVec) Add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	g.values[labelKey(labelValues)] += delta
+	g.mu.Unlock()
+}
+
+func (g *gaugeVec) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+func (g *gaugeVec) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+func (g *gaugeVec) write(sb *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(sb, "%s%s %s\n", g.name, formatLabels(g.labels, key), formatFloat(g.values[key]))
+	}
+}
+
+// histogramVec tracks observations in cumulative buckets per label combination
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	registry.register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) write(sb *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key), formatFloat(s.sum))
+		fmt.Fprintf(sb, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), s.count)
+	}
+}
+
+func writeRuntimeMetrics(sb *strings.Builder) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Bytes of allocated heap objects.", float64(mem.Alloc)},
+		{"go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", float64(mem.Sys)},
+		{"go_memstats_heap_objects", "Number of allocated heap objects.", float64(mem.HeapObjects)},
+		{"process_start_time_seconds", "Start time of the process since unix epoch in seconds.", float64(processStart.Unix())},
+		{"process_uptime_seconds", "Seconds since the process started.", time.Since(processStart).Seconds()},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value))
+	}
+	fmt.Fprintf(sb, "# HELP go_gc_cycles_total Completed GC cycles.\n# TYPE go_gc_cycles_total counter\ngo_gc_cycles_total %d\n", mem.NumGC)
+}
+
+func renderMetrics() string {
+	var sb strings.Builder
+	registry.mu.Lock()
+	metrics := append([]collector(nil), registry.metrics...)
+	registry.mu.Unlock()
+	for _, m := range metrics {
+		m.write(&sb)
+	}
+	writeRuntimeMetrics(&sb)
+	return sb.String()
+}
+
+// MetricsHandler serves /metrics on the main listener; only admins may read it.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, isAdmin := ValidateAdmin(w, r); !isAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	serveMetrics(w, r)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(renderMetrics()))
+}
+
+// ServeMetrics exposes /metrics without authentication on a separate
+// listener (METRICS_ADDR), meant to be reachable only from the scraper.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	slog.Info("metrics listener started", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics listener stopped", "addr", addr, "error", err)
+	}
+}
+
+// InstrumentHandler records request count, status and latency per route.
+// Routes are the patterns registered on mux, which keeps label cardinality bounded.
+func InstrumentHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(rec, r)
+		httpRequestsTotal.Inc(route, r.Method, strconv.Itoa(rec.status))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+// The instrumented driver wraps go-sqlite3 so every statement issued through
+// sql.Open(DATABASEDRIVER, ...) is timed without touching call sites.
+
+func init() {
+	sql.Register(DATABASEDRIVER, &instrumentedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+type instrumentedDriver struct {
+	driver.Driver
+}
+
+func (d *instrumentedDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type instrumentedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func observeQuery(query string, start time.Time) {
+	dbQueryDuration.Observe(time.Since(start).Seconds(), queryOperation(query))
+}
+
+// queryOperation reduces a statement to its leading keyword (select, insert, ...)
+func queryOperation(query string) string {
+	query = strings.TrimSpace(query)
+	for strings.HasPrefix(query, "--") {
+		if idx := strings.Index(query, "\n"); idx != -1 {
+			query = strings.TrimSpace(query[idx+1:])
+		} else {
+			return "other"
+		}
+	}
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+	switch op := strings.ToLower(fields[0]); op {
+	case "select", "insert", "update", "delete", "create", "alter", "pragma", "with":
+		return op
+	}
+	return "other"
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer observeQuery(query, time.Now())
+	return c.SQLiteConn.QueryContext(ctx, query, args)
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer observeQuery(query, time.Now())
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
@@ -0,0 +1,459 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// migration is a numbered schema change applied once, in order, after the
+// base schema in CreateDatabase. Append new migrations; never edit applied ones.
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+	// Go runs after SQL in the same transaction, for data changes that need
+	// more than SQL (e.g. looking at uploaded files)
+	Go func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{Version: 1, Name: "baseline schema"},
+	{Version: 2, Name: "job queue, cart reservations and store reports", SQL: `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		payload TEXT NOT NULL DEFAULT '{}',
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 5,
+		run_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		locked_at DATETIME,
+		last_error TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_jobs_status_run_at ON jobs(status, run_at);
+
+	CREATE TABLE IF NOT EXISTS scheduled_jobs (
+		kind TEXT PRIMARY KEY,
+		interval_seconds INTEGER NOT NULL,
+		next_run_at DATETIME NOT NULL
+	);
+
+	ALTER TABLE cart ADD COLUMN updated_at DATETIME;
+
+	CREATE TABLE IF NOT EXISTS store_reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		store_id INTEGER NOT NULL,
+		period_start DATE NOT NULL,
+		orders_count INTEGER NOT NULL DEFAULT 0,
+		items_sold INTEGER NOT NULL DEFAULT 0,
+		revenue REAL NOT NULL DEFAULT 0,
+		top_product_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE,
+		UNIQUE(store_id, period_start)
+	);`},
+	{Version: 3, Name: "notifications and preferences", SQL: `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		link TEXT NOT NULL DEFAULT '',
+		read_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, read_at);
+
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		user_id INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		PRIMARY KEY (user_id, event_type),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS app_secrets (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`},
+	{Version: 4, Name: "order claims and optimistic locking", SQL: `
+	ALTER TABLE orders ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+	ALTER TABLE orders ADD COLUMN claimed_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+	ALTER TABLE orders ADD COLUMN claimed_at DATETIME;
+	ALTER TABLE orders ADD COLUMN paid_at DATETIME;
+	UPDATE orders SET paid_at = updated_at WHERE status NOT IN ('pending', 'cancelled');
+	CREATE INDEX IF NOT EXISTS idx_orders_store_status ON orders(store_id, status);`},
+	{Version: 5, Name: "order tracking and status history", SQL: `
+	ALTER TABLE orders ADD COLUMN tracking_number TEXT;
+	ALTER TABLE orders ADD COLUMN estimated_delivery DATETIME;
+	ALTER TABLE orders ADD COLUMN shipped_at DATETIME;
+	ALTER TABLE orders ADD COLUMN delivered_at DATETIME;
+
+	CREATE TABLE IF NOT EXISTS order_status_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_order_status_history_order ON order_status_history(order_id);
+	INSERT INTO order_status_history (order_id, status, created_at)
+		SELECT id, status, COALESCE(updated_at, created_at) FROM orders;`},
+	{Version: 6, Name: "shipments", SQL: `
+	CREATE TABLE IF NOT EXISTS shipments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id INTEGER NOT NULL,
+		store_id INTEGER NOT NULL,
+		carrier TEXT NOT NULL,
+		service TEXT NOT NULL DEFAULT '',
+		tracking_number TEXT NOT NULL DEFAULT '',
+		label_url TEXT NOT NULL DEFAULT '',
+		cost REAL NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'label_created',
+		estimated_delivery DATETIME,
+		delivered_at DATETIME,
+		polled_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_shipments_order ON shipments(order_id);
+	CREATE INDEX IF NOT EXISTS idx_shipments_tracking ON shipments(tracking_number);
+
+	CREATE TABLE IF NOT EXISTS shipment_items (
+		shipment_id INTEGER NOT NULL,
+		order_product_id INTEGER NOT NULL,
+		quantity INTEGER NOT NULL,
+		PRIMARY KEY (shipment_id, order_product_id),
+		FOREIGN KEY (shipment_id) REFERENCES shipments(id) ON DELETE CASCADE,
+		FOREIGN KEY (order_product_id) REFERENCES order_products(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS shipment_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		shipment_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		location TEXT NOT NULL DEFAULT '',
+		occurred_at DATETIME NOT NULL,
+		UNIQUE (shipment_id, status, occurred_at),
+		FOREIGN KEY (shipment_id) REFERENCES shipments(id) ON DELETE CASCADE
+	);
+
+	-- tracking numbers typed in by owners become manual shipments of the whole order
+	INSERT INTO shipments (order_id, store_id, carrier, tracking_number, status, delivered_at, created_at, updated_at)
+		SELECT id, store_id, 'manual', tracking_number,
+			CASE WHEN delivered_at IS NOT NULL THEN 'delivered' ELSE 'in_transit' END,
+			delivered_at, COALESCE(shipped_at, updated_at, created_at), COALESCE(updated_at, created_at)
+		FROM orders WHERE tracking_number IS NOT NULL AND tracking_number != '';
+	INSERT INTO shipment_items (shipment_id, order_product_id, quantity)
+		SELECT s.id, op.id, op.quantity FROM shipments s JOIN order_products op ON op.order_id = s.order_id;
+	ALTER TABLE orders DROP COLUMN tracking_number;`},
+	{Version: 7, Name: "returns", SQL: `
+	CREATE TABLE IF NOT EXISTS returns (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id INTEGER NOT NULL,
+		store_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'requested',
+		reason TEXT NOT NULL,
+		owner_note TEXT NOT NULL DEFAULT '',
+		restocked INTEGER NOT NULL DEFAULT 0,
+		refund_amount REAL NOT NULL DEFAULT 0,
+		received_at DATETIME,
+		refunded_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+		FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_returns_store_status ON returns(store_id, status);
+	CREATE INDEX IF NOT EXISTS idx_returns_order ON returns(order_id);
+
+	CREATE TABLE IF NOT EXISTS return_items (
+		return_id INTEGER NOT NULL,
+		order_product_id INTEGER NOT NULL,
+		quantity INTEGER NOT NULL,
+		PRIMARY KEY (return_id, order_product_id),
+		FOREIGN KEY (return_id) REFERENCES returns(id) ON DELETE CASCADE,
+		FOREIGN KEY (order_product_id) REFERENCES order_products(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS return_photos (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		return_id INTEGER NOT NULL,
+		filename TEXT NOT NULL,
+		FOREIGN KEY (return_id) REFERENCES returns(id) ON DELETE CASCADE
+	);
+
+	-- return labels are shipments going the other way
+	ALTER TABLE shipments ADD COLUMN return_id INTEGER REFERENCES returns(id) ON DELETE CASCADE;`},
+	{Version: 8, Name: "product variants", SQL: `
+	CREATE TABLE IF NOT EXISTS product_options (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		product_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+		UNIQUE(product_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS product_variants (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		product_id INTEGER NOT NULL,
+		sku TEXT NOT NULL DEFAULT '',
+		price REAL NOT NULL,
+		quantity INTEGER NOT NULL DEFAULT 0,
+		image TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_product_variants_product ON product_variants(product_id);
+
+	CREATE TABLE IF NOT EXISTS product_variant_options (
+		variant_id INTEGER NOT NULL,
+		option_id INTEGER NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (variant_id, option_id),
+		FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE,
+		FOREIGN KEY (option_id) REFERENCES product_options(id) ON DELETE CASCADE
+	);
+
+	-- every existing product becomes a single default variant
+	INSERT INTO product_variants (product_id, price, quantity)
+		SELECT id, price, quantity FROM products;
+
+	-- carts now hold a variant; the old unique key was per product
+	CREATE TABLE cart_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		product_id INTEGER NOT NULL,
+		variant_id INTEGER NOT NULL,
+		quantity INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+		FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE,
+		UNIQUE(user_id, variant_id)
+	);
+	INSERT INTO cart_new (id, user_id, product_id, variant_id, quantity, created_at, updated_at)
+		SELECT c.id, c.user_id, c.product_id, v.id, c.quantity, c.created_at, c.updated_at
+		FROM cart c JOIN product_variants v ON v.product_id = c.product_id;
+	DROP TABLE cart;
+	ALTER TABLE cart_new RENAME TO cart;
+
+	ALTER TABLE order_products ADD COLUMN variant_id INTEGER REFERENCES product_variants(id) ON DELETE SET NULL;
+	ALTER TABLE order_products ADD COLUMN variant_title TEXT NOT NULL DEFAULT '';
+	UPDATE order_products SET variant_id = (SELECT v.id FROM product_variants v WHERE v.product_id = order_products.product_id);`},
+	{Version: 9, Name: "categories, tags and collections", SQL: `
+	CREATE TABLE IF NOT EXISTS categories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		store_id INTEGER NOT NULL,
+		parent_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+		name TEXT NOT NULL,
+		slug TEXT NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE,
+		UNIQUE(store_id, slug)
+	);
+	ALTER TABLE products ADD COLUMN category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL;
+
+	CREATE TABLE IF NOT EXISTS product_tags (
+		product_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (product_id, tag),
+		FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_product_tags_tag ON product_tags(tag);
+
+	CREATE TABLE IF NOT EXISTS collections (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		store_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		slug TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		kind TEXT NOT NULL DEFAULT 'manual',
+		rules TEXT NOT NULL DEFAULT '{}',
+		position INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE,
+		UNIQUE(store_id, slug)
+	);
+
+	CREATE TABLE IF NOT EXISTS collection_products (
+		collection_id INTEGER NOT NULL,
+		product_id INTEGER NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (collection_id, product_id),
+		FOREIGN KEY (collection_id) REFERENCES collections(id) ON DELETE CASCADE,
+		FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+	);`},
+	{Version: 10, Name: "product media", SQL: `
+	CREATE TABLE IF NOT EXISTS product_media (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		product_id INTEGER NOT NULL,
+		kind TEXT NOT NULL DEFAULT 'image',
+		file TEXT NOT NULL,
+		alt TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_product_media_product ON product_media(product_id, position);
+
+	INSERT INTO product_media (product_id, kind, file, alt)
+	SELECT id, 'image', image, name FROM products WHERE image != '';`},
+	{Version: 11, Name: "upload quarantine", SQL: `
+	CREATE TABLE IF NOT EXISTS upload_quarantine (
+		key TEXT PRIMARY KEY,
+		size INTEGER NOT NULL DEFAULT 0,
+		quarantined_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`},
+	{Version: 12, Name: "product 3D models", SQL: `
+	CREATE TABLE IF NOT EXISTS product_models (
+		product_id INTEGER PRIMARY KEY,
+		format TEXT NOT NULL,
+		file TEXT NOT NULL,
+		material TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL DEFAULT 0,
+		triangles INTEGER NOT NULL DEFAULT 0,
+		vertices INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_product_models_file ON product_models(file);`, Go: linkLegacyModels},
+	{Version: 13, Name: "3D model metadata and previews", SQL: `
+	ALTER TABLE product_models ADD COLUMN metadata TEXT NOT NULL DEFAULT '';
+	ALTER TABLE product_models ADD COLUMN preview TEXT NOT NULL DEFAULT '';`},
+	{Version: 14, Name: "store API keys", SQL: `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		store_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		rate_limit INTEGER NOT NULL DEFAULT 60,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		last_used_at DATETIME,
+		revoked_at DATETIME,
+		FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_api_keys_store ON api_keys(store_id);`},
+	{Version: 15, Name: "webhooks", SQL: `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		store_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		events TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		active INTEGER NOT NULL DEFAULT 1,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (store_id) REFERENCES stores(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhooks_store ON webhooks(store_id);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		response_status INTEGER NOT NULL DEFAULT 0,
+		response_body TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		redelivery_of INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_attempt_at DATETIME,
+		FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);`},
+	// order lines of variants deleted before saveVariants cleared them
+	{Version: 16, Name: "release order lines of deleted variants", SQL: `
+	UPDATE order_products SET variant_id = NULL
+	WHERE variant_id IS NOT NULL AND variant_id NOT IN (SELECT id FROM product_variants);`},
+}
+
+// runMigrations applies every migration newer than the recorded schema version
+func runMigrations(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if m.SQL != "" {
+			if _, err := tx.Exec(m.SQL); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+		}
+		if m.Go != nil {
+			if err := m.Go(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	return nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// SchemaVersion returns the latest applied migration version
+func SchemaVersion() (int, error) {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return schemaVersion(db)
+}
+
+// latestMigration is the version this binary expects the database to be at
+func latestMigration() int {
+	return migrations[len(migrations)-1].Version
+}
@@ -0,0 +1,917 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// previewSize is the edge of the PNG previews rendered for 3D models; they
+// are drawn at previewSupersample times that size and scaled down to smooth
+// the edges
+const (
+	previewSize        = 512
+	previewSupersample = 2
+)
+
+// ModelMetadata is what the server reads from a 3D model: its extent in
+// model units, geometry counts, materials and textures
+type ModelMetadata struct {
+	BoundsMin  [3]float64      `json:"bounds_min"`
+	BoundsMax  [3]float64      `json:"bounds_max"`
+	Dimensions [3]float64      `json:"dimensions"`
+	Triangles  int             `json:"triangles"`
+	Vertices   int             `json:"vertices"`
+	Materials  []ModelMaterial `json:"materials"`
+	Textures   []ModelTexture  `json:"textures"`
+	// Error is set instead when the model could not be read
+	Error string `json:"error,omitempty"`
+}
+
+// ModelMaterial is a material of a model. BaseColor is linear RGBA;
+// Texture indexes ModelMetadata.Textures.
+type ModelMaterial struct {
+	Name        string     `json:"name"`
+	BaseColor   [4]float64 `json:"base_color"`
+	Texture     *int       `json:"texture,omitempty"`
+	Metallic    float64    `json:"metallic"`
+	Roughness   float64    `json:"roughness"`
+	DoubleSided bool       `json:"double_sided,omitempty"`
+}
+
+// ModelTexture is an image used by a model. Embedded textures are stored in
+// the GLB's binary chunk or as data URIs rather than as files of their own.
+type ModelTexture struct {
+	Name     string `json:"name,omitempty"`
+	MimeType string `json:"mime_type"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Size     int    `json:"size"`
+	Embedded bool   `json:"embedded"`
+}
+
+type vec3 [3]float64
+
+func (a vec3) sub(b vec3) vec3 { return vec3{a[0] - b[0], a[1] - b[1], a[2] - b[2]} }
+
+func (a vec3) dot(b vec3) float64 { return a[0]*b[0] + a[1]*b[1] + a[2]*b[2] }
+
+func (a vec3) cross(b vec3) vec3 {
+	return vec3{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func (a vec3) normalize() vec3 {
+	length := math.Sqrt(a.dot(a))
+	if length == 0 {
+		return a
+	}
+	return vec3{a[0] / length, a[1] / length, a[2] / length}
+}
+
+// mat4 is a column-major transform, as glTF stores them
+type mat4 [16]float64
+
+var identity4 = mat4{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}
+
+func (m mat4) mul(n mat4) mat4 {
+	var out mat4
+	for col := 0; col < 4; col++ {
+		for row := 0; row < 4; row++ {
+			for k := 0; k < 4; k++ {
+				out[col*4+row] += m[k*4+row] * n[col*4+k]
+			}
+		}
+	}
+	return out
+}
+
+func (m mat4) apply(p vec3) vec3 {
+	return vec3{
+		m[0]*p[0] + m[4]*p[1] + m[8]*p[2] + m[12],
+		m[1]*p[0] + m[5]*p[1] + m[9]*p[2] + m[13],
+		m[2]*p[0] + m[6]*p[1] + m[10]*p[2] + m[14],
+	}
+}
+
+// trsMatrix builds a node transform from its translation, rotation
+// quaternion (x, y, z, w) and scale
+func trsMatrix(t []float64, r []float64, s []float64) mat4 {
+	tx, ty, tz := 0.0, 0.0, 0.0
+	if len(t) == 3 {
+		tx, ty, tz = t[0], t[1], t[2]
+	}
+	x, y, z, w := 0.0, 0.0, 0.0, 1.0
+	if len(r) == 4 {
+		x, y, z, w = r[0], r[1], r[2], r[3]
+	}
+	sx, sy, sz := 1.0, 1.0, 1.0
+	if len(s) == 3 {
+		sx, sy, sz = s[0], s[1], s[2]
+	}
+	return mat4{
+		(1 - 2*(y*y+z*z)) * sx, 2 * (x*y + z*w) * sx, 2 * (x*z - y*w) * sx, 0,
+		2 * (x*y - z*w) * sy, (1 - 2*(x*x+z*z)) * sy, 2 * (y*z + x*w) * sy, 0,
+		2 * (x*z + y*w) * sz, 2 * (y*z - x*w) * sz, (1 - 2*(x*x+y*y)) * sz, 0,
+		tx, ty, tz, 1,
+	}
+}
+
+type modelTriangle struct {
+	P [3]vec3
+	// Material indexes modelScene.Materials, -1 for none
+	Material int
+}
+
+// modelScene is a model flattened to world space triangles
+type modelScene struct {
+	Triangles []modelTriangle
+	Vertices  int
+	Materials []ModelMaterial
+	Textures  []ModelTexture
+	// colors are the linear colors materials are shaded with: the base color
+	// times the average of its texture
+	colors []vec3
+}
+
+func (s *modelScene) addTriangle(t modelTriangle) error {
+	if len(s.Triangles) >= maxModelTriangles {
+		return modelError("The model has more than %d triangles", maxModelTriangles)
+	}
+	s.Triangles = append(s.Triangles, t)
+	return nil
+}
+
+// metadata sums up the scene; the bounds cover the vertices that are drawn
+func (s *modelScene) metadata() ModelMetadata {
+	meta := ModelMetadata{
+		Triangles: len(s.Triangles),
+		Vertices:  s.Vertices,
+		Materials: s.Materials,
+		Textures:  s.Textures,
+	}
+	if meta.Materials == nil {
+		meta.Materials = []ModelMaterial{}
+	}
+	if meta.Textures == nil {
+		meta.Textures = []ModelTexture{}
+	}
+	if len(s.Triangles) == 0 {
+		return meta
+	}
+	min, max := s.Triangles[0].P[0], s.Triangles[0].P[0]
+	for _, t := range s.Triangles {
+		for _, p := range t.P {
+			for i := 0; i < 3; i++ {
+				min[i] = math.Min(min[i], p[i])
+				max[i] = math.Max(max[i], p[i])
+			}
+		}
+	}
+	meta.BoundsMin, meta.BoundsMax = min, max
+	meta.Dimensions = max.sub(min)
+	return meta
+}
+
+// textureInfo describes an image used by a model and returns its average
+// linear color, or nil when the image cannot be decoded (WebP)
+func textureInfo(name string, mimeType string, data []byte, embedded bool) (ModelTexture, *vec3) {
+	texture := ModelTexture{Name: name, MimeType: mimeType, Size: len(data), Embedded: embedded}
+	format := sniffImage(data)
+	if texture.MimeType == "" && format != "" {
+		texture.MimeType = "image/" + format
+	}
+	if format == FormatWebP {
+		texture.Width, texture.Height, _ = webpSize(data)
+		return texture, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return texture, nil
+	}
+	b := img.Bounds()
+	texture.Width, texture.Height = b.Dx(), b.Dy()
+	// a grid of samples is plenty for a shading color
+	var sum vec3
+	n := 0
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			r, g, bl, a := img.At(b.Min.X+x*b.Dx()/32, b.Min.Y+y*b.Dy()/32).RGBA()
+			if a == 0 {
+				continue
+			}
+			sum[0] += srgbToLinear(float64(r) / float64(a))
+			sum[1] += srgbToLinear(float64(g) / float64(a))
+			sum[2] += srgbToLinear(float64(bl) / float64(a))
+			n++
+		}
+	}
+	if n == 0 {
+		return texture, nil
+	}
+	average := vec3{sum[0] / float64(n), sum[1] / float64(n), sum[2] / float64(n)}
+	return texture, &average
+}
+
+func srgbToLinear(c float64) float64 { return math.Pow(c, 2.2) }
+
+func linearToSRGB(c float64) float64 { return math.Pow(math.Max(0, math.Min(1, c)), 1/2.2) }
+
+// readModelFile reads a stored model file; companion files are looked up
+// next to main and may not leave its folder
+func readModelFile(main string, name string) ([]byte, error) {
+	dir := path.Dir(main)
+	file := path.Join(dir, name)
+	if !validBlobKey(file) || (dir != "." && !strings.HasPrefix(file, dir+"/")) {
+		return nil, modelError("The model refers to %q, which is not a file next to it", name)
+	}
+	r, err := currentBlobStore().Get(blobKey(Store3DPath, file))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, maxModelUnpacked))
+}
+
+// loadModelScene reads a stored glTF, GLB or OBJ model with its companion
+// files
+func loadModelScene(format string, file string, material string) (*modelScene, error) {
+	data, err := readModelFile(file, path.Base(file))
+	if err != nil {
+		return nil, err
+	}
+	readFile := func(name string) ([]byte, error) { return readModelFile(file, name) }
+	switch format {
+	case ModelGLB, ModelGLTF:
+		if bytes.HasPrefix(data, []byte("glTF")) {
+			document, bin, err := splitGLB(data)
+			if err != nil {
+				return nil, err
+			}
+			return gltfScene(document, bin, readFile)
+		}
+		return gltfScene(data, nil, readFile)
+	case ModelOBJ:
+		return objScene(data, path.Base(material), readFile)
+	}
+	return nil, modelError("Only glTF and OBJ models can be read, not %s", format)
+}
+
+// gltfScene flattens the default scene of a glTF document
+func gltfScene(document []byte, bin []byte, readFile func(string) ([]byte, error)) (*modelScene, error) {
+	var doc gltfDocument
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, modelError("The glTF JSON could not be read: %v", err)
+	}
+	if !strings.HasPrefix(doc.Asset.Version, "2.") {
+		return nil, modelError("Only glTF 2.0 models are supported")
+	}
+	le := binary.LittleEndian
+
+	// load returns the contents of a URI and whether they were embedded
+	load := func(uri string) ([]byte, bool, error) {
+		if strings.HasPrefix(uri, "data:") {
+			comma := strings.Index(uri, ",")
+			if comma < 0 || !strings.HasSuffix(uri[:comma], ";base64") {
+				return nil, true, modelError("Unsupported data URI in the model")
+			}
+			data, err := base64.StdEncoding.DecodeString(uri[comma+1:])
+			if err != nil {
+				return nil, true, modelError("Invalid data URI in the model")
+			}
+			return data, true, nil
+		}
+		name, err := url.PathUnescape(uri)
+		if err != nil || strings.Contains(uri, "://") {
+			return nil, false, modelError("The model refers to %q, which is not a file next to it", uri)
+		}
+		data, err := readFile(name)
+		if errors.Is(err, errBlobNotFound) {
+			return nil, false, modelError("The model refers to %s, which is missing", name)
+		}
+		return data, false, err
+	}
+
+	buffers := make([][]byte, len(doc.Buffers))
+	for i, buffer := range doc.Buffers {
+		if buffer.URI == "" {
+			if i != 0 || bin == nil {
+				return nil, modelError("Buffer %d has no data", i)
+			}
+			buffers[i] = bin
+			continue
+		}
+		data, _, err := load(buffer.URI)
+		if err != nil {
+			return nil, err
+		}
+		buffers[i] = data
+	}
+	bufferView := func(index int) ([]byte, int, error) {
+		if index < 0 || index >= len(doc.BufferViews) {
+			return nil, 0, modelError("Buffer view %d is missing", index)
+		}
+		view := doc.BufferViews[index]
+		if view.Buffer < 0 || view.Buffer >= len(buffers) || view.ByteOffset < 0 || view.ByteLength < 0 ||
+			view.ByteOffset > len(buffers[view.Buffer]) || view.ByteLength > len(buffers[view.Buffer])-view.ByteOffset {
+			return nil, 0, modelError("Buffer view %d is out of bounds", index)
+		}
+		return buffers[view.Buffer][view.ByteOffset : view.ByteOffset+view.ByteLength], view.ByteStride, nil
+	}
+	// accessor returns the bytes of an accessor's first element and the
+	// distance between elements; data is nil for accessors without a buffer
+	// view, which are all zeros
+	accessor := func(index int, types map[int]bool, kind string) (data []byte, stride int, count int, err error) {
+		if index < 0 || index >= len(doc.Accessors) {
+			return nil, 0, 0, modelError("Accessor %d is missing", index)
+		}
+		a := doc.Accessors[index]
+		if !types[a.ComponentType] || a.Type != kind || a.Count < 0 || a.Count > 3*maxModelTriangles {
+			return nil, 0, 0, modelError("Accessor %d has an unsupported layout", index)
+		}
+		if a.BufferView == nil {
+			return nil, 0, a.Count, nil
+		}
+		view, stride, err := bufferView(*a.BufferView)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		element := gltfComponentSizes[a.ComponentType] * gltfTypeComponents[a.Type]
+		if stride == 0 {
+			stride = element
+		}
+		// models stored before uploads checked strides may still have bad ones
+		if stride < element || stride > 252 {
+			return nil, 0, 0, modelError("Accessor %d has an invalid byte stride", index)
+		}
+		if a.ByteOffset < 0 || a.ByteOffset > len(view) ||
+			(a.Count > 0 && a.ByteOffset+(a.Count-1)*stride+element > len(view)) {
+			return nil, 0, 0, modelError("Accessor %d reads past its buffer view", index)
+		}
+		return view[a.ByteOffset:], stride, a.Count, nil
+	}
+	positions := func(index int) ([]vec3, error) {
+		data, stride, count, err := accessor(index, map[int]bool{5126: true}, "VEC3")
+		if err != nil {
+			return nil, err
+		}
+		out := make([]vec3, count)
+		if data == nil {
+			return out, nil
+		}
+		for i := range out {
+			for c := 0; c < 3; c++ {
+				out[i][c] = float64(math.Float32frombits(le.Uint32(data[i*stride+4*c:])))
+			}
+		}
+		return out, nil
+	}
+	indices := func(index int) ([]int, error) {
+		data, stride, count, err := accessor(index, map[int]bool{5121: true, 5123: true, 5125: true}, "SCALAR")
+		if err != nil {
+			return nil, err
+		}
+		out := make([]int, count)
+		if data == nil {
+			return out, nil
+		}
+		componentType := doc.Accessors[index].ComponentType
+		for i := range out {
+			switch componentType {
+			case 5121:
+				out[i] = int(data[i*stride])
+			case 5123:
+				out[i] = int(le.Uint16(data[i*stride:]))
+			default:
+				out[i] = int(le.Uint32(data[i*stride:]))
+			}
+		}
+		return out, nil
+	}
+
+	scene := &modelScene{}
+	averages := make([]*vec3, len(doc.Images))
+	for i, img := range doc.Images {
+		var data []byte
+		embedded := true
+		var err error
+		if img.URI != "" {
+			data, embedded, err = load(img.URI)
+		} else if img.BufferView != nil {
+			data, _, err = bufferView(*img.BufferView)
+		}
+		// a missing texture still leaves a model worth showing
+		if err != nil && !errors.Is(err, errInvalidModel) {
+			return nil, err
+		}
+		var texture ModelTexture
+		texture, averages[i] = textureInfo(img.Name, img.MimeType, data, embedded)
+		scene.Textures = append(scene.Textures, texture)
+	}
+	for _, m := range doc.Materials {
+		pbr := m.PBRMetallicRoughness
+		material := ModelMaterial{Name: m.Name, BaseColor: [4]float64{1, 1, 1, 1}, Metallic: 1, Roughness: 1, DoubleSided: m.DoubleSided}
+		if len(pbr.BaseColorFactor) == 4 {
+			copy(material.BaseColor[:], pbr.BaseColorFactor)
+		}
+		if pbr.MetallicFactor != nil {
+			material.Metallic = *pbr.MetallicFactor
+		}
+		if pbr.RoughnessFactor != nil {
+			material.Roughness = *pbr.RoughnessFactor
+		}
+		shade := vec3{material.BaseColor[0], material.BaseColor[1], material.BaseColor[2]}
+		if t := pbr.BaseColorTexture; t != nil && t.Index >= 0 && t.Index < len(doc.Textures) {
+			if source := doc.Textures[t.Index].Source; source != nil && *source >= 0 && *source < len(doc.Images) {
+				image := *source
+				material.Texture = &image
+				if average := averages[image]; average != nil {
+					shade = vec3{shade[0] * average[0], shade[1] * average[1], shade[2] * average[2]}
+				}
+			}
+		}
+		scene.Materials = append(scene.Materials, material)
+		scene.colors = append(scene.colors, shade)
+	}
+
+	addMesh := func(index int, transform mat4) error {
+		if index < 0 || index >= len(doc.Meshes) {
+			return modelError("Mesh %d is missing", index)
+		}
+		for _, primitive := range doc.Meshes[index].Primitives {
+			position, ok := primitive.Attributes["POSITION"]
+			if !ok {
+				continue
+			}
+			points, err := positions(position)
+			if err != nil {
+				return err
+			}
+			scene.Vertices += len(points)
+			order := make([]int, len(points))
+			for i := range order {
+				order[i] = i
+			}
+			if primitive.Indices != nil {
+				if order, err = indices(*primitive.Indices); err != nil {
+					return err
+				}
+			}
+			material := -1
+			if primitive.Material != nil && *primitive.Material >= 0 && *primitive.Material < len(scene.Materials) {
+				material = *primitive.Material
+			}
+			mode := 4
+			if primitive.Mode != nil {
+				mode = *primitive.Mode
+			}
+			triangle := func(a, b, c int) error {
+				if a >= len(points) || b >= len(points) || c >= len(points) {
+					return modelError("Mesh %d has an index past its vertices", index)
+				}
+				return scene.addTriangle(modelTriangle{
+					P:        [3]vec3{transform.apply(points[a]), transform.apply(points[b]), transform.apply(points[c])},
+					Material: material,
+				})
+			}
+			switch mode {
+			case 4: // triangles
+				for i := 0; i+2 < len(order); i += 3 {
+					if err := triangle(order[i], order[i+1], order[i+2]); err != nil {
+						return err
+					}
+				}
+			case 5: // strip
+				for i := 0; i+2 < len(order); i++ {
+					a, b := order[i], order[i+1]
+					if i%2 == 1 {
+						a, b = b, a
+					}
+					if err := triangle(a, b, order[i+2]); err != nil {
+						return err
+					}
+				}
+			case 6: // fan
+				for i := 1; i+1 < len(order); i++ {
+					if err := triangle(order[0], order[i], order[i+1]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	visited := make([]bool, len(doc.Nodes))
+	var visit func(index int, parent mat4) error
+	visit = func(index int, parent mat4) error {
+		if index < 0 || index >= len(doc.Nodes) || visited[index] {
+			return modelError("The node hierarchy is invalid")
+		}
+		visited[index] = true
+		node := doc.Nodes[index]
+		local := trsMatrix(node.Translation, node.Rotation, node.Scale)
+		if len(node.Matrix) == 16 {
+			copy(local[:], node.Matrix)
+		}
+		transform := parent.mul(local)
+		if node.Mesh != nil {
+			if err := addMesh(*node.Mesh, transform); err != nil {
+				return err
+			}
+		}
+		for _, child := range node.Children {
+			if err := visit(child, transform); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// draw the default scene, else every root node, else every mesh as is
+	var roots []int
+	switch {
+	case len(doc.Scenes) > 0:
+		index := 0
+		if doc.Scene != nil {
+			index = *doc.Scene
+		}
+		if index < 0 || index >= len(doc.Scenes) {
+			return nil, modelError("Scene %d is missing", index)
+		}
+		roots = doc.Scenes[index].Nodes
+	case len(doc.Nodes) > 0:
+		child := make([]bool, len(doc.Nodes))
+		for _, node := range doc.Nodes {
+			for _, c := range node.Children {
+				if c >= 0 && c < len(child) {
+					child[c] = true
+				}
+			}
+		}
+		for i := range doc.Nodes {
+			if !child[i] {
+				roots = append(roots, i)
+			}
+		}
+	default:
+		for i := range doc.Meshes {
+			if err := addMesh(i, identity4); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, root := range roots {
+		if err := visit(root, identity4); err != nil {
+			return nil, err
+		}
+	}
+	return scene, nil
+}
+
+// objScene reads the vertices, faces and materials of an OBJ model
+func objScene(data []byte, material string, readFile func(string) ([]byte, error)) (*modelScene, error) {
+	scene := &modelScene{}
+	materials := map[string]int{}
+
+	if material != "" {
+		library, err := readFile(material)
+		if err != nil && !errors.Is(err, errBlobNotFound) {
+			return nil, err
+		}
+		var averages []*vec3
+		scanner := bufio.NewScanner(bytes.NewReader(library))
+		current := -1
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			switch {
+			case fields[0] == "newmtl":
+				current = len(scene.Materials)
+				materials[fields[1]] = current
+				scene.Materials = append(scene.Materials, ModelMaterial{Name: fields[1], BaseColor: [4]float64{1, 1, 1, 1}, Roughness: 1})
+				averages = append(averages, nil)
+			case current < 0:
+			case fields[0] == "Kd" && len(fields) >= 4:
+				for i := 0; i < 3; i++ {
+					scene.Materials[current].BaseColor[i], _ = strconv.ParseFloat(fields[i+1], 64)
+				}
+			case fields[0] == "d":
+				scene.Materials[current].BaseColor[3], _ = strconv.ParseFloat(fields[1], 64)
+			case fields[0] == "map_Kd":
+				// the file is the last argument, after any options
+				name := strings.ReplaceAll(fields[len(fields)-1], "\\", "/")
+				image, err := readFile(name)
+				if err != nil && !errors.Is(err, errBlobNotFound) && !errors.Is(err, errInvalidModel) {
+					return nil, err
+				}
+				texture, average := textureInfo(path.Base(name), "", image, false)
+				index := len(scene.Textures)
+				scene.Textures = append(scene.Textures, texture)
+				scene.Materials[current].Texture = &index
+				averages[current] = average
+			}
+		}
+		for i, m := range scene.Materials {
+			shade := vec3{m.BaseColor[0], m.BaseColor[1], m.BaseColor[2]}
+			if average := averages[i]; average != nil {
+				shade = vec3{shade[0] * average[0], shade[1] * average[1], shade[2] * average[2]}
+			}
+			scene.colors = append(scene.colors, shade)
+		}
+	}
+
+	var points []vec3
+	current := -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "v":
+			var p vec3
+			for i := 0; i < 3 && i+1 < len(fields); i++ {
+				p[i], _ = strconv.ParseFloat(fields[i+1], 64)
+			}
+			points = append(points, p)
+		case "usemtl":
+			current = -1
+			if index, ok := materials[strings.Join(fields[1:], " ")]; ok {
+				current = index
+			}
+		case "f":
+			corners := make([]int, 0, len(fields)-1)
+			for _, field := range fields[1:] {
+				vertex, _, _ := strings.Cut(field, "/")
+				index, err := strconv.Atoi(vertex)
+				if index < 0 {
+					index += len(points) + 1
+				}
+				if err != nil || index < 1 || index > len(points) {
+					return nil, modelError("The OBJ has a face with an invalid vertex %q", field)
+				}
+				corners = append(corners, index-1)
+			}
+			for i := 1; i+1 < len(corners); i++ {
+				err := scene.addTriangle(modelTriangle{
+					P:        [3]vec3{points[corners[0]], points[corners[i]], points[corners[i+1]]},
+					Material: current,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, modelError("The OBJ could not be read: %v", err)
+	}
+	scene.Vertices = len(points)
+	return scene, nil
+}
+
+// renderScene draws a scene from the front right and a little above, flat
+// shaded with one light, on a transparent background
+func renderScene(scene *modelScene, size int) *image.NRGBA {
+	out := image.NewNRGBA(image.Rect(0, 0, size, size))
+	if len(scene.Triangles) == 0 {
+		return out
+	}
+	n := size * previewSupersample
+
+	// turn the model 35 degrees and tilt it 20 degrees towards the camera,
+	// which looks down -z
+	yaw, pitch := 35*math.Pi/180, 20*math.Pi/180
+	cy, sy, cp, sp := math.Cos(yaw), math.Sin(yaw), math.Cos(pitch), math.Sin(pitch)
+	view := func(p vec3) vec3 {
+		x := p[0]*cy + p[2]*sy
+		z := -p[0]*sy + p[2]*cy
+		return vec3{x, p[1]*cp - z*sp, p[1]*sp + z*cp}
+	}
+
+	// fit the turned model into the image with a small margin
+	min, max := view(scene.Triangles[0].P[0]), view(scene.Triangles[0].P[0])
+	for _, t := range scene.Triangles {
+		for _, p := range t.P {
+			v := view(p)
+			min = vec3{math.Min(min[0], v[0]), math.Min(min[1], v[1]), 0}
+			max = vec3{math.Max(max[0], v[0]), math.Max(max[1], v[1]), 0}
+		}
+	}
+	extent := math.Max(max[0]-min[0], max[1]-min[1])
+	if extent == 0 {
+		extent = 1
+	}
+	scale := float64(n) * 0.9 / extent
+	midX, midY := (min[0]+max[0])/2, (min[1]+max[1])/2
+	screen := func(p vec3) vec3 {
+		return vec3{float64(n)/2 + (p[0]-midX)*scale, float64(n)/2 - (p[1]-midY)*scale, p[2]}
+	}
+	light := vec3{-0.4, 0.7, 0.6}.normalize()
+
+	depth := make([]float64, n*n)
+	for i := range depth {
+		depth[i] = math.Inf(-1)
+	}
+	colors := make([]vec3, n*n)
+	for _, t := range scene.Triangles {
+		a, b, c := view(t.P[0]), view(t.P[1]), view(t.P[2])
+		// the normal is flipped to face the camera so that models with
+		// inconsistent winding still look solid
+		normal := b.sub(a).cross(c.sub(a)).normalize()
+		if normal[2] < 0 {
+			normal = vec3{-normal[0], -normal[1], -normal[2]}
+		}
+		base := vec3{0.7, 0.7, 0.7}
+		if t.Material >= 0 && t.Material < len(scene.colors) {
+			base = scene.colors[t.Material]
+		}
+		shade := 0.3 + 0.7*math.Max(0, normal.dot(light))
+		color := vec3{base[0] * shade, base[1] * shade, base[2] * shade}
+
+		a, b, c = screen(a), screen(b), screen(c)
+		area := (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+		if math.Abs(area) < 1e-12 {
+			continue
+		}
+		minX := int(math.Max(0, math.Floor(math.Min(a[0], math.Min(b[0], c[0])))))
+		maxX := int(math.Min(float64(n-1), math.Ceil(math.Max(a[0], math.Max(b[0], c[0])))))
+		minY := int(math.Max(0, math.Floor(math.Min(a[1], math.Min(b[1], c[1])))))
+		maxY := int(math.Min(float64(n-1), math.Ceil(math.Max(a[1], math.Max(b[1], c[1])))))
+		for y := minY; y <= maxY; y++ {
+			py := float64(y) + 0.5
+			for x := minX; x <= maxX; x++ {
+				px := float64(x) + 0.5
+				w0 := ((b[0]-px)*(c[1]-py) - (b[1]-py)*(c[0]-px)) / area
+				w1 := ((c[0]-px)*(a[1]-py) - (c[1]-py)*(a[0]-px)) / area
+				w2 := 1 - w0 - w1
+				if w0 < 0 || w1 < 0 || w2 < 0 {
+					continue
+				}
+				z := w0*a[2] + w1*b[2] + w2*c[2]
+				if i := y*n + x; z > depth[i] {
+					depth[i] = z
+					colors[i] = color
+				}
+			}
+		}
+	}
+
+	samples := float64(previewSupersample * previewSupersample)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var sum vec3
+			covered := 0
+			for sy := 0; sy < previewSupersample; sy++ {
+				for sx := 0; sx < previewSupersample; sx++ {
+					i := (y*previewSupersample+sy)*n + x*previewSupersample + sx
+					if math.IsInf(depth[i], -1) {
+						continue
+					}
+					sum = vec3{sum[0] + colors[i][0], sum[1] + colors[i][1], sum[2] + colors[i][2]}
+					covered++
+				}
+			}
+			if covered == 0 {
+				continue
+			}
+			k := float64(covered)
+			out.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(linearToSRGB(sum[0]/k)*255 + 0.5),
+				G: uint8(linearToSRGB(sum[1]/k)*255 + 0.5),
+				B: uint8(linearToSRGB(sum[2]/k)*255 + 0.5),
+				A: uint8(k/samples*255 + 0.5),
+			})
+		}
+	}
+	return out
+}
+
+// modelPreviewName is where the preview of a model is kept, relative to the
+// 3d_images folder
+func modelPreviewName(file string) string {
+	name := strings.TrimSuffix(file, path.Ext(file))
+	return "previews/" + strings.ReplaceAll(name, "/", "-") + ".png"
+}
+
+type modelPreviewJob struct {
+	ProductID int `json:"product_id,omitempty"`
+}
+
+// queueModelPreview schedules reading and rendering a product's new model
+func queueModelPreview(productID int) error {
+	_, err := EnqueueJob(JobModelPreview, modelPreviewJob{ProductID: productID})
+	return err
+}
+
+// renderModelPreviewsJob reads and renders the models that have no metadata
+// yet: the product's in the payload, or all of them when run on schedule,
+// which picks up models linked by migration
+func renderModelPreviewsJob(ctx context.Context, payload json.RawMessage) error {
+	var job modelPreviewJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	query := "SELECT product_id, format, file, material FROM product_models WHERE metadata = ''"
+	var args []interface{}
+	if job.ProductID != 0 {
+		query += " AND product_id = ?"
+		args = append(args, job.ProductID)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	var models []ProductModel
+	for rows.Next() {
+		var m ProductModel
+		if err := rows.Scan(&m.ProductID, &m.Format, &m.File, &m.Material); err != nil {
+			rows.Close()
+			return err
+		}
+		models = append(models, m)
+	}
+	rows.Close()
+
+	for _, m := range models {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := renderModelPreview(db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderModelPreview stores the metadata and preview of one model. Models
+// that cannot be read get the reason as their metadata, so they are not
+// tried again.
+func renderModelPreview(db *sql.DB, m ProductModel) error {
+	scene, err := loadModelScene(m.Format, m.File, m.Material)
+	if errors.Is(err, errBlobNotFound) {
+		err = modelError("The model file is missing")
+	}
+	if errors.Is(err, errInvalidModel) {
+		slog.Warn("cannot read 3D model", "product_id", m.ProductID, "file", m.File, "error", err)
+		failed, _ := json.Marshal(map[string]string{"error": strings.TrimPrefix(err.Error(), errInvalidModel.Error()+": ")})
+		_, err = db.Exec("UPDATE product_models SET metadata = ? WHERE product_id = ? AND file = ?", string(failed), m.ProductID, m.File)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	meta := scene.metadata()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderScene(scene, previewSize)); err != nil {
+		return err
+	}
+	preview := modelPreviewName(m.File)
+	if err := putUpload(Store3DPath, preview, buf.Bytes()); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec(`
+		UPDATE product_models SET metadata = ?, preview = ?, triangles = ?, vertices = ?
+		WHERE product_id = ? AND file = ?
+	`, string(encoded), preview, meta.Triangles, meta.Vertices, m.ProductID, m.File)
+	if err != nil {
+		return err
+	}
+	// the model was replaced while it was being rendered
+	if n, _ := result.RowsAffected(); n == 0 {
+		removeUpload(Store3DPath, preview)
+		return nil
+	}
+	slog.Info("rendered 3D model preview", "product_id", m.ProductID, "file", m.File, "triangles", meta.Triangles)
+	return nil
+}
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+// Models stored before uploads checked strides must fail the preview job
+// cleanly instead of panicking in it
+func TestGLTFSceneRejectsBadStrides(t *testing.T) {
+	scene, err := gltfScene(testGLTF(t, nil), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scene.Triangles) != 1 {
+		t.Errorf("scene has %d triangles, want 1", len(scene.Triangles))
+	}
+	for _, stride := range []int{-12, 8, 256} {
+		document := testGLTF(t, func(view, _ map[string]interface{}) { view["byteStride"] = stride })
+		if _, err := gltfScene(document, nil, nil); !errors.Is(err, errInvalidModel) {
+			t.Errorf("byteStride %d: %v, want errInvalidModel", stride, err)
+		}
+	}
+}
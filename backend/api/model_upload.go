@@ -0,0 +1,756 @@
+package api
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// 3D model formats
+const (
+	ModelGLB  = "glb"
+	ModelGLTF = "gltf"
+	ModelOBJ  = "obj"
+)
+
+// Limits for uploaded 3D models
+const (
+	maxModelSize      = 50 << 20  // the uploaded file or zip
+	maxModelUnpacked  = 200 << 20 // everything in a zip once extracted
+	maxModelFiles     = 100       // entries in a zip
+	maxModelTriangles = 500_000
+)
+
+var errInvalidModel = errors.New("invalid model")
+
+// modelFileTypes are the files a zipped model may contain
+var modelFileTypes = map[string]bool{
+	".gltf": true, ".glb": true, ".bin": true, ".obj": true, ".mtl": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".webp": true,
+}
+
+// ProductModel is the 3D model linked to a product
+type ProductModel struct {
+	ProductID int    `json:"product_id"`
+	Format    string `json:"format"`
+	// File is the main file, relative to the 3d_images folder; models with
+	// several files keep them in a folder of their own
+	File string `json:"file"`
+	// Material is the .mtl of an OBJ model
+	Material  string `json:"material,omitempty"`
+	Size      int64  `json:"size"`
+	Triangles int    `json:"triangles"`
+	Vertices  int    `json:"vertices"`
+	URL       string `json:"url"`
+	ViewerURL string `json:"viewer_url"`
+	// PreviewURL and Metadata are filled in by a job once the model has
+	// been read (see renderModelPreview)
+	PreviewURL string         `json:"preview_url,omitempty"`
+	Metadata   *ModelMetadata `json:"metadata,omitempty"`
+}
+
+// modelPackage is an uploaded model that passed validation: its files keyed
+// by path relative to the main file's folder
+type modelPackage struct {
+	Format    string
+	Main      string
+	Material  string
+	Files     map[string][]byte
+	Triangles int
+	Vertices  int
+}
+
+func modelError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{errInvalidModel}, args...)...)
+}
+
+// parseModelUpload recognises a GLB, a self-contained .gltf or a zip holding
+// a glTF or OBJ model with its buffers, materials and textures, and checks it
+func parseModelUpload(filename string, data []byte) (*modelPackage, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("glTF")):
+		return parseGLB(data, nil)
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return parseModelZip(data)
+	case strings.EqualFold(path.Ext(filename), ".gltf") && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		return parseGLTF(data, "model.gltf", nil, nil)
+	}
+	return nil, modelError("Upload a .glb, a .gltf with embedded buffers, or a .zip with a glTF or OBJ model and its files")
+}
+
+// gltfDocument is the part of a glTF 2.0 document that is validated and
+// rendered
+type gltfDocument struct {
+	Asset struct {
+		Version string `json:"version"`
+	} `json:"asset"`
+	Buffers []struct {
+		URI        string `json:"uri"`
+		ByteLength int    `json:"byteLength"`
+	} `json:"buffers"`
+	BufferViews []struct {
+		Buffer     int `json:"buffer"`
+		ByteOffset int `json:"byteOffset"`
+		ByteLength int `json:"byteLength"`
+		ByteStride int `json:"byteStride"`
+	} `json:"bufferViews"`
+	Accessors []struct {
+		BufferView    *int   `json:"bufferView"`
+		ByteOffset    int    `json:"byteOffset"`
+		ComponentType int    `json:"componentType"`
+		Count         int    `json:"count"`
+		Type          string `json:"type"`
+	} `json:"accessors"`
+	Meshes []struct {
+		Primitives []struct {
+			Attributes map[string]int `json:"attributes"`
+			Indices    *int           `json:"indices"`
+			Mode       *int           `json:"mode"`
+			Material   *int           `json:"material"`
+		} `json:"primitives"`
+	} `json:"meshes"`
+	Images []struct {
+		Name       string `json:"name"`
+		URI        string `json:"uri"`
+		MimeType   string `json:"mimeType"`
+		BufferView *int   `json:"bufferView"`
+	} `json:"images"`
+	Textures []struct {
+		Source *int `json:"source"`
+	} `json:"textures"`
+	Materials []struct {
+		Name                 string `json:"name"`
+		DoubleSided          bool   `json:"doubleSided"`
+		PBRMetallicRoughness struct {
+			BaseColorFactor  []float64 `json:"baseColorFactor"`
+			BaseColorTexture *struct {
+				Index int `json:"index"`
+			} `json:"baseColorTexture"`
+			MetallicFactor  *float64 `json:"metallicFactor"`
+			RoughnessFactor *float64 `json:"roughnessFactor"`
+		} `json:"pbrMetallicRoughness"`
+	} `json:"materials"`
+	Scene  *int `json:"scene"`
+	Scenes []struct {
+		Nodes []int `json:"nodes"`
+	} `json:"scenes"`
+	Nodes []struct {
+		Mesh        *int      `json:"mesh"`
+		Children    []int     `json:"children"`
+		Matrix      []float64 `json:"matrix"`
+		Translation []float64 `json:"translation"`
+		Rotation    []float64 `json:"rotation"`
+		Scale       []float64 `json:"scale"`
+	} `json:"nodes"`
+}
+
+var gltfComponentSizes = map[int]int{5120: 1, 5121: 1, 5122: 2, 5123: 2, 5125: 4, 5126: 4}
+var gltfTypeComponents = map[string]int{"SCALAR": 1, "VEC2": 2, "VEC3": 3, "VEC4": 4, "MAT2": 4, "MAT3": 9, "MAT4": 16}
+
+// splitGLB returns the JSON and the optional BIN chunk of a binary glTF
+func splitGLB(data []byte) ([]byte, []byte, error) {
+	le := binary.LittleEndian
+	if len(data) < 20 || le.Uint32(data[4:]) != 2 {
+		return nil, nil, modelError("Only glTF 2.0 GLB files are supported")
+	}
+	if int(le.Uint32(data[8:])) != len(data) {
+		return nil, nil, modelError("The GLB file is truncated")
+	}
+	jsonLength := int(le.Uint32(data[12:]))
+	if string(data[16:20]) != "JSON" || 20+jsonLength > len(data) {
+		return nil, nil, modelError("The GLB file has no JSON chunk")
+	}
+	document := data[20 : 20+jsonLength]
+	var bin []byte
+	if rest := data[20+jsonLength:]; len(rest) >= 8 && string(rest[4:8]) == "BIN\x00" {
+		binLength := int(le.Uint32(rest))
+		if 8+binLength > len(rest) {
+			return nil, nil, modelError("The GLB file is truncated")
+		}
+		bin = rest[8 : 8+binLength]
+	}
+	return document, bin, nil
+}
+
+// parseGLB checks a binary glTF: the header, the JSON chunk and the optional
+// BIN chunk that the first buffer may refer to
+func parseGLB(data []byte, files map[string][]byte) (*modelPackage, error) {
+	document, bin, err := splitGLB(data)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := parseGLTF(document, "model.glb", bin, files)
+	if err != nil {
+		return nil, err
+	}
+	if files == nil {
+		pkg.Format = ModelGLB
+		pkg.Files = map[string][]byte{"model.glb": data}
+	}
+	return pkg, nil
+}
+
+// parseGLTF checks a glTF document. bin is the GLB's binary chunk, if any;
+// files are the other files of a zipped model, keyed relative to the
+// document, which its URIs may point at. Without files every URI must be a
+// data: URI.
+func parseGLTF(document []byte, name string, bin []byte, files map[string][]byte) (*modelPackage, error) {
+	var doc gltfDocument
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, modelError("The glTF JSON could not be read: %v", err)
+	}
+	if !strings.HasPrefix(doc.Asset.Version, "2.") {
+		return nil, modelError("Only glTF 2.0 models are supported")
+	}
+	if len(doc.Meshes) == 0 {
+		return nil, modelError("The model has no meshes")
+	}
+
+	pkg := &modelPackage{Format: ModelGLTF, Main: name, Files: map[string][]byte{name: document}}
+	load := func(uri string) ([]byte, error) {
+		if strings.HasPrefix(uri, "data:") {
+			comma := strings.Index(uri, ",")
+			if comma < 0 || !strings.HasSuffix(uri[:comma], ";base64") {
+				return nil, modelError("Unsupported data URI in the model")
+			}
+			data, err := base64.StdEncoding.DecodeString(uri[comma+1:])
+			if err != nil {
+				return nil, modelError("Invalid data URI in the model")
+			}
+			return data, nil
+		}
+		file, err := url.PathUnescape(uri)
+		if err != nil || strings.Contains(uri, "://") || !validBlobKey(file) {
+			return nil, modelError("The model refers to %q, which is not a file next to it", uri)
+		}
+		data, ok := files[file]
+		if !ok {
+			return nil, modelError("The model refers to %s, which is missing; upload a zip with the model and all its files", file)
+		}
+		pkg.Files[file] = data
+		return data, nil
+	}
+
+	buffers := make([][]byte, len(doc.Buffers))
+	for i, buffer := range doc.Buffers {
+		var data []byte
+		var err error
+		if buffer.URI == "" {
+			if i != 0 || bin == nil {
+				return nil, modelError("Buffer %d has no data", i)
+			}
+			data = bin
+		} else if data, err = load(buffer.URI); err != nil {
+			return nil, err
+		}
+		if buffer.ByteLength < 0 || len(data) < buffer.ByteLength {
+			return nil, modelError("Buffer %d is shorter than declared", i)
+		}
+		buffers[i] = data
+	}
+	for i, view := range doc.BufferViews {
+		// compared by subtraction, which cannot overflow once both are known
+		// to be positive
+		if view.Buffer < 0 || view.Buffer >= len(buffers) || view.ByteOffset < 0 || view.ByteLength < 0 ||
+			view.ByteOffset > doc.Buffers[view.Buffer].ByteLength ||
+			view.ByteLength > doc.Buffers[view.Buffer].ByteLength-view.ByteOffset {
+			return nil, modelError("Buffer view %d is out of bounds", i)
+		}
+		// glTF allows strides of 4 to 252 bytes in steps of 4, or none for
+		// tightly packed data
+		if view.ByteStride != 0 && (view.ByteStride < 4 || view.ByteStride > 252 || view.ByteStride%4 != 0) {
+			return nil, modelError("Buffer view %d has an invalid byteStride", i)
+		}
+	}
+	for i, accessor := range doc.Accessors {
+		size, ok1 := gltfComponentSizes[accessor.ComponentType]
+		components, ok2 := gltfTypeComponents[accessor.Type]
+		if !ok1 || !ok2 || accessor.Count < 1 {
+			return nil, modelError("Accessor %d is invalid", i)
+		}
+		if accessor.BufferView == nil {
+			continue
+		}
+		if *accessor.BufferView < 0 || *accessor.BufferView >= len(doc.BufferViews) {
+			return nil, modelError("Accessor %d uses a missing buffer view", i)
+		}
+		view := doc.BufferViews[*accessor.BufferView]
+		element := size * components
+		stride := view.ByteStride
+		if stride == 0 {
+			stride = element
+		}
+		if stride < element {
+			return nil, modelError("Accessor %d is wider than the byteStride of its buffer view", i)
+		}
+		// the room after the first element must hold count-1 strides
+		room := view.ByteLength - element
+		if accessor.ByteOffset < 0 || accessor.ByteOffset > room || accessor.Count-1 > (room-accessor.ByteOffset)/stride {
+			return nil, modelError("Accessor %d reads past its buffer view", i)
+		}
+	}
+	for i, image := range doc.Images {
+		if image.URI != "" {
+			data, err := load(image.URI)
+			if err != nil {
+				return nil, err
+			}
+			if format := sniffImage(data); format != FormatPNG && format != FormatJPEG && format != FormatWebP {
+				return nil, modelError("Texture %d is not a PNG, JPEG or WebP image", i)
+			}
+		} else if image.BufferView == nil || *image.BufferView < 0 || *image.BufferView >= len(doc.BufferViews) {
+			return nil, modelError("Texture %d has no data", i)
+		}
+	}
+
+	accessorCount := func(index int) (int, bool) {
+		if index < 0 || index >= len(doc.Accessors) {
+			return 0, false
+		}
+		return doc.Accessors[index].Count, true
+	}
+	for m, mesh := range doc.Meshes {
+		for _, primitive := range mesh.Primitives {
+			position, ok := primitive.Attributes["POSITION"]
+			vertices, valid := accessorCount(position)
+			if !ok || !valid {
+				return nil, modelError("Mesh %d has a primitive without positions", m)
+			}
+			pkg.Vertices += vertices
+			count := vertices
+			if primitive.Indices != nil {
+				if count, valid = accessorCount(*primitive.Indices); !valid {
+					return nil, modelError("Mesh %d uses missing indices", m)
+				}
+			}
+			mode := 4
+			if primitive.Mode != nil {
+				mode = *primitive.Mode
+			}
+			switch mode {
+			case 4: // triangles
+				pkg.Triangles += count / 3
+			case 5, 6: // strip, fan
+				if count > 2 {
+					pkg.Triangles += count - 2
+				}
+			}
+		}
+	}
+	if pkg.Triangles > maxModelTriangles {
+		return nil, modelError("The model has %d triangles; the limit is %d", pkg.Triangles, maxModelTriangles)
+	}
+	return pkg, nil
+}
+
+// parseOBJ counts the vertices and faces of an OBJ model and checks that its
+// material library and the textures it uses are in files
+func parseOBJ(data []byte, name string, files map[string][]byte) (*modelPackage, error) {
+	pkg := &modelPackage{Format: ModelOBJ, Main: name, Files: map[string][]byte{name: data}}
+	require := func(file string, what string) error {
+		file = path.Clean(strings.ReplaceAll(file, "\\", "/"))
+		if !validBlobKey(file) {
+			return modelError("The model refers to %s %q, which is not a file next to it", what, file)
+		}
+		data, ok := files[file]
+		if !ok {
+			return modelError("The %s %s is missing from the zip", what, file)
+		}
+		pkg.Files[file] = data
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "v":
+			pkg.Vertices++
+		case "f":
+			if len(fields) < 4 {
+				return nil, modelError("The OBJ has a face with fewer than 3 vertices")
+			}
+			pkg.Triangles += len(fields) - 3
+		case "mtllib":
+			if pkg.Material != "" || len(fields) < 2 {
+				continue
+			}
+			material := strings.Join(fields[1:], " ")
+			if err := require(material, "material library"); err != nil {
+				return nil, err
+			}
+			pkg.Material = path.Clean(material)
+		}
+		if pkg.Triangles > maxModelTriangles {
+			return nil, modelError("The model has more than %d triangles", maxModelTriangles)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, modelError("The OBJ could not be read: %v", err)
+	}
+	if pkg.Triangles == 0 {
+		return nil, modelError("The OBJ has no faces")
+	}
+
+	if pkg.Material != "" {
+		scanner := bufio.NewScanner(bytes.NewReader(pkg.Files[pkg.Material]))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			if strings.HasPrefix(fields[0], "map_") || fields[0] == "bump" || fields[0] == "disp" || fields[0] == "norm" {
+				// the texture is the last argument, after any options
+				texture := fields[len(fields)-1]
+				if err := require(texture, "texture"); err != nil {
+					return nil, err
+				}
+				if format := sniffImage(pkg.Files[path.Clean(texture)]); format != FormatPNG && format != FormatJPEG && format != FormatWebP {
+					return nil, modelError("The texture %s is not a PNG, JPEG or WebP image", texture)
+				}
+			}
+		}
+	}
+	return pkg, nil
+}
+
+// parseModelZip unpacks a zipped model with care (sizes, entry count, paths)
+// and checks the one glTF, GLB or OBJ file inside it
+func parseModelZip(data []byte) (*modelPackage, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, modelError("The zip could not be read: %v", err)
+	}
+	if len(archive.File) > maxModelFiles {
+		return nil, modelError("The zip has more than %d files", maxModelFiles)
+	}
+	files := map[string][]byte{}
+	var mains []string
+	var unpacked int64
+	for _, entry := range archive.File {
+		name := entry.Name
+		if entry.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		if !validBlobKey(name) {
+			return nil, modelError("The zip has an unsafe path %q", name)
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if !modelFileTypes[ext] {
+			return nil, modelError("The zip may only hold glTF, GLB, OBJ, MTL, BIN and image files, not %s", name)
+		}
+		unpacked += int64(entry.UncompressedSize64)
+		if unpacked > maxModelUnpacked {
+			return nil, modelError("The zip unpacks to more than %d MB", maxModelUnpacked>>20)
+		}
+		r, err := entry.Open()
+		if err != nil {
+			return nil, modelError("The zip could not be read: %v", err)
+		}
+		// the declared size may lie, so never read more than it
+		content, err := io.ReadAll(io.LimitReader(r, int64(entry.UncompressedSize64)+1))
+		r.Close()
+		if err != nil || int64(len(content)) != int64(entry.UncompressedSize64) {
+			return nil, modelError("The zip entry %s is corrupt", name)
+		}
+		files[name] = content
+		if ext == ".gltf" || ext == ".glb" || ext == ".obj" {
+			mains = append(mains, name)
+		}
+	}
+	if len(mains) != 1 {
+		return nil, modelError("The zip must hold exactly one .gltf, .glb or .obj model (found %d)", len(mains))
+	}
+
+	// URIs and material paths are relative to the model file
+	main := mains[0]
+	dir := path.Dir(main)
+	relative := map[string][]byte{}
+	for name, content := range files {
+		if dir == "." {
+			relative[name] = content
+		} else if strings.HasPrefix(name, dir+"/") {
+			relative[strings.TrimPrefix(name, dir+"/")] = content
+		}
+	}
+	base := path.Base(main)
+	switch strings.ToLower(path.Ext(main)) {
+	case ".glb":
+		pkg, err := parseGLB(files[main], relative)
+		if err != nil {
+			return nil, err
+		}
+		pkg.Format, pkg.Main = ModelGLB, base
+		delete(pkg.Files, "model.glb")
+		pkg.Files[base] = files[main]
+		return pkg, nil
+	case ".gltf":
+		return parseGLTF(files[main], base, nil, relative)
+	default:
+		return parseOBJ(files[main], base, relative)
+	}
+}
+
+// modelURL is where the viewer and browsers load a model file from
+func modelURL(file string) string {
+	return "/3d_images/" + (&url.URL{Path: file}).EscapedPath()
+}
+
+func modelViewerURL(file string) string {
+	return "/3dview.html?model=" + url.QueryEscape(file)
+}
+
+// productModelColumns are the product_models columns read by scanProductModel
+const productModelColumns = "product_id, format, file, material, size, triangles, vertices, metadata, preview"
+
+// scanProductModel reads a product_models row selected as productModelColumns
+// followed by extra
+func scanProductModel(row interface{ Scan(...interface{}) error }, extra ...interface{}) (ProductModel, error) {
+	var m ProductModel
+	var metadata, preview string
+	err := row.Scan(append([]interface{}{&m.ProductID, &m.Format, &m.File, &m.Material, &m.Size, &m.Triangles, &m.Vertices, &metadata, &preview}, extra...)...)
+	m.URL = modelURL(m.File)
+	m.ViewerURL = modelViewerURL(m.File)
+	if preview != "" {
+		m.PreviewURL = modelURL(preview)
+	}
+	if metadata != "" {
+		m.Metadata = &ModelMetadata{}
+		json.Unmarshal([]byte(metadata), m.Metadata)
+	}
+	return m, err
+}
+
+// storeModel writes a validated model to the blob store and returns its
+// main file. Single-file models are stored as <uuid>.<ext>, others in a
+// <uuid>/ folder.
+func storeModel(pkg *modelPackage) (string, string, int64, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", "", 0, err
+	}
+	var size int64
+	for _, content := range pkg.Files {
+		size += int64(len(content))
+	}
+	if len(pkg.Files) == 1 {
+		name := id.String() + strings.ToLower(path.Ext(pkg.Main))
+		return name, "", size, putUpload(Store3DPath, name, pkg.Files[pkg.Main])
+	}
+	folder := id.String()
+	for name, content := range pkg.Files {
+		if err := putUpload(Store3DPath, folder+"/"+name, content); err != nil {
+			removeModelFiles(folder + "/" + pkg.Main)
+			return "", "", 0, err
+		}
+	}
+	material := ""
+	if pkg.Material != "" {
+		material = folder + "/" + pkg.Material
+	}
+	return folder + "/" + pkg.Main, material, size, nil
+}
+
+// removeModelFiles deletes a stored model: its folder, or its single file,
+// and its preview
+func removeModelFiles(file string) {
+	removeUpload(Store3DPath, modelPreviewName(file))
+	folder, _, nested := strings.Cut(file, "/")
+	if !nested {
+		removeUpload(Store3DPath, file)
+		return
+	}
+	blobs, err := currentBlobStore().List(blobKey(Store3DPath, folder) + "/")
+	if err != nil {
+		return
+	}
+	for _, blob := range blobs {
+		currentBlobStore().Delete(blob.Key)
+	}
+}
+
+func writeModelError(w http.ResponseWriter, r *http.Request, productID int, err error) {
+	if errors.Is(err, errInvalidModel) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, invalidMessage(err, errInvalidModel))
+		return
+	}
+	Logger(r).Error("product model update failed", "product_id", productID, "error", err)
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save the 3D model")
+}
+
+// UploadProductModel links a 3D model to a product, replacing any previous
+// one: POST /api/products/model/upload as multipart with product_id and a
+// model file (.glb, .gltf or .zip)
+func UploadProductModel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxModelSize+1<<20)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, fmt.Sprintf("The model must be at most %d MB", maxModelSize>>20))
+		return
+	}
+	productID, _ := strconv.Atoi(r.FormValue("product_id"))
+	file, header, err := r.FormFile("model")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "No model uploaded")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxModelSize+1))
+	file.Close()
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, "Failed to read the upload")
+		return
+	}
+	if len(data) > maxModelSize {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, fmt.Sprintf("The model must be at most %d MB", maxModelSize>>20))
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+	storeID, ok := mediaProduct(w, r, db, productID)
+	if !ok {
+		return
+	}
+
+	pkg, err := parseModelUpload(header.Filename, data)
+	if err != nil {
+		writeModelError(w, r, productID, err)
+		return
+	}
+	main, material, size, err := storeModel(pkg)
+	if err != nil {
+		writeModelError(w, r, productID, err)
+		return
+	}
+
+	var previous string
+	db.QueryRow("SELECT file FROM product_models WHERE product_id = ?", productID).Scan(&previous)
+	_, err = db.Exec(`
+		INSERT INTO product_models (product_id, format, file, material, size, triangles, vertices)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(product_id) DO UPDATE SET format = excluded.format, file = excluded.file,
+			material = excluded.material, size = excluded.size, triangles = excluded.triangles,
+			vertices = excluded.vertices, metadata = '', preview = '', created_at = CURRENT_TIMESTAMP
+	`, productID, pkg.Format, main, material, size, pkg.Triangles, pkg.Vertices)
+	if err != nil {
+		removeModelFiles(main)
+		writeModelError(w, r, productID, err)
+		return
+	}
+	if previous != "" && previous != main {
+		removeModelFiles(previous)
+	}
+	Logger(r).Info("product model uploaded", "product_id", productID, "format", pkg.Format,
+		"triangles", pkg.Triangles, "size", size)
+	if err := queueModelPreview(productID); err != nil {
+		Logger(r).Warn("failed to queue model preview", "product_id", productID, "error", err)
+	}
+	PublishEvent(Event{Type: EventProductUpdated, StoreID: storeID, Data: map[string]interface{}{"product_id": productID}})
+
+	model, _ := scanProductModel(db.QueryRow("SELECT "+productModelColumns+" FROM product_models WHERE product_id = ?", productID))
+	json.NewEncoder(w).Encode(map[string]interface{}{"model": model})
+}
+
+// deleteModelRequest is the body of DeleteProductModel
+type deleteModelRequest struct {
+	ProductID int `json:"product_id"`
+}
+
+// DeleteProductModel unlinks and deletes a product's 3D model:
+// POST /api/products/model/delete with {"product_id"}
+func DeleteProductModel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req deleteModelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+	storeID, ok := mediaProduct(w, r, db, req.ProductID)
+	if !ok {
+		return
+	}
+	var file string
+	if err := db.QueryRow("SELECT file FROM product_models WHERE product_id = ?", req.ProductID).Scan(&file); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "The product has no 3D model")
+		return
+	}
+	if _, err := db.Exec("DELETE FROM product_models WHERE product_id = ?", req.ProductID); err != nil {
+		writeModelError(w, r, req.ProductID, err)
+		return
+	}
+	removeModelFiles(file)
+	PublishEvent(Event{Type: EventProductUpdated, StoreID: storeID, Data: map[string]interface{}{"product_id": req.ProductID}})
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// linkLegacyModels links models that were copied into the 3d_images folder
+// by hand, named after a product image, to their product
+func linkLegacyModels(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, image FROM products WHERE image != ''")
+	if err != nil {
+		return err
+	}
+	images := map[int]string{}
+	for rows.Next() {
+		var id int
+		var image string
+		if err := rows.Scan(&id, &image); err != nil {
+			rows.Close()
+			return err
+		}
+		images[id] = image
+	}
+	rows.Close()
+	for id, image := range images {
+		base := strings.TrimSuffix(path.Base(image), path.Ext(image))
+		for _, ext := range []string{".glb", ".gltf", ".obj", ".fbx", ".usdz"} {
+			info, err := currentBlobStore().Stat(blobKey(Store3DPath, base+ext))
+			if err != nil {
+				continue
+			}
+			if _, err := tx.Exec(`
+				INSERT OR IGNORE INTO product_models (product_id, format, file, size) VALUES (?, ?, ?, ?)
+			`, id, strings.TrimPrefix(ext, "."), base+ext, info.Size); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+// triangleBuffer is one triangle's positions, each followed by four bytes of
+// padding so a stride of 16 can also read it
+func triangleBuffer() []byte {
+	var buf bytes.Buffer
+	for _, v := range [][3]float32{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}} {
+		for _, c := range v {
+			binary.Write(&buf, binary.LittleEndian, math.Float32bits(c))
+		}
+		buf.Write([]byte{0, 0, 0, 0})
+	}
+	return buf.Bytes()
+}
+
+// testGLTF is a one-triangle glTF with an embedded buffer; edit changes the
+// view and the accessor before it is encoded
+func testGLTF(t *testing.T, edit func(view map[string]interface{}, accessor map[string]interface{})) []byte {
+	t.Helper()
+	data := triangleBuffer()
+	view := map[string]interface{}{"buffer": 0, "byteLength": len(data), "byteStride": 16}
+	accessor := map[string]interface{}{"bufferView": 0, "componentType": 5126, "count": 3, "type": "VEC3"}
+	if edit != nil {
+		edit(view, accessor)
+	}
+	document, err := json.Marshal(map[string]interface{}{
+		"asset":       map[string]string{"version": "2.0"},
+		"buffers":     []interface{}{map[string]interface{}{"uri": "data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(data), "byteLength": len(data)}},
+		"bufferViews": []interface{}{view},
+		"accessors":   []interface{}{accessor},
+		"meshes":      []interface{}{map[string]interface{}{"primitives": []interface{}{map[string]interface{}{"attributes": map[string]int{"POSITION": 0}}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return document
+}
+
+// testGLB packs a glTF document and its binary chunk into a GLB
+func testGLB(document []byte, bin []byte) []byte {
+	for len(document)%4 != 0 {
+		document = append(document, ' ')
+	}
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&buf, le, [3]uint32{0x46546C67, 2, uint32(12 + 8 + len(document) + 8 + len(bin))})
+	binary.Write(&buf, le, [2]uint32{uint32(len(document)), 0x4E4F534A})
+	buf.Write(document)
+	binary.Write(&buf, le, [2]uint32{uint32(len(bin)), 0x004E4942})
+	buf.Write(bin)
+	return buf.Bytes()
+}
+
+func TestParseGLTF(t *testing.T) {
+	pkg, err := parseModelUpload("chair.gltf", testGLTF(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Format != ModelGLTF || pkg.Vertices != 3 || pkg.Triangles != 1 {
+		t.Errorf("package = %s with %d vertices and %d triangles", pkg.Format, pkg.Vertices, pkg.Triangles)
+	}
+
+	document, _ := json.Marshal(map[string]interface{}{
+		"asset":       map[string]string{"version": "2.0"},
+		"buffers":     []interface{}{map[string]interface{}{"byteLength": 48}},
+		"bufferViews": []interface{}{map[string]interface{}{"buffer": 0, "byteLength": 48, "byteStride": 16}},
+		"accessors":   []interface{}{map[string]interface{}{"bufferView": 0, "componentType": 5126, "count": 3, "type": "VEC3"}},
+		"meshes":      []interface{}{map[string]interface{}{"primitives": []interface{}{map[string]interface{}{"attributes": map[string]int{"POSITION": 0}}}}},
+	})
+	pkg, err = parseModelUpload("chair.glb", testGLB(document, triangleBuffer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Format != ModelGLB || pkg.Triangles != 1 {
+		t.Errorf("GLB package = %s with %d triangles", pkg.Format, pkg.Triangles)
+	}
+}
+
+func TestParseGLTFRejectsBadLayouts(t *testing.T) {
+	for name, edit := range map[string]func(view map[string]interface{}, accessor map[string]interface{}){
+		"negative stride":       func(view, _ map[string]interface{}) { view["byteStride"] = -12 },
+		"stride below 4":        func(view, _ map[string]interface{}) { view["byteStride"] = 2 },
+		"stride not a multiple": func(view, _ map[string]interface{}) { view["byteStride"] = 14 },
+		"stride above 252":      func(view, _ map[string]interface{}) { view["byteStride"] = 256 },
+		"stride below element":  func(view, _ map[string]interface{}) { view["byteStride"] = 8 },
+		"view past buffer":      func(view, _ map[string]interface{}) { view["byteOffset"] = 4 },
+		"view offset overflow": func(view, _ map[string]interface{}) {
+			view["byteOffset"], view["byteLength"] = int64(1)<<62, int64(1)<<62
+		},
+		"accessor past view":      func(_, accessor map[string]interface{}) { accessor["count"] = 4 },
+		"accessor offset":         func(_, accessor map[string]interface{}) { accessor["byteOffset"] = 8 },
+		"accessor count overflow": func(_, accessor map[string]interface{}) { accessor["count"] = int64(1) << 60 },
+		"unknown component type":  func(_, accessor map[string]interface{}) { accessor["componentType"] = 5130 },
+	} {
+		if _, err := parseModelUpload("chair.gltf", testGLTF(t, edit)); !errors.Is(err, errInvalidModel) {
+			t.Errorf("%s: %v, want errInvalidModel", name, err)
+		}
+	}
+}
@@ -1,11 +1,5 @@
 package api
 
-//Error Response
-type ErrorResponse struct {
-	ErrorNbr int    `json:"error_number"`
-	ErrorMsg string `json:"error_message"`
-}
-
 //Store and Store Display
 type StoreDisplay struct {
 	MyStores  []Store     `json:"my_stores"`
@@ -41,6 +35,9 @@ type Store struct {
 	EstimatedShipping     int       `json:"estimated_shipping"`
 	FreeShippingThreshold float64   `json:"free_shipping_threshold"`
 	IsLoggedIn            bool      `json:"is_logged_in"`
+	Categories            []Category   `json:"categories,omitempty"`
+	Tags                  []string     `json:"tags,omitempty"`
+	Collections           []Collection `json:"collections,omitempty"`
 }
 
 type Product struct {
@@ -53,6 +50,12 @@ type Product struct {
 	Reviews       []Review `json:"reviews,omitempty"`
 	AverageRating float64  `json:"average_rating,omitempty"`
 	ReviewCount   int      `json:"review_count,omitempty"`
+	CategoryID    int              `json:"category_id,omitempty"`
+	Category      string           `json:"category,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+	Options       []ProductOption  `json:"options,omitempty"`
+	Variants      []ProductVariant `json:"variants,omitempty"`
+	Media         []ProductMedia   `json:"media,omitempty"`
 }
 
 type Review struct {
@@ -80,6 +83,8 @@ type Color struct {
 type CartItem struct {
 	ID        int     `json:"id"`
 	ProductID int     `json:"product_id"`
+	VariantID int     `json:"variant_id"`
+	Variant   string  `json:"variant,omitempty"`
 	Quantity  int     `json:"quantity"`
 	Product   Product `json:"product"`
 	ItemTotal float64 `json:"item_total"`
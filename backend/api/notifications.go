@@ -0,0 +1,548 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Notification event types
+const (
+	NotifyOrderStatus = "order_status"
+	NotifyOrderPlaced = "order_placed"
+	NotifyNewReview   = "new_review"
+	NotifyLowStock    = "low_stock"
+	NotifyReturn      = "return_update"
+	NotifyNewReturn   = "return_requested"
+)
+
+// Delivery channels a user can pick per event type
+const (
+	ChannelEmail = "email"
+	ChannelInApp = "in_app"
+	ChannelBoth  = "both"
+	ChannelNone  = "none"
+)
+
+type notificationEvent struct {
+	Type     string `json:"type"`
+	Label    string `json:"label"`
+	Audience string `json:"audience"` // "customer" or "owner"
+	Default  string `json:"default"`
+}
+
+var notificationEvents = []notificationEvent{
+	{NotifyOrderStatus, "Order status updates", "customer", ChannelBoth},
+	{NotifyReturn, "Return and refund updates", "customer", ChannelBoth},
+	{NotifyOrderPlaced, "New paid orders", "owner", ChannelInApp},
+	{NotifyNewReview, "New product reviews", "owner", ChannelInApp},
+	{NotifyLowStock, "Low stock alerts", "owner", ChannelBoth},
+	{NotifyNewReturn, "Return requests", "owner", ChannelInApp},
+}
+
+type Notification struct {
+	ID        int64  `json:"id"`
+	UserID    int    `json:"-"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Link      string `json:"link,omitempty"`
+	Read      bool   `json:"read"`
+	CreatedAt string `json:"created_at"`
+}
+
+// notificationEmail overrides the generic notification email with one of
+// the dedicated templates, e.g. the order status email
+type notificationEmail struct {
+	Kind    string
+	StoreID int
+	Data    map[string]interface{}
+}
+
+func findNotificationEvent(eventType string) (notificationEvent, bool) {
+	for _, event := range notificationEvents {
+		if event.Type == eventType {
+			return event, true
+		}
+	}
+	return notificationEvent{}, false
+}
+
+func validChannel(channel string) bool {
+	switch channel {
+	case ChannelEmail, ChannelInApp, ChannelBoth, ChannelNone:
+		return true
+	}
+	return false
+}
+
+// notificationChannel returns the user's choice for an event, or its default
+func notificationChannel(db *sql.DB, userID int, eventType string) string {
+	var channel string
+	err := db.QueryRow("SELECT channel FROM notification_preferences WHERE user_id = ? AND event_type = ?", userID, eventType).Scan(&channel)
+	if err == nil && validChannel(channel) {
+		return channel
+	}
+	event, _ := findNotificationEvent(eventType)
+	if event.Default == "" {
+		return ChannelBoth
+	}
+	return event.Default
+}
+
+// notify delivers a notification according to the user's preference for its
+// type: stored for the in-app feed and pushed to open websockets, emailed
+// with an unsubscribe link, or both. r may be nil outside a request.
+func notify(r *http.Request, n Notification, email *notificationEmail) {
+	logger := Logger(r).With("user_id", n.UserID, "notification", n.Type)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		logger.Error("failed to open database for notification", "error", err)
+		return
+	}
+	defer db.Close()
+
+	channel := notificationChannel(db, n.UserID, n.Type)
+	if channel == ChannelInApp || channel == ChannelBoth {
+		result, err := db.Exec("INSERT INTO notifications (user_id, type, title, body, link) VALUES (?, ?, ?, ?, ?)",
+			n.UserID, n.Type, n.Title, n.Body, n.Link)
+		if err != nil {
+			logger.Error("failed to store notification", "error", err)
+		} else {
+			n.ID, _ = result.LastInsertId()
+			n.CreatedAt = sqlTime(time.Now())
+			PublishEvent(Event{Type: EventNotificationCreated, UserID: n.UserID, Data: map[string]interface{}{
+				"notification": n,
+				"unread":       unreadNotificationCount(db, n.UserID),
+			}})
+		}
+	}
+
+	if channel == ChannelEmail || channel == ChannelBoth {
+		var address string
+		if err := db.QueryRow("SELECT email FROM users WHERE id = ?", n.UserID).Scan(&address); err != nil || address == "" {
+			logger.Warn("no email address for notification", "error", err)
+			return
+		}
+		if email == nil {
+			email = &notificationEmail{Kind: EmailNotification, Data: map[string]interface{}{
+				"Title": n.Title, "Body": n.Body, "Link": absoluteLink(n.Link),
+			}}
+		}
+		unsubscribe := unsubscribeURL(n.UserID, n.Type)
+		email.Data["UnsubscribeURL"] = unsubscribe
+		msg, err := RenderEmail(email.Kind, storeBranding(email.StoreID), email.Data)
+		if err != nil {
+			logger.Error("failed to render notification email", "error", err)
+			return
+		}
+		msg.Unsubscribe = unsubscribe
+		queueEmail(r, address, msg)
+	}
+}
+
+func absoluteLink(link string) string {
+	if link == "" {
+		return ""
+	}
+	return publicBaseURL() + link
+}
+
+// unsubscribeURL is a signed link that turns off email for one event type
+func unsubscribeURL(userID int, eventType string) string {
+	q := url.Values{}
+	q.Set("u", strconv.Itoa(userID))
+	q.Set("e", eventType)
+	q.Set("sig", signValue("unsubscribe", strconv.Itoa(userID)+":"+eventType))
+	return publicBaseURL() + "/notifications/unsubscribe?" + q.Encode()
+}
+
+// lowStockThreshold is the quantity at which owners are warned (LOW_STOCK_THRESHOLD)
+func lowStockThreshold() int {
+	if n, err := strconv.Atoi(os.Getenv("LOW_STOCK_THRESHOLD")); err == nil && n >= 0 {
+		return n
+	}
+	return 5
+}
+
+// checkLowStock notifies the store owner when a product's stock drops to the
+// threshold, only on the change that crosses it so owners are not spammed.
+func checkLowStock(r *http.Request, productID int, before int, after int) {
+	threshold := lowStockThreshold()
+	if before <= threshold || after > threshold {
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	var ownerID, storeID int
+	var name, storeName string
+	err = db.QueryRow(`
+		SELECT s.owner_id, s.id, s.name, p.name FROM products p JOIN stores s ON p.store_id = s.id WHERE p.id = ?
+	`, productID).Scan(&ownerID, &storeID, &storeName, &name)
+	if err != nil {
+		Logger(r).Warn("low stock lookup failed", "product_id", productID, "error", err)
+		return
+	}
+	PublishEvent(Event{Type: EventLowStock, StoreID: storeID, Data: map[string]interface{}{
+		"product_id": productID,
+		"quantity":   after,
+		"threshold":  threshold,
+	}})
+	notify(r, Notification{
+		UserID: ownerID,
+		Type:   NotifyLowStock,
+		Title:  "Low stock: " + name,
+		Body:   fmt.Sprintf("Only %d left in stock.", after),
+		Link:   "/" + storeName + "/dashboard",
+	}, nil)
+}
+
+// notificationUser authenticates the caller: a store customer when store_id
+// is given, otherwise the platform session user
+func notificationUser(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if storeID := r.URL.Query().Get("store_id"); storeID != "" {
+		return ValidateStoreCustomer(w, r, storeID)
+	}
+	return ValidateUser(w, r)
+}
+
+func unreadNotificationCount(db *sql.DB, userID int) int {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	return count
+}
+
+func recentNotifications(db *sql.DB, userID int, limit int) ([]Notification, error) {
+	rows, err := db.Query(`
+		SELECT id, type, title, body, link, read_at IS NOT NULL, created_at
+		FROM notifications WHERE user_id = ?
+		ORDER BY id DESC LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notifications := []Notification{}
+	for rows.Next() {
+		n := Notification{UserID: userID}
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Body, &n.Link, &n.Read, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// markNotificationsRead marks one notification, or all when id is 0, as read
+func markNotificationsRead(db *sql.DB, userID int, id int64) error {
+	if id == 0 {
+		_, err := db.Exec("UPDATE notifications SET read_at = datetime('now') WHERE user_id = ? AND read_at IS NULL", userID)
+		return err
+	}
+	_, err := db.Exec("UPDATE notifications SET read_at = datetime('now') WHERE id = ? AND user_id = ? AND read_at IS NULL", id, userID)
+	return err
+}
+
+// GetNotifications returns the caller's latest notifications and unread count
+func GetNotifications(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, valid := notificationUser(w, r)
+	if !valid {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+
+	notifications, err := recentNotifications(db, userID, 50)
+	if err != nil {
+		Logger(r).Error("notifications query failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch notifications")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notifications": notifications,
+		"unread":        unreadNotificationCount(db, userID),
+	})
+}
+
+// markReadRequest is the body of MarkNotificationsRead
+type markReadRequest struct {
+	ID  int64 `json:"id"`
+	All bool  `json:"all"`
+}
+
+// MarkNotificationsRead marks {"id": N} or, with {"all": true}, every
+// notification as read
+func MarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	userID, valid := notificationUser(w, r)
+	if !valid {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	var req markReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.ID == 0 && !req.All) {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Notification ID is required")
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+
+	if err := markNotificationsRead(db, userID, req.ID); err != nil {
+		Logger(r).Error("failed to mark notifications read", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update notifications")
+		return
+	}
+	unread := unreadNotificationCount(db, userID)
+	publishUnreadCount(userID, unread)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "unread": unread})
+}
+
+// notificationPreferencesRequest is the body of a NotificationPreferences POST
+type notificationPreferencesRequest struct {
+	Preferences map[string]string `json:"preferences"`
+}
+
+// NotificationPreferences returns (GET) or updates (POST) the caller's
+// channel per event type. POST takes {"preferences": {"order_status": "email"}}.
+func NotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, valid := notificationUser(w, r)
+	if !valid {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+
+	if r.Method == http.MethodPost {
+		var req notificationPreferencesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Preferences) == 0 {
+			writeError(w, r, http.StatusBadRequest, CodeMissingField, "Preferences are required")
+			return
+		}
+		for eventType, channel := range req.Preferences {
+			if _, ok := findNotificationEvent(eventType); !ok || !validChannel(channel) {
+				writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid event type or channel")
+				return
+			}
+		}
+		for eventType, channel := range req.Preferences {
+			_, err := db.Exec(`
+				INSERT INTO notification_preferences (user_id, event_type, channel) VALUES (?, ?, ?)
+				ON CONFLICT(user_id, event_type) DO UPDATE SET channel = excluded.channel
+			`, userID, eventType, channel)
+			if err != nil {
+				Logger(r).Error("failed to save notification preference", "error", err)
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save preferences")
+				return
+			}
+		}
+	} else if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// store customers only see customer events, platform users see all of them
+	audience := "owner"
+	if r.URL.Query().Get("store_id") != "" {
+		audience = "customer"
+	}
+	type preference struct {
+		notificationEvent
+		Channel string `json:"channel"`
+	}
+	preferences := []preference{}
+	for _, event := range notificationEvents {
+		if event.Audience != audience && audience == "customer" {
+			continue
+		}
+		preferences = append(preferences, preference{event, notificationChannel(db, userID, event.Type)})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"preferences": preferences})
+}
+
+// UnsubscribeNotifications handles the signed link in notification emails.
+// It stops email for that event type but keeps in-app notifications. POST is
+// accepted for one-click unsubscribe from mail clients.
+func UnsubscribeNotifications(w http.ResponseWriter, r *http.Request) {
+	userIDStr := r.URL.Query().Get("u")
+	eventType := r.URL.Query().Get("e")
+	userID, err := strconv.Atoi(userIDStr)
+	event, known := findNotificationEvent(eventType)
+	if err != nil || !known || !verifySignature("unsubscribe", userIDStr+":"+eventType, r.URL.Query().Get("sig")) {
+		HandleError(w, r, http.StatusBadRequest, "This unsubscribe link is invalid")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer db.Close()
+
+	channel := ChannelNone
+	if current := notificationChannel(db, userID, eventType); current == ChannelBoth || current == ChannelInApp {
+		channel = ChannelInApp
+	}
+	_, err = db.Exec(`
+		INSERT INTO notification_preferences (user_id, event_type, channel) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, event_type) DO UPDATE SET channel = excluded.channel
+	`, userID, eventType, channel)
+	if err != nil {
+		Logger(r).Error("failed to unsubscribe", "user_id", userID, "event", eventType, "error", err)
+		HandleError(w, r, http.StatusInternalServerError, "Failed to update your preferences")
+		return
+	}
+	Logger(r).Info("unsubscribed from notification emails", "user_id", userID, "event", eventType)
+
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	tmpl, err := template.ParseFiles(FrontendUnsubscribeHTML)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load template")
+		return
+	}
+	tmpl.Execute(w, event)
+}
+
+// publishUnreadCount lets the user's other tabs and devices update their badge
+func publishUnreadCount(userID int, unread int) {
+	PublishEvent(Event{Type: EventNotificationsRead, UserID: userID, Data: map[string]interface{}{"unread": unread}})
+}
+
+// notificationMessage converts a bus event into the websocket message shape
+func notificationMessage(e Event) map[string]interface{} {
+	if e.Type == EventNotificationCreated {
+		return map[string]interface{}{
+			"type":         "notification",
+			"notification": e.Data["notification"],
+			"unread":       e.Data["unread"],
+		}
+	}
+	return map[string]interface{}{"type": "unread", "unread": e.Data["unread"]}
+}
+
+// NotificationsWebSocketHandler streams new notifications and the unread
+// count. Clients may send {"action": "mark_read", "id": N} or
+// {"action": "mark_all_read"}.
+func NotificationsWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	userID, valid := notificationUser(w, r)
+	if !valid {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	websocketConnections.Inc("notifications")
+	defer websocketConnections.Dec("notifications")
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	updates := events.Subscribe(EventFilter{UserID: userID, Types: []string{EventNotificationCreated, EventNotificationsRead}})
+	defer updates.Close()
+
+	notifications, err := recentNotifications(db, userID, 20)
+	if err != nil {
+		Logger(r).Error("notifications query failed", "error", err)
+		return
+	}
+	if err := conn.WriteJSON(map[string]interface{}{
+		"type":          "init",
+		"notifications": notifications,
+		"unread":        unreadNotificationCount(db, userID),
+	}); err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var msg struct {
+				Action string `json:"action"`
+				ID     int64  `json:"id"`
+			}
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			switch msg.Action {
+			case "mark_read", "mark_all_read":
+				id := msg.ID
+				if msg.Action == "mark_all_read" {
+					id = 0
+				} else if id == 0 {
+					continue
+				}
+				if err := markNotificationsRead(db, userID, id); err != nil {
+					Logger(r).Error("failed to mark notifications read", "error", err)
+					continue
+				}
+				publishUnreadCount(userID, unreadNotificationCount(db, userID))
+			}
+		}
+	}()
+
+	pingTicker := time.NewTicker(30 * time.Second)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-updates.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(notificationMessage(e)); err != nil {
+				return
+			}
+		case <-pingTicker.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
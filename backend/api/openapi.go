@@ -0,0 +1,381 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// The OpenAPI document is generated from apiRoutes: request and response
+// schemas are read off the Go types the handlers decode and encode, and the
+// list parameters off each route's ListSpec.
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// OpenAPIHandler serves the OpenAPI 3 document of /api/v1
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(openAPIDocument(apiRoutes()), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIJSON)
+}
+
+func openAPIDocument(routes []APIRoute) map[string]interface{} {
+	schemas := &schemaBuilder{components: map[string]interface{}{}}
+	errorSchema := schemas.of(reflect.ValueOf(errorEnvelope{Error: &APIError{}}))
+
+	paths := map[string]map[string]interface{}{}
+	operationIDs := map[string]int{}
+	for _, route := range routes {
+		name := handlerName(route.Handler)
+		operationIDs[name]++
+		if operationIDs[name] > 1 {
+			name += route.Method[:1] + strings.ToLower(route.Method[1:])
+		}
+		op := map[string]interface{}{
+			"operationId": name,
+			"summary":     route.Summary,
+			"tags":        []string{route.Tag},
+		}
+		if route.Legacy != "" {
+			op["x-legacy-path"] = route.Legacy
+		}
+		if len(route.Auth) > 0 {
+			var security []map[string][]string
+			for _, auth := range route.Auth {
+				if auth == authAdmin {
+					auth = authSession
+					op["description"] = "Admins only."
+				}
+				security = append(security, map[string][]string{auth: {}})
+			}
+			if route.Scope != "" {
+				security = append(security, map[string][]string{authAPIKey: {}})
+			}
+			op["security"] = security
+		}
+		if route.Scope != "" {
+			op["x-scope"] = route.Scope
+		}
+
+		var params []map[string]interface{}
+		for _, m := range pathWildcard.FindAllStringSubmatch(route.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": paramSchema(APIParam{Type: "integer"}),
+			})
+		}
+		query := route.Query
+		if route.List != nil {
+			query = append(append([]APIParam(nil), query...), listParams(*route.List)...)
+		}
+		for _, p := range query {
+			param := map[string]interface{}{"name": p.Name, "in": "query", "schema": paramSchema(p)}
+			if p.Required {
+				param["required"] = true
+			}
+			if p.Description != "" {
+				param["description"] = p.Description
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		switch {
+		case route.Body != nil:
+			op["requestBody"] = jsonBody(schemas.of(reflect.ValueOf(route.Body)))
+		case route.Form != nil:
+			op["requestBody"] = jsonBody(schemas.of(reflect.ValueOf(route.Form)))
+		case len(route.Multipart) > 0:
+			properties := map[string]interface{}{}
+			var required []string
+			for _, p := range route.Multipart {
+				properties[p.Name] = paramSchema(p)
+				if p.Required {
+					required = append(required, p.Name)
+				}
+			}
+			schema := map[string]interface{}{"type": "object", "properties": properties}
+			if len(required) > 0 {
+				schema["required"] = required
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"multipart/form-data": map[string]interface{}{"schema": schema}},
+			}
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case route.Content != "":
+			response["content"] = map[string]interface{}{
+				route.Content: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+			}
+		case route.Response != nil:
+			response["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.of(reflect.ValueOf(route.Response))},
+			}
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(status): response,
+			"default":            map[string]interface{}{"$ref": "#/components/responses/Error"},
+		}
+
+		path := apiPrefix + route.Path
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Marketplace API",
+			"version":     "1.0.0",
+			"description": "Errors are reported as {\"error\": {\"code\", \"message\", \"details\"}}; branch on the code.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "An error",
+					"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				authSession: map[string]interface{}{
+					"type": "apiKey", "in": "cookie", "name": "session_token",
+					"description": "The session of a platform user, set by /auth/verify",
+				},
+				authCustomer: map[string]interface{}{
+					"type": "apiKey", "in": "cookie", "name": "customer_token_{store_id}",
+					"description": "The session of a store customer, one cookie per store, set by /store-auth/verify",
+				},
+				authAPIKey: map[string]interface{}{
+					"type": "http", "scheme": "bearer",
+					"description": "A store API key from /stores/keys/create. It acts as the store's owner on operations whose x-scope it holds; " +
+						"a write scope includes the read scope.",
+				},
+			},
+		},
+	}
+}
+
+func jsonBody(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"required": true,
+		"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+	}
+}
+
+func paramSchema(p APIParam) map[string]interface{} {
+	if p.Type == "file" {
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	}
+	schema := map[string]interface{}{"type": p.Type}
+	if len(p.Enum) > 0 {
+		schema["enum"] = p.Enum
+	}
+	return schema
+}
+
+// listParams are the query parameters a ListSpec accepts; see Parse
+func listParams(spec ListSpec) []APIParam {
+	names := make([]string, 0, len(spec.Fields))
+	for name := range spec.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []APIParam
+	var sorts, facets []string
+	search := false
+	for _, name := range names {
+		field := spec.Fields[name]
+		if field.Filter {
+			param := APIParam{Name: name, Type: "string", Description: "Comma-separated values", Enum: field.Values}
+			if field.Kind == listBool {
+				param = APIParam{Name: name, Type: "boolean"}
+			}
+			params = append(params, param)
+			switch field.Kind {
+			case listInt:
+				params = append(params, APIParam{Name: "min_" + name, Type: "integer"}, APIParam{Name: "max_" + name, Type: "integer"})
+			case listNumber:
+				params = append(params, APIParam{Name: "min_" + name, Type: "number"}, APIParam{Name: "max_" + name, Type: "number"})
+			case listTime:
+				description := "A date (YYYY-MM-DD) or an RFC 3339 time"
+				params = append(params,
+					APIParam{Name: "min_" + name, Type: "string", Description: description},
+					APIParam{Name: "max_" + name, Type: "string", Description: description})
+			}
+		}
+		if field.Sort {
+			sorts = append(sorts, name)
+		}
+		if field.Facet {
+			facets = append(facets, name)
+		}
+		search = search || field.Search
+	}
+	if search {
+		params = append(params, queryParam("q", "string", "Text found in any searchable field"))
+	}
+	params = append(params,
+		queryParam("sort", "string", "Comma-separated fields, - for descending, of "+strings.Join(sorts, ", ")+"; "+spec.Sort+" by default"),
+		queryParam("limit", "integer", "Page size, "+strconv.Itoa(defaultListLimit)+" by default and at most "+strconv.Itoa(maxListLimit)),
+		queryParam("cursor", "string", "The next_cursor of the previous page"),
+	)
+	if len(facets) > 0 {
+		params = append(params, queryParam("facets", "string", "Comma-separated fields to count values of, of "+strings.Join(facets, ", ")))
+	}
+	return params
+}
+
+// schemaBuilder describes Go values as OpenAPI schemas. Named structs
+// become components; structs holding an interface are described inline,
+// since what they hold differs between routes.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (b *schemaBuilder) of(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return map[string]interface{}{}
+	}
+	t := v.Type()
+	if t == reflect.TypeOf(ErrorCode("")) {
+		return map[string]interface{}{"type": "string", "enum": errorCodes}
+	}
+	if t == rawMessageType {
+		// stored JSON documents, such as webhook payloads
+		return map[string]interface{}{"type": "object"}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return map[string]interface{}{}
+		}
+		return b.of(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return b.of(reflect.Zero(t.Elem()))
+		}
+		return b.of(v.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		item := reflect.Zero(t.Elem())
+		if v.Len() > 0 {
+			item = v.Index(0)
+		}
+		return map[string]interface{}{"type": "array", "items": b.of(item)}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface && v.Len() > 0 {
+			properties := map[string]interface{}{}
+			iter := v.MapRange()
+			for iter.Next() {
+				properties[iter.Key().String()] = b.of(iter.Value())
+			}
+			return map[string]interface{}{"type": "object", "properties": properties}
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": b.of(reflect.Zero(t.Elem()))}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" || holdsInterface(t) {
+			return b.object(v)
+		}
+		name := componentName(t)
+		if _, done := b.components[name]; !done {
+			b.components[name] = nil // a placeholder, so recursive types end
+			b.components[name] = b.object(reflect.Zero(t))
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object describes a struct by its JSON fields
+func (b *schemaBuilder) object(v reflect.Value) map[string]interface{} {
+	properties := map[string]interface{}{}
+	b.fields(v, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (b *schemaBuilder) fields(v reflect.Value, properties map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.fields(v.Field(i), properties)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if options == "string" {
+			properties[name] = map[string]interface{}{"type": "string"}
+			continue
+		}
+		properties[name] = b.of(v.Field(i))
+	}
+}
+
+func holdsInterface(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() == reflect.Interface {
+			return true
+		}
+	}
+	return false
+}
+
+// componentName is the type's name, capitalized: the request types are
+// unexported
+func componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
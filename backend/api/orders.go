@@ -5,13 +5,39 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// checkoutRequest is the v1 JSON body of CreateOrder
+type checkoutRequest struct {
+	FullName string `json:"full_name"`
+	Phone    string `json:"phone"`
+	Address  string `json:"address"`
+	City     string `json:"city"`
+	State    string `json:"state"`
+	ZipCode  string `json:"zip_code"`
+	Country  string `json:"country"`
+}
+
+func (req checkoutRequest) form() url.Values {
+	return url.Values{
+		"full_name": {req.FullName},
+		"phone":     {req.Phone},
+		"address":   {req.Address},
+		"city":      {req.City},
+		"state":     {req.State},
+		"zip_code":  {req.ZipCode},
+		"country":   {req.Country},
+	}
+}
+
 func CreateOrder(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -27,38 +53,41 @@ func CreateOrder(w http.ResponseWriter, r *http.Request) {
 	country := strings.TrimSpace(r.FormValue("country"))
 
 	if fullName == "" || address == "" || city == "" || country == "" {
-		http.Error(w, `{"error": "All shipping fields are required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "All shipping fields are required")
 		return
 	}
 
 	shippingInfo := strings.Join([]string{fullName, phone, address, city, state, zipCode, country}, "|")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
 
 	// Get cart items and calculate total
 	rows, err := db.Query(`
-		SELECT c.id, c.product_id, c.quantity, p.price, p.store_id
+		SELECT c.id, c.product_id, c.variant_id, c.quantity, v.price, p.store_id, `+variantTitleColumn+`
 		FROM cart c
 		JOIN products p ON c.product_id = p.id
+		JOIN product_variants v ON c.variant_id = v.id
 		WHERE c.user_id = ?
 	`, userID)
 
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch cart"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch cart")
 		return
 	}
 
 	type CartData struct {
-		ID        int
-		ProductID int
-		Quantity  int
-		Price     float64
-		StoreID   int
+		ID           int
+		ProductID    int
+		VariantID    int
+		Quantity     int
+		Price        float64
+		StoreID      int
+		VariantTitle string
 	}
 
 	var cartItems []CartData
@@ -67,9 +96,9 @@ func CreateOrder(w http.ResponseWriter, r *http.Request) {
 
 	for rows.Next() {
 		var item CartData
-		if err := rows.Scan(&item.ID, &item.ProductID, &item.Quantity, &item.Price, &item.StoreID); err != nil {
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.VariantID, &item.Quantity, &item.Price, &item.StoreID, &item.VariantTitle); err != nil {
 			rows.Close()
-			http.Error(w, `{"error": "Failed to process cart"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to process cart")
 			return
 		}
 		if storeID == 0 {
@@ -81,20 +110,23 @@ func CreateOrder(w http.ResponseWriter, r *http.Request) {
 	rows.Close()
 
 	if len(cartItems) == 0 {
-		http.Error(w, `{"error": "Cart is empty"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, "Cart is empty")
 		return
 	}
 
 	// Delete any older pending orders (unpaid orders)
-	_, err = db.Exec("DELETE FROM orders WHERE user_id = ? AND status = 'pending'", userID)
+	abandoned, err := db.Exec("DELETE FROM orders WHERE user_id = ? AND status = 'pending'", userID)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to clean up old orders"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to clean up old orders")
 		return
 	}
+	if n, err := abandoned.RowsAffected(); err == nil && n > 0 {
+		cartsAbandonedTotal.Add(float64(n))
+	}
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 
@@ -106,64 +138,52 @@ func CreateOrder(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		tx.Rollback()
-		http.Error(w, `{"error": "Failed to create order"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create order")
 		return
 	}
 
 	orderID, err := result.LastInsertId()
 	if err != nil {
 		tx.Rollback()
-		http.Error(w, `{"error": "Failed to create order"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create order")
 		return
 	}
 
 	// Create order items
 	for _, item := range cartItems {
 		_, err = tx.Exec(`
-			INSERT INTO order_products (order_id, product_id, quantity, price)
-			VALUES (?, ?, ?, ?)
-		`, orderID, item.ProductID, item.Quantity, item.Price)
+			INSERT INTO order_products (order_id, product_id, variant_id, variant_title, quantity, price)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, orderID, item.ProductID, item.VariantID, item.VariantTitle, item.Quantity, item.Price)
 
 		if err != nil {
 			tx.Rollback()
-			http.Error(w, `{"error": "Failed to create order items"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create order items")
 			return
 		}
 	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		http.Error(w, `{"error": "Failed to complete order"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to complete order")
 		return
 	}
+	ordersCreatedTotal.Inc()
+	recordOrderStatus(db, orderID, "pending")
+	PublishEvent(Event{Type: EventOrderCreated, StoreID: storeID, UserID: userID, Data: map[string]interface{}{
+		"order_id": orderID,
+		"total":    totalAmount,
+	}})
 
 	// Send order confirmation email
 	var userEmail string
 	err = db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&userEmail)
 	if err == nil && userEmail != "" {
-		orderConfirmationEmail := fmt.Sprintf(`
-<html>
-<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
-  <h2>Order Confirmation</h2>
-  <p>Thank you for your order! Your order has been created successfully.</p>
-  
-  <div style="background-color: #f5f5f5; padding: 15px; border-radius: 5px; margin: 20px 0;">
-    <p><strong>Order ID:</strong> #%d</p>
-    <p><strong>Total Amount:</strong> BD %.2f</p>
-    <p><strong>Status:</strong> Pending Payment</p>
-    <p><strong>Shipping Address:</strong></p>
-    <p style="margin-left: 20px;">%s</p>
-  </div>
-  
-  <p>Please proceed to payment to complete your order.</p>
-  <p>If you have any questions, please contact our support team.</p>
-  
-  <p>Best regards,<br><strong>Astropify Team</strong></p>
-</body>
-</html>
-		`, orderID, totalAmount, shippingInfo)
-
-		go SendEmail(userEmail, "Order Confirmation - Astropify", orderConfirmationEmail)
+		queueTemplatedEmail(r, userEmail, EmailOrder, storeID, map[string]interface{}{
+			"OrderID":         orderID,
+			"Total":           totalAmount,
+			"ShippingAddress": shippingInfo,
+		})
 	}
 
 	response := map[string]interface{}{
@@ -178,15 +198,15 @@ func CreateOrder(w http.ResponseWriter, r *http.Request) {
 func GetOrders(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -199,7 +219,7 @@ func GetOrders(w http.ResponseWriter, r *http.Request) {
 	`, userID)
 
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch orders"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch orders")
 		return
 	}
 	defer rows.Close()
@@ -213,6 +233,7 @@ func GetOrders(w http.ResponseWriter, r *http.Request) {
 
 		err := rows.Scan(&id, &userID, &storeID, &totalAmount, &status, &shippingInfo, &createdAt)
 		if err != nil {
+			Logger(r).Warn("order row scan failed", "error", err)
 			continue
 		}
 
@@ -234,15 +255,15 @@ func GetOrders(w http.ResponseWriter, r *http.Request) {
 func GetPendingOrder(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -261,10 +282,10 @@ func GetPendingOrder(w http.ResponseWriter, r *http.Request) {
 	`, userID).Scan(&orderID, &storeID, &totalAmount, &shippingInfo, &createdAt)
 
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error": "No pending order found"}`, http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "No pending order found")
 		return
 	} else if err != nil {
-		http.Error(w, `{"error": "Failed to fetch order"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch order")
 		return
 	}
 
@@ -282,11 +303,30 @@ func GetPendingOrder(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// paymentRequest is the v1 JSON body of ProcessPayment
+type paymentRequest struct {
+	OrderID    int    `json:"order_id"`
+	CardHolder string `json:"card_holder"`
+	CardNumber string `json:"card_number"`
+	Expiry     string `json:"expiry"`
+	CVV        string `json:"cvv"`
+}
+
+func (req paymentRequest) form() url.Values {
+	return url.Values{
+		"order_id":    {strconv.Itoa(req.OrderID)},
+		"card_holder": {req.CardHolder},
+		"card_number": {req.CardNumber},
+		"expiry":      {req.Expiry},
+		"cvv":         {req.CVV},
+	}
+}
+
 // ProcessPayment simulates payment processing (fake payment system)
 func ProcessPayment(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -301,39 +341,39 @@ func ProcessPayment(w http.ResponseWriter, r *http.Request) {
 
 	// Validate inputs
 	if orderIDStr == "" || cardHolder == "" || cardNumber == "" || expiry == "" || cvv == "" {
-		http.Error(w, `{"error": "All payment fields are required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "All payment fields are required")
 		return
 	}
 
 	// Convert order ID
 	orderID := 0
 	if _, err := fmt.Sscanf(orderIDStr, "%d", &orderID); err != nil {
-		http.Error(w, `{"error": "Invalid order ID"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid order ID")
 		return
 	}
 
 	// Basic card validation
 	cardNumberClean := strings.ReplaceAll(cardNumber, " ", "")
 	if len(cardNumberClean) < 13 || len(cardNumberClean) > 19 {
-		http.Error(w, `{"error": "Invalid card number"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid card number")
 		return
 	}
 
 	// Validate CVV
 	if len(cvv) < 3 || len(cvv) > 4 {
-		http.Error(w, `{"error": "Invalid CVV"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid CVV")
 		return
 	}
 
 	// Validate expiry format (MM/YY)
 	if len(expiry) != 5 || expiry[2] != '/' {
-		http.Error(w, `{"error": "Invalid expiry date format"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid expiry date format")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -348,30 +388,40 @@ func ProcessPayment(w http.ResponseWriter, r *http.Request) {
 	`, orderID).Scan(&orderUserID, &status)
 
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error": "Order not found"}`, http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
 		return
 	} else if err != nil {
-		http.Error(w, `{"error": "Failed to verify order"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to verify order")
 		return
 	}
 
 	if orderUserID != userID {
-		http.Error(w, `{"error": "Unauthorized to pay for this order"}`, http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, CodeForbidden, "Unauthorized to pay for this order")
 		return
 	}
 
 	if status != "pending" {
-		http.Error(w, `{"error": "Order has already been processed"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, "Order has already been processed")
 		return
 	}
 
 	// Simulate payment processing (fake payment - always succeeds)
 	// In a real system, this would integrate with a payment gateway like Stripe, PayPal, etc.
 
+	// Only attempts count: the rejections above are not failed payments
+	paymentSucceeded := false
+	defer func() {
+		if paymentSucceeded {
+			paymentsTotal.Inc("succeeded")
+		} else {
+			paymentsTotal.Inc("failed")
+		}
+	}()
+
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 
@@ -388,14 +438,14 @@ func ProcessPayment(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		tx.Rollback()
-		http.Error(w, `{"error": "Failed to store payment method"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to store payment method")
 		return
 	}
 
 	paymentMethodID, err := paymentResult.LastInsertId()
 	if err != nil {
 		tx.Rollback()
-		http.Error(w, `{"error": "Failed to retrieve payment method ID"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to retrieve payment method ID")
 		return
 	}
 
@@ -404,7 +454,7 @@ func ProcessPayment(w http.ResponseWriter, r *http.Request) {
 	err = tx.QueryRow(`SELECT total_amount FROM orders WHERE id = ?`, orderID).Scan(&totalAmount)
 	if err != nil {
 		tx.Rollback()
-		http.Error(w, `{"error": "Failed to retrieve order amount"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to retrieve order amount")
 		return
 	}
 
@@ -416,71 +466,83 @@ func ProcessPayment(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		tx.Rollback()
-		http.Error(w, `{"error": "Failed to create transaction record"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create transaction record")
 		return
 	}
 
 	// Store payment info in order and update status to 'paid'
 	paymentInfo := strings.Join([]string{cardHolder, maskedCard, expiry}, "|")
-	_, err = tx.Exec(`
+	// the status check catches orders cancelled by expireCartReservationsJob
+	// since they were read, whose stock is no longer reserved
+	result, err := tx.Exec(`
 		UPDATE orders 
-		SET status = 'paid', payment_info = ?, updated_at = datetime('now')
-		WHERE id = ?
+		SET status = 'paid', payment_info = ?, paid_at = datetime('now'), version = version + 1, updated_at = datetime('now')
+		WHERE id = ? AND status = 'pending'
 	`, paymentInfo, orderID)
 
 	if err != nil {
 		tx.Rollback()
-		http.Error(w, `{"error": "Failed to update order status"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update order status")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		writeError(w, r, http.StatusConflict, CodeInvalidState, "Order has already been processed")
 		return
 	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		http.Error(w, `{"error": "Failed to complete payment"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to complete payment")
 		return
 	}
+	paymentSucceeded = true
+	recordOrderStatus(db, int64(orderID), "paid")
 
 	// Clear cart after successful payment
 	_, err = db.Exec("DELETE FROM cart WHERE user_id = ?", userID)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to clear cart"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to clear cart")
 		return
 	}
 
 	// Send payment confirmation email
 	var userEmail string
 	var orderTotal float64
+	var orderStoreID int
 	err = db.QueryRow(`
-		SELECT u.email, o.total_amount 
+		SELECT u.email, o.total_amount, o.store_id
 		FROM users u 
 		JOIN orders o ON u.id = o.user_id 
 		WHERE o.id = ?
-	`, orderID).Scan(&userEmail, &orderTotal)
+	`, orderID).Scan(&userEmail, &orderTotal, &orderStoreID)
+	if err == nil {
+		PublishEvent(Event{Type: EventOrderPaid, StoreID: orderStoreID, UserID: userID, Data: map[string]interface{}{
+			"order_id": orderID,
+			"total":    orderTotal,
+		}})
+	}
 
 	if err == nil && userEmail != "" {
-		paymentConfirmationEmail := fmt.Sprintf(`
-<html>
-<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
-  <h2>Payment Confirmation</h2>
-  <p>Your payment has been processed successfully!</p>
-  
-  <div style="background-color: #f5f5f5; padding: 15px; border-radius: 5px; margin: 20px 0;">
-    <p><strong>Order ID:</strong> #%d</p>
-    <p><strong>Amount Paid:</strong> BD %.2f</p>
-    <p><strong>Payment Method:</strong> %s</p>
-    <p><strong>Status:</strong> Completed</p>
-    <p><strong>Date:</strong> %s</p>
-  </div>
-  
-  <p>Your order will be processed and shipped soon. You will receive a shipping notification with tracking details.</p>
-  
-  <p>Thank you for your purchase!</p>
-  <p>Best regards,<br><strong>Astropify Team</strong></p>
-</body>
-</html>
-		`, orderID, orderTotal, paymentMethodName, getFormattedDate())
-
-		go SendEmail(userEmail, "Payment Confirmation - Astropify", paymentConfirmationEmail)
+		queueTemplatedEmail(r, userEmail, EmailPayment, orderStoreID, map[string]interface{}{
+			"OrderID":       orderID,
+			"Amount":        orderTotal,
+			"PaymentMethod": paymentMethodName,
+			"Date":          getFormattedDate(),
+		})
+	}
+
+	// Let the store owner know a paid order came in
+	var ownerID int
+	var storeName string
+	if err := db.QueryRow("SELECT owner_id, name FROM stores WHERE id = ?", orderStoreID).Scan(&ownerID, &storeName); err == nil {
+		notify(r, Notification{
+			UserID: ownerID,
+			Type:   NotifyOrderPlaced,
+			Title:  fmt.Sprintf("New order #%d", orderID),
+			Body:   fmt.Sprintf("Payment of BD %.2f received by %s.", orderTotal, paymentMethodName),
+			Link:   "/" + storeName + "/dashboard",
+		}, nil)
 	}
 
 	response := map[string]interface{}{
@@ -492,281 +554,259 @@ func ProcessPayment(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// GetStoreOrders retrieves all orders for products from a specific store
+// GetStoreOrders lists the orders of a store; see storeOrderListSpec for
+// the filters, e.g. ?status=paid,shipped
 func GetStoreOrders(w http.ResponseWriter, r *http.Request) {
-	user, err := GetCookie(r, "session_token")
-	if err != nil {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+	if _, validUser := ValidateUser(w, r); !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
-	if err != nil {
-		http.Error(w, `{"error": "Database Error"}`, http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	// Get user ID from session
-	var userID int
-	err = db.QueryRow("SELECT user_id FROM sessions WHERE session_token = ?", user).Scan(&userID)
-	if err != nil {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
-		return
-	}
-
 	// Get store ID for this user
 	storeIDStr := r.URL.Query().Get("store_id")
 	storeID := 0
 	if _, err := fmt.Sscanf(storeIDStr, "%d", &storeID); err != nil {
-		http.Error(w, `{"error": "Invalid store ID"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
 		return
 	}
 
 	// Verify user owns this store
-	var storeOwnerID int
-	err = db.QueryRow("SELECT owner_id FROM stores WHERE id = ?", storeID).Scan(&storeOwnerID)
-	if err != nil || storeOwnerID != userID {
-		http.Error(w, `{"error": "Unauthorized to view these orders"}`, http.StatusUnauthorized)
+	if _, isOwner := ValidateStoreOwner(w, r, storeID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized to view these orders")
 		return
 	}
 
-	// Get all orders for this store
-	query := `
-		SELECT 
-			o.id, 
-			o.user_id, 
-			o.total_amount, 
-			o.status, 
-			o.shipping_info, 
-			o.payment_info, 
-			o.created_at, 
-			o.updated_at,
-			u.first_name,
-			COUNT(op.id) as product_count
-		FROM orders o
-		LEFT JOIN order_products op ON o.id = op.order_id
-		LEFT JOIN users u ON o.user_id = u.id
-		WHERE o.store_id = ?
-		GROUP BY o.id
-		ORDER BY o.created_at DESC
-	`
-
-	rows, err := db.Query(query, storeID)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch orders"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
 		return
 	}
-	defer rows.Close()
+	defer db.Close()
 
-	type OrderData struct {
-		ID           int    `json:"id"`
-		CustomerName string `json:"customer_name"`
-		ProductCount int    `json:"product_count"`
-		TotalAmount  string `json:"total_amount"`
-		Status       string `json:"status"`
-		CreatedAt    string `json:"created_at"`
+	list, err := storeOrderListSpec.Parse(r.URL.Query())
+	if err != nil {
+		writeListError(w, r, "orders", err)
+		return
 	}
-
-	var orders []OrderData
-	for rows.Next() {
-		var order OrderData
-		var userID int
-		var firstName sql.NullString
-		var shippingInfo sql.NullString
-		var paymentInfo sql.NullString
-		var updatedAt sql.NullString
-
-		err := rows.Scan(
-			&order.ID,
-			&userID,
-			&order.TotalAmount,
-			&order.Status,
-			&shippingInfo,
-			&paymentInfo,
-			&order.CreatedAt,
-			&updatedAt,
-			&firstName,
-			&order.ProductCount,
-		)
-		if err != nil {
-			continue
-		}
-
-		if firstName.Valid {
-			order.CustomerName = firstName.String
-		} else {
-			order.CustomerName = "Guest"
-		}
-
-		orders = append(orders, order)
+	page, err := listStoreOrders(db, storeID, list)
+	if err != nil {
+		writeListError(w, r, "orders", err)
+		return
 	}
 
-	response := map[string]interface{}{
-		"orders": orders,
-	}
+	json.NewEncoder(w).Encode(page)
+}
 
-	json.NewEncoder(w).Encode(response)
+// updateOrderStatusRequest is the body of UpdateOrderStatus
+type updateOrderStatusRequest struct {
+	OrderID int    `json:"order_id"`
+	Status  string `json:"status"`
+	StoreID int    `json:"store_id"`
+	Version int    `json:"version"`
+	// optional, usually sent when shipping
+	TrackingNumber    string `json:"tracking_number"`
+	EstimatedDelivery string `json:"estimated_delivery"`
 }
 
 // UpdateOrderStatus updates the status of an order
 func UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
-	user, err := GetCookie(r, "session_token")
-	if err != nil {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+	if _, validUser := ValidateUser(w, r); !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	var req struct {
-		OrderID int    `json:"order_id"`
-		Status  string `json:"status"`
-		StoreID int    `json:"store_id"`
-	}
+	var req updateOrderStatusRequest
 
-	err = json.NewDecoder(r.Body).Decode(&req)
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, `{"error": "Invalid request"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request")
 		return
 	}
-
-	db, err := sql.Open("sqlite3", DATABASEPATH)
-	if err != nil {
-		http.Error(w, `{"error": "Database Error"}`, http.StatusInternalServerError)
+	if !validOrderStatus(req.Status) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid order status")
+		return
+	}
+	var estimatedDelivery interface{}
+	if req.EstimatedDelivery != "" {
+		if _, err := time.Parse("2006-01-02", req.EstimatedDelivery); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Estimated delivery must be a date (YYYY-MM-DD)")
+			return
+		}
+		estimatedDelivery = req.EstimatedDelivery
+	}
+	req.TrackingNumber = strings.TrimSpace(req.TrackingNumber)
+	if req.TrackingNumber != "" && req.Status != "shipped" {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "A tracking number can only be added when shipping")
 		return
 	}
-	defer db.Close()
 
-	// Get user ID from session
-	var userID int
-	err = db.QueryRow("SELECT user_id FROM sessions WHERE session_token = ?", user).Scan(&userID)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
 		return
 	}
+	defer db.Close()
 
 	// Verify user owns this store
-	var storeOwnerID int
-	err = db.QueryRow("SELECT owner_id FROM stores WHERE id = ?", req.StoreID).Scan(&storeOwnerID)
-	if err != nil || storeOwnerID != userID {
-		http.Error(w, `{"error": "Unauthorized to update this order"}`, http.StatusUnauthorized)
+	if _, isOwner := ValidateStoreOwner(w, r, req.StoreID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized to update this order")
 		return
 	}
 
 	// Verify the order belongs to this store
-	var orderExists int
+	var previousStatus string
 	err = db.QueryRow(`
-		SELECT COUNT(*) FROM orders
+		SELECT status FROM orders
 		WHERE id = ? AND store_id = ?
-	`, req.OrderID, req.StoreID).Scan(&orderExists)
-	if err != nil || orderExists == 0 {
-		http.Error(w, `{"error": "Order not found"}`, http.StatusNotFound)
+	`, req.OrderID, req.StoreID).Scan(&previousStatus)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
 		return
 	}
+	// A tracking number ships everything left as one manual shipment; use
+	// /api/shipments/create to split the order.
+	if req.TrackingNumber != "" {
+		lines, err := shippableItems(db, req.OrderID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch order items")
+			return
+		}
+		if unshippedCount(lines) == 0 {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidState, "Every item is already in a shipment")
+			return
+		}
+	}
 
-	// Update order status
-	_, err = db.Exec(
-		"UPDATE orders SET status = ?, updated_at = datetime('now') WHERE id = ?",
-		req.Status,
-		req.OrderID,
-	)
+	// Update order status. Clients that send the version they loaded get a
+	// 409 instead of overwriting a change made since.
+	query := `
+		UPDATE orders
+		SET status = ?, version = version + 1, updated_at = datetime('now'),
+			paid_at = CASE WHEN ? = 'paid' THEN COALESCE(paid_at, datetime('now')) ELSE paid_at END,
+			shipped_at = CASE WHEN ? = 'shipped' THEN COALESCE(shipped_at, datetime('now')) ELSE shipped_at END,
+			delivered_at = CASE WHEN ? IN ('delivered', 'completed') THEN COALESCE(delivered_at, datetime('now')) ELSE delivered_at END,
+			estimated_delivery = COALESCE(?, estimated_delivery)
+		WHERE id = ?`
+	args := []interface{}{req.Status, req.Status, req.Status, req.Status, estimatedDelivery, req.OrderID}
+	if req.Version != 0 {
+		query += " AND version = ?"
+		args = append(args, req.Version)
+	}
+	result, err := db.Exec(query, args...)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to update order"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update order")
 		return
 	}
-
-	// Send status update email to customer
-	var customerEmail string
-	var customerName string
-	var totalAmount float64
-	err = db.QueryRow(`
-		SELECT u.email, u.first_name, o.total_amount
-		FROM orders o
-		JOIN users u ON o.user_id = u.id
-		WHERE o.id = ?
-	`, req.OrderID).Scan(&customerEmail, &customerName, &totalAmount)
-
-	if err == nil && customerEmail != "" {
-		statusMessageMap := map[string]string{
-			"processing": "Your order is being processed and will be shipped soon.",
-			"shipped":    "Great news! Your order has been shipped. You will receive tracking information soon.",
-			"delivered":  "Your order has been delivered. Thank you for your purchase!",
-			"cancelled":  "Your order has been cancelled. Please contact us if you have any questions.",
-		}
-
-		statusMessage := statusMessageMap[req.Status]
-		if statusMessage == "" {
-			statusMessage = "Your order status has been updated to: " + req.Status
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeOrderConflict(w, r, db, req.StoreID, req.OrderID, "Order was changed by someone else")
+		return
+	}
+	if req.Status != previousStatus {
+		recordOrderStatus(db, int64(req.OrderID), req.Status)
+	}
+	if req.Status == "delivered" || req.Status == "completed" {
+		deliverManualShipments(db, req.OrderID)
+	}
+	if req.TrackingNumber != "" {
+		shipmentID, err := createShipment(db, shipmentRequest{
+			StoreID: req.StoreID, OrderID: req.OrderID, Carrier: manualCarrier, TrackingNumber: req.TrackingNumber,
+		})
+		if err != nil {
+			Logger(r).Error("failed to record manual shipment", "order_id", req.OrderID, "error", err)
+		} else {
+			publishShipment(db, req.StoreID, req.OrderID, shipmentID, ShipmentInTransit)
 		}
-
-		statusEmail := fmt.Sprintf(`
-<html>
-<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
-  <h2>Order Status Update</h2>
-  <p>Hi %s,</p>
-  
-  <p>%s</p>
-  
-  <div style="background-color: #f5f5f5; padding: 15px; border-radius: 5px; margin: 20px 0;">
-    <p><strong>Order ID:</strong> #%d</p>
-    <p><strong>Order Status:</strong> <span style="color: #2c3e50; font-weight: bold; text-transform: capitalize;">%s</span></p>
-    <p><strong>Order Total:</strong> BD %.2f</p>
-  </div>
-  
-  <p>If you have any questions about your order, please don't hesitate to contact us.</p>
-  
-  <p>Best regards,<br><strong>Astropify Team</strong></p>
-</body>
-</html>
-		`, customerName, statusMessage, req.OrderID, req.Status, totalAmount)
-
-		go SendEmail(customerEmail, "Order Status Update - Order #"+fmt.Sprint(req.OrderID), statusEmail)
 	}
+	announceOrderStatus(r, db, req.StoreID, req.OrderID, req.Status)
 
 	response := map[string]interface{}{
 		"success": true,
 		"message": "Order status updated successfully",
 	}
+	if order, err := loadStoreOrder(db, req.StoreID, req.OrderID); err == nil {
+		response["order"] = order
+	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
+// announceOrderStatus publishes an order's new status and notifies the
+// customer by email and/or in-app, as they prefer
+func announceOrderStatus(r *http.Request, db *sql.DB, storeID int, orderID int, status string) {
+	var customerID int
+	var customerName string
+	var totalAmount float64
+	var storeName string
+	err := db.QueryRow(`
+		SELECT o.user_id, u.first_name, o.total_amount, s.name
+		FROM orders o
+		JOIN users u ON o.user_id = u.id
+		JOIN stores s ON o.store_id = s.id
+		WHERE o.id = ?
+	`, orderID).Scan(&customerID, &customerName, &totalAmount, &storeName)
+	trackingNumber := orderTrackingNumbers(db, orderID)
+	PublishEvent(Event{Type: EventOrderStatusChanged, StoreID: storeID, UserID: customerID, Data: map[string]interface{}{
+		"order_id":        orderID,
+		"status":          status,
+		"tracking_number": trackingNumber,
+	}})
+	if err != nil {
+		Logger(r).Warn("order status notification lookup failed", "order_id", orderID, "error", err)
+		return
+	}
+
+	notify(r, Notification{
+		UserID: customerID,
+		Type:   NotifyOrderStatus,
+		Title:  fmt.Sprintf("Order #%d is now %s", orderID, status),
+		Body:   orderStatusMessage(status),
+		Link:   orderTrackingPath(storeName, orderID),
+	}, &notificationEmail{Kind: EmailStatus, StoreID: storeID, Data: map[string]interface{}{
+		"OrderID":        orderID,
+		"CustomerName":   customerName,
+		"Status":         status,
+		"Message":        orderStatusMessage(status),
+		"Total":          totalAmount,
+		"TrackingNumber": trackingNumber,
+		"TrackingURL":    absoluteLink(orderTrackingPath(storeName, orderID)),
+	}})
+}
+
 // GetOrderProducts retrieves all products in a specific order
 func GetOrderProducts(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
 		return
 	}
 	defer db.Close()
 
-	// Get store ID and order ID from URL
+	// Get store ID and order ID from URL; the legacy route has no wildcard
 	storeIDStr := r.URL.Query().Get("store_id")
-	pathSegments := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/orders/"), "/")
-	if len(pathSegments) < 1 {
-		http.Error(w, `{"error": "Invalid request"}`, http.StatusBadRequest)
-		return
+	orderIDStr := r.PathValue("order_id")
+	if orderIDStr == "" {
+		pathSegments := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/orders/"), "/")
+		orderIDStr = pathSegments[0]
 	}
-
-	orderIDStr := pathSegments[0]
 	storeID := 0
 	orderID := 0
 	if _, err := fmt.Sscanf(storeIDStr, "%d", &storeID); err != nil {
-		http.Error(w, `{"error": "Invalid store ID"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
 		return
 	}
 	if _, err := fmt.Sscanf(orderIDStr, "%d", &orderID); err != nil {
-		http.Error(w, `{"error": "Invalid order ID"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid order ID")
 		return
 	}
 
 	// Try to validate as store owner first
-	userID, isStoreOwner := ValidateUser(w, r)
+	_, isStoreOwner := ValidateUser(w, r)
 	isCustomer := false
 	customerID := 0
 
@@ -774,17 +814,15 @@ func GetOrderProducts(w http.ResponseWriter, r *http.Request) {
 		// If not store owner, try to validate as customer
 		customerID, isCustomer = ValidateCustomer(w, r)
 		if !isCustomer {
-			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 			return
 		}
 	}
 
 	// If store owner, verify they own this store
 	if isStoreOwner {
-		var storeOwnerID int
-		err = db.QueryRow("SELECT owner_id FROM stores WHERE id = ?", storeID).Scan(&storeOwnerID)
-		if err != nil || storeOwnerID != userID {
-			http.Error(w, `{"error": "Unauthorized to view these products"}`, http.StatusUnauthorized)
+		if _, owns := ValidateStoreOwner(w, r, storeID); !owns {
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized to view these products")
 			return
 		}
 
@@ -795,7 +833,7 @@ func GetOrderProducts(w http.ResponseWriter, r *http.Request) {
 			WHERE id = ? AND store_id = ?
 		`, orderID, storeID).Scan(&orderExists)
 		if err != nil || orderExists == 0 {
-			http.Error(w, `{"error": "Order not found"}`, http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
 			return
 		}
 	} else if isCustomer {
@@ -806,16 +844,17 @@ func GetOrderProducts(w http.ResponseWriter, r *http.Request) {
 			WHERE id = ? AND store_id = ?
 		`, orderID, storeID).Scan(&orderUserID)
 		if err != nil || orderUserID != customerID {
-			http.Error(w, `{"error": "Order not found"}`, http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
 			return
 		}
 	}
 
 	// Get all products in this order
 	query := `
-		SELECT op.product_id, p.name, p.image, op.quantity, op.price
+		SELECT op.product_id, ` + orderLineName + `, COALESCE(NULLIF(v.image, ''), p.image), op.quantity, op.price
 		FROM order_products op
 		INNER JOIN products p ON op.product_id = p.id
+		LEFT JOIN product_variants v ON op.variant_id = v.id
 		INNER JOIN orders o ON op.order_id = o.id
 		INNER JOIN stores s ON p.store_id = s.id
 		WHERE o.id = ? AND s.id = ?
@@ -824,7 +863,7 @@ func GetOrderProducts(w http.ResponseWriter, r *http.Request) {
 
 	rows, err := db.Query(query, orderID, storeID)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch products"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch products")
 		return
 	}
 	defer rows.Close()
@@ -842,6 +881,7 @@ func GetOrderProducts(w http.ResponseWriter, r *http.Request) {
 		var product OrderProduct
 		err := rows.Scan(&product.ID, &product.Name, &product.Image, &product.Quantity, &product.Price)
 		if err != nil {
+			Logger(r).Warn("order product row scan failed", "order_id", orderID, "error", err)
 			continue
 		}
 		products = append(products, product)
@@ -854,142 +894,125 @@ func GetOrderProducts(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// GetCustomerOrders fetches all orders for the logged-in customer for a specific store
+// GetCustomerOrders lists the logged-in customer's orders on a store; see
+// customerOrderListSpec for the filters
 func GetCustomerOrders(w http.ResponseWriter, r *http.Request) {
 	storeIDStr := r.URL.Query().Get("store_id")
 	if storeIDStr == "" {
-		http.Error(w, `{"error": "store_id is required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "store_id is required")
 		return
 	}
 	userID, validUser := ValidateStoreCustomer(w, r, storeIDStr)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
 	defer db.Close()
 
-	// Get orders for this customer on this store
-	query := `
-		SELECT 
-			o.id,
-			o.created_at,
-			o.status,
-			SUM(op.quantity * op.price) as total_amount,
-			COUNT(op.id) as product_count
-		FROM orders o
-		JOIN order_products op ON o.id = op.order_id
-		JOIN products p ON op.product_id = p.id
-		WHERE o.user_id = ? AND p.store_id = ?
-		GROUP BY o.id
-		ORDER BY o.created_at DESC
-	`
-
-	rows, err := db.Query(query, userID, storeIDStr)
+	storeID, err := strconv.Atoi(storeIDStr)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch orders"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
 		return
 	}
-	defer rows.Close()
 
-	type OrderInfo struct {
-		ID           int     `json:"id"`
-		CreatedAt    string  `json:"created_at"`
-		Status       string  `json:"status"`
-		TotalAmount  float64 `json:"total_amount"`
-		ProductCount int     `json:"product_count"`
+	list, err := customerOrderListSpec.Parse(r.URL.Query())
+	if err != nil {
+		writeListError(w, r, "orders", err)
+		return
 	}
-
-	var orders []OrderInfo
-	for rows.Next() {
-		var order OrderInfo
-		err := rows.Scan(&order.ID, &order.CreatedAt, &order.Status, &order.TotalAmount, &order.ProductCount)
-		if err != nil {
-			continue
-		}
-		orders = append(orders, order)
+	page, err := listCustomerOrders(db, storeID, userID, list)
+	if err != nil {
+		writeListError(w, r, "orders", err)
+		return
 	}
 
-	response := map[string]interface{}{
-		"orders": orders,
-	}
+	json.NewEncoder(w).Encode(page)
+}
 
-	json.NewEncoder(w).Encode(response)
+// completeOrderRequest is the body of MarkOrderAsCompleted
+type completeOrderRequest struct {
+	OrderID int `json:"order_id"`
 }
 
 // MarkOrderAsCompleted allows customers to mark their delivered order as completed/received
 func MarkOrderAsCompleted(w http.ResponseWriter, r *http.Request) {
 	storeIDStr := r.URL.Query().Get("store_id")
 	if storeIDStr == "" {
-		http.Error(w, `{"error": "store_id is required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "store_id is required")
 		return
 	}
 
 	userID, validUser := ValidateStoreCustomer(w, r, storeIDStr)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	var req struct {
-		OrderID int `json:"order_id"`
-	}
+	var req completeOrderRequest
 
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, `{"error": "Invalid request"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
 		return
 	}
 	defer db.Close()
 
 	// Verify the order belongs to this customer
 	var orderUserID int
+	var orderStoreID int
 	var currentStatus string
 	err = db.QueryRow(`
-		SELECT o.user_id, o.status
+		SELECT o.user_id, o.store_id, o.status
 		FROM orders o
 		WHERE o.id = ?
-	`, req.OrderID).Scan(&orderUserID, &currentStatus)
+	`, req.OrderID).Scan(&orderUserID, &orderStoreID, &currentStatus)
 
 	if err != nil {
-		http.Error(w, `{"error": "Order not found"}`, http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
 		return
 	}
 
 	if orderUserID != userID {
-		http.Error(w, `{"error": "Unauthorized to update this order"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized to update this order")
 		return
 	}
 
 	// Only allow marking as completed if status is "delivered" or "shipped"
 	if currentStatus != "delivered" && currentStatus != "shipped" {
-		http.Error(w, `{"error": "Order must be delivered or shipped to mark as completed"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, "Order must be delivered or shipped to mark as completed")
 		return
 	}
 
 	// Update order status to completed
 	_, err = db.Exec(
-		"UPDATE orders SET status = 'completed', updated_at = datetime('now') WHERE id = ?",
+		"UPDATE orders SET status = 'completed', version = version + 1, delivered_at = COALESCE(delivered_at, datetime('now')), updated_at = datetime('now') WHERE id = ?",
 		req.OrderID,
 	)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to update order"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update order")
 		return
 	}
+	recordOrderStatus(db, int64(req.OrderID), "completed")
+	deliverManualShipments(db, req.OrderID)
+	PublishEvent(Event{Type: EventOrderStatusChanged, StoreID: orderStoreID, UserID: userID, Data: map[string]interface{}{
+		"order_id": req.OrderID,
+		"status":   "completed",
+	}})
 
 	response := map[string]interface{}{
 		"success": true,
@@ -1003,3 +1026,18 @@ func MarkOrderAsCompleted(w http.ResponseWriter, r *http.Request) {
 func getFormattedDate() string {
 	return fmt.Sprintf("%s", "today")
 }
+
+// orderStatusMessage is the customer-facing sentence for an order status
+func orderStatusMessage(status string) string {
+	switch status {
+	case "processing":
+		return "Your order is being processed and will be shipped soon."
+	case "shipped":
+		return "Great news! Your order has been shipped. Follow it with the tracking details below."
+	case "delivered":
+		return "Your order has been delivered. Thank you for your purchase!"
+	case "cancelled":
+		return "Your order has been cancelled. Please contact us if you have any questions."
+	}
+	return "Your order status has been updated to: " + status
+}
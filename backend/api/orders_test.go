@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func paymentCount(result string) float64 {
+	paymentsTotal.mu.Lock()
+	defer paymentsTotal.mu.Unlock()
+	return paymentsTotal.values[labelKey([]string{result})]
+}
+
+func TestPaymentMetricCountsOnlyAttempts(t *testing.T) {
+	db := openTestDB(t)
+	_, storeID, _ := createTestStore(t, db)
+	var storeName string
+	db.QueryRow("SELECT name FROM stores WHERE id = ?", storeID).Scan(&storeName)
+	customer, other := createTestUser(t, db), createTestUser(t, db)
+	mustExec(t, db, "INSERT INTO sessions (user_id, session_token) VALUES (?, ?)", customer, fmt.Sprintf("customer-%d", customer))
+	orderID := mustExec(t, db, "INSERT INTO orders (user_id, store_id, total_amount, status, shipping_info) VALUES (?, ?, 25, 'pending', '{}')",
+		customer, storeID)
+	othersOrder := mustExec(t, db, "INSERT INTO orders (user_id, store_id, total_amount, status, shipping_info) VALUES (?, ?, 25, 'pending', '{}')",
+		other, storeID)
+	// the confirmation mail is not part of this test
+	t.Cleanup(func() { mustExec(t, db, "DELETE FROM jobs WHERE kind = ? AND status = ?", JobSendEmail, JobPending) })
+
+	pay := func(signedIn bool, fields map[string]string) int {
+		form := url.Values{"store_name": {storeName}, "card_holder": {"Test Customer"}, "card_number": {"4242 4242 4242 4242"},
+			"expiry": {"12/30"}, "cvv": {"123"}, "order_id": {fmt.Sprint(orderID)}}
+		for name, value := range fields {
+			form.Set(name, value)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/payment/process", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if signedIn {
+			req.AddCookie(&http.Cookie{Name: fmt.Sprintf("customer_token_%d", storeID), Value: fmt.Sprintf("customer-%d", customer)})
+		}
+		w := httptest.NewRecorder()
+		ProcessPayment(w, req)
+		return w.Code
+	}
+
+	succeeded, failed := paymentCount("succeeded"), paymentCount("failed")
+	for name, code := range map[string]int{
+		"signed out":      pay(false, nil),
+		"missing fields":  pay(true, map[string]string{"card_holder": ""}),
+		"bad CVV":         pay(true, map[string]string{"cvv": "1"}),
+		"someone's order": pay(true, map[string]string{"order_id": fmt.Sprint(othersOrder)}),
+	} {
+		if code < 400 {
+			t.Errorf("%s: payment accepted with %d", name, code)
+		}
+	}
+	if paymentCount("succeeded") != succeeded || paymentCount("failed") != failed {
+		t.Fatalf("rejected requests were counted as payments")
+	}
+
+	if code := pay(true, nil); code != http.StatusOK {
+		t.Fatalf("payment = %d", code)
+	}
+	if code := pay(true, nil); code != http.StatusBadRequest {
+		t.Errorf("paying twice = %d, want 400", code)
+	}
+	if paymentCount("succeeded") != succeeded+1 || paymentCount("failed") != failed {
+		t.Errorf("payments = %v succeeded, %v failed; want %v and %v",
+			paymentCount("succeeded"), paymentCount("failed"), succeeded+1, failed)
+	}
+}
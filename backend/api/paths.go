@@ -3,6 +3,9 @@ package api
 // Database
 const DATABASEPATH = "./database/database.db"
 
+// DATABASEDRIVER is go-sqlite3 wrapped with query timing (see metrics.go)
+const DATABASEDRIVER = "sqlite3_instrumented"
+
 // Frontend Templates
 const (
 	FrontendIndexHTML          = "./frontend/index.html"
@@ -13,15 +16,29 @@ const (
 	FrontendOrdersHTML         = "./frontend/orders.html"
 	FrontendErrorHTML          = "./frontend/templates/Error.html"
 	FrontendAdminDashboardHTML = "./frontend/admin_dashboard.html"
+	FrontendDiagnosticsHTML    = "./frontend/diagnostics.html"
+	FrontendDevMailHTML        = "./frontend/dev_mail.html"
+	FrontendUnsubscribeHTML    = "./frontend/unsubscribe.html"
+	FrontendPackingSlipHTML    = "./frontend/packing_slip.html"
+	FrontendOrderTrackingHTML  = "./frontend/order_tracking.html"
+	FrontendShippingLabelHTML  = "./frontend/shipping_label.html"
 	FrontendTemplateDir        = "./frontend/templates/"
+	FrontendEmailDir           = "./frontend/emails/"
 	FrontendTemplateExtension  = "_template.html"
 )
 
+// TLS
+const (
+	CertFile = "cert.pem"
+	KeyFile  = "key.pem"
+)
+
 // Static File Paths
 const (
 	StoreLogosPath    = "./store_images/logos/"
 	StoreBannersPath  = "./store_images/banners/"
 	StoreProductsPath = "./store_images/products/"
+	StoreReturnsPath  = "./store_images/returns/"
 	AvatarsPath       = "./avatars/"
 )
 
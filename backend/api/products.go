@@ -3,17 +3,20 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 )
 
 func GetProductsByStoreID(storeID uint) ([]Product, error) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return nil, err
 	}
 	defer db.Close()
-	rows, err := db.Query("SELECT id, name, description, price, image, quantity FROM products WHERE store_id = ?", storeID)
+	rows, err := db.Query("SELECT id, name, description, price, image, quantity, COALESCE(category_id, 0) FROM products WHERE store_id = ?", storeID)
 	if err != nil {
 		return nil, err
 	}
@@ -22,17 +25,148 @@ func GetProductsByStoreID(storeID uint) ([]Product, error) {
 	var products []Product
 	for rows.Next() {
 		var product Product
-		if err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Image, &product.Quantity); err != nil {
+		if err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Image, &product.Quantity, &product.CategoryID); err != nil {
 			return nil, err
 		}
 		products = append(products, product)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := loadProductDetails(db, int(storeID), products, "p.store_id = ?", storeID); err != nil {
+		return nil, err
+	}
 	return products, nil
 }
 
+// loadProductDetails fills in the options, variants, tags, gallery and
+// category of a store's products; where selects them (on products p)
+func loadProductDetails(db *sql.DB, storeID int, products []Product, where string, args ...interface{}) error {
+	options, variants, err := loadVariants(db, where, args...)
+	if err != nil {
+		return err
+	}
+	tags, err := loadProductTags(db, storeID)
+	if err != nil {
+		return err
+	}
+	categories, err := loadCategories(db, storeID)
+	if err != nil {
+		return err
+	}
+	media, err := loadProductMedia(db, where, args...)
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		products[i].Options = options[int(products[i].ID)]
+		products[i].Variants = variants[int(products[i].ID)]
+		products[i].Tags = tags[int(products[i].ID)]
+		products[i].Media = media[int(products[i].ID)]
+		if products[i].CategoryID != 0 {
+			products[i].Category = categoryByID(categories, products[i].CategoryID).Path
+		}
+	}
+	return nil
+}
+
+// productListSpec is what GET /api/products filters and sorts by
+var productListSpec = ListSpec{
+	Key:  "p.id",
+	Sort: "id",
+	Fields: map[string]ListField{
+		"id":          {Expr: "p.id", Kind: listInt, Filter: true, Sort: true},
+		"name":        {Expr: "p.name", Kind: listText, Sort: true, Search: true},
+		"description": {Expr: "p.description", Kind: listText, Search: true},
+		"price":       {Expr: "p.price", Kind: listNumber, Filter: true, Sort: true},
+		"quantity":    {Expr: "p.quantity", Kind: listInt, Filter: true, Sort: true},
+		"in_stock":    {Expr: "p.quantity > 0", Kind: listBool, Filter: true, Facet: true},
+		"created_at":  {Expr: "p.created_at", Kind: listTime, Filter: true, Sort: true},
+		"category_id": {Expr: "p.category_id", Kind: listInt, Facet: true, Label: "c.name"},
+	},
+}
+
+// inList is the condition "expr is one of ids"; with no ids it matches nothing
+func inList(expr string, ids []int) (string, []interface{}) {
+	if len(ids) == 0 {
+		return "0 = 1", nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return expr + " IN (?" + strings.Repeat(", ?", len(ids)-1) + ")", args
+}
+
+// filterProductList narrows a product listing to a category (including its
+// subcategories), a tag and a collection, each given by id or slug. Empty
+// filters are ignored; an unknown category or collection matches nothing.
+// The collection's products are those of collectionIDs.
+func filterProductList(db *sql.DB, storeID int, q *ListQuery, category, tag, collection string, collectionIDs []int) error {
+	if category != "" {
+		categories, err := loadCategories(db, storeID)
+		if err != nil {
+			return err
+		}
+		c, _ := findCategory(categories, category)
+		condition, args := inList("p.category_id", c.Descendants)
+		q.Where("category_id", condition, args...)
+	}
+	if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+		q.Where("tag", "p.id IN (SELECT product_id FROM product_tags WHERE tag = ?)", tag)
+	}
+	if collection != "" {
+		condition, args := inList("p.id", collectionIDs)
+		q.Where("collection", condition, args...)
+	}
+	return nil
+}
+
+// collectionProducts returns the ids of a store's collection, in its order
+func collectionProducts(storeID int, collection string) ([]int, error) {
+	products, err := GetProductsByStoreID(uint(storeID))
+	if err != nil {
+		return nil, err
+	}
+	_, _, collections, err := storeCatalog(storeID, products)
+	if err != nil {
+		return nil, err
+	}
+	c, _ := findCollection(collections, collection)
+	return c.ProductIDs, nil
+}
+
+// createProductRequest is the v1 JSON body of CreateProductAPI; Image is a
+// data URL
+type createProductRequest struct {
+	StoreID     int      `json:"store_id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Price       float64  `json:"price"`
+	Quantity    int      `json:"quantity"`
+	Image       string   `json:"image"`
+	CategoryID  int      `json:"category_id,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+func (req createProductRequest) form() url.Values {
+	return url.Values{
+		"store_id":           {strconv.Itoa(req.StoreID)},
+		"productName":        {req.Name},
+		"productDescription": {req.Description},
+		"productPrice":       {strconv.FormatFloat(req.Price, 'f', -1, 64)},
+		"productQuantity":    {strconv.Itoa(req.Quantity)},
+		"productImage":       {req.Image},
+		"productCategory":    {strconv.Itoa(req.CategoryID)},
+		"productTags":        {strings.Join(req.Tags, ",")},
+	}
+}
+
 func CreateProductAPI(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, `{"error": "Method Not Allowed"}`, http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method Not Allowed")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -40,108 +174,135 @@ func CreateProductAPI(w http.ResponseWriter, r *http.Request) {
 	// Parse multipart form to access form fields and files
 	r.ParseMultipartForm(10 << 20) // 10MB max
 
-	user, err := GetCookie(r, "session_token")
-	if err != nil {
-		http.Error(w, `{"error": "Couldnt verify user"}`, http.StatusInternalServerError)
+	if _, validUser := ValidateUser(w, r); !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
 		return
 	}
-	query := "SELECT user_id FROM sessions WHERE session_token = ?"
 	defer db.Close()
-	var userID int
-	err = db.QueryRow(query, user).Scan(&userID)
-	if err != nil {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
-		return
-	}
 	itemName := r.FormValue("productName")
 	if itemName == "" {
-		http.Error(w, `{"error": "Product name is required"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Product name is required")
 		return
 	}
 	itemDescription := r.FormValue("productDescription")
 	if itemDescription == "" {
-		http.Error(w, `{"error": "Product description is required"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Product description is required")
 		return
 	}
 	itemPrice := r.FormValue("productPrice")
 	if itemPrice == "" {
-		http.Error(w, `{"error": "Product price is required"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Product price is required")
 		return
 	}
 	if price, err := strconv.ParseFloat(itemPrice, 64); err != nil || price < 0 {
-		http.Error(w, `{"error": "Product price cannot be negative"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Product price cannot be negative")
 		return
 	}
 	itemImage := r.FormValue("productImage")
 	if itemImage == "" {
-		http.Error(w, `{"error": "Product image is required"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Product image is required")
 		return
 	}
 	itemQuantity := r.FormValue("productQuantity")
 	if itemQuantity == "" {
-		http.Error(w, `{"error": "Product quantity is required"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Product quantity is required")
 		return
 	}
 	if qty, err := strconv.Atoi(itemQuantity); err != nil || qty < 0 {
-		http.Error(w, `{"error": "Product quantity cannot be negative"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Product quantity cannot be negative")
 		return
 	}
-	storeID := r.FormValue("store_id")
-	query = "select id from stores where owner_id = ? and id = ?"
-	var storeOwnerID int
-	err = db.QueryRow(query, userID, storeID).Scan(&storeOwnerID)
-	if err != nil {
-		http.Error(w, `{"error": "Unauthorized to add products to this store"}`, http.StatusUnauthorized)
+	storeID, _ := strconv.Atoi(r.FormValue("store_id"))
+	if _, isOwner := ValidateStoreOwner(w, r, storeID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized to add products to this store")
 		return
 	}
+	var categoryID interface{}
+	if itemCategory := r.FormValue("productCategory"); itemCategory != "" && itemCategory != "0" {
+		id, err := strconv.Atoi(itemCategory)
+		if err != nil || !validCategory(db, storeID, id) {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Category not found")
+			return
+		}
+		categoryID = id
+	}
 	var imageName string
 	valid, imageName := ValidateImage(StoreProductsPath, itemImage)
 	if !valid {
-		http.Error(w, `{"error": "`+imageName+`"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, imageName)
+		return
+	}
+	insertQuery := "INSERT INTO products (name, description, price, image, quantity, store_id, category_id) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := db.Exec(insertQuery, itemName, itemDescription, itemPrice, imageName, itemQuantity, storeID, categoryID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create product")
 		return
 	}
-	insertQuery := "INSERT INTO products (name, description, price, image, quantity, store_id) VALUES (?, ?, ?, ?, ?, ?)"
-	_, err = db.Exec(insertQuery, itemName, itemDescription, itemPrice, imageName, itemQuantity, storeOwnerID)
+	productID, _ := result.LastInsertId()
+	// every product starts as a single variant; options are added from the dashboard
+	_, err = db.Exec("INSERT INTO product_variants (product_id, price, quantity) VALUES (?, ?, ?)", productID, itemPrice, itemQuantity)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to create product"}`, http.StatusInternalServerError)
+		db.Exec("DELETE FROM products WHERE id = ?", productID)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create product")
 		return
 	}
+	if _, err := db.Exec("INSERT INTO product_media (product_id, kind, file, alt) VALUES (?, 'image', ?, ?)", productID, imageName, itemName); err != nil {
+		Logger(r).Warn("failed to add product image to gallery", "product_id", productID, "error", err)
+	}
+	if tags := r.FormValue("productTags"); tags != "" {
+		if err := setProductTags(db, int(productID), strings.Split(tags, ",")); err != nil {
+			Logger(r).Warn("failed to save product tags", "product_id", productID, "error", err)
+		}
+	}
+	PublishEvent(Event{Type: EventProductCreated, StoreID: storeID, Data: map[string]interface{}{
+		"product_id": productID,
+		"name":       itemName,
+	}})
+	if err := queueThumbnail(StoreProductsPath, imageName); err != nil {
+		Logger(r).Warn("failed to queue product thumbnail", "image", imageName, "error", err)
+	}
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte(`{"success": true}`))
 }
 
+// favoriteRequest is the v1 JSON body of FavoriteProduct and
+// UnfavoriteProduct
+type favoriteRequest struct {
+	ProductID int `json:"product_id"`
+}
+
+func (req favoriteRequest) form() url.Values {
+	return url.Values{"product_id": {strconv.Itoa(req.ProductID)}}
+}
+
 func FavoriteProduct(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte(`{"error": "Only Post Method Allowed"}`))
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Only Post Method Allowed")
 		return
 	}
 	userid, valid := ValidateCustomer(w, r)
 	if !valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`{"error": "Failed to validated customer","invalid": true}`))
+		sendError(w, r, (&APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "Failed to validated customer"}).With("invalid", true))
 		return
 	}
 	product_id := r.FormValue("product_id")
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error": "Database Error"}`))
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
 		return
 	}
 	defer db.Close()
 	query := "INSERT INTO favorites (user_id,product_id) values(?,?);"
 	_, err = db.Exec(query, userid, product_id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error": "Failed to favorite product"}`))
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to favorite product")
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -151,71 +312,131 @@ func FavoriteProduct(w http.ResponseWriter, r *http.Request) {
 func UnfavoriteProduct(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte(`{"error": "Only Post Method Allowed"}`))
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Only Post Method Allowed")
 		return
 	}
 	userid, valid := ValidateCustomer(w, r)
 	if !valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`{"error": "Failed to validated customer","invalid": true}`))
+		sendError(w, r, (&APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "Failed to validated customer"}).With("invalid", true))
 		return
 	}
 	product_id := r.FormValue("product_id")
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error": "Database Error"}`))
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
 		return
 	}
 	defer db.Close()
 	query := "DELETE FROM favorites WHERE user_id = ? AND product_id = ?;"
 	result, err := db.Exec(query, userid, product_id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error": "Failed to unfavorite product"}`))
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to unfavorite product")
 		return
 	}
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`{"error": "Favorite not found"}`))
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Favorite not found")
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"success": true}`))
 }
 
-// GetProductsAPI - Get all products for a store (JSON response)
+// GetProductsAPI lists a store's products (JSON response). Besides the
+// productListSpec fields it filters by ?category=, ?tag= and ?collection=;
+// a collection is sorted in its own order unless ?sort= is given.
 func GetProductsAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	storeIDStr := r.URL.Query().Get("store_id")
 	if storeIDStr == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "store_id is required"})
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "store_id is required")
 		return
 	}
 
 	storeID, err := strconv.ParseUint(storeIDStr, 10, 32)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid store_id"})
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store_id")
 		return
 	}
 
-	products, err := GetProductsByStoreID(uint(storeID))
+	params := r.URL.Query()
+	spec := productListSpec
+	var inCollection []int
+	if collection := params.Get("collection"); collection != "" {
+		if inCollection, err = collectionProducts(int(storeID), collection); err != nil {
+			writeListError(w, r, "products", err)
+			return
+		}
+		position := "CASE p.id"
+		for i, id := range inCollection {
+			position += fmt.Sprintf(" WHEN %d THEN %d", id, i)
+		}
+		position += fmt.Sprintf(" ELSE %d END", len(inCollection))
+		spec = spec.With("position", ListField{Expr: position, Kind: listInt, Sort: true})
+		spec.Sort = "position"
+	}
+	list, err := spec.Parse(params)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch products"})
+		writeListError(w, r, "products", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"products": products,
-		"success":  true,
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeListError(w, r, "products", err)
+		return
+	}
+	defer db.Close()
+	if err := filterProductList(db, int(storeID), list, params.Get("category"), params.Get("tag"), params.Get("collection"), inCollection); err != nil {
+		writeListError(w, r, "products", err)
+		return
+	}
+
+	products := []Product{}
+	page, err := list.Run(db, listSource{
+		Columns: "p.id, p.name, p.description, p.price, p.image, p.quantity, COALESCE(p.category_id, 0)",
+		From:    "products p LEFT JOIN categories c ON c.id = p.category_id",
+		Where:   "p.store_id = ?",
+		Args:    []interface{}{storeID},
+	}, func(scan func(dest ...interface{}) error) error {
+		var product Product
+		if err := scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Image, &product.Quantity, &product.CategoryID); err != nil {
+			return err
+		}
+		products = append(products, product)
+		return nil
 	})
+	if err != nil {
+		writeListError(w, r, "products", err)
+		return
+	}
+	ids := make([]int, len(products))
+	for i, p := range products {
+		ids[i] = int(p.ID)
+	}
+	where, args := inList("p.id", ids)
+	if err := loadProductDetails(db, int(storeID), products, where, args...); err != nil {
+		writeListError(w, r, "products", err)
+		return
+	}
+
+	page.Data = products
+	json.NewEncoder(w).Encode(page)
+}
+
+// updateProductRequest is the body of UpdateProductAPI
+type updateProductRequest struct {
+	ID          uint    `json:"id"`
+	StoreID     uint    `json:"store_id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+	Quantity    int     `json:"quantity"`
+	// CategoryID and Tags are left alone when missing; a category of 0
+	// clears it
+	CategoryID *int      `json:"category_id"`
+	Tags       *[]string `json:"tags"`
 }
 
 // UpdateProductAPI - Update an existing product
@@ -223,106 +444,116 @@ func UpdateProductAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Only POST method allowed"})
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Only POST method allowed")
 		return
 	}
 
-	// Get user from session
-	user, err := GetCookie(r, "session_token")
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+	if _, validUser := ValidateUser(w, r); !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
 		return
 	}
 	defer db.Close()
 
-	var userID int
-	query := "SELECT user_id FROM sessions WHERE session_token = ?"
-	err = db.QueryRow(query, user).Scan(&userID)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
-		return
-	}
-
 	// Parse JSON request
-	var productReq struct {
-		ID          uint    `json:"id"`
-		StoreID     uint    `json:"store_id"`
-		Name        string  `json:"name"`
-		Description string  `json:"description"`
-		Price       float64 `json:"price"`
-		Quantity    int     `json:"quantity"`
-	}
+	var productReq updateProductRequest
 
 	err = json.NewDecoder(r.Body).Decode(&productReq)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
 		return
 	}
 
 	// Validate inputs
 	if productReq.ID == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Product ID is required"})
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Product ID is required")
 		return
 	}
 
 	if productReq.Name == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Product name is required"})
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Product name is required")
 		return
 	}
 
 	if productReq.Price < 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Product price cannot be negative"})
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Product price cannot be negative")
 		return
 	}
 
 	if productReq.Quantity < 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Product quantity cannot be negative"})
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Product quantity cannot be negative")
 		return
 	}
 
 	// Verify product exists and get store_id
 	var checkStoreID uint
-	query = "SELECT store_id FROM products WHERE id = ?"
+	query := "SELECT store_id FROM products WHERE id = ?"
 	err = db.QueryRow(query, productReq.ID).Scan(&checkStoreID)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Product not found")
 		return
 	}
 
 	// Verify user owns the store
-	var storeOwnerID int
-	query = "SELECT id FROM stores WHERE owner_id = ? AND id = ?"
-	err = db.QueryRow(query, userID, checkStoreID).Scan(&storeOwnerID)
-	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized to update this product"})
+	storeOwnerID := int(checkStoreID)
+	if _, isOwner := ValidateStoreOwner(w, r, storeOwnerID); !isOwner {
+		writeError(w, r, http.StatusForbidden, CodeForbidden, "Unauthorized to update this product")
+		return
+	}
+	if productReq.CategoryID != nil && *productReq.CategoryID != 0 && !validCategory(db, storeOwnerID, *productReq.CategoryID) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Category not found")
 		return
 	}
 
-	// Update product
+	// Update product. Price and stock belong to the variants: a product with a
+	// single variant takes them from this form, one with options keeps the
+	// values from its variants.
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update product")
+		return
+	}
+	defer tx.Rollback()
 	updateQuery := "UPDATE products SET name = ?, description = ?, price = ?, quantity = ? WHERE id = ?"
-	_, err = db.Exec(updateQuery, productReq.Name, productReq.Description, productReq.Price, productReq.Quantity, productReq.ID)
+	_, err = tx.Exec(updateQuery, productReq.Name, productReq.Description, productReq.Price, productReq.Quantity, productReq.ID)
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE product_variants SET price = ?, quantity = ?
+			WHERE product_id = ? AND (SELECT COUNT(*) FROM product_variants WHERE product_id = ?) = 1
+		`, productReq.Price, productReq.Quantity, productReq.ID, productReq.ID)
+	}
+	if err == nil && productReq.CategoryID != nil {
+		var category interface{}
+		if *productReq.CategoryID != 0 {
+			category = *productReq.CategoryID
+		}
+		_, err = tx.Exec("UPDATE products SET category_id = ? WHERE id = ?", category, productReq.ID)
+	}
+	if err == nil && productReq.Tags != nil {
+		err = setProductTags(tx, int(productReq.ID), *productReq.Tags)
+	}
+	if err == nil {
+		err = syncProductFromVariants(tx, int(productReq.ID))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update product")
 		return
 	}
+	db.QueryRow("SELECT price, quantity FROM products WHERE id = ?", productReq.ID).Scan(&productReq.Price, &productReq.Quantity)
+	PublishEvent(Event{Type: EventProductUpdated, StoreID: storeOwnerID, Data: map[string]interface{}{
+		"product_id": productReq.ID,
+		"name":       productReq.Name,
+		"price":      productReq.Price,
+		"quantity":   productReq.Quantity,
+	}})
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -330,77 +561,60 @@ func UpdateProductAPI(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// deleteProductRequest is the body of DeleteProductAPI
+type deleteProductRequest struct {
+	ID      uint `json:"id"`
+	StoreID uint `json:"store_id"`
+}
+
 // DeleteProductAPI - Delete a product
 func DeleteProductAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Only POST method allowed"})
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Only POST method allowed")
 		return
 	}
 
-	// Get user from session
-	user, err := GetCookie(r, "session_token")
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+	if _, validUser := ValidateUser(w, r); !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
 		return
 	}
 	defer db.Close()
 
-	var userID int
-	query := "SELECT user_id FROM sessions WHERE session_token = ?"
-	err = db.QueryRow(query, user).Scan(&userID)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
-		return
-	}
-
 	// Parse JSON request
-	var deleteReq struct {
-		ID      uint `json:"id"`
-		StoreID uint `json:"store_id"`
-	}
+	var deleteReq deleteProductRequest
 
 	err = json.NewDecoder(r.Body).Decode(&deleteReq)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
 		return
 	}
 
 	if deleteReq.ID == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Product ID is required"})
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Product ID is required")
 		return
 	}
 
 	// Verify product exists and get store_id
 	var checkStoreID uint
-	query = "SELECT store_id FROM products WHERE id = ?"
+	query := "SELECT store_id FROM products WHERE id = ?"
 	err = db.QueryRow(query, deleteReq.ID).Scan(&checkStoreID)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Product not found")
 		return
 	}
 
 	// Verify user owns the store
-	var storeOwnerID int
-	query = "SELECT id FROM stores WHERE owner_id = ? AND id = ?"
-	err = db.QueryRow(query, userID, checkStoreID).Scan(&storeOwnerID)
-	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized to delete this product"})
+	storeOwnerID := int(checkStoreID)
+	if _, isOwner := ValidateStoreOwner(w, r, storeOwnerID); !isOwner {
+		writeError(w, r, http.StatusForbidden, CodeForbidden, "Unauthorized to delete this product")
 		return
 	}
 
@@ -408,17 +622,32 @@ func DeleteProductAPI(w http.ResponseWriter, r *http.Request) {
 	deleteQuery := "DELETE FROM products WHERE id = ?"
 	result, err := db.Exec(deleteQuery, deleteReq.ID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete product"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete product")
 		return
 	}
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
-		return
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Product not found")
+		return
+	}
+	for _, query := range []string{
+		"DELETE FROM product_variant_options WHERE variant_id IN (SELECT id FROM product_variants WHERE product_id = ?)",
+		"DELETE FROM product_options WHERE product_id = ?",
+		"UPDATE order_products SET variant_id = NULL WHERE variant_id IN (SELECT id FROM product_variants WHERE product_id = ?)",
+		"DELETE FROM product_variants WHERE product_id = ?",
+		"DELETE FROM product_tags WHERE product_id = ?",
+		"DELETE FROM collection_products WHERE product_id = ?",
+		"DELETE FROM product_media WHERE product_id = ?",
+		"DELETE FROM product_models WHERE product_id = ?",
+	} {
+		if _, err := db.Exec(query, deleteReq.ID); err != nil {
+			Logger(r).Warn("failed to remove product details", "product_id", deleteReq.ID, "error", err)
+		}
 	}
+	PublishEvent(Event{Type: EventProductDeleted, StoreID: storeOwnerID, Data: map[string]interface{}{
+		"product_id": deleteReq.ID,
+	}})
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -15,10 +16,12 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	sessionToken, err := GetCookie(r, "session_token")
 	if err == nil && sessionToken != "" {
 		// Delete the session from database
-		db, err := sql.Open("sqlite3", DATABASEPATH)
+		db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 		if err == nil {
 			defer db.Close()
-			db.Exec("DELETE FROM sessions WHERE session_token = ?", sessionToken)
+			if _, err := db.Exec("DELETE FROM sessions WHERE session_token = ?", sessionToken); err != nil {
+				Logger(r).Warn("failed to delete session on logout", "error", err)
+			}
 		}
 	}
 
@@ -26,17 +29,27 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// loginRequest is the v1 JSON body of LoginHandler
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (req loginRequest) form() url.Values {
+	return url.Values{"email": {req.Email}, "password": {req.Password}}
+}
+
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database connection error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database connection error")
 		return
 	}
 	defer db.Close()
@@ -45,25 +58,25 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	password := r.FormValue("password")
 	honeypot := r.FormValue("honeypot")
 	if honeypot != "" {
-		http.Error(w, `{"error": "Bot detected"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Bot detected")
 		return
 	}
 	query := "SELECT id,password FROM users WHERE email = ? AND store_id IS NULL"
 	row := db.QueryRow(query, email)
 
 	if row.Err() == sql.ErrNoRows {
-		http.Error(w, `{"error": "Invalid email or password"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email or password")
 		return
 	}
 	var userID int
 	var storedPassword string
 	if err := row.Scan(&userID, &storedPassword); err != nil {
-		http.Error(w, `{"error": "Invalid email or password"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email or password")
 		return
 	}
 
 	if bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password)) != nil {
-		http.Error(w, `{"error": "Invalid email or password"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email or password")
 		return
 	}
 	token := GenerateEmailCode()
@@ -71,12 +84,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	query = "INSERT INTO verification_codes (user_id, code, expires_at) VALUES (?, ?, datetime('now', '+5 minutes'))"
 	_, err = db.Exec(query, userID, token)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to store verification code"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to store verification code")
 		return
 	}
-	err = SendEmail(email, "Verification Code To Astropify: "+token, "A login to your account was just made. If this wasn't you, please reset your password immediately.")
+	err = sendTemplatedEmail(email, EmailVerification, 0, map[string]interface{}{
+		"Code": token, "Intro": "A login to your account was just made. If this wasn't you, please reset your password immediately.",
+	})
 	if err != nil {
-		http.Error(w, `{"error": "Failed to send email"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to send email")
 		return
 	}
 
@@ -85,17 +100,39 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"message": "Login successful","user_id": "` + fmt.Sprint(userID) + `", "email": "` + email + `"}`))
 }
 
+// registerRequest is the v1 JSON body of RegisterHandler; ProfilePicture is
+// a data URL
+type registerRequest struct {
+	Email          string `json:"email"`
+	Password       string `json:"password"`
+	FirstName      string `json:"first_name"`
+	LastName       string `json:"last_name"`
+	Age            int    `json:"age"`
+	ProfilePicture string `json:"profile_picture,omitempty"`
+}
+
+func (req registerRequest) form() url.Values {
+	return url.Values{
+		"email":           {req.Email},
+		"password":        {req.Password},
+		"first_name":      {req.FirstName},
+		"last_name":       {req.LastName},
+		"age":             {strconv.Itoa(req.Age)},
+		"profile_picture": {req.ProfilePicture},
+	}
+}
+
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	// Handle registration logic here
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database connection error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database connection error")
 		return
 	}
 	defer db.Close()
@@ -107,28 +144,28 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	age := r.FormValue("age")
 	ageInt, err := strconv.Atoi(age)
 	if err != nil {
-		http.Error(w, `{"error": "Age must be a valid number"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Age must be a valid number")
 		return
 	}
 	if ageInt < 13 {
-		http.Error(w, `{"error": "Users must be 13 and above"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Users must be 13 and above")
 		return
 	}
 	if ageInt > 120 {
-		http.Error(w, `{"error": "Users must be less than 120"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Users must be less than 120")
 		return
 	}
 	honeypot := r.FormValue("honeypot")
 	if honeypot != "" {
-		http.Error(w, `{"error": "Bot detected"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Bot detected")
 		return
 	}
 	if firstName == "" {
-		http.Error(w, `{"error": "First Name Required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "First Name Required")
 		return
 	}
 	if lastName == "" {
-		http.Error(w, `{"error": "Last Name Required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Last Name Required")
 		return
 	}
 	//picture can be empty
@@ -137,27 +174,29 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var exists int
 	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? and store_id IS NULL", email).Scan(&exists)
 	if err != nil {
-		http.Error(w, `{"error": "Database query error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database query error")
 		return
 	}
 	if exists > 0 {
-		http.Error(w, `{"error": "Email already exists"}`, http.StatusConflict)
+		writeError(w, r, http.StatusConflict, CodeAlreadyExists, "Email already exists")
 		return
 	}
 	// Validate email and password
 	if msg, valid := validateEmail(email); !valid {
-		http.Error(w, `{"error": "`+msg+`"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, msg)
 		return
 	}
 	if msg, valid := validatePassword(password); !valid {
-		http.Error(w, `{"error": "`+msg+`"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, msg)
 		return
 	}
 
 	token := GenerateEmailCode()
-	err = SendEmail(email, "Verification Code To Astropify: "+token, "Welcome to Astropify, Where you can create your store on the fly! Your verification code is: "+token)
+	err = sendTemplatedEmail(email, EmailVerification, 0, map[string]interface{}{
+		"Code": token, "Intro": "Welcome to Astropify, Where you can create your store on the fly!",
+	})
 	if err != nil {
-		http.Error(w, `{"error": "Failed to send email"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to send email")
 		return
 	}
 
@@ -167,34 +206,34 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if profilePicture != "" {
 		valid, picture := ValidateImage(avatarPath, profilePicture)
 		if !valid {
-			http.Error(w, `{"error": "`+picture+`"}`, http.StatusInternalServerError)
+			writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, picture)
 			return
 		}
 	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, `{"error": "Error processing password"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Error processing password")
 		return
 	}
 
 	query := "INSERT INTO users (email, password, first_name, last_name, age,user_type, profile_picture) VALUES (?, ?, ?, ?, ?, ?, ?)"
 	result, err := db.Exec(query, email, string(hashedPassword), firstName, lastName, age, 2, picture)
 	if err != nil {
-		http.Error(w, `{"error": "Error creating user"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Error creating user")
 		return
 	}
 
 	// Get the last inserted ID
 	userID, err := result.LastInsertId()
 	if err != nil {
-		http.Error(w, `{"error": "Error retrieving user ID"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Error retrieving user ID")
 		return
 	}
 
 	query = "INSERT INTO verification_codes (user_id, code, expires_at) VALUES (?, ?, datetime('now', '+5 minutes'))"
 	_, err = db.Exec(query, userID, token)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to store verification code"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to store verification code")
 		return
 	}
 
@@ -202,16 +241,31 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"message": "Registration successful", "user_id": "` + fmt.Sprint(userID) + `", "email": "` + email + `"}`))
 }
 
+// storeLoginRequest is the v1 JSON body of StoreLoginHandler
+type storeLoginRequest struct {
+	StoreID  int    `json:"store_id"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (req storeLoginRequest) form() url.Values {
+	return url.Values{
+		"store_id":      {strconv.Itoa(req.StoreID)},
+		"loginEmail":    {req.Email},
+		"loginPassword": {req.Password},
+	}
+}
+
 func StoreLoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database connection error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database connection error")
 		return
 	}
 	defer db.Close()
@@ -220,7 +274,7 @@ func StoreLoginHandler(w http.ResponseWriter, r *http.Request) {
 	storeID := r.FormValue("store_id")
 	honeypot := r.FormValue("honeypot")
 	if honeypot != "" {
-		http.Error(w, `{"error": "Bot detected"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Bot detected")
 		return
 	}
 	query := `SELECT id, password FROM users WHERE email = ? AND store_id = ?`
@@ -236,25 +290,25 @@ func StoreLoginHandler(w http.ResponseWriter, r *http.Request) {
 		new_row := db.QueryRow(queryStoreOwner, email)
 
 		if err := new_row.Scan(&userID, &storedPassword); err != nil {
-			http.Error(w, `{"error": "Invalid email, password, or store ID"}`, http.StatusUnauthorized)
+			writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email, password, or store ID")
 			return
 		}
 
 		if bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password)) != nil {
-			http.Error(w, `{"error": "Invalid email, password, or store ID"}`, http.StatusUnauthorized)
+			writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email, password, or store ID")
 			return
 		}
 
 		// Successful login for store owner
-		SetCookie(w, userID, "session_token")
+		SetCookie(w, r, userID, "session_token")
 		w.WriteHeader(http.StatusOK)
 		return
 	} else if err != nil {
-		http.Error(w, `{"error": "Invalid email, password, or store ID"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email, password, or store ID")
 		return
 	}
 	if bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password)) != nil {
-		http.Error(w, `{"error": "Invalid email, password, or store ID"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email, password, or store ID")
 		return
 	}
 
@@ -263,13 +317,16 @@ func StoreLoginHandler(w http.ResponseWriter, r *http.Request) {
 	query = "INSERT INTO verification_codes (user_id, code, expires_at) VALUES (?, ?, datetime('now', '+5 minutes'))"
 	_, err = db.Exec(query, userID, token)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to store verification code"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to store verification code")
 		return
 	}
 
-	err = SendEmail(email, "Verification Code: "+token, "Your store login verification code is: "+token)
+	brandStoreID, _ := strconv.Atoi(storeID)
+	err = sendTemplatedEmail(email, EmailVerification, brandStoreID, map[string]interface{}{
+		"Code": token, "Intro": "Use this code to finish logging in to the store.",
+	})
 	if err != nil {
-		http.Error(w, `{"error": "Failed to send verification email"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to send verification email")
 		return
 	}
 
@@ -278,16 +335,33 @@ func StoreLoginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"message": "Verification code sent", "user_id": "` + fmt.Sprint(userID) + `", "email": "` + email + `", "store_id": "` + storeID + `"}`))
 }
 
+// storeRegisterRequest is the v1 JSON body of StoreRegisterHandler
+type storeRegisterRequest struct {
+	StoreID  int    `json:"store_id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (req storeRegisterRequest) form() url.Values {
+	return url.Values{
+		"store_id":       {strconv.Itoa(req.StoreID)},
+		"signupName":     {req.Name},
+		"signupEmail":    {req.Email},
+		"signupPassword": {req.Password},
+	}
+}
+
 func StoreRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database connection error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database connection error")
 		return
 	}
 	defer db.Close()
@@ -298,64 +372,64 @@ func StoreRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	honeypot := r.FormValue("honeypot")
 
 	if honeypot != "" {
-		http.Error(w, `{"error": "Bot detected"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Bot detected")
 		return
 	}
 	// Check if store exists and get owner_id
 	var ownerID int
 	err = db.QueryRow("SELECT owner_id FROM stores WHERE id = ?", storeID).Scan(&ownerID)
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error": "Store does not exist"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Store does not exist")
 		return
 	}
 	if err != nil {
-		http.Error(w, `{"error": "Database query error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database query error")
 		return
 	}
 	// Validate email and password
 	if msg, valid := validateEmail(email); !valid {
-		http.Error(w, `{"error": "`+msg+`"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, msg)
 		return
 	}
 	if msg, valid := validatePassword(password); !valid {
-		http.Error(w, `{"error": "`+msg+`"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, msg)
 		return
 	}
 	// Check if email already exists
 	var exists int
 	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? and store_id = ?", email, storeID).Scan(&exists)
 	if err != nil {
-		http.Error(w, `{"error": "Database query error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database query error")
 		return
 	}
 	if exists > 0 {
-		http.Error(w, `{"error": "Email already exists"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeAlreadyExists, "Email already exists")
 		return
 	}
 	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? and store_id IS NULL", email).Scan(&exists)
 	if err != nil {
-		http.Error(w, `{"error": "Database query error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database query error")
 		return
 	}
 	if exists > 0 {
-		http.Error(w, `{"error": "Email already exists"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeAlreadyExists, "Email already exists")
 		return
 	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, `{"error": "Error processing password"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Error processing password")
 		return
 	}
 	query := "INSERT INTO users (email, password, first_name, user_type, store_id) VALUES (?, ?, ?, ?, ?)"
 	result, err := db.Exec(query, email, string(hashedPassword), name, 2, storeID)
 	if err != nil {
-		http.Error(w, `{"error": "Error creating user"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Error creating user")
 		return
 	}
 	// Get the last inserted ID
 	userID, err := result.LastInsertId()
 	if err != nil {
-		http.Error(w, `{"error": "Error retrieving user ID"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Error retrieving user ID")
 		return
 	}
 
@@ -364,13 +438,16 @@ func StoreRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	query = "INSERT INTO verification_codes (user_id, code, expires_at) VALUES (?, ?, datetime('now', '+5 minutes'))"
 	_, err = db.Exec(query, userID, token)
 	if err != nil {
-		http.Error(w, `{"error": "Failed to store verification code"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to store verification code")
 		return
 	}
 
-	err = SendEmail(email, "Verification Code: "+token, "Welcome! Your verification code is: "+token)
+	brandStoreID, _ := strconv.Atoi(storeID)
+	err = sendTemplatedEmail(email, EmailVerification, brandStoreID, map[string]interface{}{
+		"Code": token, "Intro": "Welcome! Use this code to verify your email address.",
+	})
 	if err != nil {
-		http.Error(w, `{"error": "Failed to send verification email"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to send verification email")
 		return
 	}
 
@@ -379,16 +456,27 @@ func StoreRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"message": "Verification code sent", "user_id": "` + fmt.Sprint(userID) + `", "email": "` + email + `", "store_id": "` + storeID + `"}`))
 }
 
+// storeVerifyRequest is the v1 JSON body of StoreVerifyCodeHandler
+type storeVerifyRequest struct {
+	StoreID int    `json:"store_id"`
+	UserID  int    `json:"user_id"`
+	Code    string `json:"code"`
+}
+
+func (req storeVerifyRequest) form() url.Values {
+	return url.Values{"store_id": {strconv.Itoa(req.StoreID)}, "user_id": {strconv.Itoa(req.UserID)}, "code": {req.Code}}
+}
+
 func StoreVerifyCodeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Database connection error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database connection error")
 		return
 	}
 	defer db.Close()
@@ -398,7 +486,7 @@ func StoreVerifyCodeHandler(w http.ResponseWriter, r *http.Request) {
 	storeID := r.FormValue("store_id")
 
 	if userID == "" || code == "" || storeID == "" {
-		http.Error(w, `{"error": "Missing required fields"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Missing required fields")
 		return
 	}
 
@@ -409,53 +497,59 @@ func StoreVerifyCodeHandler(w http.ResponseWriter, r *http.Request) {
 	err = db.QueryRow(query, userID).Scan(&storedCode, &expiresAt)
 
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error": "Invalid or expired verification code"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCode, "Invalid or expired verification code")
 		return
 	}
 	if err != nil {
-		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
 		return
 	}
 
 	if storedCode != code {
-		http.Error(w, `{"error": "Invalid verification code"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCode, "Invalid verification code")
 		return
 	}
 
 	// Check if code is expired
-	expiry, err := sql.Open("sqlite3", DATABASEPATH)
+	expiry, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err == nil {
 		defer expiry.Close()
 		var isExpired bool
-		expiry.QueryRow("SELECT datetime('now') > ?", expiresAt).Scan(&isExpired)
+		if err := expiry.QueryRow("SELECT datetime('now') > ?", expiresAt).Scan(&isExpired); err != nil {
+			Logger(r).Error("verification code expiry check failed", "user_id", userID, "error", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+			return
+		}
 		if isExpired {
-			http.Error(w, `{"error": "Verification code has expired"}`, http.StatusUnauthorized)
+			writeError(w, r, http.StatusUnauthorized, CodeInvalidCode, "Verification code has expired")
 			return
 		}
 	}
 
 	// Delete used code
-	db.Exec("DELETE FROM verification_codes WHERE user_id = ? AND code = ?", userID, code)
+	if _, err := db.Exec("DELETE FROM verification_codes WHERE user_id = ? AND code = ?", userID, code); err != nil {
+		Logger(r).Warn("failed to delete used verification code", "user_id", userID, "error", err)
+	}
 
 	// Set cookies for successful verification
 	userIDInt, err := strconv.Atoi(userID)
 	if err != nil {
-		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Invalid user ID")
 		return
 	}
 
 	customerTokenName := "customer_token_" + storeID
-	SetCookie(w, userIDInt, customerTokenName)
+	SetCookie(w, r, userIDInt, customerTokenName)
 
 	// Set store-specific cookie
 	storeIDInt, err := strconv.Atoi(storeID)
 	if err != nil {
-		http.Error(w, `{"error": "Can't find Store ID"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Can't find Store ID")
 		return
 	}
 	store, err := GetStoreByID(storeIDInt)
 	if err == nil && store.ID != 0 {
-		SetStoreCookie(w, int(store.OwnerID), store.Name)
+		SetStoreCookie(w, r, int(store.OwnerID), store.Name)
 	}
 
 	w.WriteHeader(http.StatusOK)
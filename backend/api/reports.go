@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type StoreReport struct {
+	StoreID      int     `json:"store_id"`
+	PeriodStart  string  `json:"period_start"`
+	OrdersCount  int     `json:"orders_count"`
+	ItemsSold    int     `json:"items_sold"`
+	Revenue      float64 `json:"revenue"`
+	TopProductID int     `json:"top_product_id,omitempty"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+// dailyReportJob summarises one day of sales per store into store_reports.
+// It covers yesterday (UTC) unless the payload names a "date" (YYYY-MM-DD),
+// and can be re-run for the same day since rows are upserted.
+func dailyReportJob(ctx context.Context, payload json.RawMessage) error {
+	var req struct {
+		Date string `json:"date"`
+	}
+	json.Unmarshal(payload, &req)
+
+	day := time.Now().UTC().AddDate(0, 0, -1)
+	if req.Date != "" {
+		parsed, err := time.Parse("2006-01-02", req.Date)
+		if err != nil {
+			return err
+		}
+		day = parsed
+	}
+	start := day.Format("2006-01-02")
+	end := day.AddDate(0, 0, 1).Format("2006-01-02")
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT o.store_id, COUNT(DISTINCT o.id), COALESCE(SUM(op.quantity), 0), COALESCE(SUM(op.quantity * op.price), 0)
+		FROM orders o
+		JOIN order_products op ON o.id = op.order_id
+		WHERE o.status IN ('paid', 'shipped', 'completed')
+		AND o.created_at >= ? AND o.created_at < ?
+		GROUP BY o.store_id
+	`, start, end)
+	if err != nil {
+		return err
+	}
+	var reports []StoreReport
+	for rows.Next() {
+		report := StoreReport{PeriodStart: start}
+		if err := rows.Scan(&report.StoreID, &report.OrdersCount, &report.ItemsSold, &report.Revenue); err != nil {
+			rows.Close()
+			return err
+		}
+		reports = append(reports, report)
+	}
+	rows.Close()
+
+	for _, report := range reports {
+		var topProduct sql.NullInt64
+		err := db.QueryRowContext(ctx, `
+			SELECT op.product_id
+			FROM orders o
+			JOIN order_products op ON o.id = op.order_id
+			WHERE o.store_id = ? AND o.status IN ('paid', 'shipped', 'completed')
+			AND o.created_at >= ? AND o.created_at < ?
+			GROUP BY op.product_id
+			ORDER BY SUM(op.quantity) DESC
+			LIMIT 1
+		`, report.StoreID, start, end).Scan(&topProduct)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO store_reports (store_id, period_start, orders_count, items_sold, revenue, top_product_id)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(store_id, period_start) DO UPDATE SET
+				orders_count = excluded.orders_count,
+				items_sold = excluded.items_sold,
+				revenue = excluded.revenue,
+				top_product_id = excluded.top_product_id,
+				created_at = datetime('now')
+		`, report.StoreID, start, report.OrdersCount, report.ItemsSold, report.Revenue, topProduct)
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("generated daily store reports", "date", start, "stores", len(reports))
+	return nil
+}
+
+// GetStoreReports returns the daily sales reports of a store to its owner,
+// newest first.
+func GetStoreReports(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, validUser := ValidateUser(w, r); !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	if r.URL.Query().Get("store_id") == "" {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Store ID is required")
+		return
+	}
+	ownedStoreID, _ := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if _, isOwner := ValidateStoreOwner(w, r, ownedStoreID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized to view reports for this store")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT store_id, period_start, orders_count, items_sold, revenue, COALESCE(top_product_id, 0), created_at
+		FROM store_reports
+		WHERE store_id = ?
+		ORDER BY period_start DESC
+		LIMIT 90
+	`, ownedStoreID)
+	if err != nil {
+		Logger(r).Error("store reports query failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch reports")
+		return
+	}
+	defer rows.Close()
+
+	reports := []StoreReport{}
+	for rows.Next() {
+		var report StoreReport
+		if err := rows.Scan(&report.StoreID, &report.PeriodStart, &report.OrdersCount, &report.ItemsSold,
+			&report.Revenue, &report.TopProductID, &report.CreatedAt); err != nil {
+			Logger(r).Warn("store report scan failed", "error", err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reports": reports,
+	})
+}
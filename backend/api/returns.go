@@ -0,0 +1,944 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Return statuses. A request is approved or rejected; an approved return is
+// received back at the store and then refunded.
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnRefunded  = "refunded"
+)
+
+// maxReturnPhotos caps the photos a customer can attach to one request
+const maxReturnPhotos = 5
+
+// returnTransitions are the owner's actions on a return and the status each
+// one moves it from and to
+var returnTransitions = map[string]struct{ from, to string }{
+	"approve": {ReturnRequested, ReturnApproved},
+	"reject":  {ReturnRequested, ReturnRejected},
+	"receive": {ReturnApproved, ReturnReceived},
+	"refund":  {ReturnReceived, ReturnRefunded},
+}
+
+// Return is a customer's request to send some of an order back
+type Return struct {
+	ID           int          `json:"id"`
+	OrderID      int          `json:"order_id"`
+	CustomerName string       `json:"customer_name"`
+	Status       string       `json:"status"`
+	Reason       string       `json:"reason"`
+	OwnerNote    string       `json:"owner_note,omitempty"`
+	Restocked    bool         `json:"restocked"`
+	Value        float64      `json:"value"`
+	RefundAmount float64      `json:"refund_amount,omitempty"`
+	Items        []ReturnItem `json:"items"`
+	Photos       []string     `json:"photos"`
+	Shipment     *Shipment    `json:"shipment,omitempty"`
+	CreatedAt    string       `json:"created_at"`
+	UpdatedAt    string       `json:"updated_at"`
+	ReceivedAt   string       `json:"received_at,omitempty"`
+	RefundedAt   string       `json:"refunded_at,omitempty"`
+}
+
+// ReturnItem is a quantity of one order line being sent back
+type ReturnItem struct {
+	OrderProductID int     `json:"order_product_id"`
+	ProductID      int     `json:"product_id,omitempty"`
+	VariantID      int     `json:"variant_id,omitempty"`
+	Name           string  `json:"name,omitempty"`
+	Quantity       int     `json:"quantity"`
+	Price          float64 `json:"price,omitempty"`
+}
+
+// ReturnableItem is an order line with how much of it is already in a return
+type ReturnableItem struct {
+	OrderProductID int    `json:"order_product_id"`
+	Name           string `json:"name"`
+	Image          string `json:"image"`
+	Quantity       int    `json:"quantity"`
+	Returned       int    `json:"returned"`
+}
+
+// errInvalidReturn marks return requests that can never succeed as sent
+var errInvalidReturn = errors.New("invalid return")
+
+// errNotReturnable marks orders that cannot be returned as they are now
+var errNotReturnable = errors.New("order not returnable")
+
+// returnWindow is how long after delivery an order can be returned,
+// RETURN_WINDOW_DAYS days (30 by default)
+func returnWindow() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("RETURN_WINDOW_DAYS"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// returnPhotoPath is where a return photo is served from. Photos are private
+// to the store and the customer, so they are not under a public file server.
+func returnPhotoPath(photoID int) string {
+	return "/returns/photo?id=" + strconv.Itoa(photoID)
+}
+
+// loadReturns returns the returns matching where, newest first, with their
+// items, photos and return label. where is a fixed condition on r.
+func loadReturns(db *sql.DB, where string, args ...interface{}) ([]Return, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.order_id, COALESCE(u.first_name, ''), r.status, r.reason, r.owner_note, r.restocked,
+			r.refund_amount, r.created_at, r.updated_at, r.received_at, r.refunded_at
+		FROM returns r
+		LEFT JOIN users u ON r.user_id = u.id
+		WHERE `+where+`
+		ORDER BY r.created_at DESC, r.id DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	returns := []Return{}
+	for rows.Next() {
+		var ret Return
+		var createdAt, updatedAt time.Time
+		var receivedAt, refundedAt sql.NullTime
+		if err := rows.Scan(&ret.ID, &ret.OrderID, &ret.CustomerName, &ret.Status, &ret.Reason, &ret.OwnerNote, &ret.Restocked,
+			&ret.RefundAmount, &createdAt, &updatedAt, &receivedAt, &refundedAt); err != nil {
+			return nil, err
+		}
+		ret.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		ret.UpdatedAt = updatedAt.UTC().Format(time.RFC3339)
+		if receivedAt.Valid {
+			ret.ReceivedAt = receivedAt.Time.UTC().Format(time.RFC3339)
+		}
+		if refundedAt.Valid {
+			ret.RefundedAt = refundedAt.Time.UTC().Format(time.RFC3339)
+		}
+		returns = append(returns, ret)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range returns {
+		if returns[i].Items, err = returnItems(db, returns[i].ID); err != nil {
+			return nil, err
+		}
+		for _, item := range returns[i].Items {
+			returns[i].Value += float64(item.Quantity) * item.Price
+		}
+		returns[i].Value = math.Round(returns[i].Value*1000) / 1000
+		if returns[i].Photos, err = returnPhotos(db, returns[i].ID); err != nil {
+			return nil, err
+		}
+		if returns[i].Shipment, err = returnShipment(db, returns[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return returns, nil
+}
+
+// loadReturn returns one return of a store, or sql.ErrNoRows
+func loadReturn(db *sql.DB, storeID int, returnID int) (Return, error) {
+	returns, err := loadReturns(db, "r.id = ? AND r.store_id = ?", returnID, storeID)
+	if err != nil {
+		return Return{}, err
+	}
+	if len(returns) == 0 {
+		return Return{}, sql.ErrNoRows
+	}
+	return returns[0], nil
+}
+
+func returnItems(db *sql.DB, returnID int) ([]ReturnItem, error) {
+	rows, err := db.Query(`
+		SELECT ri.order_product_id, op.product_id, COALESCE(op.variant_id, 0), `+orderLineName+`, ri.quantity, op.price
+		FROM return_items ri
+		JOIN order_products op ON ri.order_product_id = op.id
+		JOIN products p ON op.product_id = p.id
+		WHERE ri.return_id = ?
+		ORDER BY ri.order_product_id
+	`, returnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ReturnItem{}
+	for rows.Next() {
+		var item ReturnItem
+		if err := rows.Scan(&item.OrderProductID, &item.ProductID, &item.VariantID, &item.Name, &item.Quantity, &item.Price); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func returnPhotos(db *sql.DB, returnID int) ([]string, error) {
+	rows, err := db.Query("SELECT id FROM return_photos WHERE return_id = ? ORDER BY id", returnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	photos := []string{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		photos = append(photos, returnPhotoPath(id))
+	}
+	return photos, rows.Err()
+}
+
+// returnShipment is the label booked for sending a return back, if any
+func returnShipment(db *sql.DB, returnID int) (*Shipment, error) {
+	rows, err := db.Query(`
+		SELECT id, order_id, carrier, service, tracking_number, label_url, cost, status,
+			estimated_delivery, delivered_at, created_at
+		FROM shipments WHERE return_id = ? ORDER BY id DESC LIMIT 1
+	`, returnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shipments, err := scanShipments(db, rows)
+	if err != nil || len(shipments) == 0 {
+		return nil, err
+	}
+	return &shipments[0], nil
+}
+
+// returnableItems returns every line of the order with how much of it is in
+// returns that were not rejected
+func returnableItems(db *sql.DB, orderID int) ([]ReturnableItem, error) {
+	rows, err := db.Query(`
+		SELECT op.id, `+orderLineName+`, COALESCE(NULLIF(v.image, ''), p.image, ''), op.quantity,
+			COALESCE((SELECT SUM(ri.quantity) FROM return_items ri JOIN returns r ON ri.return_id = r.id
+				WHERE ri.order_product_id = op.id AND r.status != ?), 0)
+		FROM order_products op
+		JOIN products p ON op.product_id = p.id
+		LEFT JOIN product_variants v ON op.variant_id = v.id
+		WHERE op.order_id = ?
+		ORDER BY op.id
+	`, ReturnRejected, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ReturnableItem{}
+	for rows.Next() {
+		var item ReturnableItem
+		if err := rows.Scan(&item.OrderProductID, &item.Name, &item.Image, &item.Quantity, &item.Returned); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// checkReturnable makes sure the customer's order arrived and is still
+// within the return window
+func checkReturnable(db *sql.DB, storeID int, userID int, orderID int) error {
+	var status string
+	var deliveredAt, updatedAt sql.NullTime
+	err := db.QueryRow("SELECT status, delivered_at, updated_at FROM orders WHERE id = ? AND store_id = ? AND user_id = ?",
+		orderID, storeID, userID).Scan(&status, &deliveredAt, &updatedAt)
+	if err != nil {
+		return err
+	}
+	if status != "delivered" && status != "completed" {
+		return fmt.Errorf("%w: only delivered orders can be returned", errNotReturnable)
+	}
+	arrived := deliveredAt
+	if !arrived.Valid {
+		arrived = updatedAt
+	}
+	if window := returnWindow(); arrived.Valid && time.Since(arrived.Time) > window {
+		return fmt.Errorf("%w: returns are accepted for %d days after delivery", errNotReturnable, int(window.Hours()/24))
+	}
+	return nil
+}
+
+// returnRequest is the body of POST /api/customer/returns/create. Photos are
+// data URLs, as for product images.
+type returnRequest struct {
+	OrderID int          `json:"order_id"`
+	Reason  string       `json:"reason"`
+	Items   []ReturnItem `json:"items"`
+	Photos  []string     `json:"photos"`
+}
+
+// createReturn checks the requested items against what is left to return,
+// saves the photos and stores the request
+func createReturn(db *sql.DB, storeID int, userID int, req returnRequest) (int, error) {
+	if err := checkReturnable(db, storeID, userID, req.OrderID); err != nil {
+		return 0, err
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		return 0, fmt.Errorf("%w: tell the store why you are returning the items", errInvalidReturn)
+	}
+	if len(reason) > 1000 {
+		return 0, fmt.Errorf("%w: the reason must be at most 1000 characters", errInvalidReturn)
+	}
+	if len(req.Photos) > maxReturnPhotos {
+		return 0, fmt.Errorf("%w: attach at most %d photos", errInvalidReturn, maxReturnPhotos)
+	}
+
+	lines, err := returnableItems(db, req.OrderID)
+	if err != nil {
+		return 0, err
+	}
+	remaining := map[int]int{}
+	for _, line := range lines {
+		remaining[line.OrderProductID] = line.Quantity - line.Returned
+	}
+	var items []ReturnItem
+	for _, item := range req.Items {
+		left, ok := remaining[item.OrderProductID]
+		if !ok {
+			return 0, fmt.Errorf("%w: item %d is not part of this order", errInvalidReturn, item.OrderProductID)
+		}
+		if item.Quantity == 0 {
+			continue
+		}
+		if item.Quantity < 0 || item.Quantity > left {
+			return 0, fmt.Errorf("%w: only %d of item %d can be returned", errInvalidReturn, left, item.OrderProductID)
+		}
+		remaining[item.OrderProductID] -= item.Quantity
+		items = append(items, ReturnItem{OrderProductID: item.OrderProductID, Quantity: item.Quantity})
+	}
+	if len(items) == 0 {
+		return 0, fmt.Errorf("%w: choose at least one item to return", errInvalidReturn)
+	}
+
+	var photos []string
+	removePhotos := func() {
+		for _, name := range photos {
+			removeUpload(StoreReturnsPath, name)
+		}
+	}
+	for _, photo := range req.Photos {
+		ok, result := ValidateImage(StoreReturnsPath, photo)
+		if !ok {
+			removePhotos()
+			return 0, fmt.Errorf("%w: %s", errInvalidReturn, result)
+		}
+		photos = append(photos, result)
+	}
+
+	returnID, err := insertReturn(db, storeID, userID, req.OrderID, reason, items, photos)
+	if err != nil {
+		removePhotos()
+		return 0, err
+	}
+	return returnID, nil
+}
+
+func insertReturn(db *sql.DB, storeID int, userID int, orderID int, reason string, items []ReturnItem, photos []string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO returns (order_id, store_id, user_id, reason) VALUES (?, ?, ?, ?)",
+		orderID, storeID, userID, reason)
+	if err != nil {
+		return 0, err
+	}
+	returnID, _ := result.LastInsertId()
+	for _, item := range items {
+		if _, err := tx.Exec("INSERT INTO return_items (return_id, order_product_id, quantity) VALUES (?, ?, ?)",
+			returnID, item.OrderProductID, item.Quantity); err != nil {
+			return 0, err
+		}
+	}
+	for _, name := range photos {
+		if _, err := tx.Exec("INSERT INTO return_photos (return_id, filename) VALUES (?, ?)", returnID, name); err != nil {
+			return 0, err
+		}
+	}
+	return int(returnID), tx.Commit()
+}
+
+// returnParcel is the parcel going from the customer back to the store
+func returnParcel(db *sql.DB, storeID int, ret Return) (Parcel, error) {
+	var shippingInfo string
+	var store ShippingAddress
+	err := db.QueryRow(`
+		SELECT COALESCE(o.shipping_info, ''), s.name, COALESCE(s.address, ''), COALESCE(s.phone, '')
+		FROM orders o JOIN stores s ON o.store_id = s.id
+		WHERE o.id = ? AND o.store_id = ?
+	`, ret.OrderID, storeID).Scan(&shippingInfo, &store.FullName, &store.Address, &store.Phone)
+	if err != nil {
+		return Parcel{}, err
+	}
+	customer := parseShippingInfo(shippingInfo)
+	pieces := 0
+	for _, item := range ret.Items {
+		pieces += item.Quantity
+	}
+	from := strings.TrimSpace(customer.Address + " " + customer.City)
+	return Parcel{From: from, To: store, Items: pieces}, nil
+}
+
+// bookReturnLabel buys a label for the return parcel and stores it as a
+// shipment of the order tied to the return
+func bookReturnLabel(db *sql.DB, storeID int, ret Return, carrierName string, service string) error {
+	parcel, err := returnParcel(db, storeID, ret)
+	if err != nil {
+		return err
+	}
+	label, err := bookLabel(carrierName, service, parcel)
+	if errors.Is(err, errInvalidShipment) {
+		return fmt.Errorf("%w: %s", errInvalidReturn, strings.TrimPrefix(err.Error(), errInvalidShipment.Error()+": "))
+	} else if err != nil {
+		return err
+	}
+	var estimated interface{}
+	if label.Days > 0 {
+		estimated = sqlTime(time.Now().Add(time.Duration(label.Days) * 24 * time.Hour))
+	}
+	result, err := db.Exec(`
+		INSERT INTO shipments (order_id, store_id, return_id, carrier, service, tracking_number, label_url, cost, status, estimated_delivery)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, ret.OrderID, storeID, ret.ID, carrierName, service, label.TrackingNumber, label.LabelURL, label.Cost, ShipmentLabelCreated, estimated)
+	if err != nil {
+		return err
+	}
+	shipmentID, _ := result.LastInsertId()
+	if _, _, err := pollShipment(db, int(shipmentID), carrierName, label.TrackingNumber, ShipmentLabelCreated); err != nil {
+		Logger(nil).Warn("shipment tracking failed", "shipment_id", shipmentID, "carrier", carrierName, "error", err)
+	}
+	return nil
+}
+
+// restockReturn puts the returned units back on sale
+func restockReturn(db *sql.DB, ret Return) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, item := range ret.Items {
+		var err error
+		if item.VariantID != 0 {
+			err = adjustVariantStock(tx, item.VariantID, item.Quantity)
+		} else {
+			// the variant was removed since the order; the units go back to the product
+			_, err = tx.Exec("UPDATE products SET quantity = quantity + ? WHERE id = ?", item.Quantity, item.ProductID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE returns SET restocked = 1 WHERE id = ?", ret.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, item := range ret.Items {
+		publishStockChange(db, item.ProductID)
+	}
+	return nil
+}
+
+// publishReturn tells the store's staff and the customer a return changed
+func publishReturn(db *sql.DB, storeID int, returnID int) {
+	var orderID, customerID int
+	var status string
+	if err := db.QueryRow("SELECT order_id, user_id, status FROM returns WHERE id = ?", returnID).Scan(&orderID, &customerID, &status); err != nil {
+		return
+	}
+	PublishEvent(Event{Type: EventReturnUpdated, StoreID: storeID, UserID: customerID, Data: map[string]interface{}{
+		"order_id":  orderID,
+		"return_id": returnID,
+		"status":    status,
+	}})
+}
+
+// returnStatusMessage is the line customers get when their return moves on
+func returnStatusMessage(status string, hasLabel bool) string {
+	switch status {
+	case ReturnApproved:
+		if hasLabel {
+			return "Your return was approved. Print the return label from your order page and hand the parcel to the courier."
+		}
+		return "Your return was approved. Please send the items back to the store."
+	case ReturnRejected:
+		return "Your return request was not accepted."
+	case ReturnReceived:
+		return "We received your returned items and are processing your refund."
+	}
+	return "Your return was updated."
+}
+
+// announceReturn notifies the customer of their return's new status. Refunds
+// use the refund email.
+func announceReturn(r *http.Request, db *sql.DB, storeID int, ret Return) {
+	var customerID int
+	var customerName, storeName string
+	err := db.QueryRow(`
+		SELECT r.user_id, u.first_name, s.name
+		FROM returns r JOIN users u ON r.user_id = u.id JOIN stores s ON r.store_id = s.id
+		WHERE r.id = ?
+	`, ret.ID).Scan(&customerID, &customerName, &storeName)
+	if err != nil {
+		Logger(r).Warn("return notification lookup failed", "return_id", ret.ID, "error", err)
+		return
+	}
+
+	n := Notification{
+		UserID: customerID,
+		Type:   NotifyReturn,
+		Title:  fmt.Sprintf("Return #%d for order #%d is %s", ret.ID, ret.OrderID, ret.Status),
+		Body:   returnStatusMessage(ret.Status, ret.Shipment != nil),
+		Link:   orderTrackingPath(storeName, ret.OrderID),
+	}
+	if ret.OwnerNote != "" {
+		n.Body += " " + ret.OwnerNote
+	}
+	if ret.Status != ReturnRefunded {
+		notify(r, n, nil)
+		return
+	}
+	n.Body = fmt.Sprintf("BD %.3f was refunded for your returned items.", ret.RefundAmount)
+	reason := ret.OwnerNote
+	if reason == "" {
+		reason = fmt.Sprintf("Return #%d", ret.ID)
+	}
+	notify(r, n, &notificationEmail{Kind: EmailRefund, StoreID: storeID, Data: map[string]interface{}{
+		"OrderID":      ret.OrderID,
+		"CustomerName": customerName,
+		"Amount":       ret.RefundAmount,
+		"Reason":       reason,
+	}})
+}
+
+// writeReturnError answers with 400 for requests that cannot succeed and 500
+// for everything else
+func writeReturnError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
+		return
+	}
+	if errors.Is(err, errNotReturnable) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, invalidMessage(err, errNotReturnable))
+		return
+	}
+	if errors.Is(err, errInvalidReturn) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, invalidMessage(err, errInvalidReturn))
+		return
+	}
+	Logger(r).Error("return request failed", "error", err)
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to process return")
+}
+
+// customerReturns hides what only the store needs from a customer's returns
+func customerReturns(returns []Return) []Return {
+	for i := range returns {
+		if returns[i].Shipment != nil {
+			returns[i].Shipment.Cost = 0
+		}
+	}
+	return returns
+}
+
+// CreateReturn lets a customer ask to send back some of a delivered order:
+// POST /api/customer/returns/create?store_id= with {"order_id", "reason",
+// "items": [{"order_product_id", "quantity"}], "photos": [data URLs]}
+func CreateReturn(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	storeIDStr := r.URL.Query().Get("store_id")
+	storeID, err := strconv.Atoi(storeIDStr)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
+		return
+	}
+	userID, validUser := ValidateStoreCustomer(w, r, storeIDStr)
+	if !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	var req returnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrderID == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	returnID, err := createReturn(db, storeID, userID, req)
+	if err != nil {
+		writeReturnError(w, r, err)
+		return
+	}
+	Logger(r).Info("return requested", "order_id", req.OrderID, "return_id", returnID)
+	publishReturn(db, storeID, returnID)
+
+	var ownerID int
+	var storeName string
+	if err := db.QueryRow("SELECT owner_id, name FROM stores WHERE id = ?", storeID).Scan(&ownerID, &storeName); err == nil {
+		notify(r, Notification{
+			UserID: ownerID,
+			Type:   NotifyNewReturn,
+			Title:  fmt.Sprintf("Return requested for order #%d", req.OrderID),
+			Body:   strings.TrimSpace(req.Reason),
+			Link:   "/" + storeName + "/dashboard",
+		}, nil)
+	}
+
+	response := map[string]interface{}{"success": true, "return_id": returnID}
+	if order, err := loadCustomerOrder(db, storeID, userID, req.OrderID); err == nil {
+		response["order"] = order
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetCustomerReturns lists the customer's returns on a store. With order_id
+// it lists that order's returns and what can still be returned.
+func GetCustomerReturns(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	storeIDStr := r.URL.Query().Get("store_id")
+	storeID, err := strconv.Atoi(storeIDStr)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
+		return
+	}
+	userID, validUser := ValidateStoreCustomer(w, r, storeIDStr)
+	if !validUser {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	response := map[string]interface{}{"window_days": int(returnWindow().Hours() / 24)}
+	orderIDStr := r.URL.Query().Get("order_id")
+	if orderIDStr == "" {
+		returns, err := loadReturns(db, "r.store_id = ? AND r.user_id = ?", storeID, userID)
+		if err != nil {
+			Logger(r).Error("returns query failed", "error", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch returns")
+			return
+		}
+		response["returns"] = customerReturns(returns)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	orderID, err := strconv.Atoi(orderIDStr)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid order ID")
+		return
+	}
+	if _, err := loadCustomerOrder(db, storeID, userID, orderID); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
+		return
+	}
+	returns, err := loadReturns(db, "r.order_id = ? AND r.user_id = ?", orderID, userID)
+	if err != nil {
+		Logger(r).Error("returns query failed", "order_id", orderID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch returns")
+		return
+	}
+	items, err := returnableItems(db, orderID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch order items")
+		return
+	}
+	response["returns"] = customerReturns(returns)
+	response["items"] = items
+	if err := checkReturnable(db, storeID, userID, orderID); err != nil {
+		response["returnable"] = false
+		response["reason"] = invalidMessage(err, errNotReturnable)
+	} else {
+		response["returnable"] = true
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetStoreReturns lists a store's returns for the dashboard:
+// GET /api/returns?store_id=&status= where status is "open" (the default),
+// "all" or one return status
+func GetStoreReturns(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, storeID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	where := "r.store_id = ?"
+	args := []interface{}{storeID}
+	switch status := r.URL.Query().Get("status"); status {
+	case "", "open":
+		where += " AND r.status IN (?, ?, ?)"
+		args = append(args, ReturnRequested, ReturnApproved, ReturnReceived)
+	case "all":
+	case ReturnRequested, ReturnApproved, ReturnRejected, ReturnReceived, ReturnRefunded:
+		where += " AND r.status = ?"
+		args = append(args, status)
+	default:
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid status")
+		return
+	}
+	if orderID, err := strconv.Atoi(r.URL.Query().Get("order_id")); err == nil {
+		where += " AND r.order_id = ?"
+		args = append(args, orderID)
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	returns, err := loadReturns(db, where, args...)
+	if err != nil {
+		Logger(r).Error("returns query failed", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch returns")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"returns": returns})
+}
+
+// returnRatesRequest is the body of GetReturnRates
+type returnRatesRequest struct {
+	StoreID  int `json:"store_id"`
+	ReturnID int `json:"return_id"`
+}
+
+// GetReturnRates quotes every enabled carrier for a return label:
+// POST /api/returns/rates with {"store_id", "return_id"}
+func GetReturnRates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req returnRatesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReturnID == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request")
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, req.StoreID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	ret, err := loadReturn(db, req.StoreID, req.ReturnID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Return not found")
+		return
+	} else if err != nil {
+		writeReturnError(w, r, err)
+		return
+	}
+	parcel, err := returnParcel(db, req.StoreID, ret)
+	if err != nil {
+		writeReturnError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"rates": quoteAll(parcel)})
+}
+
+// updateReturnRequest is the body of UpdateReturn
+type updateReturnRequest struct {
+	StoreID  int     `json:"store_id"`
+	ReturnID int     `json:"return_id"`
+	Action   string  `json:"action"`
+	Note     string  `json:"note"`
+	Carrier  string  `json:"carrier"`
+	Service  string  `json:"service"`
+	Restock  bool    `json:"restock"`
+	Amount   float64 `json:"amount"`
+}
+
+// UpdateReturn moves a return on: POST /api/returns/update with
+// {"store_id", "return_id", "action", "note"}. approve may book a return
+// label with "carrier" and "service", receive takes "restock" and refund
+// takes "amount", which defaults to the value of the returned items.
+// A return that already moved on returns 409 with the return as it is now.
+func UpdateReturn(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req updateReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReturnID == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request")
+		return
+	}
+	transition, ok := returnTransitions[req.Action]
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid action")
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, req.StoreID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	ret, err := loadReturn(db, req.StoreID, req.ReturnID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Return not found")
+		return
+	} else if err != nil {
+		writeReturnError(w, r, err)
+		return
+	}
+	conflict := func() {
+		current, _ := loadReturn(db, req.StoreID, req.ReturnID)
+		sendError(w, r, (&APIError{Status: http.StatusConflict, Code: CodeInvalidState,
+			Message: fmt.Sprintf("Return is already %s", current.Status)}).With("return", current))
+	}
+	if ret.Status != transition.from {
+		conflict()
+		return
+	}
+
+	amount := 0.0
+	if req.Action == "refund" {
+		amount = req.Amount
+		if amount == 0 {
+			amount = ret.Value
+		}
+		if amount < 0 || amount > ret.Value+0.0005 {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, fmt.Sprintf("Refund must be between 0 and %.3f BHD", ret.Value))
+			return
+		}
+	}
+	if req.Action == "approve" && req.Carrier != "" && req.Carrier != manualCarrier {
+		if err := bookReturnLabel(db, req.StoreID, ret, req.Carrier, req.Service); err != nil {
+			writeReturnError(w, r, err)
+			return
+		}
+	}
+
+	note := strings.TrimSpace(req.Note)
+	result, err := db.Exec(`
+		UPDATE returns
+		SET status = ?, owner_note = CASE WHEN ? != '' THEN ? ELSE owner_note END,
+			refund_amount = CASE WHEN ? = 'refunded' THEN ? ELSE refund_amount END,
+			received_at = CASE WHEN ? = 'received' THEN datetime('now') ELSE received_at END,
+			refunded_at = CASE WHEN ? = 'refunded' THEN datetime('now') ELSE refunded_at END,
+			updated_at = datetime('now')
+		WHERE id = ? AND status = ?
+	`, transition.to, note, note, transition.to, amount, transition.to, transition.to, req.ReturnID, transition.from)
+	if err != nil {
+		writeReturnError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		conflict()
+		return
+	}
+	if req.Action == "receive" && req.Restock {
+		if err := restockReturn(db, ret); err != nil {
+			Logger(r).Error("failed to restock return", "return_id", ret.ID, "error", err)
+		}
+	}
+	Logger(r).Info("return updated", "return_id", ret.ID, "order_id", ret.OrderID, "status", transition.to)
+
+	ret, err = loadReturn(db, req.StoreID, req.ReturnID)
+	if err != nil {
+		writeReturnError(w, r, err)
+		return
+	}
+	publishReturn(db, req.StoreID, ret.ID)
+	announceReturn(r, db, req.StoreID, ret)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "return": ret})
+}
+
+// ReturnPhoto serves a photo attached to a return to the store's owner and
+// the customer who sent it
+func ReturnPhoto(w http.ResponseWriter, r *http.Request) {
+	photoID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var storeID, customerID int
+	var filename string
+	err = db.QueryRow(`
+		SELECT r.store_id, r.user_id, p.filename
+		FROM return_photos p JOIN returns r ON p.return_id = r.id
+		WHERE p.id = ?
+	`, photoID).Scan(&storeID, &customerID, &filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	_, allowed := ValidateStoreOwner(w, r, storeID)
+	if !allowed {
+		userID, isCustomer := ValidateStoreCustomer(w, r, strconv.Itoa(storeID))
+		allowed = isCustomer && userID == customerID
+	}
+	if !allowed {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	serveBlob(w, r, StoreReturnsPath, filepath.Base(filename))
+}
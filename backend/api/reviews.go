@@ -3,16 +3,29 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
 
+// reviewRequest is the v1 JSON body of CreateReview
+type reviewRequest struct {
+	ProductID int    `json:"product_id"`
+	Rating    int    `json:"rating"`
+	Comment   string `json:"comment"`
+}
+
+func (req reviewRequest) form() url.Values {
+	return url.Values{"product_id": {strconv.Itoa(req.ProductID)}, "rating": {strconv.Itoa(req.Rating)}, "comment": {req.Comment}}
+}
+
 // CreateReview allows users to review a product they have received
 func CreateReview(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -24,25 +37,25 @@ func CreateReview(w http.ResponseWriter, r *http.Request) {
 	comment := strings.TrimSpace(r.FormValue("comment"))
 
 	if productIDStr == "" || ratingStr == "" {
-		http.Error(w, `{"error": "Product ID and rating are required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Product ID and rating are required")
 		return
 	}
 
 	productID, err := strconv.Atoi(productIDStr)
 	if err != nil {
-		http.Error(w, `{"error": "Invalid product ID"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid product ID")
 		return
 	}
 
 	rating, err := strconv.Atoi(ratingStr)
 	if err != nil || rating < 1 || rating > 5 {
-		http.Error(w, `{"error": "Rating must be between 1 and 5"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Rating must be between 1 and 5")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -68,10 +81,10 @@ func CreateReview(w http.ResponseWriter, r *http.Request) {
 	`, userID, productID, productID, userID).Scan(&orderID)
 
 	if err == sql.ErrNoRows {
-		http.Error(w, `{"error": "No eligible order found. You can only review products from shipped or completed orders that you haven't reviewed yet."}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, "No eligible order found. You can only review products from shipped or completed orders that you haven't reviewed yet.")
 		return
 	} else if err != nil {
-		http.Error(w, `{"error": "Failed to find eligible order"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to find eligible order")
 		return
 	}
 
@@ -82,16 +95,36 @@ func CreateReview(w http.ResponseWriter, r *http.Request) {
 	`, productID, userID, orderID, rating, comment)
 
 	if err != nil {
-		http.Error(w, `{"error": "Failed to create review"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create review")
 		return
 	}
 
 	reviewID, err := result.LastInsertId()
 	if err != nil {
-		http.Error(w, `{"error": "Failed to retrieve review ID"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to retrieve review ID")
 		return
 	}
 
+	var ownerID, storeID int
+	var productName, storeName string
+	err = db.QueryRow(`
+		SELECT s.owner_id, s.id, p.name, s.name FROM products p JOIN stores s ON p.store_id = s.id WHERE p.id = ?
+	`, productID).Scan(&ownerID, &storeID, &productName, &storeName)
+	if err == nil {
+		PublishEvent(Event{Type: EventReviewCreated, StoreID: storeID, UserID: userID, Data: map[string]interface{}{
+			"review_id":  reviewID,
+			"product_id": productID,
+			"rating":     rating,
+		}})
+		notify(r, Notification{
+			UserID: ownerID,
+			Type:   NotifyNewReview,
+			Title:  fmt.Sprintf("New %d-star review on %s", rating, productName),
+			Body:   comment,
+			Link:   "/" + storeName + "/dashboard",
+		}, nil)
+	}
+
 	response := map[string]interface{}{
 		"success":   true,
 		"review_id": reviewID,
@@ -107,19 +140,19 @@ func GetProductReviews(w http.ResponseWriter, r *http.Request) {
 
 	productIDStr := r.URL.Query().Get("product_id")
 	if productIDStr == "" {
-		http.Error(w, `{"error": "Product ID is required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Product ID is required")
 		return
 	}
 
 	productID, err := strconv.Atoi(productIDStr)
 	if err != nil {
-		http.Error(w, `{"error": "Invalid product ID"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid product ID")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -135,7 +168,7 @@ func GetProductReviews(w http.ResponseWriter, r *http.Request) {
 	`, productID)
 
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch reviews"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch reviews")
 		return
 	}
 	defer rows.Close()
@@ -146,6 +179,7 @@ func GetProductReviews(w http.ResponseWriter, r *http.Request) {
 		err := rows.Scan(&review.ID, &review.ProductID, &review.UserID, &review.OrderID,
 			&review.Rating, &review.Comment, &review.CreatedAt, &review.UserName)
 		if err != nil {
+			Logger(r).Warn("review row scan failed", "product_id", productID, "error", err)
 			continue
 		}
 		reviews = append(reviews, review)
@@ -161,7 +195,7 @@ func GetProductReviews(w http.ResponseWriter, r *http.Request) {
 	`, productID).Scan(&avgRating, &reviewCount)
 
 	if err != nil {
-		http.Error(w, `{"error": "Failed to calculate average rating"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to calculate average rating")
 		return
 	}
 
@@ -179,15 +213,15 @@ func GetProductReviews(w http.ResponseWriter, r *http.Request) {
 func GetUserReviewableOrders(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateCustomer(w, r)
 	if !validUser {
-		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Internal Server Error"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer db.Close()
@@ -206,7 +240,7 @@ func GetUserReviewableOrders(w http.ResponseWriter, r *http.Request) {
 	`, userID, userID)
 
 	if err != nil {
-		http.Error(w, `{"error": "Failed to fetch reviewable orders"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch reviewable orders")
 		return
 	}
 	defer rows.Close()
@@ -236,6 +270,7 @@ func GetUserReviewableOrders(w http.ResponseWriter, r *http.Request) {
 
 		err := rows.Scan(&orderID, &totalAmount, &status, &createdAt, &productID, &productName, &productImage, &hasReviewed)
 		if err != nil {
+			Logger(r).Warn("reviewable order row scan failed", "error", err)
 			continue
 		}
 
@@ -0,0 +1,603 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// The API is served under /api/v1 from one table, apiRoutes. An entry
+// mounts a handler, keeps the handler's pre-v1 path answering as a
+// deprecated alias and documents it in the OpenAPI document, so the routes
+// and their description cannot drift apart.
+//
+// Every v1 request body is JSON. Handlers that still read form values get
+// the JSON decoded into a typed request and handed over as a form. Every v1
+// error is an APIError; the aliases keep answering as they always did.
+
+const apiPrefix = "/api/v1"
+
+// Authentication an APIRoute asks for
+const (
+	// authSession is a platform user's session_token cookie
+	authSession = "session"
+	// authCustomer is a store customer's customer_token_<store_id> cookie
+	authCustomer = "customer"
+	// authAdmin is the session of an admin
+	authAdmin = "admin"
+	// authAPIKey is a store API key, for routes with a Scope
+	authAPIKey = "apiKey"
+)
+
+// APIParam is a query parameter or a multipart field of an APIRoute
+type APIParam struct {
+	Name string
+	// Type is integer, number, boolean, string or, for multipart uploads, file
+	Type        string
+	Required    bool
+	Description string
+	Enum        []string
+}
+
+// APIRoute is one endpoint of the v1 API
+type APIRoute struct {
+	Method string
+	// Path is relative to /api/v1 and may hold {name} wildcards
+	Path string
+	// Legacy is the pre-v1 path, served as a deprecated alias
+	Legacy  string
+	Handler http.HandlerFunc
+	Summary string
+	Tag     string
+	Auth    []string
+	// Scope lets a store API key with that scope call the route; routes
+	// without one refuse keys
+	Scope string
+	Query []APIParam
+	// List makes this a listing endpoint: it takes the list parameters of
+	// the spec and answers with a ListPage
+	List *ListSpec
+	// Body is the zero value of the JSON body the handler decodes
+	Body interface{}
+	// Form is the JSON body of a handler that reads form values
+	Form formRequest
+	// Multipart lists the fields of a multipart/form-data body
+	Multipart []APIParam
+	// Response is an example of the success body. Zero values will do;
+	// maps and interfaces are described by what they hold.
+	Response interface{}
+	// Content is the media type of a success body that is not JSON
+	Content string
+	// Status is the success status, 200 when zero
+	Status int
+}
+
+// formRequest is the JSON body of a route whose handler reads form values;
+// form returns the values under the names the handler reads
+type formRequest interface {
+	form() url.Values
+}
+
+func queryParam(name string, typ string, description string) APIParam {
+	return APIParam{Name: name, Type: typ, Description: description}
+}
+
+func requiredParam(name string, typ string, description string) APIParam {
+	return APIParam{Name: name, Type: typ, Required: true, Description: description}
+}
+
+var (
+	storeIDParam = requiredParam("store_id", "integer", "The store")
+	successBody  = map[string]interface{}{"success": true}
+	messageBody  = map[string]interface{}{"message": ""}
+	codeSentBody = map[string]interface{}{"message": "", "user_id": "", "email": ""}
+)
+
+func apiRoutes() []APIRoute {
+	return []APIRoute{
+		// Authentication
+		{Method: http.MethodPost, Path: "/auth/login", Legacy: "/api/login", Handler: LoginHandler, Tag: "Authentication",
+			Summary: "Check a user's password and email a sign-in code", Form: loginRequest{}, Response: codeSentBody},
+		{Method: http.MethodPost, Path: "/auth/register", Legacy: "/api/register", Handler: RegisterHandler, Tag: "Authentication",
+			Summary: "Create a platform account and email a sign-in code", Form: registerRequest{}, Response: codeSentBody},
+		{Method: http.MethodPost, Path: "/auth/verify", Legacy: "/api/verify_2fa", Handler: TwoFactorAuth, Tag: "Authentication",
+			Summary: "Check a sign-in code and start a session", Form: verifyCodeRequest{}, Response: messageBody},
+		{Method: http.MethodPost, Path: "/auth/resend", Legacy: "/api/resend_2fa", Handler: Resend2FAHandler, Tag: "Authentication",
+			Summary: "Email a new sign-in code", Form: resendCodeRequest{},
+			Response: map[string]interface{}{"message": "", "reset_timer": true}},
+		{Method: http.MethodPost, Path: "/store-auth/login", Legacy: "/api/store_login", Handler: StoreLoginHandler, Tag: "Authentication",
+			Summary: "Check a store customer's password and email a sign-in code", Form: storeLoginRequest{},
+			Response: map[string]interface{}{"message": "", "user_id": "", "email": "", "store_id": ""}},
+		{Method: http.MethodPost, Path: "/store-auth/register", Legacy: "/api/store_register", Handler: StoreRegisterHandler, Tag: "Authentication",
+			Summary: "Create a customer account on a store and email a sign-in code", Form: storeRegisterRequest{},
+			Response: map[string]interface{}{"message": "", "user_id": "", "email": "", "store_id": ""}},
+		{Method: http.MethodPost, Path: "/store-auth/verify", Legacy: "/api/store_verify", Handler: StoreVerifyCodeHandler, Tag: "Authentication",
+			Summary: "Check a customer's sign-in code and start a store session", Form: storeVerifyRequest{}, Response: messageBody},
+
+		// Profile
+		{Method: http.MethodPost, Path: "/profile/update", Legacy: "/api/profile/update", Handler: UpdateProfileHandler, Tag: "Profile",
+			Summary: "Update the user's name and password", Auth: []string{authSession}, Body: updateProfileRequest{}, Response: messageBody},
+		{Method: http.MethodPost, Path: "/profile/picture", Legacy: "/api/profile/picture", Handler: UpdateProfilePictureHandler, Tag: "Profile",
+			Summary: "Replace the user's profile picture", Auth: []string{authSession},
+			Multipart: []APIParam{requiredParam("profile_picture", "file", "A JPEG, PNG or GIF image")},
+			Response:  map[string]interface{}{"message": "", "filename": ""}},
+		{Method: http.MethodGet, Path: "/emails/preview", Legacy: "/api/emails/preview", Handler: PreviewEmail, Tag: "Profile",
+			Summary: "Render an email with sample data, or list the email types", Auth: []string{authSession},
+			Query: []APIParam{
+				queryParam("type", "string", "The email type; without it the types are listed"),
+				queryParam("store_id", "integer", "Render with this store's branding"),
+				{Name: "format", Type: "string", Description: "How to render the email", Enum: []string{"html", "text", "eml"}},
+			},
+			Response: map[string]interface{}{"types": []string{}}},
+
+		// Stores
+		{Method: http.MethodPost, Path: "/stores", Legacy: "/api/create_store", Handler: CreateStoreHandler, Tag: "Stores",
+			Summary: "Open a store", Auth: []string{authSession}, Form: createStoreRequest{}, Response: successBody},
+		{Method: http.MethodGet, Path: "/stores/reports", Legacy: "/api/stores/reports", Handler: GetStoreReports, Tag: "Stores", Scope: ScopeOrdersRead,
+			Summary: "Sales reports of a store", Auth: []string{authSession}, Query: []APIParam{storeIDParam},
+			Response: map[string]interface{}{"reports": []StoreReport{}}},
+		{Method: http.MethodGet, Path: "/stores/keys", Handler: ListAPIKeys, Tag: "Stores",
+			Summary: "A store's API keys", Auth: []string{authSession}, Query: []APIParam{storeIDParam},
+			Response: map[string]interface{}{"keys": []APIKey{}}},
+		{Method: http.MethodPost, Path: "/stores/keys/create", Handler: CreateAPIKey, Tag: "Stores",
+			Summary: "Issue an API key; its token is only ever shown in this answer", Auth: []string{authSession},
+			Body: createAPIKeyRequest{}, Response: map[string]interface{}{"key": APIKey{}, "token": ""}, Status: http.StatusCreated},
+		{Method: http.MethodPost, Path: "/stores/keys/revoke", Handler: RevokeAPIKey, Tag: "Stores",
+			Summary: "Revoke an API key", Auth: []string{authSession}, Body: revokeAPIKeyRequest{}, Response: successBody},
+
+		// Products
+		{Method: http.MethodGet, Path: "/products", Legacy: "/api/products", Handler: GetProductsAPI, Tag: "Products", Scope: ScopeProductsRead,
+			Summary: "List a store's products", List: &productListSpec,
+			Query: []APIParam{
+				storeIDParam,
+				queryParam("category", "integer", "A category and its subcategories"),
+				queryParam("tag", "string", "Products with this tag"),
+				queryParam("collection", "string", "The products of a collection, in its order"),
+			},
+			Response: ListPage{Data: []Product{}}},
+		{Method: http.MethodPost, Path: "/products", Legacy: "/api/create_product", Handler: CreateProductAPI, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Add a product to a store", Auth: []string{authSession}, Form: createProductRequest{},
+			Response: successBody, Status: http.StatusCreated},
+		{Method: http.MethodPost, Path: "/products/update", Legacy: "/api/products/update", Handler: UpdateProductAPI, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Update a product", Auth: []string{authSession}, Body: updateProductRequest{}, Response: successBody},
+		{Method: http.MethodPost, Path: "/products/delete", Legacy: "/api/products/delete", Handler: DeleteProductAPI, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Delete a product", Auth: []string{authSession}, Body: deleteProductRequest{}, Response: successBody},
+		{Method: http.MethodPost, Path: "/products/variants", Legacy: "/api/products/variants", Handler: SaveProductVariants, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Replace a product's options and variants", Auth: []string{authSession}, Body: variantsRequest{},
+			Response: map[string]interface{}{"success": true, "options": []ProductOption{}, "variants": []ProductVariant{}}},
+		{Method: http.MethodGet, Path: "/products/media", Legacy: "/api/products/media", Handler: GetProductMedia, Tag: "Products", Scope: ScopeProductsRead,
+			Summary: "A product's gallery", Query: []APIParam{requiredParam("product_id", "integer", "The product")},
+			Response: map[string]interface{}{"media": []ProductMedia{}}},
+		{Method: http.MethodPost, Path: "/products/media/add", Legacy: "/api/products/media/add", Handler: AddProductMedia, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Add an image or video to a product's gallery", Auth: []string{authSession}, Body: addMediaRequest{},
+			Response: map[string]interface{}{"success": true, "media": []ProductMedia{}}},
+		{Method: http.MethodPost, Path: "/products/media/update", Legacy: "/api/products/media/update", Handler: UpdateProductMedia, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Change a gallery item's alt text or make it the main image", Auth: []string{authSession}, Body: updateMediaRequest{},
+			Response: map[string]interface{}{"success": true, "media": []ProductMedia{}}},
+		{Method: http.MethodPost, Path: "/products/media/reorder", Legacy: "/api/products/media/reorder", Handler: ReorderProductMedia, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Reorder a product's gallery", Auth: []string{authSession}, Body: reorderMediaRequest{},
+			Response: map[string]interface{}{"success": true, "media": []ProductMedia{}}},
+		{Method: http.MethodPost, Path: "/products/media/delete", Legacy: "/api/products/media/delete", Handler: DeleteProductMedia, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Remove an item from a product's gallery", Auth: []string{authSession}, Body: deleteMediaRequest{},
+			Response: map[string]interface{}{"success": true, "media": []ProductMedia{}}},
+		{Method: http.MethodPost, Path: "/products/model/upload", Legacy: "/api/products/model/upload", Handler: UploadProductModel, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Upload a product's 3D model", Auth: []string{authSession},
+			Multipart: []APIParam{
+				requiredParam("product_id", "integer", "The product"),
+				requiredParam("model", "file", "A .glb file, or a .zip holding a .gltf or an .obj with its files"),
+			},
+			Response: map[string]interface{}{"model": ProductModel{}}},
+		{Method: http.MethodPost, Path: "/products/model/delete", Legacy: "/api/products/model/delete", Handler: DeleteProductModel, Tag: "Products", Scope: ScopeProductsWrite,
+			Summary: "Remove a product's 3D model", Auth: []string{authSession}, Body: deleteModelRequest{}, Response: successBody},
+		{Method: http.MethodPost, Path: "/favorites", Legacy: "/api/favorite_product", Handler: FavoriteProduct, Tag: "Products",
+			Summary: "Add a product to the customer's favorites", Auth: []string{authCustomer}, Form: favoriteRequest{}, Response: successBody},
+		{Method: http.MethodPost, Path: "/favorites/delete", Legacy: "/api/unfavorite_product", Handler: UnfavoriteProduct, Tag: "Products",
+			Summary: "Remove a product from the customer's favorites", Auth: []string{authCustomer}, Form: favoriteRequest{}, Response: successBody},
+		{Method: http.MethodGet, Path: "/search", Legacy: "/api/search", Handler: SearchProducts, Tag: "Products",
+			Summary: "Search products across every store",
+			Query: []APIParam{
+				queryParam("q", "string", "Words to look for; typos and word endings are forgiven"),
+				queryParam("store_id", "string", "Comma-separated stores to search"),
+				queryParam("min_price", "number", ""),
+				queryParam("max_price", "number", ""),
+				queryParam("min_rating", "number", ""),
+				queryParam("in_stock", "boolean", ""),
+				{Name: "sort", Type: "string", Description: "Relevance when empty", Enum: []string{"price_asc", "price_desc", "rating", "newest"}},
+				queryParam("page", "integer", ""),
+				queryParam("per_page", "integer", ""),
+			},
+			Response: SearchResponse{}},
+
+		// Catalog
+		{Method: http.MethodGet, Path: "/categories", Legacy: "/api/categories", Handler: GetCategories, Tag: "Catalog", Scope: ScopeProductsRead,
+			Summary: "A store's category tree", Query: []APIParam{storeIDParam},
+			Response: map[string]interface{}{"categories": []Category{}}},
+		{Method: http.MethodPost, Path: "/categories/save", Legacy: "/api/categories/save", Handler: SaveCategory, Tag: "Catalog", Scope: ScopeProductsWrite,
+			Summary: "Create or rename a category", Auth: []string{authSession}, Body: saveCategoryRequest{},
+			Response: map[string]interface{}{"success": true, "categories": []Category{}}},
+		{Method: http.MethodPost, Path: "/categories/delete", Legacy: "/api/categories/delete", Handler: DeleteCategory, Tag: "Catalog", Scope: ScopeProductsWrite,
+			Summary: "Delete a category", Auth: []string{authSession}, Body: deleteCategoryRequest{},
+			Response: map[string]interface{}{"success": true, "categories": []Category{}}},
+		{Method: http.MethodGet, Path: "/collections", Legacy: "/api/collections", Handler: GetCollections, Tag: "Catalog", Scope: ScopeProductsRead,
+			Summary: "A store's collections", Query: []APIParam{storeIDParam},
+			Response: map[string]interface{}{"collections": []Collection{}}},
+		{Method: http.MethodPost, Path: "/collections/save", Legacy: "/api/collections/save", Handler: SaveCollection, Tag: "Catalog", Scope: ScopeProductsWrite,
+			Summary: "Create or update a collection", Auth: []string{authSession}, Body: saveCollectionRequest{},
+			Response: map[string]interface{}{"success": true, "id": 0, "collections": []Collection{}}},
+		{Method: http.MethodPost, Path: "/collections/delete", Legacy: "/api/collections/delete", Handler: DeleteCollection, Tag: "Catalog", Scope: ScopeProductsWrite,
+			Summary: "Delete a collection", Auth: []string{authSession}, Body: deleteCollectionRequest{}, Response: successBody},
+
+		// Reviews
+		{Method: http.MethodPost, Path: "/reviews", Legacy: "/api/reviews/create", Handler: CreateReview, Tag: "Reviews",
+			Summary: "Review a product the customer received", Auth: []string{authCustomer}, Form: reviewRequest{},
+			Response: map[string]interface{}{"success": true, "review_id": 0, "message": ""}},
+		{Method: http.MethodGet, Path: "/reviews", Legacy: "/api/reviews", Handler: GetProductReviews, Tag: "Reviews",
+			Summary: "A product's reviews", Query: []APIParam{requiredParam("product_id", "integer", "The product")},
+			Response: map[string]interface{}{"success": true, "reviews": []Review{}, "average_rating": 0.0, "review_count": 0}},
+		{Method: http.MethodGet, Path: "/reviews/reviewable-orders", Legacy: "/api/reviews/reviewable-orders", Handler: GetUserReviewableOrders, Tag: "Reviews",
+			Summary: "The customer's received orders with products left to review", Auth: []string{authCustomer},
+			Response: map[string]interface{}{"success": true, "orders": []map[string]interface{}{}}},
+
+		// Cart and checkout
+		{Method: http.MethodGet, Path: "/cart", Legacy: "/api/get-cart", Handler: GetCartTotal, Tag: "Cart",
+			Summary: "Item count and total of the customer's cart", Auth: []string{authCustomer},
+			Response: map[string]interface{}{"total_items": 0, "total_price": 0.0}},
+		{Method: http.MethodPost, Path: "/cart/items", Legacy: "/api/add-to-cart", Handler: AddToCart, Tag: "Cart",
+			Summary: "Put a product in the cart", Auth: []string{authCustomer}, Form: addToCartRequest{}, Response: successBody},
+		{Method: http.MethodPost, Path: "/cart/items/update", Legacy: "/api/update-cart", Handler: UpdateCartItem, Tag: "Cart",
+			Summary: "Change the quantity of a cart item", Auth: []string{authCustomer}, Form: updateCartRequest{}, Response: successBody},
+		{Method: http.MethodPost, Path: "/cart/items/delete", Legacy: "/api/remove-from-cart", Handler: RemoveFromCart, Tag: "Cart",
+			Summary: "Take an item out of the cart", Auth: []string{authCustomer}, Form: removeFromCartRequest{}, Response: successBody},
+		{Method: http.MethodPost, Path: "/checkout", Legacy: "/api/create-order", Handler: CreateOrder, Tag: "Cart",
+			Summary: "Turn the cart into a pending order", Auth: []string{authCustomer}, Form: checkoutRequest{},
+			Response: map[string]interface{}{"success": true, "order_id": 0, "message": ""}},
+		{Method: http.MethodGet, Path: "/checkout/pending", Legacy: "/api/pending-order", Handler: GetPendingOrder, Tag: "Cart",
+			Summary: "The customer's order awaiting payment", Auth: []string{authCustomer},
+			Response: map[string]interface{}{"success": true, "order": map[string]interface{}{
+				"order_id": 0, "store_id": 0, "total_amount": 0.0, "shipping_info": "", "created_at": "",
+			}}},
+		{Method: http.MethodPost, Path: "/checkout/pay", Legacy: "/api/process-payment", Handler: ProcessPayment, Tag: "Cart",
+			Summary: "Pay for a pending order", Auth: []string{authCustomer}, Form: paymentRequest{},
+			Response: map[string]interface{}{"success": true, "message": "", "order_id": 0}},
+
+		// Store orders and fulfilment
+		{Method: http.MethodGet, Path: "/orders", Legacy: "/api/orders", Handler: GetStoreOrders, Tag: "Orders", Scope: ScopeOrdersRead,
+			Summary: "List a store's orders", Auth: []string{authSession}, List: &storeOrderListSpec, Query: []APIParam{storeIDParam},
+			Response: ListPage{Data: []StoreOrder{}}},
+		{Method: http.MethodPost, Path: "/orders/update-status", Legacy: "/api/orders/update-status", Handler: UpdateOrderStatus, Tag: "Orders", Scope: ScopeOrdersWrite,
+			Summary: "Move an order to another status", Auth: []string{authSession}, Body: updateOrderStatusRequest{},
+			Response: map[string]interface{}{"success": true, "message": "", "order": StoreOrder{}}},
+		{Method: http.MethodPost, Path: "/orders/claim", Legacy: "/api/orders/claim", Handler: ClaimOrder, Tag: "Orders", Scope: ScopeOrdersWrite,
+			Summary: "Claim an order for packing, or release it", Auth: []string{authSession}, Body: claimOrderRequest{},
+			Response: map[string]interface{}{"success": true, "order": StoreOrder{}}},
+		{Method: http.MethodGet, Path: "/orders/{order_id}/products", Legacy: "/api/orders/", Handler: GetOrderProducts, Tag: "Orders", Scope: ScopeOrdersRead,
+			Summary: "The products of an order", Auth: []string{authSession, authCustomer}, Query: []APIParam{storeIDParam},
+			Response: map[string]interface{}{"products": []map[string]interface{}{
+				{"id": 0, "name": "", "image": "", "quantity": 0, "price": 0.0},
+			}}},
+		{Method: http.MethodGet, Path: "/shipments", Legacy: "/api/shipments", Handler: GetShipments, Tag: "Orders", Scope: ScopeOrdersRead,
+			Summary: "An order's shipments, items left to ship and carriers", Auth: []string{authSession},
+			Query:    []APIParam{storeIDParam, requiredParam("order_id", "integer", "The order")},
+			Response: map[string]interface{}{"shipments": []Shipment{}, "items": []ShippableItem{}, "carriers": []string{}}},
+		{Method: http.MethodPost, Path: "/shipments/rates", Legacy: "/api/shipments/rates", Handler: GetShippingRates, Tag: "Orders", Scope: ScopeOrdersWrite,
+			Summary: "Quote every carrier for a shipment", Auth: []string{authSession}, Body: shipmentRequest{},
+			Response: map[string]interface{}{"rates": []ShippingRate{}}},
+		{Method: http.MethodPost, Path: "/shipments/create", Legacy: "/api/shipments/create", Handler: CreateShipment, Tag: "Orders", Scope: ScopeOrdersWrite,
+			Summary: "Buy a label and ship items of an order", Auth: []string{authSession}, Body: shipmentRequest{},
+			Response: map[string]interface{}{"success": true, "shipment_id": 0, "shipments": []Shipment{}, "order": StoreOrder{}}},
+		{Method: http.MethodPost, Path: "/shipments/refresh", Legacy: "/api/shipments/refresh", Handler: RefreshShipment, Tag: "Orders", Scope: ScopeOrdersWrite,
+			Summary: "Fetch a shipment's latest tracking events", Auth: []string{authSession}, Body: refreshShipmentRequest{},
+			Response: map[string]interface{}{"success": true, "shipments": []Shipment{}}},
+
+		// Customer orders and returns
+		{Method: http.MethodGet, Path: "/my-orders", Legacy: "/api/my-orders", Handler: GetOrders, Tag: "Customer orders",
+			Summary: "Every order of the customer", Auth: []string{authCustomer},
+			Response: []map[string]interface{}{
+				{"id": 0, "user_id": 0, "store_id": 0, "total_amount": 0.0, "status": "", "shipping_info": "", "created_at": ""},
+			}},
+		{Method: http.MethodGet, Path: "/customer/orders", Legacy: "/api/customer/orders", Handler: GetCustomerOrders, Tag: "Customer orders",
+			Summary: "List the customer's orders on a store", Auth: []string{authCustomer}, List: &customerOrderListSpec,
+			Query: []APIParam{storeIDParam}, Response: ListPage{Data: []CustomerOrder{}}},
+		{Method: http.MethodPost, Path: "/customer/orders/complete", Legacy: "/api/customer/orders/complete", Handler: MarkOrderAsCompleted, Tag: "Customer orders",
+			Summary: "Confirm an order was received", Auth: []string{authCustomer}, Query: []APIParam{storeIDParam},
+			Body: completeOrderRequest{}, Response: map[string]interface{}{"success": true, "message": ""}},
+		{Method: http.MethodGet, Path: "/customer/returns", Legacy: "/api/customer/returns", Handler: GetCustomerReturns, Tag: "Customer orders",
+			Summary: "The customer's returns, or what of an order can be returned", Auth: []string{authCustomer},
+			Query: []APIParam{storeIDParam, queryParam("order_id", "integer", "Also report the returnable items of this order")},
+			Response: map[string]interface{}{
+				"window_days": 0, "returns": []Return{}, "items": []ReturnableItem{}, "returnable": true, "reason": "",
+			}},
+		{Method: http.MethodPost, Path: "/customer/returns/create", Legacy: "/api/customer/returns/create", Handler: CreateReturn, Tag: "Customer orders",
+			Summary: "Request a return", Auth: []string{authCustomer}, Query: []APIParam{storeIDParam}, Body: returnRequest{},
+			Response: map[string]interface{}{"success": true, "return_id": 0, "order": CustomerOrder{}}},
+		{Method: http.MethodGet, Path: "/returns", Legacy: "/api/returns", Handler: GetStoreReturns, Tag: "Orders", Scope: ScopeOrdersRead,
+			Summary: "A store's returns", Auth: []string{authSession},
+			Query: []APIParam{
+				storeIDParam,
+				queryParam("order_id", "integer", "Only this order's returns"),
+				queryParam("status", "string", "Only returns in this status"),
+			},
+			Response: map[string]interface{}{"returns": []Return{}}},
+		{Method: http.MethodPost, Path: "/returns/rates", Legacy: "/api/returns/rates", Handler: GetReturnRates, Tag: "Orders", Scope: ScopeOrdersWrite,
+			Summary: "Quote every carrier for a return label", Auth: []string{authSession}, Body: returnRatesRequest{},
+			Response: map[string]interface{}{"rates": []ShippingRate{}}},
+		{Method: http.MethodPost, Path: "/returns/update", Legacy: "/api/returns/update", Handler: UpdateReturn, Tag: "Orders", Scope: ScopeOrdersWrite,
+			Summary: "Approve, reject, receive or refund a return", Auth: []string{authSession}, Body: updateReturnRequest{},
+			Response: map[string]interface{}{"success": true, "return": Return{}}},
+
+		// Notifications
+		{Method: http.MethodGet, Path: "/notifications", Legacy: "/api/notifications", Handler: GetNotifications, Tag: "Notifications",
+			Summary: "The latest notifications and the unread count", Auth: []string{authSession, authCustomer},
+			Query:    []APIParam{queryParam("store_id", "integer", "Read as the customer of this store")},
+			Response: map[string]interface{}{"notifications": []Notification{}, "unread": 0}},
+		{Method: http.MethodPost, Path: "/notifications/read", Legacy: "/api/notifications/read", Handler: MarkNotificationsRead, Tag: "Notifications",
+			Summary: "Mark one or every notification read", Auth: []string{authSession, authCustomer},
+			Query: []APIParam{queryParam("store_id", "integer", "Act as the customer of this store")},
+			Body:  markReadRequest{}, Response: map[string]interface{}{"success": true, "unread": 0}},
+		{Method: http.MethodGet, Path: "/notifications/preferences", Legacy: "/api/notifications/preferences", Handler: NotificationPreferences, Tag: "Notifications",
+			Summary: "The channel of each notification type", Auth: []string{authSession, authCustomer},
+			Query:    []APIParam{queryParam("store_id", "integer", "Read as the customer of this store")},
+			Response: notificationPreferencesResponse},
+		{Method: http.MethodPost, Path: "/notifications/preferences", Legacy: "/api/notifications/preferences", Handler: NotificationPreferences, Tag: "Notifications",
+			Summary: "Change the channel of notification types", Auth: []string{authSession, authCustomer},
+			Query: []APIParam{queryParam("store_id", "integer", "Act as the customer of this store")},
+			Body:  notificationPreferencesRequest{}, Response: notificationPreferencesResponse},
+
+		// Webhooks
+		{Method: http.MethodGet, Path: "/webhooks", Handler: GetWebhooks, Tag: "Webhooks",
+			Summary: "A store's webhooks and the events they can subscribe to", Auth: []string{authSession}, Query: []APIParam{storeIDParam},
+			Response: map[string]interface{}{"webhooks": []Webhook{}, "events": []string{}}},
+		{Method: http.MethodPost, Path: "/webhooks/create", Handler: CreateWebhook, Tag: "Webhooks",
+			Summary: "Subscribe a URL to store events; its signing secret is only shown in this answer", Auth: []string{authSession},
+			Body: saveWebhookRequest{}, Response: map[string]interface{}{"webhook": Webhook{}, "secret": ""}, Status: http.StatusCreated},
+		{Method: http.MethodPost, Path: "/webhooks/update", Handler: UpdateWebhook, Tag: "Webhooks",
+			Summary: "Change, pause or resume a webhook, or rotate its secret", Auth: []string{authSession},
+			Body: saveWebhookRequest{}, Response: map[string]interface{}{"success": true, "webhook": Webhook{}, "secret": ""}},
+		{Method: http.MethodPost, Path: "/webhooks/delete", Handler: DeleteWebhook, Tag: "Webhooks",
+			Summary: "Delete a webhook and its delivery log", Auth: []string{authSession}, Body: webhookRequest{}, Response: successBody},
+		{Method: http.MethodPost, Path: "/webhooks/ping", Handler: PingWebhook, Tag: "Webhooks",
+			Summary: "Send a test delivery", Auth: []string{authSession}, Body: webhookRequest{},
+			Response: map[string]interface{}{"delivery": WebhookDelivery{}}, Status: http.StatusAccepted},
+		{Method: http.MethodGet, Path: "/webhooks/deliveries", Handler: GetWebhookDeliveries, Tag: "Webhooks",
+			Summary: "The latest deliveries of a store's webhooks", Auth: []string{authSession},
+			Query:    []APIParam{storeIDParam, queryParam("webhook_id", "integer", "Only the deliveries of this webhook")},
+			Response: map[string]interface{}{"deliveries": []WebhookDelivery{}}},
+		{Method: http.MethodPost, Path: "/webhooks/redeliver", Handler: RedeliverWebhook, Tag: "Webhooks",
+			Summary: "Send a logged delivery again as a new delivery", Auth: []string{authSession}, Body: redeliverRequest{},
+			Response: map[string]interface{}{"delivery": WebhookDelivery{}}, Status: http.StatusAccepted},
+
+		// Administration
+		{Method: http.MethodGet, Path: "/admin/stats", Legacy: "/api/admin/stats", Handler: AdminStats, Tag: "Admin",
+			Summary: "Platform totals", Auth: []string{authAdmin},
+			Response: map[string]interface{}{
+				"total_stores": 0, "total_users": 0, "total_products": 0, "total_orders": 0, "pending_orders": 0, "total_revenue": 0.0,
+			}},
+		{Method: http.MethodGet, Path: "/admin/stores", Legacy: "/api/admin/stores", Handler: AdminStores, Tag: "Admin",
+			Summary: "List every store", Auth: []string{authAdmin}, List: &adminStoreListSpec,
+			Response: ListPage{Data: []map[string]interface{}{}}},
+		{Method: http.MethodGet, Path: "/admin/users", Legacy: "/api/admin/users", Handler: AdminUsers, Tag: "Admin",
+			Summary: "List every user", Auth: []string{authAdmin}, List: &adminUserListSpec,
+			Response: ListPage{Data: []map[string]interface{}{}}},
+		{Method: http.MethodGet, Path: "/admin/orders", Legacy: "/api/admin/orders", Handler: AdminOrders, Tag: "Admin",
+			Summary: "List every order", Auth: []string{authAdmin}, List: &adminOrderListSpec,
+			Response: ListPage{Data: []map[string]interface{}{}}},
+		{Method: http.MethodGet, Path: "/admin/products", Legacy: "/api/admin/products", Handler: AdminProducts, Tag: "Admin",
+			Summary: "List every product", Auth: []string{authAdmin}, List: &adminProductListSpec,
+			Response: ListPage{Data: []map[string]interface{}{}}},
+		{Method: http.MethodGet, Path: "/admin/jobs", Legacy: "/api/admin/jobs", Handler: AdminJobs, Tag: "Admin",
+			Summary: "Background jobs", Auth: []string{authAdmin},
+			Query:    []APIParam{queryParam("status", "string", "Only jobs in this status")},
+			Response: map[string]interface{}{"jobs": []Job{}}},
+		{Method: http.MethodPost, Path: "/admin/jobs/retry", Legacy: "/api/admin/jobs/retry", Handler: AdminRetryJob, Tag: "Admin",
+			Summary: "Requeue a dead job, or every dead job", Auth: []string{authAdmin}, Body: retryJobRequest{},
+			Response: map[string]interface{}{"success": true, "retried": 0, "message": ""}},
+		{Method: http.MethodGet, Path: "/admin/uploads/gc", Legacy: "/api/admin/uploads/gc", Handler: AdminUploadGC, Tag: "Admin",
+			Summary: "Report orphaned uploads without touching them", Auth: []string{authAdmin}, Response: UploadGCReport{}},
+		{Method: http.MethodPost, Path: "/admin/uploads/gc", Legacy: "/api/admin/uploads/gc", Handler: AdminUploadGC, Tag: "Admin",
+			Summary: "Quarantine and delete orphaned uploads", Auth: []string{authAdmin}, Body: uploadGCRequest{}, Response: UploadGCReport{}},
+
+		// 3D models
+		{Method: http.MethodGet, Path: "/models", Legacy: "/api/list-3d-models", Handler: ListProducts3DModels, Tag: "3D models", Scope: ScopeProductsRead,
+			Summary: "The 3D models of a store's products", Query: []APIParam{storeIDParam},
+			Response: map[string]interface{}{"models": []ProductModel{}, "available_models": map[string]bool{}}},
+		{Method: http.MethodGet, Path: "/models/check", Legacy: "/api/check-3d-model", Handler: Check3DModel, Tag: "3D models",
+			Summary:  "Whether the product with an image has a 3D model",
+			Query:    []APIParam{requiredParam("image", "string", "The product's image file")},
+			Response: map[string]interface{}{"has_3d_model": true, "model_path": "", "preview_url": ""}},
+		{Method: http.MethodGet, Path: "/models/file", Legacy: "/api/get-3d-model", Handler: Get3DModel, Tag: "3D models",
+			Summary: "Download a 3D model file", Query: []APIParam{requiredParam("model", "string", "The model file")},
+			Content: "application/octet-stream"},
+
+		{Method: http.MethodGet, Path: "/openapi.json", Handler: OpenAPIHandler, Tag: "Meta",
+			Summary: "This API's OpenAPI 3 document"},
+	}
+}
+
+var notificationPreferencesResponse = map[string]interface{}{"preferences": []map[string]interface{}{
+	{"type": "", "label": "", "audience": "", "default": "", "channel": ""},
+}}
+
+// RegisterAPIRoutes mounts the v1 API and the deprecated pre-v1 aliases
+func RegisterAPIRoutes(mux *http.ServeMux) error {
+	routes := apiRoutes()
+	if err := checkAPIRoutes(routes); err != nil {
+		return err
+	}
+	sunset := os.Getenv("LEGACY_API_SUNSET")
+	// paths answers v1 requests no route took: the path is known but not
+	// with that method
+	paths := http.NewServeMux()
+	methods := map[string][]string{}
+	aliased := map[string]bool{}
+	for _, route := range routes {
+		mux.Handle(route.Method+" "+apiPrefix+route.Path, route.handler())
+		if methods[route.Path] == nil {
+			paths.Handle(apiPrefix+route.Path, methodNotAllowed(methods, route.Path))
+		}
+		methods[route.Path] = append(methods[route.Path], route.Method)
+		if route.Legacy != "" && !aliased[route.Legacy] {
+			aliased[route.Legacy] = true
+			mux.Handle(route.Legacy, legacyAlias(route, sunset))
+		}
+	}
+	mux.Handle(apiPrefix+"/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, pattern := paths.Handler(r); pattern != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		writeAPIError(w, NewAPIError(http.StatusNotFound, "No such endpoint"))
+	}))
+	return nil
+}
+
+func methodNotAllowed(methods map[string][]string, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := methods[path]
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		e := NewAPIError(http.StatusMethodNotAllowed, "Use "+strings.Join(allowed, " or "))
+		writeAPIError(w, e)
+	})
+}
+
+// legacyAlias serves a pre-v1 path as it always was, pointing at its v1
+// successor
+func legacyAlias(route APIRoute, sunset string) http.Handler {
+	successor := apiPrefix + route.Path
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		if sunset != "" {
+			w.Header().Set("Sunset", sunset)
+		}
+		apiLegacyRequestsTotal.Inc(route.Legacy)
+		route.Handler(w, r)
+	})
+}
+
+// handler is the route's handler as v1 serves it: JSON in, APIErrors out,
+// callable with an API key when the route has a scope
+func (route APIRoute) handler() http.Handler {
+	h := http.Handler(route.Handler)
+	if route.Form != nil {
+		h = jsonForm(reflect.TypeOf(route.Form), h)
+	}
+	if route.Form != nil || route.Body != nil {
+		h = requireJSON(h)
+	}
+	return apiErrors(withAPIKey(route.Scope, h))
+}
+
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != 0 {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeAPIError(w, NewAPIError(http.StatusUnsupportedMediaType, "The request body must be application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// jsonForm decodes the JSON body into a formRequest of type typ and hands
+// it to next as the request's form
+func jsonForm(typ reflect.Type, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := reflect.New(typ)
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(req.Interface()); err != nil {
+			writeAPIError(w, &APIError{Status: http.StatusBadRequest, Code: CodeMalformedBody, Message: "Invalid JSON body: " + err.Error()})
+			return
+		}
+		form := req.Elem().Interface().(formRequest).form()
+		r.PostForm = form
+		r.Form = url.Values{}
+		for name, values := range form {
+			r.Form[name] = append([]string(nil), values...)
+		}
+		for name, values := range r.URL.Query() {
+			r.Form[name] = append(r.Form[name], values...)
+		}
+		r.Body = http.NoBody
+		next.ServeHTTP(w, r)
+	})
+}
+
+var pathWildcard = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// checkAPIRoutes catches table mistakes at startup instead of in the
+// OpenAPI document
+func checkAPIRoutes(routes []APIRoute) error {
+	seen := map[string]bool{}
+	aliases := map[string]string{}
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		bodies := 0
+		for _, set := range []bool{route.Body != nil, route.Form != nil, len(route.Multipart) > 0} {
+			if set {
+				bodies++
+			}
+		}
+		switch {
+		case route.Handler == nil:
+			return fmt.Errorf("api route %s has no handler", key)
+		case !strings.HasPrefix(route.Path, "/"):
+			return fmt.Errorf("api route %s must start with /", key)
+		case route.Summary == "" || route.Tag == "":
+			return fmt.Errorf("api route %s needs a summary and a tag", key)
+		case seen[key]:
+			return fmt.Errorf("api route %s is declared twice", key)
+		case bodies > 1:
+			return fmt.Errorf("api route %s has more than one kind of body", key)
+		case bodies > 0 && route.Method == http.MethodGet:
+			return fmt.Errorf("api route %s reads a body on GET", key)
+		case route.List != nil && route.Method != http.MethodGet:
+			return fmt.Errorf("api route %s lists on %s", key, route.Method)
+		case route.Body != nil && reflect.TypeOf(route.Body).Kind() != reflect.Struct:
+			return fmt.Errorf("api route %s: the body must be a struct", key)
+		case route.Scope != "" && !knownScope(route.Scope):
+			return fmt.Errorf("api route %s has unknown scope %s", key, route.Scope)
+		}
+		seen[key] = true
+
+		params := map[string]bool{}
+		for _, m := range pathWildcard.FindAllStringSubmatch(route.Path, -1) {
+			params[m[1]] = true
+		}
+		if route.List != nil {
+			for _, p := range listParams(*route.List) {
+				params[p.Name] = true
+			}
+		}
+		for _, p := range route.Query {
+			if params[p.Name] {
+				return fmt.Errorf("api route %s has parameter %s twice", key, p.Name)
+			}
+			params[p.Name] = true
+		}
+
+		if route.Legacy != "" {
+			name := handlerName(route.Handler)
+			if other, ok := aliases[route.Legacy]; ok && other != name {
+				return fmt.Errorf("legacy path %s is served by both %s and %s", route.Legacy, other, name)
+			}
+			aliases[route.Legacy] = name
+		}
+	}
+	return nil
+}
+
+// handlerName is the name of a handler function, e.g. GetStoreOrders
+func handlerName(h http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
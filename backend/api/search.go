@@ -0,0 +1,668 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The search index is kept in memory: SQLite's FTS5 is not compiled into
+// go-sqlite3 by default and the catalogue is small enough to hold. Products
+// are ranked with BM25 over their fields, each weighted by searchFieldWeights.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	// searchRebuildInterval rebuilds the whole index in case an event was
+	// dropped or a change did not publish one
+	searchRebuildInterval = 10 * time.Minute
+
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+var searchFieldWeights = struct {
+	Name, Tags, Store, Description float64
+}{Name: 3, Tags: 2, Store: 1.5, Description: 1}
+
+// Weights of terms matched other than exactly
+const (
+	searchPrefixWeight = 0.8
+	searchTypo1Weight  = 0.6
+	searchTypo2Weight  = 0.35
+)
+
+// searchDocument is one product as the index sees it
+type searchDocument struct {
+	ProductID   int
+	StoreID     int
+	StoreName   string
+	Name        string
+	Description string
+	Image       string
+	Tags        []string
+	Price       float64
+	Quantity    int
+	Rating      float64
+	ReviewCount int
+
+	// terms holds the weighted frequency of each term over all fields
+	terms  map[string]float64
+	length float64
+}
+
+// SearchIndex is an inverted index over the products of every store
+type SearchIndex struct {
+	mu          sync.RWMutex
+	docs        map[int]*searchDocument
+	postings    map[string]map[int]float64
+	totalLength float64
+	builtAt     time.Time
+}
+
+// NewSearchIndex returns an empty index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{docs: map[int]*searchDocument{}, postings: map[string]map[int]float64{}}
+}
+
+var searchIndex = NewSearchIndex()
+
+// searchFolding maps accented Latin letters to their base letter so that
+// "cafe" finds "café"
+var searchFolding = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "ö", "o", "õ", "o", "ø", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y", "ß", "ss",
+)
+
+// searchTerms splits text into normalized terms: lower case, without
+// accents and with plural endings removed
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(searchFolding.Replace(strings.ToLower(text)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i, word := range words {
+		words[i] = stemTerm(word)
+	}
+	return words
+}
+
+// stemTerm removes English plural endings: sofas, benches, accessories
+func stemTerm(word string) string {
+	if utf8.RuneCountInString(word) <= 3 {
+		return word
+	}
+	switch {
+	case strings.HasSuffix(word, "ies"):
+		return strings.TrimSuffix(word, "ies") + "y"
+	case strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"), strings.HasSuffix(word, "xes"), strings.HasSuffix(word, "sses"):
+		return strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		return strings.TrimSuffix(word, "s")
+	}
+	return word
+}
+
+// index computes the weighted term frequencies of a document
+func (d *searchDocument) index() {
+	d.terms = map[string]float64{}
+	d.length = 0
+	add := func(text string, weight float64) {
+		for _, term := range searchTerms(text) {
+			d.terms[term] += weight
+			d.length += weight
+		}
+	}
+	add(d.Name, searchFieldWeights.Name)
+	add(strings.Join(d.Tags, " "), searchFieldWeights.Tags)
+	add(d.StoreName, searchFieldWeights.Store)
+	add(d.Description, searchFieldWeights.Description)
+}
+
+func (ix *SearchIndex) removeLocked(productID int) {
+	doc, ok := ix.docs[productID]
+	if !ok {
+		return
+	}
+	for term := range doc.terms {
+		delete(ix.postings[term], productID)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	ix.totalLength -= doc.length
+	delete(ix.docs, productID)
+}
+
+func (ix *SearchIndex) putLocked(doc *searchDocument) {
+	ix.removeLocked(doc.ProductID)
+	ix.docs[doc.ProductID] = doc
+	for term, tf := range doc.terms {
+		if ix.postings[term] == nil {
+			ix.postings[term] = map[int]float64{}
+		}
+		ix.postings[term][doc.ProductID] = tf
+	}
+	ix.totalLength += doc.length
+}
+
+// Remove drops a product from the index
+func (ix *SearchIndex) Remove(productID int) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.removeLocked(productID)
+}
+
+// loadSearchDocuments reads the products matching where (on products p)
+// with their store name, rating and tags
+func loadSearchDocuments(db *sql.DB, where string, args ...interface{}) ([]*searchDocument, error) {
+	rows, err := db.Query(`
+		SELECT p.id, COALESCE(p.store_id, 0), COALESCE(s.name, ''), p.name, COALESCE(p.description, ''),
+			COALESCE(p.image, ''), p.price, COALESCE(p.quantity, 0),
+			COALESCE((SELECT AVG(rating) FROM reviews WHERE product_id = p.id), 0),
+			(SELECT COUNT(*) FROM reviews WHERE product_id = p.id)
+		FROM products p LEFT JOIN stores s ON s.id = p.store_id
+		WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	docs := map[int]*searchDocument{}
+	var ordered []*searchDocument
+	for rows.Next() {
+		d := &searchDocument{}
+		if err := rows.Scan(&d.ProductID, &d.StoreID, &d.StoreName, &d.Name, &d.Description,
+			&d.Image, &d.Price, &d.Quantity, &d.Rating, &d.ReviewCount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		docs[d.ProductID] = d
+		ordered = append(ordered, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tags, err := db.Query(`
+		SELECT t.product_id, t.tag FROM product_tags t
+		WHERE t.product_id IN (SELECT p.id FROM products p WHERE `+where+`)
+		ORDER BY t.tag
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer tags.Close()
+	for tags.Next() {
+		var productID int
+		var tag string
+		if err := tags.Scan(&productID, &tag); err != nil {
+			return nil, err
+		}
+		if d, ok := docs[productID]; ok {
+			d.Tags = append(d.Tags, tag)
+		}
+	}
+	if err := tags.Err(); err != nil {
+		return nil, err
+	}
+	for _, d := range ordered {
+		d.index()
+	}
+	return ordered, nil
+}
+
+// Rebuild reads every product again and swaps in the new index
+func (ix *SearchIndex) Rebuild() error {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	docs, err := loadSearchDocuments(db, "1 = 1")
+	if err != nil {
+		return err
+	}
+	fresh := NewSearchIndex()
+	for _, d := range docs {
+		fresh.putLocked(d)
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.docs, ix.postings, ix.totalLength = fresh.docs, fresh.postings, fresh.totalLength
+	ix.builtAt = time.Now()
+	return nil
+}
+
+// Reindex reads one product again, or removes it if it no longer exists
+func (ix *SearchIndex) Reindex(productID int) error {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	docs, err := loadSearchDocuments(db, "p.id = ?", productID)
+	if err != nil {
+		return err
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if len(docs) == 0 {
+		ix.removeLocked(productID)
+		return nil
+	}
+	ix.putLocked(docs[0])
+	return nil
+}
+
+// StartSearchIndex builds the index and keeps it current until ctx is done.
+// Product, stock and review events reindex the product they name; through
+// the event broker this includes changes made on other instances.
+func StartSearchIndex(ctx context.Context) {
+	updates := events.Subscribe(EventFilter{Types: []string{
+		EventProductCreated, EventProductUpdated, EventProductDeleted, EventStockChanged, EventReviewCreated,
+	}})
+	go func() {
+		defer updates.Close()
+		if err := searchIndex.Rebuild(); err != nil {
+			slog.Error("failed to build search index", "error", err)
+		} else {
+			slog.Info("search index built", "products", searchIndex.Size())
+		}
+		ticker := time.NewTicker(searchRebuildInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-updates.C:
+				productID := e.Int("product_id")
+				if productID == 0 {
+					continue
+				}
+				if e.Type == EventProductDeleted {
+					searchIndex.Remove(productID)
+					continue
+				}
+				if err := searchIndex.Reindex(productID); err != nil {
+					slog.Warn("failed to reindex product", "product_id", productID, "error", err)
+				}
+			case <-ticker.C:
+				if err := searchIndex.Rebuild(); err != nil {
+					slog.Error("failed to rebuild search index", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Size is the number of indexed products
+func (ix *SearchIndex) Size() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// editDistance is the Damerau-Levenshtein distance (optimal string
+// alignment) between a and b, or max+1 once it is known to exceed max
+func editDistance(a, b []rune, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			best = min(best, cur[j])
+		}
+		if best > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// termMatch is an index term standing in for a query term
+type termMatch struct {
+	term   string
+	weight float64
+}
+
+// expandLocked finds the index terms a query term matches: itself, words
+// it begins when prefix is set (the last word while typing), and otherwise
+// words one typo away, or two for long words
+func (ix *SearchIndex) expandLocked(term string, prefix bool) []termMatch {
+	var matches []termMatch
+	_, exact := ix.postings[term]
+	if exact {
+		matches = append(matches, termMatch{term, 1})
+	}
+	runes := []rune(term)
+	typos := 0
+	if !exact && len(runes) >= 4 {
+		typos = 1
+		if len(runes) >= 8 {
+			typos = 2
+		}
+	}
+	if !prefix && typos == 0 {
+		return matches
+	}
+	for candidate := range ix.postings {
+		if candidate == term {
+			continue
+		}
+		if prefix && len(runes) >= 2 && strings.HasPrefix(candidate, term) {
+			matches = append(matches, termMatch{candidate, searchPrefixWeight})
+			continue
+		}
+		if typos == 0 {
+			continue
+		}
+		switch distance := editDistance(runes, []rune(candidate), typos); {
+		case distance > typos:
+		case distance == 1:
+			matches = append(matches, termMatch{candidate, searchTypo1Weight})
+		case distance == 2:
+			matches = append(matches, termMatch{candidate, searchTypo2Weight})
+		}
+	}
+	return matches
+}
+
+// SearchQuery is a marketplace search. Zero values leave a filter off.
+type SearchQuery struct {
+	Text      string
+	StoreIDs  []int
+	MinPrice  float64
+	MaxPrice  float64
+	MinRating float64
+	InStock   bool
+	// Sort is relevance (the default), price_asc, price_desc, rating or newest
+	Sort    string
+	Page    int
+	PerPage int
+}
+
+// SearchResult is one product found by a search
+type SearchResult struct {
+	ID            int      `json:"id"`
+	Name          string   `json:"name"`
+	Description   string   `json:"description"`
+	Price         float64  `json:"price"`
+	Image         string   `json:"image"`
+	Quantity      int      `json:"quantity"`
+	InStock       bool     `json:"in_stock"`
+	AverageRating float64  `json:"average_rating"`
+	ReviewCount   int      `json:"review_count"`
+	Tags          []string `json:"tags,omitempty"`
+	StoreID       int      `json:"store_id"`
+	StoreName     string   `json:"store_name"`
+	Score         float64  `json:"score,omitempty"`
+}
+
+// SearchResponse is a page of results. Corrections maps query words that
+// matched nothing as typed to the word that was searched for instead.
+type SearchResponse struct {
+	Query       string            `json:"query"`
+	Results     []SearchResult    `json:"results"`
+	Total       int               `json:"total"`
+	Page        int               `json:"page"`
+	PerPage     int               `json:"per_page"`
+	Pages       int               `json:"pages"`
+	Corrections map[string]string `json:"corrections,omitempty"`
+}
+
+func (q SearchQuery) matches(d *searchDocument) bool {
+	if len(q.StoreIDs) > 0 {
+		found := false
+		for _, id := range q.StoreIDs {
+			found = found || id == d.StoreID
+		}
+		if !found {
+			return false
+		}
+	}
+	return (q.MinPrice == 0 || d.Price >= q.MinPrice) &&
+		(q.MaxPrice == 0 || d.Price <= q.MaxPrice) &&
+		(q.MinRating == 0 || d.Rating >= q.MinRating) &&
+		(!q.InStock || d.Quantity > 0)
+}
+
+// Search ranks the products matching every word of the query and the
+// filters and returns the requested page
+func (ix *SearchIndex) Search(q SearchQuery) SearchResponse {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if q.PerPage <= 0 {
+		q.PerPage = defaultSearchPageSize
+	}
+	q.PerPage = min(q.PerPage, maxSearchPageSize)
+	q.Page = max(q.Page, 1)
+	response := SearchResponse{Query: q.Text, Results: []SearchResult{}, Page: q.Page, PerPage: q.PerPage}
+
+	terms := searchTerms(q.Text)
+	scores := map[int]float64{}
+	if len(terms) == 0 {
+		for id, d := range ix.docs {
+			if q.matches(d) {
+				scores[id] = 0
+			}
+		}
+	} else {
+		avgLength := 1.0
+		if len(ix.docs) > 0 && ix.totalLength > 0 {
+			avgLength = ix.totalLength / float64(len(ix.docs))
+		}
+		n := float64(len(ix.docs))
+		for i, term := range terms {
+			// a trailing space means the last word is complete
+			prefix := i == len(terms)-1 && !strings.HasSuffix(q.Text, " ")
+			matches := ix.expandLocked(term, prefix)
+			// report the likeliest spelling of a word that matched only with typos
+			var best *termMatch
+			for j, m := range matches {
+				if m.term == term || m.weight == searchPrefixWeight {
+					best = nil
+					break
+				}
+				if best == nil || m.weight > best.weight || (m.weight == best.weight && len(ix.postings[m.term]) > len(ix.postings[best.term])) {
+					best = &matches[j]
+				}
+			}
+			if best != nil {
+				if response.Corrections == nil {
+					response.Corrections = map[string]string{}
+				}
+				response.Corrections[term] = best.term
+			}
+
+			// each product keeps the best score among the term's matches
+			termScores := map[int]float64{}
+			for _, m := range matches {
+				postings := ix.postings[m.term]
+				df := float64(len(postings))
+				idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+				for id, tf := range postings {
+					if i > 0 {
+						if _, ok := scores[id]; !ok {
+							continue
+						}
+					}
+					d := ix.docs[id]
+					if !q.matches(d) {
+						continue
+					}
+					score := m.weight * idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*d.length/avgLength))
+					termScores[id] = math.Max(termScores[id], score)
+				}
+			}
+			for id := range scores {
+				if _, ok := termScores[id]; !ok {
+					delete(scores, id)
+				}
+			}
+			for id, score := range termScores {
+				scores[id] += score
+			}
+			if len(scores) == 0 {
+				break
+			}
+		}
+	}
+
+	results := make([]*searchDocument, 0, len(scores))
+	for id := range scores {
+		results = append(results, ix.docs[id])
+	}
+	less := func(a, b *searchDocument) bool {
+		if scores[a.ProductID] != scores[b.ProductID] {
+			return scores[a.ProductID] > scores[b.ProductID]
+		}
+		return a.ProductID > b.ProductID
+	}
+	switch q.Sort {
+	case "price_asc":
+		less = func(a, b *searchDocument) bool {
+			if a.Price != b.Price {
+				return a.Price < b.Price
+			}
+			return a.ProductID > b.ProductID
+		}
+	case "price_desc":
+		less = func(a, b *searchDocument) bool {
+			if a.Price != b.Price {
+				return a.Price > b.Price
+			}
+			return a.ProductID > b.ProductID
+		}
+	case "rating":
+		less = func(a, b *searchDocument) bool {
+			if a.Rating != b.Rating {
+				return a.Rating > b.Rating
+			}
+			return a.ReviewCount > b.ReviewCount || (a.ReviewCount == b.ReviewCount && a.ProductID > b.ProductID)
+		}
+	case "newest":
+		less = func(a, b *searchDocument) bool { return a.ProductID > b.ProductID }
+	}
+	sort.Slice(results, func(i, j int) bool { return less(results[i], results[j]) })
+
+	response.Total = len(results)
+	response.Pages = (len(results) + q.PerPage - 1) / q.PerPage
+	start := min((q.Page-1)*q.PerPage, len(results))
+	end := min(start+q.PerPage, len(results))
+	for _, d := range results[start:end] {
+		response.Results = append(response.Results, SearchResult{
+			ID:            d.ProductID,
+			Name:          d.Name,
+			Description:   d.Description,
+			Price:         d.Price,
+			Image:         d.Image,
+			Quantity:      d.Quantity,
+			InStock:       d.Quantity > 0,
+			AverageRating: math.Round(d.Rating*10) / 10,
+			ReviewCount:   d.ReviewCount,
+			Tags:          d.Tags,
+			StoreID:       d.StoreID,
+			StoreName:     d.StoreName,
+			Score:         math.Round(scores[d.ProductID]*1000) / 1000,
+		})
+	}
+	return response
+}
+
+// searchSorts are the orders SearchProducts accepts
+var searchSorts = map[string]bool{"": true, "relevance": true, "price_asc": true, "price_desc": true, "rating": true, "newest": true}
+
+// SearchProducts searches the products of every store:
+// GET /api/search?q=&store_id=&min_price=&max_price=&min_rating=&in_stock=&sort=&page=&per_page=
+// store_id may be repeated or comma separated.
+func SearchProducts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	params := r.URL.Query()
+	q := SearchQuery{Text: strings.TrimLeft(params.Get("q"), " "), Sort: params.Get("sort")}
+	invalid := func(name string) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid "+name)
+	}
+	for _, value := range params["store_id"] {
+		for _, part := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || id <= 0 {
+				invalid("store_id")
+				return
+			}
+			q.StoreIDs = append(q.StoreIDs, id)
+		}
+	}
+	for name, target := range map[string]*float64{"min_price": &q.MinPrice, "max_price": &q.MaxPrice, "min_rating": &q.MinRating} {
+		if value := params.Get(name); value != "" {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil || number < 0 || math.IsNaN(number) || math.IsInf(number, 0) {
+				invalid(name)
+				return
+			}
+			*target = number
+		}
+	}
+	for name, target := range map[string]*int{"page": &q.Page, "per_page": &q.PerPage} {
+		if value := params.Get(name); value != "" {
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 1 {
+				invalid(name)
+				return
+			}
+			*target = number
+		}
+	}
+	if value := params.Get("in_stock"); value != "" {
+		inStock, err := strconv.ParseBool(value)
+		if err != nil {
+			invalid("in_stock")
+			return
+		}
+		q.InStock = inStock
+	}
+	if !searchSorts[q.Sort] {
+		invalid("sort")
+		return
+	}
+	if q.MaxPrice > 0 && q.MinPrice > q.MaxPrice {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "min_price is above max_price")
+		return
+	}
+
+	json.NewEncoder(w).Encode(searchIndex.Search(q))
+}
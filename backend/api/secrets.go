@@ -0,0 +1,81 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+var (
+	secretsMu sync.Mutex
+	secrets   = map[string][]byte{}
+)
+
+// appSecret returns the signing key with the given name. APP_SECRET, when
+// set, is used for every name; otherwise a random key is created on first use
+// and kept in the app_secrets table so signatures survive restarts.
+func appSecret(name string) []byte {
+	if secret := os.Getenv("APP_SECRET"); secret != "" {
+		return []byte(name + ":" + secret)
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if secret, ok := secrets[name]; ok {
+		return secret
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		slog.Error("failed to open database for app secret", "name", name, "error", err)
+		return nil
+	}
+	defer db.Close()
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	// keep whichever key was stored first if two processes race here
+	if _, err := db.Exec("INSERT OR IGNORE INTO app_secrets (name, value) VALUES (?, ?)", name, hex.EncodeToString(b)); err != nil {
+		slog.Error("failed to store app secret", "name", name, "error", err)
+		return nil
+	}
+	var value string
+	if err := db.QueryRow("SELECT value FROM app_secrets WHERE name = ?", name).Scan(&value); err != nil {
+		slog.Error("failed to load app secret", "name", name, "error", err)
+		return nil
+	}
+	secret, err := hex.DecodeString(value)
+	if err != nil {
+		slog.Error("invalid app secret", "name", name, "error", err)
+		return nil
+	}
+	secrets[name] = secret
+	return secret
+}
+
+// signValue returns a hex HMAC-SHA256 of value under the named secret
+func signValue(secretName string, value string) string {
+	mac := hmac.New(sha256.New, appSecret(secretName))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks a signature made by signValue in constant time
+func verifySignature(secretName string, value string, signature string) bool {
+	if appSecret(secretName) == nil {
+		return false
+	}
+	expected, err := hex.DecodeString(signValue(secretName, value))
+	if err != nil {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, got)
+}
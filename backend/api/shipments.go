@@ -0,0 +1,797 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shipment is one parcel of an order. An order can be split over several.
+type Shipment struct {
+	ID                int             `json:"id"`
+	OrderID           int             `json:"order_id"`
+	Carrier           string          `json:"carrier"`
+	Service           string          `json:"service,omitempty"`
+	TrackingNumber    string          `json:"tracking_number,omitempty"`
+	LabelURL          string          `json:"label_url,omitempty"`
+	Cost              float64         `json:"cost,omitempty"`
+	Status            string          `json:"status"`
+	EstimatedDelivery string          `json:"estimated_delivery,omitempty"`
+	DeliveredAt       string          `json:"delivered_at,omitempty"`
+	CreatedAt         string          `json:"created_at"`
+	Items             []ShipmentItem  `json:"items"`
+	Events            []TrackingEvent `json:"events"`
+}
+
+// ShipmentItem is a quantity of one order line packed in a shipment
+type ShipmentItem struct {
+	OrderProductID int    `json:"order_product_id"`
+	Name           string `json:"name,omitempty"`
+	Quantity       int    `json:"quantity"`
+}
+
+// ShippableItem is an order line with how much of it is already shipped
+type ShippableItem struct {
+	OrderProductID int    `json:"order_product_id"`
+	Name           string `json:"name"`
+	Quantity       int    `json:"quantity"`
+	Shipped        int    `json:"shipped"`
+}
+
+// errInvalidShipment marks shipment requests that can never succeed as sent
+var errInvalidShipment = errors.New("invalid shipment")
+
+// loadShipments returns an order's shipments, oldest first, with their items
+// and tracking events. Return labels are left out; see returnShipment.
+func loadShipments(db *sql.DB, orderID int) ([]Shipment, error) {
+	rows, err := db.Query(`
+		SELECT id, order_id, carrier, service, tracking_number, label_url, cost, status,
+			estimated_delivery, delivered_at, created_at
+		FROM shipments WHERE order_id = ? AND return_id IS NULL ORDER BY id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanShipments(db, rows)
+}
+
+// scanShipments reads shipment rows and loads their items and events
+func scanShipments(db *sql.DB, rows *sql.Rows) ([]Shipment, error) {
+	shipments := []Shipment{}
+	for rows.Next() {
+		var s Shipment
+		var estimated, deliveredAt sql.NullTime
+		var createdAt time.Time
+		if err := rows.Scan(&s.ID, &s.OrderID, &s.Carrier, &s.Service, &s.TrackingNumber, &s.LabelURL, &s.Cost, &s.Status,
+			&estimated, &deliveredAt, &createdAt); err != nil {
+			return nil, err
+		}
+		if estimated.Valid {
+			s.EstimatedDelivery = estimated.Time.UTC().Format(time.RFC3339)
+		}
+		if deliveredAt.Valid {
+			s.DeliveredAt = deliveredAt.Time.UTC().Format(time.RFC3339)
+		}
+		s.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		shipments = append(shipments, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	var err error
+	for i := range shipments {
+		if shipments[i].Items, err = shipmentItems(db, shipments[i].ID); err != nil {
+			return nil, err
+		}
+		if shipments[i].Events, err = shipmentEvents(db, shipments[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return shipments, nil
+}
+
+func shipmentItems(db *sql.DB, shipmentID int) ([]ShipmentItem, error) {
+	rows, err := db.Query(`
+		SELECT si.order_product_id, `+orderLineName+`, si.quantity
+		FROM shipment_items si
+		JOIN order_products op ON si.order_product_id = op.id
+		JOIN products p ON op.product_id = p.id
+		WHERE si.shipment_id = ?
+		ORDER BY si.order_product_id
+	`, shipmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ShipmentItem{}
+	for rows.Next() {
+		var item ShipmentItem
+		if err := rows.Scan(&item.OrderProductID, &item.Name, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func shipmentEvents(db *sql.DB, shipmentID int) ([]TrackingEvent, error) {
+	rows, err := db.Query(`
+		SELECT status, description, location, occurred_at
+		FROM shipment_events WHERE shipment_id = ?
+		ORDER BY occurred_at, id
+	`, shipmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []TrackingEvent{}
+	for rows.Next() {
+		var e TrackingEvent
+		if err := rows.Scan(&e.Status, &e.Description, &e.Location, &e.At); err != nil {
+			return nil, err
+		}
+		e.At = e.At.UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// shippableItems returns every line of the order with its shipped quantity
+func shippableItems(db *sql.DB, orderID int) ([]ShippableItem, error) {
+	rows, err := db.Query(`
+		SELECT op.id, `+orderLineName+`, op.quantity,
+			COALESCE((SELECT SUM(si.quantity) FROM shipment_items si WHERE si.order_product_id = op.id), 0)
+		FROM order_products op
+		JOIN products p ON op.product_id = p.id
+		WHERE op.order_id = ?
+		ORDER BY op.id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ShippableItem{}
+	for rows.Next() {
+		var item ShippableItem
+		if err := rows.Scan(&item.OrderProductID, &item.Name, &item.Quantity, &item.Shipped); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// unshippedCount is how many units of the order are not in a shipment yet
+func unshippedCount(items []ShippableItem) int {
+	n := 0
+	for _, item := range items {
+		n += item.Quantity - item.Shipped
+	}
+	return n
+}
+
+// orderTrackingNumbers lists the tracking numbers of an order's shipments
+func orderTrackingNumbers(db *sql.DB, orderID int) string {
+	var numbers sql.NullString
+	db.QueryRow("SELECT group_concat(tracking_number, ', ') FROM shipments WHERE order_id = ? AND return_id IS NULL AND tracking_number != ''", orderID).Scan(&numbers)
+	return numbers.String
+}
+
+// shipmentRequest is the body of POST /api/shipments/create and, without
+// carrier and service, of /api/shipments/rates. No items means everything
+// not shipped yet.
+type shipmentRequest struct {
+	StoreID        int            `json:"store_id"`
+	OrderID        int            `json:"order_id"`
+	Carrier        string         `json:"carrier"`
+	Service        string         `json:"service"`
+	TrackingNumber string         `json:"tracking_number"`
+	Items          []ShipmentItem `json:"items"`
+}
+
+// shipmentParcel checks the requested items against what is left to ship and
+// returns the parcel to quote or book along with the resolved items
+func shipmentParcel(db *sql.DB, req shipmentRequest) (Parcel, []ShipmentItem, error) {
+	var shippingInfo, storeAddress string
+	err := db.QueryRow(`
+		SELECT COALESCE(o.shipping_info, ''), COALESCE(s.address, '')
+		FROM orders o JOIN stores s ON o.store_id = s.id
+		WHERE o.id = ? AND o.store_id = ?
+	`, req.OrderID, req.StoreID).Scan(&shippingInfo, &storeAddress)
+	if err != nil {
+		return Parcel{}, nil, err
+	}
+
+	lines, err := shippableItems(db, req.OrderID)
+	if err != nil {
+		return Parcel{}, nil, err
+	}
+	remaining := map[int]int{}
+	for _, line := range lines {
+		remaining[line.OrderProductID] = line.Quantity - line.Shipped
+	}
+
+	items := req.Items
+	if len(items) == 0 {
+		for _, line := range lines {
+			if left := line.Quantity - line.Shipped; left > 0 {
+				items = append(items, ShipmentItem{OrderProductID: line.OrderProductID, Quantity: left})
+			}
+		}
+	}
+	total := 0
+	var resolved []ShipmentItem
+	for _, item := range items {
+		left, ok := remaining[item.OrderProductID]
+		if !ok {
+			return Parcel{}, nil, fmt.Errorf("%w: item %d is not part of this order", errInvalidShipment, item.OrderProductID)
+		}
+		if item.Quantity == 0 {
+			continue
+		}
+		if item.Quantity < 0 || item.Quantity > left {
+			return Parcel{}, nil, fmt.Errorf("%w: only %d of item %d left to ship", errInvalidShipment, left, item.OrderProductID)
+		}
+		remaining[item.OrderProductID] -= item.Quantity
+		total += item.Quantity
+		resolved = append(resolved, ShipmentItem{OrderProductID: item.OrderProductID, Quantity: item.Quantity})
+	}
+	if total == 0 {
+		return Parcel{}, nil, fmt.Errorf("%w: nothing left to ship", errInvalidShipment)
+	}
+	return Parcel{From: storeAddress, To: parseShippingInfo(shippingInfo), Items: total}, resolved, nil
+}
+
+// bookLabel buys a label for the parcel from an enabled carrier
+func bookLabel(carrierName string, service string, parcel Parcel) (ShippingLabel, error) {
+	carrier, ok := findCarrier(carrierName)
+	if !ok {
+		return ShippingLabel{}, fmt.Errorf("%w: unknown carrier %q", errInvalidShipment, carrierName)
+	}
+	label, err := carrier.CreateLabel(parcel, service)
+	if errors.Is(err, errUnknownService) {
+		return ShippingLabel{}, fmt.Errorf("%w: %s does not offer %q", errInvalidShipment, carrierName, service)
+	}
+	return label, err
+}
+
+// createShipment books the parcel with the carrier, or records the owner's
+// tracking number for manual shipments, and stores the shipment
+func createShipment(db *sql.DB, req shipmentRequest) (int, error) {
+	parcel, items, err := shipmentParcel(db, req)
+	if err != nil {
+		return 0, err
+	}
+
+	status := ShipmentLabelCreated
+	var label ShippingLabel
+	if req.Carrier == manualCarrier {
+		label.TrackingNumber = strings.TrimSpace(req.TrackingNumber)
+		if label.TrackingNumber == "" {
+			return 0, fmt.Errorf("%w: a tracking number is required for manual shipments", errInvalidShipment)
+		}
+		status = ShipmentInTransit
+	} else if label, err = bookLabel(req.Carrier, req.Service, parcel); err != nil {
+		return 0, err
+	}
+	var estimated interface{}
+	if label.Days > 0 {
+		estimated = sqlTime(time.Now().Add(time.Duration(label.Days) * 24 * time.Hour))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`
+		INSERT INTO shipments (order_id, store_id, carrier, service, tracking_number, label_url, cost, status, estimated_delivery)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.OrderID, req.StoreID, req.Carrier, req.Service, label.TrackingNumber, label.LabelURL, label.Cost, status, estimated)
+	if err != nil {
+		return 0, err
+	}
+	shipmentID, _ := result.LastInsertId()
+	for _, item := range items {
+		if _, err := tx.Exec("INSERT INTO shipment_items (shipment_id, order_product_id, quantity) VALUES (?, ?, ?)",
+			shipmentID, item.OrderProductID, item.Quantity); err != nil {
+			return 0, err
+		}
+	}
+	if req.Carrier == manualCarrier {
+		if _, err := tx.Exec("INSERT INTO shipment_events (shipment_id, status, description, occurred_at) VALUES (?, ?, ?, ?)",
+			shipmentID, ShipmentInTransit, "Handed to carrier", sqlTime(time.Now())); err != nil {
+			return 0, err
+		}
+	}
+	// the order arrives with its last parcel
+	if estimated != nil {
+		if _, err := tx.Exec(`
+			UPDATE orders SET estimated_delivery = MAX(COALESCE(estimated_delivery, ?), ?) WHERE id = ?
+		`, estimated, estimated, req.OrderID); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// the carrier's own first scans replace a made-up "label created" event
+	if req.Carrier != manualCarrier {
+		if _, _, err := pollShipment(db, int(shipmentID), req.Carrier, label.TrackingNumber, status); err != nil {
+			Logger(nil).Warn("shipment tracking failed", "shipment_id", shipmentID, "carrier", req.Carrier, "error", err)
+		}
+	}
+	return int(shipmentID), nil
+}
+
+// advanceOrderStatus moves an order to status if it is in one of from, and
+// tells the customer. It reports whether the order moved.
+func advanceOrderStatus(r *http.Request, db *sql.DB, storeID int, orderID int, status string, from ...string) bool {
+	args := []interface{}{status, status, status, orderID}
+	for _, s := range from {
+		args = append(args, s)
+	}
+	result, err := db.Exec(`
+		UPDATE orders
+		SET status = ?, version = version + 1, updated_at = datetime('now'),
+			shipped_at = CASE WHEN ? = 'shipped' THEN COALESCE(shipped_at, datetime('now')) ELSE shipped_at END,
+			delivered_at = CASE WHEN ? = 'delivered' THEN COALESCE(delivered_at, datetime('now')) ELSE delivered_at END
+		WHERE id = ? AND status IN (?`+strings.Repeat(", ?", len(from)-1)+`)
+	`, args...)
+	if err != nil {
+		Logger(r).Error("failed to advance order status", "order_id", orderID, "status", status, "error", err)
+		return false
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false
+	}
+	recordOrderStatus(db, int64(orderID), status)
+	announceOrderStatus(r, db, storeID, orderID, status)
+	return true
+}
+
+// publishShipment tells the store's staff and the customer a shipment changed
+func publishShipment(db *sql.DB, storeID int, orderID int, shipmentID int, status string) {
+	var customerID int
+	db.QueryRow("SELECT user_id FROM orders WHERE id = ?", orderID).Scan(&customerID)
+	PublishEvent(Event{Type: EventShipmentUpdated, StoreID: storeID, UserID: customerID, Data: map[string]interface{}{
+		"order_id":    orderID,
+		"shipment_id": shipmentID,
+		"status":      status,
+	}})
+}
+
+// pollShipment stores new tracking events for a shipment. It reports whether
+// the shipment's status changed.
+func pollShipment(db *sql.DB, shipmentID int, carrierName string, trackingNumber string, status string) (string, bool, error) {
+	carrier, ok := findCarrier(carrierName)
+	if !ok {
+		return status, false, fmt.Errorf("carrier %q is not enabled", carrierName)
+	}
+	events, err := carrier.Track(trackingNumber)
+	if err != nil {
+		return status, false, err
+	}
+	newStatus := status
+	var deliveredAt interface{}
+	for _, e := range events {
+		if _, err := db.Exec(`
+			INSERT OR IGNORE INTO shipment_events (shipment_id, status, description, location, occurred_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, shipmentID, e.Status, e.Description, e.Location, sqlTime(e.At)); err != nil {
+			return status, false, err
+		}
+		newStatus = e.Status
+		if e.Status == ShipmentDelivered {
+			deliveredAt = sqlTime(e.At)
+		}
+	}
+	_, err = db.Exec(`
+		UPDATE shipments SET status = ?, delivered_at = COALESCE(delivered_at, ?), polled_at = datetime('now'), updated_at = datetime('now')
+		WHERE id = ?
+	`, newStatus, deliveredAt, shipmentID)
+	return newStatus, newStatus != status, err
+}
+
+// deliverManualShipments closes the shipments nobody polls once the order is
+// known to have arrived
+func deliverManualShipments(db *sql.DB, orderID int) {
+	_, err := db.Exec(`
+		UPDATE shipments SET status = ?, delivered_at = COALESCE(delivered_at, datetime('now')), updated_at = datetime('now')
+		WHERE order_id = ? AND carrier = ? AND status != ?
+	`, ShipmentDelivered, orderID, manualCarrier, ShipmentDelivered)
+	if err != nil {
+		Logger(nil).Error("failed to close manual shipments", "order_id", orderID, "error", err)
+	}
+}
+
+// completeDeliveredOrder marks a shipped order delivered once every unit is
+// in a delivered shipment
+func completeDeliveredOrder(r *http.Request, db *sql.DB, storeID int, orderID int) {
+	lines, err := shippableItems(db, orderID)
+	if err != nil || unshippedCount(lines) > 0 {
+		return
+	}
+	var open int
+	if err := db.QueryRow("SELECT COUNT(*) FROM shipments WHERE order_id = ? AND return_id IS NULL AND status != ?", orderID, ShipmentDelivered).Scan(&open); err != nil || open > 0 {
+		return
+	}
+	advanceOrderStatus(r, db, storeID, orderID, "delivered", "shipped")
+}
+
+// pollShipmentsJob asks carriers about every parcel still on its way
+func pollShipmentsJob(ctx context.Context, payload json.RawMessage) error {
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, order_id, store_id, COALESCE(return_id, 0), carrier, tracking_number, status
+		FROM shipments
+		WHERE carrier != ? AND status != ? AND tracking_number != ''
+	`, manualCarrier, ShipmentDelivered)
+	if err != nil {
+		return err
+	}
+	type openShipment struct {
+		id, orderID, storeID, returnID  int
+		carrier, trackingNumber, status string
+	}
+	var open []openShipment
+	for rows.Next() {
+		var s openShipment
+		if err := rows.Scan(&s.id, &s.orderID, &s.storeID, &s.returnID, &s.carrier, &s.trackingNumber, &s.status); err != nil {
+			rows.Close()
+			return err
+		}
+		open = append(open, s)
+	}
+	rows.Close()
+
+	for _, s := range open {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		status, changed, err := pollShipment(db, s.id, s.carrier, s.trackingNumber, s.status)
+		if err != nil {
+			Logger(nil).Warn("shipment tracking failed", "shipment_id", s.id, "carrier", s.carrier, "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if s.returnID != 0 {
+			publishReturn(db, s.storeID, s.returnID)
+			continue
+		}
+		publishShipment(db, s.storeID, s.orderID, s.id, status)
+		if status == ShipmentDelivered {
+			completeDeliveredOrder(nil, db, s.storeID, s.orderID)
+		}
+	}
+	return nil
+}
+
+// writeShipmentError answers with 400 for requests that cannot succeed and
+// 500 for everything else
+func writeShipmentError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
+		return
+	}
+	if errors.Is(err, errInvalidShipment) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, invalidMessage(err, errInvalidShipment))
+		return
+	}
+	Logger(r).Error("shipment request failed", "error", err)
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create shipment")
+}
+
+// GetShipments lists an order's shipments with what is left to ship:
+// GET /api/shipments?store_id=&order_id=
+func GetShipments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
+		return
+	}
+	orderID, err := strconv.Atoi(r.URL.Query().Get("order_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid order ID")
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, storeID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	var exists int
+	db.QueryRow("SELECT COUNT(*) FROM orders WHERE id = ? AND store_id = ?", orderID, storeID).Scan(&exists)
+	if exists == 0 {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
+		return
+	}
+	shipments, err := loadShipments(db, orderID)
+	if err != nil {
+		Logger(r).Error("shipments query failed", "order_id", orderID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch shipments")
+		return
+	}
+	items, err := shippableItems(db, orderID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch order items")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"shipments": shipments,
+		"items":     items,
+		"carriers":  append(carrierNames(), manualCarrier),
+	})
+}
+
+// GetShippingRates quotes every enabled carrier for the requested items
+func GetShippingRates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req shipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrderID == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request")
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, req.StoreID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	parcel, _, err := shipmentParcel(db, req)
+	if err != nil {
+		writeShipmentError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"rates": quoteAll(parcel)})
+}
+
+// CreateShipment books a shipment for some or all of an order's remaining
+// items. The order moves to processing while items are left and to shipped
+// once everything is in a shipment.
+func CreateShipment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req shipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrderID == 0 || req.Carrier == "" {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Order and carrier are required")
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, req.StoreID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM orders WHERE id = ? AND store_id = ?", req.OrderID, req.StoreID).Scan(&status); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Order not found")
+		return
+	}
+	if status == "pending" || status == "cancelled" {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, "Only paid orders can be shipped")
+		return
+	}
+
+	shipmentID, err := createShipment(db, req)
+	if err != nil {
+		writeShipmentError(w, r, err)
+		return
+	}
+	Logger(r).Info("shipment created", "order_id", req.OrderID, "shipment_id", shipmentID, "carrier", req.Carrier)
+
+	if lines, err := shippableItems(db, req.OrderID); err == nil && unshippedCount(lines) == 0 {
+		advanceOrderStatus(r, db, req.StoreID, req.OrderID, "shipped", "paid", "processing")
+	} else {
+		advanceOrderStatus(r, db, req.StoreID, req.OrderID, "processing", "paid")
+	}
+	shipments, err := loadShipments(db, req.OrderID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch shipments")
+		return
+	}
+	for _, s := range shipments {
+		if s.ID == shipmentID {
+			publishShipment(db, req.StoreID, req.OrderID, shipmentID, s.Status)
+		}
+	}
+
+	response := map[string]interface{}{
+		"success":     true,
+		"shipment_id": shipmentID,
+		"shipments":   shipments,
+	}
+	if order, err := loadStoreOrder(db, req.StoreID, req.OrderID); err == nil {
+		response["order"] = order
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// refreshShipmentRequest is the body of RefreshShipment
+type refreshShipmentRequest struct {
+	StoreID    int `json:"store_id"`
+	ShipmentID int `json:"shipment_id"`
+}
+
+// RefreshShipment polls the carrier for one shipment now instead of waiting
+// for the next scheduled poll
+func RefreshShipment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req refreshShipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ShipmentID == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request")
+		return
+	}
+	if _, isOwner := ValidateStoreOwner(w, r, req.StoreID); !isOwner {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database Error")
+		return
+	}
+	defer db.Close()
+
+	var orderID, returnID int
+	var carrier, trackingNumber, status string
+	err = db.QueryRow("SELECT order_id, COALESCE(return_id, 0), carrier, tracking_number, status FROM shipments WHERE id = ? AND store_id = ?",
+		req.ShipmentID, req.StoreID).Scan(&orderID, &returnID, &carrier, &trackingNumber, &status)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Shipment not found")
+		return
+	}
+	if carrier == manualCarrier {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, "Manual shipments are not tracked")
+		return
+	}
+	newStatus, changed, err := pollShipment(db, req.ShipmentID, carrier, trackingNumber, status)
+	if err != nil {
+		Logger(r).Warn("shipment tracking failed", "shipment_id", req.ShipmentID, "error", err)
+		writeError(w, r, http.StatusBadGateway, CodeInternal, "Carrier did not answer, try again later")
+		return
+	}
+	if changed && returnID != 0 {
+		publishReturn(db, req.StoreID, returnID)
+	} else if changed {
+		publishShipment(db, req.StoreID, orderID, req.ShipmentID, newStatus)
+		if newStatus == ShipmentDelivered {
+			completeDeliveredOrder(r, db, req.StoreID, orderID)
+		}
+	}
+	shipments, err := loadShipments(db, orderID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to fetch shipments")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "shipments": shipments})
+}
+
+// ShippingLabelPage renders the printable label of a local carrier shipment.
+// Return labels swap the addresses so the parcel goes back to the store.
+func ShippingLabelPage(w http.ResponseWriter, r *http.Request) {
+	trackingNumber := r.URL.Query().Get("tracking")
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer db.Close()
+
+	var shipmentID, orderID, storeID, returnID, customerID int
+	var service, shippingInfo string
+	var createdAt time.Time
+	err = db.QueryRow(`
+		SELECT s.id, s.order_id, s.store_id, COALESCE(s.return_id, 0), o.user_id, s.service, COALESCE(o.shipping_info, ''), s.created_at
+		FROM shipments s JOIN orders o ON s.order_id = o.id
+		WHERE s.tracking_number = ? AND s.carrier = 'local'
+	`, trackingNumber).Scan(&shipmentID, &orderID, &storeID, &returnID, &customerID, &service, &shippingInfo, &createdAt)
+	if err == sql.ErrNoRows {
+		HandleError(w, r, http.StatusNotFound, "Label not found")
+		return
+	} else if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load label")
+		return
+	}
+	// customers print the labels of their own returns
+	_, allowed := ValidateStoreOwner(w, r, storeID)
+	if !allowed && returnID != 0 {
+		userID, isCustomer := ValidateStoreCustomer(w, r, strconv.Itoa(storeID))
+		allowed = isCustomer && userID == customerID
+	}
+	if !allowed {
+		HandleError(w, r, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	store, err := GetStoreByID(storeID)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load store")
+		return
+	}
+
+	from := ShippingAddress{FullName: store.Name, Address: store.Address, Phone: store.Phone}
+	to := parseShippingInfo(shippingInfo)
+	pieces := 0
+	if returnID != 0 {
+		from, to = to, from
+		db.QueryRow("SELECT COALESCE(SUM(quantity), 0) FROM return_items WHERE return_id = ?", returnID).Scan(&pieces)
+	} else {
+		items, err := shipmentItems(db, shipmentID)
+		if err != nil {
+			HandleError(w, r, http.StatusInternalServerError, "Failed to load shipment items")
+			return
+		}
+		for _, item := range items {
+			pieces += item.Quantity
+		}
+	}
+
+	tmpl, err := template.ParseFiles(FrontendShippingLabelHTML)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load template")
+		return
+	}
+	err = tmpl.Execute(w, map[string]interface{}{
+		"OrderID":        orderID,
+		"ReturnID":       returnID,
+		"TrackingNumber": trackingNumber,
+		"Service":        service,
+		"Date":           createdAt.Format("January 2, 2006"),
+		"From":           from,
+		"ShipTo":         to,
+		"Pieces":         pieces,
+	})
+	if err != nil {
+		Logger(r).Error("failed to render shipping label", "shipment_id", shipmentID, "error", err)
+	}
+}
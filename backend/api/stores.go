@@ -3,8 +3,10 @@ package api
 import (
 	"database/sql"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -48,7 +50,7 @@ func StorePage(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetStores() ([]Store, error) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return nil, err
 	}
@@ -93,7 +95,7 @@ func GetStores() ([]Store, error) {
 }
 
 func GetMyStores(userID int) ([]Store, error) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return nil, err
 	}
@@ -138,7 +140,7 @@ func GetMyStores(userID int) ([]Store, error) {
 }
 
 func GetStoreByID(storeID int) (Store, error) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return Store{}, err
 	}
@@ -177,27 +179,73 @@ func GetStoreByID(storeID int) (Store, error) {
 	return store, nil
 }
 
+// createStoreRequest is the v1 JSON body of CreateStoreHandler. Logo and
+// Banner are data URLs; Colors holds the colors of the chosen template.
+type createStoreRequest struct {
+	Name                  string  `json:"name"`
+	Description           string  `json:"description"`
+	Template              string  `json:"template"`
+	Colors                Color   `json:"colors"`
+	Logo                  string  `json:"logo"`
+	Banner                string  `json:"banner"`
+	Phone                 string  `json:"phone"`
+	Address               string  `json:"address"`
+	PaymentMethods        string  `json:"payment_methods"`
+	IBANNumber            string  `json:"iban_number"`
+	ShippingInfo          string  `json:"shipping_info"`
+	ShippingCost          float64 `json:"shipping_cost"`
+	EstimatedShipping     int     `json:"estimated_shipping"`
+	FreeShippingThreshold float64 `json:"free_shipping_threshold"`
+}
+
+func (req createStoreRequest) form() url.Values {
+	form := url.Values{
+		"storeTitle":            {req.Name},
+		"storeDescription":      {req.Description},
+		"selectedTemplate":      {req.Template},
+		"storeLogo":             {req.Logo},
+		"storeBanner":           {req.Banner},
+		"contactPhone":          {req.Phone},
+		"businessAddress":       {req.Address},
+		"paymentMethods":        {req.PaymentMethods},
+		"ibanNumber":            {req.IBANNumber},
+		"shippingInfo":          {req.ShippingInfo},
+		"shippingCost":          {strconv.FormatFloat(req.ShippingCost, 'f', -1, 64)},
+		"estimatedShipping":     {strconv.Itoa(req.EstimatedShipping)},
+		"freeShippingThreshold": {strconv.FormatFloat(req.FreeShippingThreshold, 'f', -1, 64)},
+	}
+	for name, value := range map[string]string{
+		"primary":    req.Colors.Primary,
+		"secondary":  req.Colors.Secondary,
+		"background": req.Colors.Background,
+		"accent":     req.Colors.Accent,
+		"tertiary":   req.Colors.Tertiary,
+		"supporting": req.Colors.Supporting,
+		"highlight":  req.Colors.Highlight,
+	} {
+		form.Set(req.Template+"-"+name, value)
+	}
+	return form
+}
+
 func CreateStoreHandler(w http.ResponseWriter, r *http.Request) {
 	userID, validUser := ValidateUser(w, r)
 	if !validUser {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`{"error": "Unauthorized"}`))
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error": "Database connection failed"}`))
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database connection failed")
 		return
 	}
 	defer db.Close()
 	name := strings.TrimSpace(r.FormValue("storeTitle"))
 	description := strings.TrimSpace(r.FormValue("storeDescription"))
 	if err = ValidateStoreName(name); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "` + err.Error() + `"}`))
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, err.Error())
 		return
 	}
 	query := "SELECT id FROM stores WHERE LOWER(name) = LOWER(?)"
@@ -205,8 +253,7 @@ func CreateStoreHandler(w http.ResponseWriter, r *http.Request) {
 	var existingID int
 	err = row.Scan(&existingID)
 	if err != sql.ErrNoRows {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "Store name already exists"}`))
+		writeError(w, r, http.StatusBadRequest, CodeAlreadyExists, "Store name already exists")
 		return
 	}
 
@@ -233,8 +280,7 @@ func CreateStoreHandler(w http.ResponseWriter, r *http.Request) {
 			r.FormValue("luxury-secondary"),
 			r.FormValue("luxury-background"))
 	} else {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "Couldn't determine template colors"}`))
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Couldn't determine template colors")
 		return
 	}
 
@@ -245,14 +291,15 @@ func CreateStoreHandler(w http.ResponseWriter, r *http.Request) {
 	if logo != "" {
 		valid, filename := ValidateImage(avatarPath, logo)
 		if !valid {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(`{"error": "` + filename + `"}`))
+			writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, filename)
 			return
 		}
 		logoImage = filename
+		if err := queueThumbnail(StoreLogosPath, filename); err != nil {
+			Logger(r).Warn("failed to queue logo sizes", "image", filename, "error", err)
+		}
 	} else {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "Logo is required"}`))
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Logo is required")
 		return
 	}
 	banner := r.FormValue("storeBanner")
@@ -262,14 +309,15 @@ func CreateStoreHandler(w http.ResponseWriter, r *http.Request) {
 	if banner != "" {
 		valid, filename := ValidateImage(bannerPath, banner)
 		if !valid {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(`{"error": "` + filename + `"}`))
+			writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, filename)
 			return
 		}
 		bannerImage = filename
+		if err := queueThumbnail(StoreBannersPath, filename); err != nil {
+			Logger(r).Warn("failed to queue banner sizes", "image", filename, "error", err)
+		}
 	} else {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "Banner is required"}`))
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "Banner is required")
 		return
 	}
 	colorscheme := strings.Join(colors, ",")
@@ -310,25 +358,25 @@ func CreateStoreHandler(w http.ResponseWriter, r *http.Request) {
 	query = "INSERT INTO stores (name, description, template, color_scheme, logo, banner, owner_id, phone, address, payment_methods, iban_number, shipping_info, shipping_cost, estimated_shipping, free_shipping_threshold) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 	_, err = db.Exec(query, name, description, selectedTemplate, colorscheme, logoImage, bannerImage, userID, phone, address, paymentMethods, ibanNumber, shippingInfo, shippingCost, estimatedShipping, freeShippingThreshold)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error": "Failed to create store in database"}`))
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create store in database")
 		return
 	}
 	ip, err := GetIPv4()
 	if err != nil {
-		log.Println("Error getting IPv4:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error": "Failed to get server IP address"}`))
+		Logger(r).Error("failed to resolve server IPv4", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get server IP address")
 		return
 	}
-	AddHostEntry(strings.ToLower(name)+".com", ip)
+	if err := AddHostEntry(strings.ToLower(name)+".com", ip); err != nil {
+		Logger(r).Warn("failed to add hosts entry for store", "store", name, "error", err)
+	}
 	
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"success": true}`))
 }
 
 func GetStoreByName(storeName string) (Store, error) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return Store{}, err
 	}
@@ -346,7 +394,10 @@ func GetStoreByName(storeName string) (Store, error) {
 	}
 	
 	// Get owner email
-	ownerEmail, _ := getOwnerEmail(int(store.OwnerID))
+	ownerEmail, err := getOwnerEmail(int(store.OwnerID))
+	if err != nil {
+		slog.Warn("failed to load store owner email", "store_id", store.ID, "error", err)
+	}
 	store.OwnerEmail = ownerEmail
 	
 	colors := strings.Split(colorScheme, ",")
@@ -371,13 +422,17 @@ func GetStoreByName(storeName string) (Store, error) {
 	if err != nil {
 		return Store{}, err
 	}
+	store.Categories, store.Tags, store.Collections, err = storeCatalog(int(store.ID), store.Products)
+	if err != nil {
+		return Store{}, err
+	}
 	store.ColorScheme = color
 	return store, nil
 }
 
 // GetStoreByCustomDomain retrieves a store by its custom domain
 func GetStoreByCustomDomain(customDomain string) (Store, error) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return Store{}, err
 	}
@@ -415,6 +470,10 @@ func GetStoreByCustomDomain(customDomain string) (Store, error) {
 	if err != nil {
 		return Store{}, err
 	}
+	store.Categories, store.Tags, store.Collections, err = storeCatalog(int(store.ID), store.Products)
+	if err != nil {
+		return Store{}, err
+	}
 	store.ColorScheme = color
 	return store, nil
 }
@@ -468,7 +527,7 @@ func parseInt(s string) (int, error) {
 }
 // getOwnerEmail retrieves the email of the store owner from the users table
 func getOwnerEmail(ownerID int) (string, error) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return "", err
 	}
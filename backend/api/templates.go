@@ -25,10 +25,19 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 		storeName = ""
 	}
 
+	// A single order's tracking page (e.g., /storename/orders/42)
+	trackingOrderID := 0
+	if idx := strings.LastIndex(storeName, "/orders/"); idx != -1 {
+		if id, err := strconv.Atoi(storeName[idx+len("/orders/"):]); err == nil && id > 0 {
+			trackingOrderID = id
+			storeName = storeName[:idx+len("/orders")]
+		}
+	}
+
 	// Check for orders suffix anywhere in the path (e.g., /storename/orders)
 	if strings.HasSuffix(storeName, "orders") && !isCheckout && !isDashboard && !isPayment {
 		isOrders = true
-		storeName = strings.TrimSuffix(storeName, "orders")
+		storeName = strings.TrimSuffix(strings.TrimSuffix(storeName, "orders"), "/")
 	} else if storeName == "orders" {
 		// For just /orders
 		isOrders = true
@@ -112,7 +121,7 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 		store, err := GetStoreByName(storeName)
 		if err == nil && store.ID != 0 {
 			// Set store cookie when store is accessed
-			SetStoreCookie(w, int(store.OwnerID), store.Name)
+			SetStoreCookie(w, r, int(store.OwnerID), store.Name)
 		}
 		if err == nil && store.ID != 0 && !isCheckout && !isDashboard && !isPayment && !isOrders {
 			tmpl, err := template.ParseFiles(FrontendTemplateDir + store.Template + FrontendTemplateExtension)
@@ -164,6 +173,10 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		} else if isPayment && err == nil && store.ID != 0 {
+			if trackingOrderID != 0 {
+				OrderTrackingPage(w, r, store, trackingOrderID)
+				return
+			}
 			if _, validUser := ValidateStoreCustomer(w, r, strconv.FormatUint(uint64(store.ID), 10)); !validUser {
 				HandleError(w, r, http.StatusUnauthorized, "Unauthorized, Please login!")
 				return
@@ -186,6 +199,10 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 			return
 		} else if isOrders && err == nil && store.ID != 0 {
 			// Show customer's orders for this store
+			if trackingOrderID != 0 {
+				OrderTrackingPage(w, r, store, trackingOrderID)
+				return
+			}
 			if _, validUser := ValidateStoreCustomer(w, r, strconv.FormatUint(uint64(store.ID), 10)); !validUser {
 				HandleError(w, r, http.StatusUnauthorized, "Unauthorized, Please login!")
 				return
@@ -218,9 +235,20 @@ func SampleStoreView(w http.ResponseWriter, r *http.Request) {
 		HandleError(w, r, http.StatusInternalServerError, "Failed to load template")
 		return
 	}
-	sampleStore := Store{}
+	if err := tmpl.Execute(w, sampleStore(path)); err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to render template")
+		return
+	}
+}
+
+// sampleTemplates are the templates with preview data in sampleStore
+var sampleTemplates = []string{"modern_template", "luxury_template", "vibrant_template"}
+
+// sampleStore is the made-up store shown when previewing a template
+func sampleStore(path string) Store {
+	store := Store{}
 	if path == "modern_template" {
-		sampleStore = Store{
+		store = Store{
 			ID:       0,
 			Name:     "Modern Store",
 			Template: path,
@@ -242,7 +270,7 @@ func SampleStoreView(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 	} else if path == "luxury_template" {
-		sampleStore = Store{
+		store = Store{
 			ID:       0,
 			Name:     "LUXURIA",
 			Template: path,
@@ -262,7 +290,7 @@ func SampleStoreView(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 	} else if path == "vibrant_template" {
-		sampleStore = Store{
+		store = Store{
 			ID:       0,
 			Name:     "VibrantShop",
 			Template: path,
@@ -286,10 +314,7 @@ func SampleStoreView(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 	}
-	if err := tmpl.Execute(w, sampleStore); err != nil {
-		HandleError(w, r, http.StatusInternalServerError, "Failed to render template")
-		return
-	}
+	return store
 }
 
 func extractStoreNameFromDomain(hostname string) string {
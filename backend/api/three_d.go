@@ -1,11 +1,13 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"html/template"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -13,80 +15,74 @@ const (
 	Store3DPath = "./store_images/3d_images"
 )
 
-// Check3DModel checks if a 3D model exists for a given product image name
-// It matches the product image name (without extension) to 3D model files
+// Check3DModel checks if a 3D model is linked to the product shown with a
+// given image
 func Check3DModel(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method != http.MethodGet {
-		http.Error(w, `{"error": "Method Not Allowed"}`, http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method Not Allowed")
 		return
 	}
 
 	imageName := r.URL.Query().Get("image")
 	if imageName == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "image parameter is required"})
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "image parameter is required")
 		return
 	}
 
-	// Remove file extension from the image name
-	// e.g., "product.jpg" becomes "product"
-	imageName = strings.TrimSuffix(imageName, filepath.Ext(imageName))
-
-	// Check for common 3D model file formats
-	model3DFormats := []string{".glb", ".gltf", ".obj", ".fbx", ".usdz"}
-	has3DModel := false
-	var model3DPath string
-
-	// Look for a matching 3D model file
-	for _, format := range model3DFormats {
-		path := filepath.Join(Store3DPath, imageName+format)
-		if _, err := os.Stat(path); err == nil {
-			has3DModel = true
-			model3DPath = imageName + format
-			break
-		}
-	}
-
+	model, found := find3DModel(imageName)
 	response := map[string]interface{}{
-		"has_3d_model": has3DModel,
-		"model_path":   model3DPath,
+		"has_3d_model": found,
+		"model_path":   model.File,
+	}
+	if model.PreviewURL != "" {
+		response["preview_url"] = model.PreviewURL
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
-// Get3DModel serves a 3D model file
-// Prevents directory traversal attacks by validating the file path
-func Get3DModel(w http.ResponseWriter, r *http.Request) {
-	modelName := r.URL.Query().Get("model")
-	if modelName == "" {
-		http.Error(w, `{"error": "model parameter is required"}`, http.StatusBadRequest)
-		return
-	}
-
-	// Prevent directory traversal attacks
-	modelName = filepath.Base(modelName)
-
-	modelPath := filepath.Join(Store3DPath, modelName)
+// find3DModel returns the 3D model linked to the product shown with an
+// image, its main image or one from its gallery
+func find3DModel(imageName string) (ProductModel, bool) {
+	imageName = filepath.Base(imageName)
 
-	// Verify the file exists and is in the correct directory
-	absPath, err := filepath.Abs(modelPath)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		http.Error(w, `{"error": "Invalid path"}`, http.StatusBadRequest)
-		return
-	}
+		return ProductModel{}, false
+	}
+	defer db.Close()
+
+	model, err := scanProductModel(db.QueryRow(`
+		SELECT `+productModelColumns+` FROM product_models
+		WHERE product_id IN (
+			SELECT id FROM products WHERE image = ?
+			UNION SELECT product_id FROM product_media WHERE file = ?
+		)
+		LIMIT 1
+	`, imageName, imageName))
+	return model, err == nil
+}
 
-	absStoreDir, err := filepath.Abs(Store3DPath)
-	if err != nil {
-		http.Error(w, `{"error": "Invalid path"}`, http.StatusBadRequest)
-		return
+// modelParam cleans the model parameter of the 3D endpoints. Models with
+// several files live in a folder, so one level of nesting is allowed, but
+// nothing may point outside the 3d_images folder.
+func modelParam(r *http.Request) string {
+	name := path.Clean("/" + r.URL.Query().Get("model"))[1:]
+	if !validBlobKey(name) || strings.Count(name, "/") > 1 {
+		return ""
 	}
+	return name
+}
 
-	if !strings.HasPrefix(absPath, absStoreDir) {
-		http.Error(w, `{"error": "Access denied"}`, http.StatusForbidden)
+// Get3DModel serves a 3D model file
+// Prevents directory traversal attacks by validating the file path
+func Get3DModel(w http.ResponseWriter, r *http.Request) {
+	modelName := modelParam(r)
+	if modelName == "" {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "model parameter is required")
 		return
 	}
 
@@ -111,39 +107,58 @@ func Get3DModel(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", mimeType)
 	w.Header().Set("Cache-Control", "public, max-age=3600")
-	http.ServeFile(w, r, modelPath)
+	serveBlob(w, r, Store3DPath, modelName)
 }
 
-// ListProducts3DModels returns a list of products that have 3D models available
+// ListProducts3DModels returns the 3D models linked to the products of a
+// store, with the image name of each product kept in available_models for the
+// storefront templates
 func ListProducts3DModels(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	storeIDStr := r.URL.Query().Get("store_id")
-	if storeIDStr == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "store_id is required"})
+	storeID, err := strconv.Atoi(storeIDStr)
+	if storeIDStr == "" || err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "store_id is required")
 		return
 	}
 
-	// Read the 3d_images directory to get available models
-	entries, err := os.ReadDir(Store3DPath)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read 3D models"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
 		return
 	}
+	defer db.Close()
 
-	// Get unique model names (without extensions)
+	rows, err := db.Query(`
+		SELECT `+productModelColumns+`, (SELECT image FROM products WHERE id = product_id)
+		FROM product_models
+		WHERE product_id IN (SELECT id FROM products WHERE store_id = ?)
+		ORDER BY product_id
+	`, storeID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to read 3D models")
+		return
+	}
+	defer rows.Close()
+
+	models := []ProductModel{}
 	modelMap := make(map[string]bool)
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			name := entry.Name()
-			nameWithoutExt := strings.TrimSuffix(name, filepath.Ext(name))
-			modelMap[nameWithoutExt] = true
+	for rows.Next() {
+		var image string
+		m, err := scanProductModel(rows, &image)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to read 3D models")
+			return
+		}
+		models = append(models, m)
+		if image != "" {
+			modelMap[strings.TrimSuffix(image, filepath.Ext(image))] = true
 		}
 	}
 
 	response := map[string]interface{}{
+		"models":           models,
 		"available_models": modelMap,
 	}
 
@@ -153,14 +168,19 @@ func ListProducts3DModels(w http.ResponseWriter, r *http.Request) {
 
 // View3DModel renders the 3D viewer page with the model name injected into the template
 func View3DModel(w http.ResponseWriter, r *http.Request) {
-	modelName := r.URL.Query().Get("model")
+	modelName := modelParam(r)
 	if modelName == "" {
 		http.Error(w, "Model parameter is required", http.StatusBadRequest)
 		return
 	}
 
-	// Prevent directory traversal attacks
-	modelName = filepath.Base(modelName)
+	// OBJ models are shown with their material library
+	format := strings.TrimPrefix(strings.ToLower(path.Ext(modelName)), ".")
+	material := ""
+	if db, err := sql.Open(DATABASEDRIVER, DATABASEPATH); err == nil {
+		db.QueryRow("SELECT format, material FROM product_models WHERE file = ?", modelName).Scan(&format, &material)
+		db.Close()
+	}
 
 	// Parse and execute the template
 	tmpl, err := template.ParseFiles("./frontend/3dview_template.html")
@@ -171,6 +191,12 @@ func View3DModel(w http.ResponseWriter, r *http.Request) {
 
 	data := map[string]string{
 		"ModelName": modelName,
+		"ModelURL":  modelURL(modelName),
+		"Format":    format,
+		"Material":  material,
+	}
+	if material != "" {
+		data["MaterialURL"] = modelURL(material)
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"path/filepath"
+)
+
+// thumbnailSize is the longest edge of generated product thumbnails
+const thumbnailSize = 320
+
+type thumbnailJob struct {
+	Dir  string `json:"dir"`
+	File string `json:"file"`
+}
+
+// queueThumbnail schedules the thumbnail and the other imageSizes for an
+// uploaded image. Thumbnails are written to a thumbs/ folder next to the
+// original as PNG, the other sizes to sizes/ (see sizedImageName).
+func queueThumbnail(dir string, file string) error {
+	_, err := EnqueueJob(JobGenerateThumbnail, thumbnailJob{Dir: dir, File: file})
+	return err
+}
+
+func generateThumbnailJob(ctx context.Context, payload json.RawMessage) error {
+	var job thumbnailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	file := filepath.Base(job.File)
+	f, err := currentBlobStore().Get(blobKey(job.Dir, file))
+	if errors.Is(err, errBlobNotFound) {
+		// the image was replaced or deleted before the job ran
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	src, format, err := image.Decode(f)
+	if err == image.ErrFormat {
+		slog.Info("skipping thumbnail for unsupported image format", "file", job.File)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for size, edge := range imageSizes {
+		// sizes bigger than the original would only be copies of it
+		b := src.Bounds()
+		if size != "thumb" && b.Dx() <= edge && b.Dy() <= edge {
+			continue
+		}
+		if err := writeImageSize(job.Dir, sizedImageName(file, size), scaleToFit(src, edge)); err != nil {
+			return err
+		}
+	}
+	slog.Debug("generated thumbnail and sizes", "file", job.File, "format", format)
+	return nil
+}
+
+// writeImageSize stores a generated size of an image, as JPEG or PNG
+// depending on the extension of name
+func writeImageSize(dir string, name string, img image.Image) error {
+	var buf bytes.Buffer
+	var err error
+	if filepath.Ext(name) == ".png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return err
+	}
+	return putUpload(dir, name, buf.Bytes())
+}
+
+// scaleToFit shrinks src so its longest edge is at most size, averaging the
+// source pixels that fall into each destination pixel. Smaller images are
+// returned unchanged.
+func scaleToFit(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			// RGBA() is alpha-premultiplied; NRGBA wants straight alpha
+			if a > 0 {
+				dst.Pix[i+0] = uint8(r * 0xff / a)
+				dst.Pix[i+1] = uint8(g * 0xff / a)
+				dst.Pix[i+2] = uint8(bl * 0xff / a)
+			}
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
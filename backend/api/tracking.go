@@ -0,0 +1,396 @@
+package api
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CustomerOrder is an order as its customer sees it, with what they need to
+// follow it: tracking numbers, expected delivery, returns and, for one
+// order, the history of its statuses and its shipments.
+type CustomerOrder struct {
+	ID                int                 `json:"id"`
+	CreatedAt         string              `json:"created_at"`
+	Status            string              `json:"status"`
+	TotalAmount       float64             `json:"total_amount"`
+	ProductCount      int                 `json:"product_count"`
+	TrackingNumber    string              `json:"tracking_number,omitempty"`
+	EstimatedDelivery string              `json:"estimated_delivery,omitempty"`
+	ShippedAt         string              `json:"shipped_at,omitempty"`
+	DeliveredAt       string              `json:"delivered_at,omitempty"`
+	History           []OrderStatusChange `json:"history,omitempty"`
+	Shipments         []Shipment          `json:"shipments,omitempty"`
+	Returns           []Return            `json:"returns,omitempty"`
+}
+
+// OrderStatusChange is one entry of an order's status history
+type OrderStatusChange struct {
+	Status string `json:"status"`
+	At     string `json:"at"`
+}
+
+// recordOrderStatus appends to the order's status history
+func recordOrderStatus(db *sql.DB, orderID int64, status string) {
+	if _, err := db.Exec("INSERT INTO order_status_history (order_id, status) VALUES (?, ?)", orderID, status); err != nil {
+		Logger(nil).Error("failed to record order status", "order_id", orderID, "status", status, "error", err)
+	}
+}
+
+// orderETA is when the customer can expect the order: the date the owner set
+// when shipping, otherwise estimated_shipping days after payment
+func orderETA(status string, estimated sql.NullTime, paidAt sql.NullTime, estimatedShipping int) string {
+	switch {
+	case status == "pending" || status == "cancelled" || status == "delivered" || status == "completed":
+		return ""
+	case estimated.Valid:
+		return estimated.Time.UTC().Format(time.RFC3339)
+	case paidAt.Valid && estimatedShipping > 0:
+		return paidAt.Time.Add(time.Duration(estimatedShipping) * 24 * time.Hour).UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+// customerOrderColumns and customerOrderFrom are how a customer's orders
+// are read; scanCustomerOrder reads a row of them
+const (
+	customerOrderColumns = `
+		o.id,
+		o.created_at,
+		o.status,
+		SUM(op.quantity * op.price) as total_amount,
+		COUNT(op.id) as product_count,
+		(SELECT group_concat(s.tracking_number, ', ') FROM shipments s
+			WHERE s.order_id = o.id AND s.return_id IS NULL AND s.tracking_number != '') as tracking_numbers,
+		o.estimated_delivery,
+		o.paid_at,
+		o.shipped_at,
+		o.delivered_at`
+	customerOrderFrom = "orders o JOIN order_products op ON o.id = op.order_id"
+)
+
+// customerOrderListSpec is what GET /api/customer/orders filters and sorts by
+var customerOrderListSpec = ListSpec{
+	Key:  "o.id",
+	Sort: "-created_at",
+	Fields: map[string]ListField{
+		"id":         {Expr: "o.id", Kind: listInt, Filter: true, Sort: true},
+		"status":     {Expr: "o.status", Kind: listText, Values: orderStatuses, Filter: true, Sort: true, Facet: true},
+		"created_at": {Expr: "o.created_at", Kind: listTime, Filter: true, Sort: true},
+		"total":      {Expr: "(SELECT SUM(quantity * price) FROM order_products WHERE order_id = o.id)", Kind: listNumber, Filter: true, Sort: true},
+	},
+}
+
+func scanCustomerOrder(scan func(dest ...interface{}) error, estimatedShipping int) (CustomerOrder, error) {
+	var order CustomerOrder
+	var trackingNumber sql.NullString
+	var estimated, paidAt, shippedAt, deliveredAt sql.NullTime
+	if err := scan(&order.ID, &order.CreatedAt, &order.Status, &order.TotalAmount, &order.ProductCount,
+		&trackingNumber, &estimated, &paidAt, &shippedAt, &deliveredAt); err != nil {
+		return order, err
+	}
+	order.TrackingNumber = trackingNumber.String
+	order.EstimatedDelivery = orderETA(order.Status, estimated, paidAt, estimatedShipping)
+	if shippedAt.Valid {
+		order.ShippedAt = shippedAt.Time.UTC().Format(time.RFC3339)
+	}
+	if deliveredAt.Valid {
+		order.DeliveredAt = deliveredAt.Time.UTC().Format(time.RFC3339)
+	}
+	return order, nil
+}
+
+// loadCustomerOrders returns the customer's orders on a store, newest first.
+// With orderID set it returns only that order, including its history and
+// shipments.
+func loadCustomerOrders(db *sql.DB, storeID int, userID int, orderID int) ([]CustomerOrder, error) {
+	estimatedShipping, err := storeEstimatedShipping(db, storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + customerOrderColumns + " FROM " + customerOrderFrom + " WHERE o.user_id = ? AND o.store_id = ?"
+	args := []interface{}{userID, storeID}
+	if orderID != 0 {
+		query += " AND o.id = ?"
+		args = append(args, orderID)
+	}
+	query += " GROUP BY o.id ORDER BY o.created_at DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []CustomerOrder{}
+	for rows.Next() {
+		order, err := scanCustomerOrder(rows.Scan, estimatedShipping)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := loadCustomerOrderReturns(db, userID, orders); err != nil {
+		return nil, err
+	}
+
+	if orderID != 0 {
+		for i := range orders {
+			if orders[i].History, err = orderHistory(db, orders[i].ID); err != nil {
+				return nil, err
+			}
+			if orders[i].Shipments, err = loadShipments(db, orders[i].ID); err != nil {
+				return nil, err
+			}
+			// labels and postage are the store's business
+			for j := range orders[i].Shipments {
+				orders[i].Shipments[j].LabelURL = ""
+				orders[i].Shipments[j].Cost = 0
+			}
+		}
+	}
+	return orders, nil
+}
+
+func loadCustomerOrderReturns(db *sql.DB, userID int, orders []CustomerOrder) error {
+	for i := range orders {
+		returns, err := loadReturns(db, "r.order_id = ? AND r.user_id = ?", orders[i].ID, userID)
+		if err != nil {
+			return err
+		}
+		orders[i].Returns = customerReturns(returns)
+	}
+	return nil
+}
+
+// listCustomerOrders returns one page of the customer's orders on a store
+func listCustomerOrders(db *sql.DB, storeID int, userID int, list *ListQuery) (ListPage, error) {
+	estimatedShipping, err := storeEstimatedShipping(db, storeID)
+	if err != nil {
+		return ListPage{}, err
+	}
+	orders := []CustomerOrder{}
+	page, err := list.Run(db, listSource{
+		Columns: customerOrderColumns,
+		From:    customerOrderFrom,
+		Where:   "o.user_id = ? AND o.store_id = ?",
+		Args:    []interface{}{userID, storeID},
+		GroupBy: "o.id",
+	}, func(scan func(dest ...interface{}) error) error {
+		order, err := scanCustomerOrder(scan, estimatedShipping)
+		if err != nil {
+			return err
+		}
+		orders = append(orders, order)
+		return nil
+	})
+	if err != nil {
+		return page, err
+	}
+	if err := loadCustomerOrderReturns(db, userID, orders); err != nil {
+		return page, err
+	}
+	page.Data = orders
+	return page, nil
+}
+
+func orderHistory(db *sql.DB, orderID int) ([]OrderStatusChange, error) {
+	rows, err := db.Query("SELECT status, created_at FROM order_status_history WHERE order_id = ? ORDER BY created_at, id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var change OrderStatusChange
+		var at time.Time
+		if err := rows.Scan(&change.Status, &at); err != nil {
+			return nil, err
+		}
+		change.At = at.UTC().Format(time.RFC3339)
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+// loadCustomerOrder returns one of the customer's orders, or sql.ErrNoRows
+func loadCustomerOrder(db *sql.DB, storeID int, userID int, orderID int) (CustomerOrder, error) {
+	orders, err := loadCustomerOrders(db, storeID, userID, orderID)
+	if err != nil {
+		return CustomerOrder{}, err
+	}
+	if len(orders) == 0 {
+		return CustomerOrder{}, sql.ErrNoRows
+	}
+	return orders[0], nil
+}
+
+// orderTrackingPath is the customer's tracking page for an order
+func orderTrackingPath(storeName string, orderID int) string {
+	return "/" + storeName + "/orders/" + strconv.Itoa(orderID)
+}
+
+// CustomerOrdersWebSocketHandler pushes the customer's orders on a store as
+// they change: {"type": "snapshot", "orders": [...]} on connect, then
+// {"type": "order", "event": ..., "order": ...} with the order's history.
+func CustomerOrdersWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	storeIDStr := r.URL.Query().Get("store_id")
+	storeID, err := strconv.Atoi(storeIDStr)
+	if err != nil {
+		http.Error(w, "Invalid store ID", http.StatusBadRequest)
+		return
+	}
+	userID, validUser := ValidateStoreCustomer(w, r, storeIDStr)
+	if !validUser {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	websocketConnections.Inc("customer_orders")
+	defer websocketConnections.Dec("customer_orders")
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	updates := events.Subscribe(EventFilter{StoreID: storeID, UserID: userID, Types: []string{
+		EventOrderCreated, EventOrderPaid, EventOrderStatusChanged, EventShipmentUpdated, EventReturnUpdated,
+	}})
+	defer updates.Close()
+
+	orders, err := loadCustomerOrders(db, storeID, userID, 0)
+	if err != nil {
+		Logger(r).Error("customer orders query failed", "error", err)
+		return
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": "snapshot", "orders": orders}); err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	pingTicker := time.NewTicker(30 * time.Second)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-updates.C:
+			order, err := loadCustomerOrder(db, storeID, userID, e.Int("order_id"))
+			if err != nil {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(map[string]interface{}{"type": "order", "event": e.Type, "order": order}); err != nil {
+				return
+			}
+		case <-pingTicker.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type trackingItem struct {
+	Name     string
+	Image    string
+	Quantity int
+	Price    float64
+}
+
+// OrderTrackingPage renders /<store>/orders/<id> for the customer who placed
+// the order. The page keeps itself current over /ws/customer/orders.
+func OrderTrackingPage(w http.ResponseWriter, r *http.Request, store Store, orderID int) {
+	userID, validUser := ValidateStoreCustomer(w, r, strconv.FormatUint(uint64(store.ID), 10))
+	if !validUser {
+		HandleError(w, r, http.StatusUnauthorized, "Unauthorized, Please login!")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer db.Close()
+
+	order, err := loadCustomerOrder(db, int(store.ID), userID, orderID)
+	if err == sql.ErrNoRows {
+		HandleError(w, r, http.StatusNotFound, "Order not found")
+		return
+	} else if err != nil {
+		Logger(r).Error("order tracking query failed", "order_id", orderID, "error", err)
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load order")
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+orderLineName+`, COALESCE(NULLIF(v.image, ''), p.image), op.quantity, op.price
+		FROM order_products op
+		JOIN products p ON op.product_id = p.id
+		LEFT JOIN product_variants v ON op.variant_id = v.id
+		WHERE op.order_id = ?
+	`, orderID)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load order items")
+		return
+	}
+	defer rows.Close()
+	var items []trackingItem
+	for rows.Next() {
+		var item trackingItem
+		var image sql.NullString
+		if err := rows.Scan(&item.Name, &image, &item.Quantity, &item.Price); err != nil {
+			HandleError(w, r, http.StatusInternalServerError, "Failed to load order items")
+			return
+		}
+		item.Image = image.String
+		items = append(items, item)
+	}
+
+	tmpl, err := template.ParseFiles(FrontendOrderTrackingHTML)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, "Failed to load template")
+		return
+	}
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Store": store,
+		"Order": order,
+		"Items": items,
+	})
+	if err != nil {
+		Logger(r).Error("failed to render order tracking page", "order_id", orderID, "error", err)
+	}
+}
@@ -0,0 +1,333 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantinePrefix is where orphaned uploads wait out the grace period
+// before they are deleted; it is outside every served folder
+const quarantinePrefix = "quarantine/"
+
+// uploadMinAge keeps the collector away from files that were just written
+// and whose database row may not be committed yet
+const uploadMinAge = time.Hour
+
+// collectableExtensions are the kinds of file the app writes into the
+// upload folders; anything else there (READMEs, dotfiles) is left alone
+var collectableExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".bmp": true, ".ico": true,
+	".mp4": true, ".webm": true,
+	".glb": true, ".gltf": true, ".bin": true, ".obj": true, ".mtl": true, ".fbx": true, ".usdz": true,
+}
+
+// uploadReferences lists, per upload folder, the queries returning the file
+// names that are still in use
+var uploadReferences = []struct {
+	Dir     string
+	Queries []string
+}{
+	{StoreProductsPath, []string{
+		"SELECT image FROM products",
+		"SELECT file FROM product_media",
+		"SELECT image FROM product_variants",
+	}},
+	{StoreLogosPath, []string{"SELECT logo FROM stores"}},
+	{StoreBannersPath, []string{"SELECT banner FROM stores"}},
+	{AvatarsPath, []string{"SELECT profile_picture FROM users"}},
+	{StoreReturnsPath, []string{"SELECT filename FROM return_photos"}},
+}
+
+// UploadGCReport is what one collection did, or would do in a dry run
+type UploadGCReport struct {
+	DryRun      bool       `json:"dry_run"`
+	Scanned     int        `json:"scanned"`
+	Referenced  int        `json:"referenced"`
+	Quarantined []BlobInfo `json:"quarantined"`
+	Restored    []string   `json:"restored"`
+	Deleted     []string   `json:"deleted"`
+	FreedBytes  int64      `json:"freed_bytes"`
+	Errors      []string   `json:"errors,omitempty"`
+}
+
+// uploadGCGrace is how long orphaned files stay in quarantine
+// (UPLOAD_GC_GRACE, a Go duration such as 72h)
+func uploadGCGrace() time.Duration {
+	grace, err := time.ParseDuration(envOr("UPLOAD_GC_GRACE", "168h"))
+	if err != nil || grace < 0 {
+		return 7 * 24 * time.Hour
+	}
+	return grace
+}
+
+// referencedUploads returns every key the database still points at, with
+// the generated sizes of each image and every file and preview of the linked
+// 3D models
+func referencedUploads(db *sql.DB) (map[string]bool, error) {
+	keys := map[string]bool{}
+	for _, ref := range uploadReferences {
+		// the defaults ship with the app and are never collected
+		for _, name := range []string{DefaultLogoFilename, DefaultBannerFilename, DefaultAvatarFilename, DefaultProductFilename} {
+			keys[blobKey(ref.Dir, name)] = true
+		}
+		for _, query := range ref.Queries {
+			rows, err := db.Query(query)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", query, err)
+			}
+			for rows.Next() {
+				var name sql.NullString
+				if err := rows.Scan(&name); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				if name.String == "" {
+					continue
+				}
+				file := filepath.Base(name.String)
+				keys[blobKey(ref.Dir, file)] = true
+				for size := range imageSizes {
+					keys[blobKey(ref.Dir, sizedImageName(file, size))] = true
+				}
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// template previews use images that ship with the app
+	for _, name := range sampleTemplates {
+		sample := sampleStore(name)
+		for _, product := range sample.Products {
+			if product.Image != "" {
+				keys[blobKey(StoreProductsPath, product.Image)] = true
+			}
+		}
+		keys[blobKey(StoreLogosPath, sample.Logo)] = true
+		keys[blobKey(StoreBannersPath, sample.Banner)] = true
+	}
+
+	// linked models; those with several files keep them all in one folder
+	rows, err := db.Query("SELECT file FROM product_models")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	folders := map[string]bool{}
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			return nil, err
+		}
+		keys[blobKey(Store3DPath, file)] = true
+		keys[blobKey(Store3DPath, modelPreviewName(file))] = true
+		if folder, _, nested := strings.Cut(file, "/"); nested {
+			folders[blobKey(Store3DPath, folder)+"/"] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for folder := range folders {
+		blobs, err := currentBlobStore().List(folder)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range blobs {
+			keys[blob.Key] = true
+		}
+	}
+	return keys, nil
+}
+
+// moveBlob copies a blob to a new key and deletes the old one
+func moveBlob(store BlobStore, from string, to string) error {
+	r, err := store.Get(from)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if err := store.Put(to, data, blobContentType(to)); err != nil {
+		return err
+	}
+	return store.Delete(from)
+}
+
+// collectUploads moves uploads nobody references into quarantine, brings
+// back quarantined files that are referenced again and deletes the ones that
+// have been in quarantine longer than grace. A dry run only reports.
+func collectUploads(ctx context.Context, dryRun bool, grace time.Duration) (UploadGCReport, error) {
+	report := UploadGCReport{DryRun: dryRun, Quarantined: []BlobInfo{}, Restored: []string{}, Deleted: []string{}}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return report, err
+	}
+	defer db.Close()
+
+	referenced, err := referencedUploads(db)
+	if err != nil {
+		return report, err
+	}
+	store := currentBlobStore()
+	fail := func(key string, err error) {
+		slog.Warn("upload collection failed for file", "key", key, "error", err)
+		report.Errors = append(report.Errors, key+": "+err.Error())
+	}
+
+	// quarantined files: restore or expire
+	rows, err := db.Query("SELECT key, size, quarantined_at FROM upload_quarantine ORDER BY quarantined_at")
+	if err != nil {
+		return report, err
+	}
+	type quarantined struct {
+		key  string
+		size int64
+		at   time.Time
+	}
+	var held []quarantined
+	for rows.Next() {
+		var q quarantined
+		if err := rows.Scan(&q.key, &q.size, &q.at); err != nil {
+			rows.Close()
+			return report, err
+		}
+		held = append(held, q)
+	}
+	rows.Close()
+	inQuarantine := map[string]bool{}
+	for _, q := range held {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		inQuarantine[q.key] = true
+		switch {
+		case referenced[q.key]:
+			report.Restored = append(report.Restored, q.key)
+			if dryRun {
+				continue
+			}
+			if err := moveBlob(store, quarantinePrefix+q.key, q.key); err != nil && !errors.Is(err, errBlobNotFound) {
+				fail(q.key, err)
+				continue
+			}
+			db.Exec("DELETE FROM upload_quarantine WHERE key = ?", q.key)
+		case time.Since(q.at) >= grace:
+			report.Deleted = append(report.Deleted, q.key)
+			report.FreedBytes += q.size
+			if dryRun {
+				continue
+			}
+			if err := store.Delete(quarantinePrefix + q.key); err != nil {
+				fail(q.key, err)
+				continue
+			}
+			db.Exec("DELETE FROM upload_quarantine WHERE key = ?", q.key)
+		}
+	}
+
+	// live files: quarantine the orphans
+	for _, dir := range storageDirs {
+		blobs, err := store.List(blobKey(dir, "") + "/")
+		if err != nil {
+			return report, fmt.Errorf("list %s: %w", dir, err)
+		}
+		for _, blob := range blobs {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.Scanned++
+			if referenced[blob.Key] {
+				report.Referenced++
+				continue
+			}
+			name := path.Base(blob.Key)
+			if strings.HasPrefix(name, ".") || !collectableExtensions[strings.ToLower(path.Ext(name))] ||
+				time.Since(blob.ModTime) < uploadMinAge || inQuarantine[blob.Key] {
+				continue
+			}
+			report.Quarantined = append(report.Quarantined, blob)
+			if dryRun {
+				continue
+			}
+			if err := moveBlob(store, blob.Key, quarantinePrefix+blob.Key); err != nil {
+				fail(blob.Key, err)
+				continue
+			}
+			if _, err := db.Exec(`
+				INSERT INTO upload_quarantine (key, size, quarantined_at) VALUES (?, ?, datetime('now'))
+				ON CONFLICT(key) DO UPDATE SET size = excluded.size, quarantined_at = excluded.quarantined_at
+			`, blob.Key, blob.Size); err != nil {
+				fail(blob.Key, err)
+			}
+		}
+	}
+	return report, nil
+}
+
+func collectUploadsJob(ctx context.Context, payload json.RawMessage) error {
+	report, err := collectUploads(ctx, false, uploadGCGrace())
+	if err != nil {
+		return err
+	}
+	slog.Info("collected orphaned uploads", "scanned", report.Scanned, "quarantined", len(report.Quarantined),
+		"restored", len(report.Restored), "deleted", len(report.Deleted), "freed_bytes", report.FreedBytes, "errors", len(report.Errors))
+	return nil
+}
+
+// uploadGCRequest is the optional body of an AdminUploadGC POST
+type uploadGCRequest struct {
+	DryRun bool `json:"dry_run"`
+}
+
+// AdminUploadGC reports orphaned uploads. GET is always a dry run; POST runs
+// a collection now unless the body has {"dry_run": true}.
+func AdminUploadGC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if _, isAdmin := ValidateAdmin(w, r); !isAdmin {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	dryRun := true
+	if r.Method == http.MethodPost {
+		var req uploadGCRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+				return
+			}
+		}
+		dryRun = req.DryRun
+	}
+
+	report, err := collectUploads(r.Context(), dryRun, uploadGCGrace())
+	if err != nil {
+		Logger(r).Error("upload collection failed", "dry_run", dryRun, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to collect uploads")
+		return
+	}
+	if !dryRun {
+		Logger(r).Info("admin ran upload collection", "quarantined", len(report.Quarantined), "deleted", len(report.Deleted))
+	}
+	json.NewEncoder(w).Encode(report)
+}
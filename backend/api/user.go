@@ -3,20 +3,16 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"html/template"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
 )
 
 func getUser(user_id int) (UserProfile, bool) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return UserProfile{}, false
 	}
@@ -31,7 +27,7 @@ func getUser(user_id int) (UserProfile, bool) {
 }
 
 func getUserDetails(user_id int) (map[string]interface{}, bool) {
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return nil, false
 	}
@@ -97,35 +93,35 @@ func ProfilePageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// updateProfileRequest is the body of UpdateProfileHandler
+type updateProfileRequest struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
 func UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	user_id, valid := ValidateUser(w, r)
 	if !valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
-	var reqData struct {
-		FirstName string `json:"first_name"`
-		LastName  string `json:"last_name"`
-	}
+	var reqData updateProfileRequest
 
 	err := json.NewDecoder(r.Body).Decode(&reqData)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request")
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
 		return
 	}
 	defer db.Close()
@@ -133,8 +129,7 @@ func UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
 	query := "UPDATE users SET first_name = ?, last_name = ? WHERE id = ?"
 	_, err = db.Exec(query, reqData.FirstName, reqData.LastName, user_id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update profile"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update profile")
 		return
 	}
 
@@ -144,72 +139,64 @@ func UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 func UpdateProfilePictureHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	user_id, valid := ValidateUser(w, r)
 	if !valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	// Parse multipart form (max 10MB)
 	err := r.ParseMultipartForm(10 << 20)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "File too large"})
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, "File too large")
 		return
 	}
 
-	file, handler, err := r.FormFile("profile_picture")
+	file, _, err := r.FormFile("profile_picture")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "No file uploaded"})
+		writeError(w, r, http.StatusBadRequest, CodeMissingField, "No file uploaded")
 		return
 	}
 	defer file.Close()
 
-	// Validate file type
-	contentType := handler.Header.Get("Content-Type")
-	if !strings.HasPrefix(contentType, "image/") {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Only image files are allowed"})
+	// The type comes from the bytes, not the Content-Type or file name
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, "Failed to read file")
+		return
+	}
+	ext, data, err := processImage(data)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidUpload, err.Error())
 		return
 	}
 
 	// Generate unique filename
-	ext := filepath.Ext(handler.Filename)
-	uuidV4, _ := uuid.NewV4()
-	filename := fmt.Sprintf("%s%s", uuidV4.String(), ext)
-
-	// Create avatars directory if it doesn't exist
-	avatarsDir := "avatars"
-	os.MkdirAll(avatarsDir, os.ModePerm)
-
-	// Save file
-	filepath := filepath.Join(avatarsDir, filename)
-	dst, err := os.Create(filepath)
+	uuidV4, err := uuid.NewV4()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save file"})
+		Logger(r).Error("failed to generate avatar filename", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save file")
 		return
 	}
-	defer dst.Close()
+	filename := uuidV4.String() + ext
 
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save file"})
+	// Save file
+	if err := putUpload(AvatarsPath, filename, data); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save file")
 		return
 	}
+	if err := queueThumbnail(AvatarsPath, filename); err != nil {
+		Logger(r).Warn("failed to queue avatar sizes", "image", filename, "error", err)
+	}
 
 	// Update database
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
 		return
 	}
 	defer db.Close()
@@ -217,8 +204,7 @@ func UpdateProfilePictureHandler(w http.ResponseWriter, r *http.Request) {
 	query := "UPDATE users SET profile_picture = ? WHERE id = ?"
 	_, err = db.Exec(query, filename, user_id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update profile picture"})
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update profile picture")
 		return
 	}
 
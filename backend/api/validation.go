@@ -5,20 +5,26 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
-	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/gofrs/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ValidateUser returns the session user, or the owner of the store whose API
+// key authenticated the request
 func ValidateUser(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if key := requestAPIKey(r); key != nil {
+		setRequestUser(r, key.ownerID)
+		return key.ownerID, true
+	}
 	cookie, err := r.Cookie("session_token")
 	if err != nil {
 		return 0, false
 	}
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return 0, false
 	}
@@ -32,10 +38,34 @@ func ValidateUser(w http.ResponseWriter, r *http.Request) (int, bool) {
 	if err := row.Scan(&userID); err != nil {
 		return 0, false
 	}
+	setRequestUser(r, userID)
 
 	return userID, true
 }
 
+// ValidateAdmin checks that the session user has the admin user type. API
+// keys never act as admins.
+func ValidateAdmin(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if requestAPIKey(r) != nil {
+		return 0, false
+	}
+	userID, validUser := ValidateUser(w, r)
+	if !validUser {
+		return 0, false
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return 0, false
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ? AND user_type = 1", userID).Scan(&count); err != nil {
+		Logger(r).Error("admin role lookup failed", "error", err)
+		return 0, false
+	}
+	return userID, count > 0
+}
+
 func ValidateCustomer(w http.ResponseWriter, r *http.Request) (int, bool) {
 	var storeName string
 
@@ -123,7 +153,7 @@ func ValidateCustomer(w http.ResponseWriter, r *http.Request) (int, bool) {
 		return 0, false
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return 0, false
 	}
@@ -146,7 +176,7 @@ func ValidateStoreCustomer(w http.ResponseWriter, r *http.Request, storeID strin
 	if err != nil {
 		return 0, false
 	}
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return 0, false
 	}
@@ -160,6 +190,33 @@ func ValidateStoreCustomer(w http.ResponseWriter, r *http.Request, storeID strin
 	if err := row.Scan(&userID); err != nil {
 		return 0, false
 	}
+	setRequestUser(r, userID)
+	if id, err := strconv.Atoi(storeID); err == nil {
+		setRequestStore(r, id)
+	}
+	return userID, true
+}
+
+// ValidateStoreOwner checks that the session user owns the store, or that
+// the request's API key is the store's
+func ValidateStoreOwner(w http.ResponseWriter, r *http.Request, storeID int) (int, bool) {
+	userID, validUser := ValidateUser(w, r)
+	if !validUser {
+		return 0, false
+	}
+	if key := requestAPIKey(r); key != nil && key.StoreID != storeID {
+		return 0, false
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return 0, false
+	}
+	defer db.Close()
+	var ownerID int
+	if err := db.QueryRow("SELECT owner_id FROM stores WHERE id = ?", storeID).Scan(&ownerID); err != nil || ownerID != userID {
+		return 0, false
+	}
+	setRequestStore(r, storeID)
 	return userID, true
 }
 
@@ -208,44 +265,35 @@ func validatePassword(password string) (string, bool) {
 	return "", true
 }
 
+// ValidateImage decodes a base64 data URL and stores the image in path under
+// a new name. The declared type is ignored: the format is detected from the
+// bytes and the image goes through processImage, which strips metadata and
+// caps its size. It returns the file name, or the error message.
 func ValidateImage(path string, avatar string) (bool, string) {
-	photoType := ".png"
-	err := ""
-	if !strings.HasPrefix(avatar, "data:image/png;base64,") &&
-		!strings.HasPrefix(avatar, "data:image/jpeg;base64,") &&
-		!strings.HasPrefix(avatar, "data:image/webp;base64,") &&
-		!strings.HasPrefix(avatar, "data:image/bmp;base64,") &&
-		!strings.HasPrefix(avatar, "data:image/vnd.microsoft.icon;base64,") && // ICO format
-		!strings.HasPrefix(avatar, "data:image/gif;base64,") { // GIF format
-		err = "Image should be either 'png', 'jpg', 'webp', 'bmp', 'ico', or 'gif'"
-		return false, err
-	}
-	if strings.HasPrefix(avatar, "data:image/gif;base64,") {
-		photoType = ".gif"
-	}
-	data := strings.Split(avatar, ",")[1] // Get the Base64 part
+	header, data, found := strings.Cut(avatar, ",")
+	if !found || !strings.HasPrefix(header, "data:image/") || !strings.HasSuffix(header, ";base64") {
+		return false, errNotImage.Error()
+	}
 	fileData, errorBase := base64.StdEncoding.DecodeString(data)
 	if errorBase != nil {
-		err = "Error decoding Base64"
-		return false, err
+		return false, "Error decoding Base64"
 	}
 	if len(fileData) >= 1*1024*1024 { // 1 MB
-		err = "Image size should not exceed 1 MB"
-		return false, err
+		return false, "Image size should not exceed 1 MB"
+	}
+	photoType, fileData, errorImage := processImage(fileData)
+	if errorImage != nil {
+		return false, errorImage.Error()
 	}
-	// Save the file (you can customize the file name and path)
 	uuid, erroruuid := uuid.NewV4()
 	if erroruuid != nil {
-		err = "Unable to Generate UUID"
-		return false, err
+		return false, "Unable to Generate UUID"
 	}
-	errorOs := os.WriteFile(path+uuid.String()+photoType, fileData, 0644)
-	if errorOs != nil {
-		err = "Error writing file"
-		return false, err
+	errorStore := putUpload(path, uuid.String()+photoType, fileData)
+	if errorStore != nil {
+		return false, "Error writing file"
 	}
-	avatar = uuid.String() + photoType
-	return true, avatar
+	return true, uuid.String() + photoType
 }
 
 func ValidateStoreName(name string) error {
@@ -0,0 +1,534 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxProductOptions caps how many option types (size, colour...) a product has
+const maxProductOptions = 3
+
+// ProductOption is an option type and the values its variants use, in order
+type ProductOption struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// ProductVariant is one sellable combination of a product's option values
+// with its own SKU, price, stock and image. Products without options have a
+// single variant.
+type ProductVariant struct {
+	ID       int               `json:"id"`
+	SKU      string            `json:"sku"`
+	Price    float64           `json:"price"`
+	Quantity int               `json:"quantity"`
+	Image    string            `json:"image"`
+	Options  map[string]string `json:"options"`
+	Title    string            `json:"title"`
+}
+
+// errInvalidVariants marks variant edits that can never succeed as sent
+var errInvalidVariants = errors.New("invalid variants")
+
+// errVariantNotFound means the stock of a variant that no longer exists was
+// to be moved
+var errVariantNotFound = errors.New("variant not found")
+
+// variantTitleColumn selects a variant's option values as "M / Red", for
+// queries that alias product_variants as v
+const variantTitleColumn = `(SELECT COALESCE(GROUP_CONCAT(vo.value, ' / ' ORDER BY o.position), '')
+			FROM product_variant_options vo JOIN product_options o ON vo.option_id = o.id
+			WHERE vo.variant_id = v.id)`
+
+// orderLineName is an order line's product name with the variant it was
+// bought as, for queries that alias products as p and order_products as op
+const orderLineName = `p.name || CASE WHEN op.variant_title = '' THEN '' ELSE ' (' || op.variant_title || ')' END`
+
+// execer is what *sql.DB and *sql.Tx share for writes
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// adjustVariantStock moves a variant's stock by delta and keeps its product's
+// quantity, the sum over all variants, in step
+func adjustVariantStock(ex execer, variantID int, delta int) error {
+	result, err := ex.Exec("UPDATE product_variants SET quantity = quantity + ? WHERE id = ?", delta, variantID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %d", errVariantNotFound, variantID)
+	}
+	_, err = ex.Exec(`
+		UPDATE products SET quantity = (SELECT COALESCE(SUM(quantity), 0) FROM product_variants WHERE product_id = products.id)
+		WHERE id = (SELECT product_id FROM product_variants WHERE id = ?)
+	`, variantID)
+	return err
+}
+
+// syncProductFromVariants keeps a product's price at its cheapest variant and
+// its quantity at the stock of all variants, so listings and reports that only
+// read products stay right
+func syncProductFromVariants(ex execer, productID int) error {
+	_, err := ex.Exec(`
+		UPDATE products SET
+			price = COALESCE((SELECT MIN(price) FROM product_variants WHERE product_id = products.id), price),
+			quantity = (SELECT COALESCE(SUM(quantity), 0) FROM product_variants WHERE product_id = products.id)
+		WHERE id = ?
+	`, productID)
+	return err
+}
+
+// resolveVariant finds the variant a cart request refers to. Without a
+// variant_id the product must have exactly one variant.
+func resolveVariant(db *sql.DB, productID string, variantID string) (int, error) {
+	if variantID != "" {
+		var id int
+		err := db.QueryRow("SELECT id FROM product_variants WHERE id = ? AND product_id = ?", variantID, productID).Scan(&id)
+		return id, err
+	}
+	rows, err := db.Query("SELECT id FROM product_variants WHERE product_id = ? ORDER BY position, id", productID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	switch len(ids) {
+	case 0:
+		return 0, sql.ErrNoRows
+	case 1:
+		return ids[0], nil
+	}
+	return 0, fmt.Errorf("%w: Please choose an option", errInvalidVariants)
+}
+
+// loadVariants returns the options and variants of the products matching
+// where, a condition on products aliased as p, keyed by product id
+func loadVariants(db *sql.DB, where string, args ...interface{}) (map[int][]ProductOption, map[int][]ProductVariant, error) {
+	rows, err := db.Query(`
+		SELECT o.id, o.product_id, o.name
+		FROM product_options o JOIN products p ON o.product_id = p.id
+		WHERE `+where+`
+		ORDER BY o.product_id, o.position, o.id
+	`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	options := map[int][]ProductOption{}
+	for rows.Next() {
+		var opt ProductOption
+		var productID int
+		if err := rows.Scan(&opt.ID, &productID, &opt.Name); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		opt.Values = []string{}
+		options[productID] = append(options[productID], opt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT v.id, v.product_id, v.sku, v.price, v.quantity, v.image
+		FROM product_variants v JOIN products p ON v.product_id = p.id
+		WHERE `+where+`
+		ORDER BY v.product_id, v.position, v.id
+	`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	variants := map[int][]ProductVariant{}
+	for rows.Next() {
+		var v ProductVariant
+		var productID int
+		if err := rows.Scan(&v.ID, &productID, &v.SKU, &v.Price, &v.Quantity, &v.Image); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		v.Options = map[string]string{}
+		variants[productID] = append(variants[productID], v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT vo.variant_id, vo.option_id, vo.value
+		FROM product_variant_options vo
+		JOIN product_variants v ON vo.variant_id = v.id
+		JOIN products p ON v.product_id = p.id
+		WHERE `+where+`
+	`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	values := map[int]map[int]string{}
+	for rows.Next() {
+		var variantID, optionID int
+		var value string
+		if err := rows.Scan(&variantID, &optionID, &value); err != nil {
+			return nil, nil, err
+		}
+		if values[variantID] == nil {
+			values[variantID] = map[int]string{}
+		}
+		values[variantID][optionID] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// option values are listed in the order variants first use them, and
+	// titles follow the option order
+	for productID, list := range variants {
+		opts := options[productID]
+		for i := range list {
+			var title []string
+			for j := range opts {
+				value, ok := values[list[i].ID][opts[j].ID]
+				if !ok {
+					continue
+				}
+				list[i].Options[opts[j].Name] = value
+				title = append(title, value)
+				if !containsString(opts[j].Values, value) {
+					opts[j].Values = append(opts[j].Values, value)
+				}
+			}
+			list[i].Title = strings.Join(title, " / ")
+		}
+	}
+	return options, variants, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// variantsRequest is the full set of options and variants an owner saves for
+// a product. Variants with an id update that variant; the rest are new, and
+// variants left out are removed.
+type variantsRequest struct {
+	ProductID int `json:"product_id"`
+	Options   []struct {
+		Name   string   `json:"name"`
+		Values []string `json:"values"`
+	} `json:"options"`
+	Variants []struct {
+		ID       int               `json:"id"`
+		SKU      string            `json:"sku"`
+		Price    float64           `json:"price"`
+		Quantity int               `json:"quantity"`
+		Image    string            `json:"image"`
+		Options  map[string]string `json:"options"`
+	} `json:"variants"`
+}
+
+// validate trims the request and checks every variant picks exactly one
+// listed value of every option, with no two variants alike
+func (req *variantsRequest) validate() error {
+	if len(req.Options) > maxProductOptions {
+		return fmt.Errorf("%w: A product can have at most %d options", errInvalidVariants, maxProductOptions)
+	}
+	if len(req.Variants) == 0 {
+		return fmt.Errorf("%w: A product needs at least one variant", errInvalidVariants)
+	}
+	if len(req.Options) == 0 && len(req.Variants) > 1 {
+		return fmt.Errorf("%w: Add an option such as size or colour to sell more than one variant", errInvalidVariants)
+	}
+	names := map[string]bool{}
+	for i := range req.Options {
+		opt := &req.Options[i]
+		opt.Name = strings.TrimSpace(opt.Name)
+		if opt.Name == "" {
+			return fmt.Errorf("%w: Option names are required", errInvalidVariants)
+		}
+		if names[strings.ToLower(opt.Name)] {
+			return fmt.Errorf("%w: Option %q is listed twice", errInvalidVariants, opt.Name)
+		}
+		names[strings.ToLower(opt.Name)] = true
+		var values []string
+		for _, value := range opt.Values {
+			value = strings.TrimSpace(value)
+			if value != "" && !containsString(values, value) {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("%w: Option %q needs at least one value", errInvalidVariants, opt.Name)
+		}
+		opt.Values = values
+	}
+
+	seen := map[string]bool{}
+	skus := map[string]bool{}
+	for i := range req.Variants {
+		v := &req.Variants[i]
+		v.SKU = strings.TrimSpace(v.SKU)
+		if v.Price < 0 {
+			return fmt.Errorf("%w: Variant prices cannot be negative", errInvalidVariants)
+		}
+		if v.Quantity < 0 {
+			return fmt.Errorf("%w: Variant stock cannot be negative", errInvalidVariants)
+		}
+		if v.SKU != "" {
+			if skus[v.SKU] {
+				return fmt.Errorf("%w: SKU %q is used twice", errInvalidVariants, v.SKU)
+			}
+			skus[v.SKU] = true
+		}
+		if len(v.Options) != len(req.Options) {
+			return fmt.Errorf("%w: Every variant needs a value for each option", errInvalidVariants)
+		}
+		var key []string
+		for _, opt := range req.Options {
+			value := strings.TrimSpace(v.Options[opt.Name])
+			if !containsString(opt.Values, value) {
+				return fmt.Errorf("%w: %q is not a value of option %q", errInvalidVariants, v.Options[opt.Name], opt.Name)
+			}
+			v.Options[opt.Name] = value
+			key = append(key, value)
+		}
+		if seen[strings.Join(key, "\x00")] {
+			return fmt.Errorf("%w: Variant %s is listed twice", errInvalidVariants, strings.Join(key, " / "))
+		}
+		seen[strings.Join(key, "\x00")] = true
+	}
+	return nil
+}
+
+// saveVariants replaces a product's options and variants. Stock held in carts
+// for removed variants goes with them.
+func saveVariants(db *sql.DB, storeID int, req variantsRequest) error {
+	existing := map[int]string{}
+	rows, err := db.Query("SELECT id, image FROM product_variants WHERE product_id = ?", req.ProductID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		var image string
+		if err := rows.Scan(&id, &image); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[id] = image
+	}
+	rows.Close()
+
+	for _, v := range req.Variants {
+		if v.ID != 0 {
+			if _, ok := existing[v.ID]; !ok {
+				return fmt.Errorf("%w: Variant %d does not belong to this product", errInvalidVariants, v.ID)
+			}
+		}
+		if v.SKU == "" {
+			continue
+		}
+		var taken int
+		err := db.QueryRow(`
+			SELECT COUNT(*) FROM product_variants v JOIN products p ON v.product_id = p.id
+			WHERE p.store_id = ? AND v.sku = ? AND v.product_id != ?
+		`, storeID, v.SKU, req.ProductID).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return fmt.Errorf("%w: SKU %q is already used by another product", errInvalidVariants, v.SKU)
+		}
+	}
+
+	// new images are stored before the transaction so a bad upload fails the
+	// whole save
+	images := make([]string, len(req.Variants))
+	var thumbnails []string
+	for i, v := range req.Variants {
+		switch {
+		case strings.HasPrefix(v.Image, "data:"):
+			valid, name := ValidateImage(StoreProductsPath, v.Image)
+			if !valid {
+				return fmt.Errorf("%w: %s", errInvalidVariants, name)
+			}
+			images[i] = name
+			thumbnails = append(thumbnails, name)
+		case v.ID != 0 && v.Image == existing[v.ID]:
+			images[i] = v.Image
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM product_variant_options WHERE variant_id IN (SELECT id FROM product_variants WHERE product_id = ?)", req.ProductID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM product_options WHERE product_id = ?", req.ProductID); err != nil {
+		return err
+	}
+	optionIDs := map[string]int64{}
+	for i, opt := range req.Options {
+		result, err := tx.Exec("INSERT INTO product_options (product_id, name, position) VALUES (?, ?, ?)", req.ProductID, opt.Name, i)
+		if err != nil {
+			return err
+		}
+		optionIDs[opt.Name], _ = result.LastInsertId()
+	}
+
+	kept := map[int]bool{}
+	for i, v := range req.Variants {
+		variantID := int64(v.ID)
+		if v.ID != 0 {
+			_, err = tx.Exec("UPDATE product_variants SET sku = ?, price = ?, quantity = ?, image = ?, position = ? WHERE id = ?",
+				v.SKU, v.Price, v.Quantity, images[i], i, v.ID)
+			kept[v.ID] = true
+		} else {
+			var result sql.Result
+			result, err = tx.Exec("INSERT INTO product_variants (product_id, sku, price, quantity, image, position) VALUES (?, ?, ?, ?, ?, ?)",
+				req.ProductID, v.SKU, v.Price, v.Quantity, images[i], i)
+			if err == nil {
+				variantID, _ = result.LastInsertId()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		for name, value := range v.Options {
+			if _, err := tx.Exec("INSERT INTO product_variant_options (variant_id, option_id, value) VALUES (?, ?, ?)",
+				variantID, optionIDs[name], value); err != nil {
+				return err
+			}
+		}
+	}
+	for id := range existing {
+		if kept[id] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM cart WHERE variant_id = ?", id); err != nil {
+			return err
+		}
+		// foreign keys are not enforced, so past order lines are let go of
+		// here; they keep their variant title and restock to the product
+		if _, err := tx.Exec("UPDATE order_products SET variant_id = NULL WHERE variant_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM product_variants WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	if err := syncProductFromVariants(tx, req.ProductID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, name := range thumbnails {
+		if err := queueThumbnail(StoreProductsPath, name); err != nil {
+			Logger(nil).Warn("failed to queue product thumbnail", "image", name, "error", err)
+		}
+	}
+	return nil
+}
+
+// SaveProductVariants replaces a product's options and variants:
+// POST /api/products/variants with {"product_id", "options": [{"name",
+// "values"}], "variants": [{"id", "sku", "price", "quantity", "image",
+// "options": {name: value}}]}. New images are sent as data URLs.
+func SaveProductVariants(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<20)
+	var req variantsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ProductID == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer db.Close()
+
+	var storeID int
+	if err := db.QueryRow("SELECT store_id FROM products WHERE id = ?", req.ProductID).Scan(&storeID); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Product not found")
+		return
+	}
+	if _, ok := ValidateStoreOwner(w, r, storeID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	err = req.validate()
+	if err == nil {
+		err = saveVariants(db, storeID, req)
+	}
+	if errors.Is(err, errInvalidVariants) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, invalidMessage(err, errInvalidVariants))
+		return
+	}
+	if err != nil {
+		Logger(r).Error("saving variants failed", "product_id", req.ProductID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to save variants")
+		return
+	}
+
+	options, variants, err := loadVariants(db, "p.id = ?", req.ProductID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to load variants")
+		return
+	}
+	var price float64
+	var quantity int
+	db.QueryRow("SELECT price, quantity FROM products WHERE id = ?", req.ProductID).Scan(&price, &quantity)
+	PublishEvent(Event{Type: EventProductUpdated, StoreID: storeID, Data: map[string]interface{}{
+		"product_id": req.ProductID,
+		"price":      price,
+		"quantity":   quantity,
+	}})
+	publishStockChange(db, req.ProductID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"options":  nonNilOptions(options[req.ProductID]),
+		"variants": variants[req.ProductID],
+	})
+}
+
+func nonNilOptions(options []ProductOption) []ProductOption {
+	if options == nil {
+		return []ProductOption{}
+	}
+	return options
+}
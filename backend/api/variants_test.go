@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// A variant removed after it was sold must leave its order lines pointing
+// nowhere rather than at a missing row, so returns of it can still restock
+func TestRemovedVariantReleasesOrderLines(t *testing.T) {
+	db := openTestDB(t)
+	_, storeID, _ := createTestStore(t, db)
+	productID := createTestProduct(t, db, storeID, 0)
+	small := mustExec(t, db, "INSERT INTO product_variants (product_id, price, quantity) VALUES (?, 25, 5)", productID)
+	large := mustExec(t, db, "INSERT INTO product_variants (product_id, price, quantity, position) VALUES (?, 25, 3, 1)", productID)
+	customer := createTestUser(t, db)
+	orderID := mustExec(t, db, "INSERT INTO orders (user_id, store_id, total_amount, status, shipping_info) VALUES (?, ?, 50, 'delivered', '{}')",
+		customer, storeID)
+	line := mustExec(t, db, "INSERT INTO order_products (order_id, product_id, variant_id, variant_title, quantity, price) VALUES (?, ?, ?, 'Large', 2, 25)",
+		orderID, productID, large)
+	returnID := mustExec(t, db, "INSERT INTO returns (order_id, store_id, user_id, status, reason) VALUES (?, ?, ?, 'received', 'Too big')",
+		orderID, storeID, customer)
+	mustExec(t, db, "INSERT INTO return_items (return_id, order_product_id, quantity) VALUES (?, ?, 2)", returnID, line)
+
+	var req variantsRequest
+	body := fmt.Sprintf(`{"product_id": %d, "variants": [{"id": %d, "price": 25, "quantity": 5}]}`, productID, small)
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveVariants(db, storeID, req); err != nil {
+		t.Fatal(err)
+	}
+	var variantID *int
+	db.QueryRow("SELECT variant_id FROM order_products WHERE id = ?", line).Scan(&variantID)
+	if variantID != nil {
+		t.Fatalf("order line still points at removed variant %d", *variantID)
+	}
+
+	ret, err := loadReturn(db, storeID, returnID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restockReturn(db, ret); err != nil {
+		t.Fatal(err)
+	}
+	var quantity, restocked int
+	db.QueryRow("SELECT quantity FROM products WHERE id = ?", productID).Scan(&quantity)
+	db.QueryRow("SELECT restocked FROM returns WHERE id = ?", returnID).Scan(&restocked)
+	if quantity != 7 || restocked != 1 {
+		t.Errorf("product quantity %d, restocked %d; want 7 and 1", quantity, restocked)
+	}
+}
+
+func TestAdjustMissingVariantStock(t *testing.T) {
+	if err := adjustVariantStock(openTestDB(t), 1<<30, 2); !errors.Is(err, errVariantNotFound) {
+		t.Errorf("adjust = %v, want errVariantNotFound", err)
+	}
+}
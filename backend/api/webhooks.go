@@ -0,0 +1,868 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Webhooks tell a store's other systems about its events. Each delivery is
+// a POST of a WebhookPayload, signed with the webhook's secret, and runs as
+// a job, so failures are retried with the job queue's backoff. Every
+// delivery is logged in webhook_deliveries and can be sent again by hand.
+
+// Events a webhook can subscribe to
+var webhookEvents = []string{EventOrderCreated, EventOrderPaid, EventOrderStatusChanged, EventLowStock, EventReviewCreated}
+
+// webhookPing is the event of test deliveries; it cannot be subscribed to
+const webhookPing = "ping"
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryRetrying  = "retrying"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	maxWebhooksPerStore = 10
+	webhookTimeout      = 10 * time.Second
+	// webhookResponseLimit is how much of a receiver's answer is logged
+	webhookResponseLimit = 1024
+)
+
+// errInvalidWebhook marks webhook requests that can never succeed as sent
+var errInvalidWebhook = errors.New("invalid webhook")
+
+// Webhook is an endpoint subscribed to some of a store's events. The secret
+// is only returned when it is created or rotated.
+type Webhook struct {
+	ID        int      `json:"id"`
+	StoreID   int      `json:"store_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Active    bool     `json:"active"`
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at"`
+}
+
+// WebhookDelivery is one event sent, or being sent, to a webhook
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	ResponseBody   string          `json:"response_body,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	DurationMS     int             `json:"duration_ms"`
+	RedeliveryOf   int             `json:"redelivery_of,omitempty"`
+	CreatedAt      string          `json:"created_at"`
+	LastAttemptAt  string          `json:"last_attempt_at,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// WebhookPayload is the body of a delivery. ID names the event, so a
+// receiver can tell a redelivery from a new event. Order, Product and Review
+// are set by the events about them, as they were when the event happened.
+type WebhookPayload struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Store     Store           `json:"store"`
+	Order     *StoreOrder     `json:"order,omitempty"`
+	Items     []ShippableItem `json:"items,omitempty"`
+	Product   *Product        `json:"product,omitempty"`
+	Review    *Review         `json:"review,omitempty"`
+	// Threshold is the low stock threshold the product crossed
+	Threshold int `json:"threshold,omitempty"`
+}
+
+func webhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookAllowPrivate lets webhooks reach loopback and private addresses,
+// for local receivers in development (WEBHOOK_ALLOW_PRIVATE_TARGETS=true)
+func webhookAllowPrivate() bool {
+	return envOr("WEBHOOK_ALLOW_PRIVATE_TARGETS", "") == "true"
+}
+
+func privateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// checkWebhookURL catches URLs that can never be delivered to. The address
+// a name resolves to is checked again when connecting.
+func checkWebhookURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return "", fmt.Errorf("%w: the URL must be an http or https address", errInvalidWebhook)
+	}
+	if u.User != nil {
+		return "", fmt.Errorf("%w: the URL cannot hold credentials", errInvalidWebhook)
+	}
+	if len(raw) > 2048 {
+		return "", fmt.Errorf("%w: the URL is too long", errInvalidWebhook)
+	}
+	if !webhookAllowPrivate() {
+		host := u.Hostname()
+		if ip := net.ParseIP(host); (ip != nil && privateAddress(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return "", fmt.Errorf("%w: the URL must be a public address", errInvalidWebhook)
+		}
+	}
+	return u.String(), nil
+}
+
+// normalizeWebhookEvents checks events against webhookEvents, keeping their
+// order there
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, e := range events {
+		if !webhookEvent(e) {
+			return nil, fmt.Errorf("%w: unknown event %q", errInvalidWebhook, e)
+		}
+		wanted[e] = true
+	}
+	var out []string
+	for _, e := range webhookEvents {
+		if wanted[e] {
+			out = append(out, e)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: a webhook needs at least one event", errInvalidWebhook)
+	}
+	return out, nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// signWebhook is the X-Webhook-Signature of a body sent at timestamp:
+// "sha256=" and the hex HMAC-SHA256 of "<timestamp>.<body>" under the
+// webhook's secret. Signing the timestamp lets receivers refuse replays.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+const webhookColumns = "id, store_id, url, events, active, created_at, updated_at"
+
+func scanWebhook(scan func(dest ...interface{}) error) (Webhook, error) {
+	var hook Webhook
+	var events string
+	err := scan(&hook.ID, &hook.StoreID, &hook.URL, &events, &hook.Active, &hook.CreatedAt, &hook.UpdatedAt)
+	hook.Events = strings.Split(events, ",")
+	return hook, err
+}
+
+func loadWebhooks(db *sql.DB, storeID int) ([]Webhook, error) {
+	rows, err := db.Query("SELECT "+webhookColumns+" FROM webhooks WHERE store_id = ? ORDER BY id", storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// loadWebhook returns a webhook of the store, or sql.ErrNoRows
+func loadWebhook(db *sql.DB, storeID int, id int) (Webhook, error) {
+	return scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ? AND store_id = ?", id, storeID).Scan)
+}
+
+const deliveryColumns = `d.id, d.webhook_id, d.event, d.status, d.attempts, d.response_status, d.response_body, d.error,
+	d.duration_ms, COALESCE(d.redelivery_of, 0), d.created_at, d.last_attempt_at, d.payload`
+
+func scanDelivery(scan func(dest ...interface{}) error) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var lastAttemptAt sql.NullString
+	var payload string
+	err := scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &d.ResponseStatus, &d.ResponseBody, &d.Error,
+		&d.DurationMS, &d.RedeliveryOf, &d.CreatedAt, &lastAttemptAt, &payload)
+	d.LastAttemptAt = lastAttemptAt.String
+	d.Payload = json.RawMessage(payload)
+	return d, err
+}
+
+// loadDeliveries returns the latest deliveries of a store's webhooks, or of
+// one of them when webhookID is not 0
+func loadDeliveries(db *sql.DB, storeID int, webhookID int) ([]WebhookDelivery, error) {
+	rows, err := db.Query(`
+		SELECT `+deliveryColumns+`
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE w.store_id = ? AND (? = 0 OR d.webhook_id = ?)
+		ORDER BY d.id DESC
+		LIMIT 100
+	`, storeID, webhookID, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func loadDelivery(db *sql.DB, id int) (WebhookDelivery, error) {
+	return scanDelivery(db.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries d WHERE d.id = ?", id).Scan)
+}
+
+// queueDelivery logs a delivery of payload to a webhook and queues the job
+// that sends it
+func queueDelivery(db *sql.DB, webhookID int, event string, payload []byte, redeliveryOf int) (int, error) {
+	var original interface{}
+	if redeliveryOf != 0 {
+		original = redeliveryOf
+	}
+	result, err := db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, redelivery_of)
+		VALUES (?, ?, ?, ?, ?)
+	`, webhookID, event, string(payload), DeliveryPending, original)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	if _, err := EnqueueJob(JobDeliverWebhook, map[string]int64{"delivery_id": id}); err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// webhookPayload describes an event with the records it is about
+func webhookPayload(db *sql.DB, e Event) (WebhookPayload, error) {
+	payload := WebhookPayload{ID: "evt_" + newRequestID(), Event: e.Type, CreatedAt: e.Time}
+	store, err := GetStoreByID(e.StoreID)
+	if err != nil {
+		return payload, err
+	}
+	// the payment details stay with the platform
+	store.IBANNumber = ""
+	store.PaymentMethods = ""
+	payload.Store = store
+
+	switch e.Type {
+	case EventOrderCreated, EventOrderPaid, EventOrderStatusChanged:
+		order, err := loadStoreOrder(db, e.StoreID, e.Int("order_id"))
+		if err != nil {
+			return payload, err
+		}
+		items, err := shippableItems(db, order.ID)
+		if err != nil {
+			return payload, err
+		}
+		payload.Order, payload.Items = &order, items
+	case EventLowStock:
+		product, err := webhookProduct(db, e.StoreID, e.Int("product_id"))
+		if err != nil {
+			return payload, err
+		}
+		// the stock when the threshold was crossed, not what it is by now
+		product.Quantity = e.Int("quantity")
+		payload.Product, payload.Threshold = &product, e.Int("threshold")
+	case EventReviewCreated:
+		var review Review
+		err := db.QueryRow(`
+			SELECT r.id, r.product_id, r.user_id, r.order_id, r.rating, COALESCE(r.comment, ''), r.created_at, COALESCE(u.first_name, '')
+			FROM reviews r LEFT JOIN users u ON u.id = r.user_id
+			WHERE r.id = ?
+		`, e.Int("review_id")).Scan(&review.ID, &review.ProductID, &review.UserID, &review.OrderID, &review.Rating,
+			&review.Comment, &review.CreatedAt, &review.UserName)
+		if err != nil {
+			return payload, err
+		}
+		product, err := webhookProduct(db, e.StoreID, int(review.ProductID))
+		if err != nil {
+			return payload, err
+		}
+		payload.Review, payload.Product = &review, &product
+	}
+	return payload, nil
+}
+
+func webhookProduct(db *sql.DB, storeID int, productID int) (Product, error) {
+	var product Product
+	err := db.QueryRow(`
+		SELECT id, name, description, price, image, quantity, COALESCE(category_id, 0) FROM products WHERE id = ? AND store_id = ?
+	`, productID, storeID).Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Image,
+		&product.Quantity, &product.CategoryID)
+	if err != nil {
+		return product, err
+	}
+	products := []Product{product}
+	if err := loadProductDetails(db, storeID, products, "p.id = ?", productID); err != nil {
+		return product, err
+	}
+	return products[0], nil
+}
+
+// queueWebhooks logs and queues a delivery of e to every active webhook of
+// its store that subscribes to it
+func queueWebhooks(e Event) error {
+	if e.StoreID == 0 {
+		return nil
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, events FROM webhooks WHERE store_id = ? AND active = 1", e.StoreID)
+	if err != nil {
+		return err
+	}
+	var subscribed []int
+	for rows.Next() {
+		var id int
+		var events string
+		if err := rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, event := range strings.Split(events, ",") {
+			if event == e.Type {
+				subscribed = append(subscribed, id)
+			}
+		}
+	}
+	rows.Close()
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	payload, err := webhookPayload(db, e)
+	if err != nil {
+		return fmt.Errorf("webhook payload for %s: %w", e.Type, err)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for _, id := range subscribed {
+		if _, err := queueDelivery(db, id, e.Type, body, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartWebhooks queues deliveries for the webhook events published on this
+// instance until ctx is done. Events relayed by the broker were queued by
+// the instance that published them.
+func StartWebhooks(ctx context.Context) {
+	updates := events.Subscribe(EventFilter{Types: webhookEvents})
+	go func() {
+		defer updates.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-updates.C:
+				if e.Origin != instanceID {
+					continue
+				}
+				if err := queueWebhooks(e); err != nil {
+					slog.Error("failed to queue webhooks", "event", e.Type, "store_id", e.StoreID, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// webhookClient refuses private addresses at connect time, after DNS, and
+// does not follow redirects: a receiver has to answer at its own URL
+func webhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !webhookAllowPrivate() {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || privateAddress(ip) {
+				return fmt.Errorf("%s is not a public address", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 5 * time.Second},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deliverWebhookJob sends one delivery and logs the attempt. An error makes
+// the job queue retry it; once its attempts are spent the delivery failed.
+func deliverWebhookJob(ctx context.Context, payload json.RawMessage) error {
+	var job struct {
+		DeliveryID int `json:"delivery_id"`
+	}
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var hookURL, secret, event, body string
+	var active bool
+	err = db.QueryRow(`
+		SELECT w.url, w.secret, w.active, d.event, d.payload
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.id = ?
+	`, job.DeliveryID).Scan(&hookURL, &secret, &active, &event, &body)
+	if err == sql.ErrNoRows {
+		// the webhook was deleted
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !active && event != webhookPing {
+		_, err := db.Exec("UPDATE webhook_deliveries SET status = ?, error = ? WHERE id = ?",
+			DeliveryFailed, "The webhook is paused", job.DeliveryID)
+		return err
+	}
+
+	status, response, duration, sendErr := sendWebhook(ctx, hookURL, secret, job.DeliveryID, event, []byte(body))
+	result := DeliverySucceeded
+	message := ""
+	if sendErr != nil {
+		message = sendErr.Error()
+		result = DeliveryRetrying
+	}
+	_, err = db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = CASE WHEN ? = ? AND attempts + 1 >= ? THEN ? ELSE ? END,
+			attempts = attempts + 1, response_status = ?, response_body = ?, error = ?, duration_ms = ?,
+			last_attempt_at = datetime('now')
+		WHERE id = ?
+	`, result, DeliveryRetrying, defaultJobAttempts, DeliveryFailed, result,
+		status, response, message, duration.Milliseconds(), job.DeliveryID)
+	if err != nil {
+		return err
+	}
+	webhookDeliveriesTotal.Inc(event, result)
+	return sendErr
+}
+
+// sendWebhook POSTs body and returns the status and the start of the
+// answer; any status but 2xx is an error
+func sendWebhook(ctx context.Context, hookURL string, secret string, deliveryID int, event string, body []byte) (int, string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Astropify-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-ID", strconv.Itoa(deliveryID))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, body))
+
+	start := time.Now()
+	resp, err := webhookClient().Do(req)
+	if err != nil {
+		return 0, "", time.Since(start), err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+	duration := time.Since(start)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, string(answer), duration, fmt.Errorf("the receiver answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, string(answer), duration, nil
+}
+
+// writeWebhookError answers with 400 for requests that cannot succeed and
+// 500 for everything else
+func writeWebhookError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Webhook not found")
+		return
+	}
+	if errors.Is(err, errInvalidWebhook) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, invalidMessage(err, errInvalidWebhook))
+		return
+	}
+	Logger(r).Error("webhook request failed", "error", err)
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to process webhook")
+}
+
+// webhookStore opens the database for a request by the owner of storeID
+func webhookStore(w http.ResponseWriter, r *http.Request, storeID int) (*sql.DB, bool) {
+	if _, ok := ValidateStoreOwner(w, r, storeID); !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return nil, false
+	}
+	return db, true
+}
+
+// GetWebhooks lists a store's webhooks and the events they can subscribe
+// to: GET /api/v1/webhooks?store_id=
+func GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
+		return
+	}
+	db, ok := webhookStore(w, r, storeID)
+	if !ok {
+		return
+	}
+	defer db.Close()
+	hooks, err := loadWebhooks(db, storeID)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": hooks, "events": webhookEvents})
+}
+
+// saveWebhookRequest is the body of CreateWebhook and UpdateWebhook
+type saveWebhookRequest struct {
+	StoreID int      `json:"store_id"`
+	ID      int      `json:"id"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	// Active pauses or resumes a webhook; new webhooks start active
+	Active *bool `json:"active"`
+	// RotateSecret replaces the secret of an existing webhook
+	RotateSecret bool `json:"rotate_secret"`
+}
+
+// CreateWebhook subscribes a URL to events of a store: POST
+// /api/v1/webhooks/create with {"store_id", "url", "events"}. The answer
+// holds the signing secret.
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req saveWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	userID, ok := ValidateStoreOwner(w, r, req.StoreID)
+	if !ok {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	hookURL, err := checkWebhookURL(req.URL)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	events, err := normalizeWebhookEvents(req.Events)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Database error")
+		return
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM webhooks WHERE store_id = ?", req.StoreID).Scan(&count); err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	if count >= maxWebhooksPerStore {
+		writeWebhookError(w, r, fmt.Errorf("%w: a store can have %d webhooks", errInvalidWebhook, maxWebhooksPerStore))
+		return
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	result, err := db.Exec(`
+		INSERT INTO webhooks (store_id, url, events, secret, active, created_by) VALUES (?, ?, ?, ?, ?, ?)
+	`, req.StoreID, hookURL, strings.Join(events, ","), secret, req.Active == nil || *req.Active, userID)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	id, _ := result.LastInsertId()
+	hook, err := loadWebhook(db, req.StoreID, int(id))
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	Logger(r).Info("webhook created", "webhook_id", hook.ID, "events", strings.Join(events, ","))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"webhook": hook, "secret": secret})
+}
+
+// UpdateWebhook changes a webhook's URL, events or state, or rotates its
+// secret: POST /api/v1/webhooks/update with {"store_id", "id", "url",
+// "events", "active", "rotate_secret"}; omitted fields stay as they are
+func UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req saveWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	db, ok := webhookStore(w, r, req.StoreID)
+	if !ok {
+		return
+	}
+	defer db.Close()
+	hook, err := loadWebhook(db, req.StoreID, req.ID)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	if req.URL != "" {
+		if hook.URL, err = checkWebhookURL(req.URL); err != nil {
+			writeWebhookError(w, r, err)
+			return
+		}
+	}
+	if req.Events != nil {
+		if hook.Events, err = normalizeWebhookEvents(req.Events); err != nil {
+			writeWebhookError(w, r, err)
+			return
+		}
+	}
+	if req.Active != nil {
+		hook.Active = *req.Active
+	}
+	if _, err := db.Exec("UPDATE webhooks SET url = ?, events = ?, active = ?, updated_at = datetime('now') WHERE id = ?",
+		hook.URL, strings.Join(hook.Events, ","), hook.Active, hook.ID); err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	response := map[string]interface{}{"success": true}
+	if req.RotateSecret {
+		secret, err := newWebhookSecret()
+		if err == nil {
+			_, err = db.Exec("UPDATE webhooks SET secret = ? WHERE id = ?", secret, hook.ID)
+		}
+		if err != nil {
+			writeWebhookError(w, r, err)
+			return
+		}
+		response["secret"] = secret
+	}
+	if response["webhook"], err = loadWebhook(db, req.StoreID, hook.ID); err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// webhookRequest is the body of DeleteWebhook and PingWebhook
+type webhookRequest struct {
+	StoreID int `json:"store_id"`
+	ID      int `json:"id"`
+}
+
+// DeleteWebhook removes a webhook and its delivery log: POST
+// /api/v1/webhooks/delete with {"store_id", "id"}
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	db, ok := webhookStore(w, r, req.StoreID)
+	if !ok {
+		return
+	}
+	defer db.Close()
+	result, err := db.Exec("DELETE FROM webhooks WHERE id = ? AND store_id = ?", req.ID, req.StoreID)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeWebhookError(w, r, sql.ErrNoRows)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", req.ID); err != nil {
+		Logger(r).Warn("webhook delivery log not removed", "webhook_id", req.ID, "error", err)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// PingWebhook sends a test delivery, even to a paused webhook: POST
+// /api/v1/webhooks/ping with {"store_id", "id"}
+func PingWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	db, ok := webhookStore(w, r, req.StoreID)
+	if !ok {
+		return
+	}
+	defer db.Close()
+	if _, err := loadWebhook(db, req.StoreID, req.ID); err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	payload, err := webhookPayload(db, Event{Type: webhookPing, StoreID: req.StoreID, Time: time.Now().UTC()})
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	body, _ := json.Marshal(payload)
+	id, err := queueDelivery(db, req.ID, webhookPing, body, 0)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	delivery, err := loadDelivery(db, id)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"delivery": delivery})
+}
+
+// GetWebhookDeliveries is the delivery log of a store's webhooks, newest
+// first: GET /api/v1/webhooks/deliveries?store_id=&webhook_id=
+func GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	storeID, err := strconv.Atoi(r.URL.Query().Get("store_id"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid store ID")
+		return
+	}
+	webhookID := 0
+	if value := r.URL.Query().Get("webhook_id"); value != "" {
+		if webhookID, err = strconv.Atoi(value); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidField, "Invalid webhook ID")
+			return
+		}
+	}
+	db, ok := webhookStore(w, r, storeID)
+	if !ok {
+		return
+	}
+	defer db.Close()
+	deliveries, err := loadDeliveries(db, storeID, webhookID)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": deliveries})
+}
+
+// redeliverRequest is the body of RedeliverWebhook
+type redeliverRequest struct {
+	StoreID    int `json:"store_id"`
+	DeliveryID int `json:"delivery_id"`
+}
+
+// RedeliverWebhook sends a logged delivery again, with the same payload, as
+// a new delivery: POST /api/v1/webhooks/redeliver with {"store_id",
+// "delivery_id"}
+func RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req redeliverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Invalid request body")
+		return
+	}
+	db, ok := webhookStore(w, r, req.StoreID)
+	if !ok {
+		return
+	}
+	defer db.Close()
+	var webhookID int
+	var event, payload string
+	err := db.QueryRow(`
+		SELECT d.webhook_id, d.event, d.payload
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.id = ? AND w.store_id = ?
+	`, req.DeliveryID, req.StoreID).Scan(&webhookID, &event, &payload)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Delivery not found")
+		return
+	}
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	id, err := queueDelivery(db, webhookID, event, []byte(payload), req.DeliveryID)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	delivery, err := loadDelivery(db, id)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	Logger(r).Info("webhook redelivery queued", "delivery_id", id, "redelivery_of", req.DeliveryID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"delivery": delivery})
+}
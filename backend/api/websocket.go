@@ -1,8 +1,11 @@
 package api
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
@@ -10,6 +13,13 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// dashboardDebounce groups the events of one change into one update
+	dashboardDebounce = 300 * time.Millisecond
+	// dashboardRefreshInterval re-checks stats that move without an event
+	dashboardRefreshInterval = 5 * time.Minute
+)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -29,6 +39,16 @@ type DashboardStats struct {
 	AvgChange      float64              `json:"avg_change"`
 	SalesData      []SalesDataPoint     `json:"sales_data"`
 	TopProducts    []ProductPerformance `json:"top_products"`
+	CategorySales  []CategorySales      `json:"category_sales"`
+}
+
+// CategorySales totals a store's sales for one category, subcategories
+// included
+type CategorySales struct {
+	Category  string  `json:"category"`
+	Products  int     `json:"products"`
+	UnitsSold int     `json:"units_sold"`
+	Revenue   float64 `json:"revenue"`
 }
 
 type SalesDataPoint struct {
@@ -72,6 +92,8 @@ func DashboardWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close()
+	websocketConnections.Inc("dashboard")
+	defer websocketConnections.Dec("dashboard")
 
 	// Get store ID from query parameters
 	storeIDStr := r.URL.Query().Get("store_id")
@@ -90,7 +112,7 @@ func DashboardWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db, err := sql.Open("sqlite3", DATABASEPATH)
+	db, err := sql.Open(DATABASEDRIVER, DATABASEPATH)
 	if err != nil {
 		return
 	}
@@ -108,11 +130,12 @@ func DashboardWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil || userID != ownerID {
 		return
 	}
+	setRequestUser(r, userID)
 
 	// Fetch store and set cookie
 	store, err := GetStoreByID(storeID)
 	if err == nil && store.ID != 0 {
-		SetStoreCookie(w, int(store.OwnerID), store.Name)
+		SetStoreCookie(w, r, int(store.OwnerID), store.Name)
 	}
 
 	// Configure ping/pong for connection health check
@@ -122,10 +145,13 @@ func DashboardWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
+	// Subscribe before the first query so no change slips in between
+	updates := events.Subscribe(EventFilter{StoreID: storeID})
+	defer updates.Close()
+
 	// Send initial data
 	stats := getDashboardStats(db, storeID)
-
-	if err := conn.WriteJSON(stats); err != nil {
+	if err := conn.WriteJSON(map[string]interface{}{"type": "snapshot", "stats": stats}); err != nil {
 		return
 	}
 
@@ -143,20 +169,45 @@ func DashboardWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Send updates every 5 seconds and ping every 30 seconds
-	ticker := time.NewTicker(5 * time.Second)
+	// Events arrive in bursts (an order touches stock, the order and a
+	// notification), so recompute once they settle and send only what changed.
+	// The slow refresh picks up time-based changes such as a new month.
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	var pending []string
+	refreshTicker := time.NewTicker(dashboardRefreshInterval)
 	pingTicker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+	defer refreshTicker.Stop()
 	defer pingTicker.Stop()
 
+	push := func() error {
+		next := getDashboardStats(db, storeID)
+		changes := statsChanges(stats, next)
+		triggers := pending
+		pending = nil
+		if len(changes) == 0 {
+			return nil
+		}
+		stats = next
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(map[string]interface{}{"type": "update", "events": triggers, "changes": changes})
+	}
+
 	for {
 		select {
 		case <-done:
 			return
-		case <-ticker.C:
-			stats := getDashboardStats(db, storeID)
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := conn.WriteJSON(stats); err != nil {
+		case e := <-updates.C:
+			if len(pending) == 0 {
+				debounce.Reset(dashboardDebounce)
+			}
+			pending = append(pending, e.Type)
+		case <-debounce.C:
+			if err := push(); err != nil {
+				return
+			}
+		case <-refreshTicker.C:
+			if err := push(); err != nil {
 				return
 			}
 		case <-pingTicker.C:
@@ -168,10 +219,41 @@ func DashboardWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// statsChanges returns the top-level fields of next that differ from prev,
+// keyed by their JSON names
+func statsChanges(prev DashboardStats, next DashboardStats) map[string]json.RawMessage {
+	fields := func(stats DashboardStats) map[string]json.RawMessage {
+		data, _ := json.Marshal(stats)
+		m := map[string]json.RawMessage{}
+		json.Unmarshal(data, &m)
+		return m
+	}
+	before, after := fields(prev), fields(next)
+	changes := map[string]json.RawMessage{}
+	for name, value := range after {
+		if !bytes.Equal(before[name], value) {
+			changes[name] = value
+		}
+	}
+	return changes
+}
+
 func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 	stats := DashboardStats{
-		SalesData:   make([]SalesDataPoint, 0),
-		TopProducts: make([]ProductPerformance, 0),
+		SalesData:     make([]SalesDataPoint, 0),
+		TopProducts:   make([]ProductPerformance, 0),
+		CategorySales: make([]CategorySales, 0),
+	}
+	logger := slog.With("store_id", storeID)
+	categories, err := loadCategories(db, storeID)
+	if err != nil {
+		logger.Error("dashboard categories query failed", "error", err)
+	}
+	categoryName := func(categoryID int) string {
+		if c := categoryByID(categories, categoryID); c.ID != 0 {
+			return c.Path
+		}
+		return "Uncategorized"
 	}
 
 	// Get total revenue and items sold from orders
@@ -187,7 +269,10 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 		WHERE p.store_id = ? AND (o.status = 'paid' OR o.status= 'shipped' 
 		OR o.status = 'completed')
 	`
-	err := db.QueryRow(query, storeID).Scan(&totalRevenue, &itemsSold)
+	err = db.QueryRow(query, storeID).Scan(&totalRevenue, &itemsSold)
+	if err != nil {
+		logger.Error("dashboard revenue query failed", "error", err)
+	}
 
 	if totalRevenue.Valid {
 		stats.TotalRevenue = totalRevenue.Float64
@@ -199,6 +284,9 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 	// Get active products count
 	var activeProducts int
 	err = db.QueryRow("SELECT COUNT(*) FROM products WHERE store_id = ?", storeID).Scan(&activeProducts)
+	if err != nil {
+		logger.Error("dashboard product count query failed", "error", err)
+	}
 
 	stats.ActiveProducts = activeProducts
 
@@ -232,8 +320,11 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 		AND strftime('%Y', o.created_at) = ?
 		AND (o.status = 'paid' OR o.status = 'shipped' OR o.status = 'completed')
 	`
-	db.QueryRow(lastMonthQuery, storeID, fmt.Sprintf("%02d", lastMonth), fmt.Sprintf("%d", lastYear)).
+	err = db.QueryRow(lastMonthQuery, storeID, fmt.Sprintf("%02d", lastMonth), fmt.Sprintf("%d", lastYear)).
 		Scan(&lastMonthRevenue, &lastMonthSales)
+	if err != nil {
+		logger.Error("dashboard last month query failed", "error", err)
+	}
 
 	// Calculate revenue change percentage
 	if lastMonthRevenue.Valid && lastMonthRevenue.Float64 > 0 {
@@ -273,11 +364,14 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 
 	// Get last month's product count for comparison
 	var lastMonthProductCount int
-	db.QueryRow(`
+	err = db.QueryRow(`
 		SELECT COUNT(*) FROM products 
 		WHERE store_id = ? 
 		AND created_at < date('now', 'start of month')
 	`, storeID).Scan(&lastMonthProductCount)
+	if err != nil {
+		logger.Error("dashboard last month product count query failed", "error", err)
+	}
 
 	// Calculate products change percentage
 	if lastMonthProductCount > 0 {
@@ -303,7 +397,9 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 		ORDER BY month
 	`
 	rows, err := db.Query(monthlyQuery, storeID)
-	if err == nil {
+	if err != nil {
+		logger.Error("dashboard monthly sales query failed", "error", err)
+	} else {
 		defer rows.Close()
 		months := []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
 		for rows.Next() {
@@ -329,7 +425,8 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 			p.price,
 			COALESCE(SUM(op.quantity), 0) as units_sold,
 			COALESCE(SUM(op.quantity * op.price), 0) as revenue,
-			p.created_at
+			p.created_at,
+			COALESCE(p.category_id, 0)
 		FROM products p
 		LEFT JOIN order_products op ON p.id = op.product_id
 		WHERE p.store_id = ?
@@ -339,20 +436,22 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 		LIMIT 5
 	`
 	rows, err = db.Query(topProductsQuery, storeID)
-
-	if err == nil {
+	if err != nil {
+		logger.Error("dashboard top products query failed", "error", err)
+	} else {
 		defer rows.Close()
 		for rows.Next() {
 			var perf ProductPerformance
 			var unitsSold int
 			var revenue float64
 			var createdAt string
-			if err := rows.Scan(&perf.ProductName, &perf.Price, &unitsSold, &revenue, &createdAt); err == nil {
+			var categoryID int
+			if err := rows.Scan(&perf.ProductName, &perf.Price, &unitsSold, &revenue, &createdAt, &categoryID); err == nil {
 				perf.UnitsSold = unitsSold
 				perf.Revenue = revenue
 				perf.Profit = revenue * 0.3 // 30% profit margin assumption
 				perf.Margin = 30.0
-				perf.Category = "General"
+				perf.Category = categoryName(categoryID)
 
 				// Parse and format the created_at date
 				if t, err := time.Parse("2006-01-02 15:04:05", createdAt); err == nil {
@@ -381,7 +480,8 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 			SELECT 
 				p.name,
 				p.price,
-				p.created_at
+				p.created_at,
+				COALESCE(p.category_id, 0)
 			FROM products p
 			WHERE p.store_id = ? 
 			AND p.id NOT IN (
@@ -392,18 +492,20 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 		`
 		limit := 5 - len(stats.TopProducts)
 		rows, err = db.Query(remainingQuery, storeID, limit)
-
-		if err == nil {
+		if err != nil {
+			logger.Error("dashboard new products query failed", "error", err)
+		} else {
 			defer rows.Close()
 			for rows.Next() {
 				var perf ProductPerformance
 				var createdAt string
-				if err := rows.Scan(&perf.ProductName, &perf.Price, &createdAt); err == nil {
+				var categoryID int
+				if err := rows.Scan(&perf.ProductName, &perf.Price, &createdAt, &categoryID); err == nil {
 					perf.UnitsSold = 0
 					perf.Revenue = 0
 					perf.Profit = 0
 					perf.Margin = 0
-					perf.Category = "General"
+					perf.Category = categoryName(categoryID)
 					perf.Performance = "NEW"
 
 					if t, err := time.Parse("2006-01-02 15:04:05", createdAt); err == nil {
@@ -418,5 +520,57 @@ func getDashboardStats(db *sql.DB, storeID int) DashboardStats {
 		}
 	}
 
+	// Sales per category, each product counted once under its own category
+	// and once under every category above it
+	categoryQuery := `
+		SELECT
+			COALESCE(p.category_id, 0),
+			COALESCE(SUM(op.quantity), 0),
+			COALESCE(SUM(op.quantity * op.price), 0)
+		FROM products p
+		LEFT JOIN order_products op ON p.id = op.product_id
+		WHERE p.store_id = ?
+		GROUP BY p.id
+	`
+	rows, err = db.Query(categoryQuery, storeID)
+	if err != nil {
+		logger.Error("dashboard category sales query failed", "error", err)
+	} else {
+		defer rows.Close()
+		totals := map[string]*CategorySales{}
+		add := func(name string, units int, revenue float64) {
+			if totals[name] == nil {
+				totals[name] = &CategorySales{Category: name}
+			}
+			totals[name].Products++
+			totals[name].UnitsSold += units
+			totals[name].Revenue += revenue
+		}
+		for rows.Next() {
+			var categoryID, units int
+			var revenue float64
+			if err := rows.Scan(&categoryID, &units, &revenue); err != nil {
+				continue
+			}
+			if categoryID == 0 || categoryByID(categories, categoryID).ID == 0 {
+				add("Uncategorized", units, revenue)
+				continue
+			}
+			for _, c := range categories {
+				if containsInt(c.Descendants, categoryID) {
+					add(c.Path, units, revenue)
+				}
+			}
+		}
+		for _, c := range categories {
+			if totals[c.Path] != nil {
+				stats.CategorySales = append(stats.CategorySales, *totals[c.Path])
+			}
+		}
+		if totals["Uncategorized"] != nil {
+			stats.CategorySales = append(stats.CategorySales, *totals["Uncategorized"])
+		}
+	}
+
 	return stats
 }
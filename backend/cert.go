@@ -7,7 +7,8 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
-	"fmt"
+	"finalProj/api"
+	"log/slog"
 	"math/big"
 	"net"
 	"os"
@@ -16,8 +17,8 @@ import (
 
 func generateCert() error {
 	// Check if certificates already exist
-	if _, err := os.Stat("cert.pem"); err == nil {
-		if _, err := os.Stat("key.pem"); err == nil {
+	if _, err := os.Stat(api.CertFile); err == nil {
+		if _, err := os.Stat(api.KeyFile); err == nil {
 			return nil // Certificates already exist
 		}
 	}
@@ -67,14 +68,14 @@ func generateCert() error {
 		return err
 	}
 
-	certOut, err := os.Create("cert.pem")
+	certOut, err := os.Create(api.CertFile)
 	if err != nil {
 		return err
 	}
 	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	certOut.Close()
 
-	keyOut, err := os.Create("key.pem")
+	keyOut, err := os.Create(api.KeyFile)
 	if err != nil {
 		return err
 	}
@@ -85,6 +86,6 @@ func generateCert() error {
 	pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: privBytes})
 	keyOut.Close()
 
-	fmt.Println("✓ Generated SSL certificates")
+	slog.Info("generated SSL certificates", "cert", api.CertFile, "key", api.KeyFile)
 	return nil
 }
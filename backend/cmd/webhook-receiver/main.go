@@ -0,0 +1,88 @@
+// Command webhook-receiver is a local endpoint for trying store webhooks. It
+// checks each delivery's signature and logs it.
+//
+//	go run ./cmd/webhook-receiver -secret whsec_... [-addr :9000] [-status 500]
+//
+// The server only delivers to local addresses with
+// WEBHOOK_ALLOW_PRIVATE_TARGETS=true. -status makes the receiver fail every
+// delivery with that status, to watch the retries in the delivery log.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// tolerance is how old a delivery's timestamp may be before it is refused
+// as a replay
+const tolerance = 5 * time.Minute
+
+// verify checks the X-Webhook-Signature of body, the way a receiver should:
+// the HMAC-SHA256 of "<timestamp>.<body>", compared in constant time
+func verify(secret string, r *http.Request, body []byte) error {
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing timestamp")
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp is %s off", age.Round(time.Second))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Webhook-Signature"))) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+func main() {
+	addr := flag.String("addr", ":9000", "address to listen on")
+	secret := flag.String("secret", os.Getenv("WEBHOOK_SECRET"), "the webhook's signing secret (or WEBHOOK_SECRET)")
+	status := flag.Int("status", 0, "answer every delivery with this status instead of 200")
+	flag.Parse()
+	if *secret == "" {
+		fmt.Fprintln(os.Stderr, "webhook-receiver: -secret is required")
+		os.Exit(2)
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "unreadable body", http.StatusBadRequest)
+			return
+		}
+		logger := slog.With("delivery", r.Header.Get("X-Webhook-ID"), "event", r.Header.Get("X-Webhook-Event"))
+		if err := verify(*secret, r, body); err != nil {
+			logger.Warn("delivery refused", "error", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		logger.Info("delivery received", "payload", string(body))
+		if *status != 0 {
+			http.Error(w, "failing on purpose", *status)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	slog.Info("webhook receiver listening", "addr", *addr)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		slog.Error("receiver stopped", "error", err)
+		os.Exit(1)
+	}
+}
@@ -190,10 +190,13 @@ function goToPage(text) {
 }
 
 // Standalone addToCart function for programmatic calls
-async function addToCart(productId, quantity = 1) {
+async function addToCart(productId, quantity = 1, variantId = null) {
     const formData = new FormData();
     formData.append('product_id', productId);
     formData.append('quantity', quantity.toString());
+    if (variantId) {
+        formData.append('variant_id', variantId);
+    }
     
     try {
         const fullPath = window.location.href;
@@ -0,0 +1,120 @@
+// Category, tag and collection filters shared by the store templates. The
+// filter bar (#catalogFilters) holds one chip per category, tag and
+// collection; product cards carry data-product-id, data-category and
+// data-tags ("|tag|tag|"). Filtering uses the catalog-hidden class so it
+// stacks with the search box, which hides cards through their inline style.
+// The choice is kept in the URL (?category=&tag=&collection=) so filtered
+// pages can be shared.
+
+const catalogFilter = { category: '', tag: '', collection: '' };
+
+function injectCatalogStyles() {
+    if (document.getElementById('catalogStyles')) return;
+    const style = document.createElement('style');
+    style.id = 'catalogStyles';
+    style.textContent = `
+        .catalog-hidden { display: none !important; }
+        .catalog-filters { display: flex; flex-direction: column; gap: 0.6rem; margin: 0 0 2rem; }
+        .catalog-filter-group { display: flex; flex-wrap: wrap; align-items: center; gap: 0.5rem; }
+        .catalog-filter-label { font-size: 0.85rem; opacity: 0.7; margin-right: 0.25rem; }
+        .catalog-chip, .catalog-clear {
+            padding: 0.35rem 0.85rem;
+            border: 1px solid var(--primary-color, #333);
+            background: transparent;
+            color: inherit;
+            border-radius: 999px;
+            cursor: pointer;
+            font: inherit;
+            font-size: 0.9rem;
+        }
+        .catalog-chip.sub { font-size: 0.8rem; opacity: 0.85; }
+        .catalog-chip.active { background: var(--primary-color, #333); color: #fff; }
+    `;
+    document.head.appendChild(style);
+}
+
+function catalogChipMatches(chip, card) {
+    const value = chip.dataset.value;
+    switch (chip.dataset.filter) {
+        case 'category':
+            return (chip.dataset.descendants || '').includes('|' + card.dataset.category + '|');
+        case 'tag':
+            return (card.dataset.tags || '').includes('|' + value + '|');
+        case 'collection':
+            return (chip.dataset.products || '').includes('|' + card.dataset.productId + '|');
+    }
+    return true;
+}
+
+function applyCatalogFilter() {
+    const bar = document.getElementById('catalogFilters');
+    const grid = document.getElementById('productGrid');
+    if (!bar || !grid) return;
+
+    const active = [];
+    bar.querySelectorAll('.catalog-chip').forEach(chip => {
+        const on = catalogFilter[chip.dataset.filter] === chip.dataset.value;
+        chip.classList.toggle('active', on);
+        if (on) active.push(chip);
+    });
+
+    let visible = 0;
+    const cards = [...grid.querySelectorAll('.product-card')];
+    cards.forEach(card => {
+        const show = active.every(chip => catalogChipMatches(chip, card));
+        card.classList.toggle('catalog-hidden', !show);
+        if (show && card.style.display !== 'none') visible++;
+    });
+
+    // a collection lists its products in its own order
+    const collection = active.find(chip => chip.dataset.filter === 'collection');
+    const order = collection ? collection.dataset.products.split('|').filter(Boolean) : [];
+    cards
+        .map(card => ({ card, rank: order.includes(card.dataset.productId) ? order.indexOf(card.dataset.productId) : order.length + Number(card.dataset.order) }))
+        .sort((a, b) => a.rank - b.rank)
+        .forEach(({ card }) => grid.appendChild(card));
+
+    const noResults = document.getElementById('noResults');
+    if (noResults) noResults.style.display = visible === 0 ? 'block' : 'none';
+
+    const params = new URLSearchParams(window.location.search);
+    Object.keys(catalogFilter).forEach(key => {
+        if (catalogFilter[key]) params.set(key, catalogFilter[key]);
+        else params.delete(key);
+    });
+    const query = params.toString();
+    history.replaceState(null, '', window.location.pathname + (query ? '?' + query : '') + window.location.hash);
+}
+
+function initializeCatalog() {
+    const bar = document.getElementById('catalogFilters');
+    const grid = document.getElementById('productGrid');
+    if (!bar || !grid) return;
+    injectCatalogStyles();
+    grid.querySelectorAll('.product-card').forEach((card, i) => { card.dataset.order = i; });
+
+    // categories and collections can be linked by id or slug
+    const params = new URLSearchParams(window.location.search);
+    Object.keys(catalogFilter).forEach(key => {
+        const wanted = params.get(key);
+        if (!wanted) return;
+        const chip = [...bar.querySelectorAll(`.catalog-chip[data-filter="${key}"]`)]
+            .find(c => c.dataset.value === wanted || c.dataset.id === wanted);
+        if (chip) catalogFilter[key] = chip.dataset.value;
+    });
+
+    bar.querySelectorAll('.catalog-chip').forEach(chip => {
+        chip.addEventListener('click', () => {
+            const key = chip.dataset.filter;
+            catalogFilter[key] = catalogFilter[key] === chip.dataset.value ? '' : chip.dataset.value;
+            applyCatalogFilter();
+        });
+    });
+    bar.querySelector('.catalog-clear')?.addEventListener('click', () => {
+        Object.keys(catalogFilter).forEach(key => { catalogFilter[key] = ''; });
+        applyCatalogFilter();
+    });
+    applyCatalogFilter();
+}
+
+document.addEventListener('DOMContentLoaded', initializeCatalog);
@@ -0,0 +1,89 @@
+// Product gallery shared by the store templates. Each template fills
+// window.productMedia with {productId: [media]} in gallery order; an item is
+// an image, a video or the product's 3D model, which opens the 3D viewer.
+
+function injectGalleryStyles() {
+    if (document.getElementById('productGalleryStyles')) return;
+    const style = document.createElement('style');
+    style.id = 'productGalleryStyles';
+    style.textContent = `
+        .product-gallery { display: flex; gap: 0.5rem; margin-top: 0.75rem; overflow-x: auto; padding-bottom: 0.25rem; }
+        .product-gallery-thumb {
+            flex: 0 0 64px;
+            height: 64px;
+            border: 2px solid transparent;
+            border-radius: 6px;
+            overflow: hidden;
+            padding: 0;
+            background: rgba(0, 0, 0, 0.05);
+            color: inherit;
+            cursor: pointer;
+            font: inherit;
+            font-size: 0.8rem;
+        }
+        .product-gallery-thumb img { width: 100%; height: 100%; object-fit: cover; display: block; }
+        .product-gallery-thumb.selected { border-color: var(--primary-color, #333); }
+        .product-detail-main-image video { width: 100%; height: 100%; object-fit: contain; }
+    `;
+    document.head.appendChild(style);
+}
+
+function showGalleryItem(stage, item, name) {
+    if (item.kind === 'video') {
+        stage.innerHTML = '';
+        const video = document.createElement('video');
+        video.src = item.url;
+        video.controls = true;
+        video.setAttribute('aria-label', item.alt || name);
+        stage.appendChild(video);
+        return;
+    }
+    const img = document.createElement('img');
+    img.src = item.url;
+    img.alt = item.alt || name;
+    stage.innerHTML = '';
+    stage.appendChild(img);
+}
+
+// Draws a thumbnail strip into strip; picking an image or video shows it in
+// stage, picking the 3D model opens the viewer. The strip stays hidden when
+// the product has a single item.
+function renderProductGallery(productId, strip, stage, name) {
+    if (!strip) return;
+    strip.innerHTML = '';
+    const media = (window.productMedia || {})[productId] || [];
+    if (media.length < 2) {
+        strip.style.display = 'none';
+        return;
+    }
+    injectGalleryStyles();
+    strip.style.display = '';
+    strip.className = 'product-gallery';
+
+    media.forEach(item => {
+        const thumb = document.createElement('button');
+        thumb.type = 'button';
+        thumb.className = 'product-gallery-thumb';
+        thumb.title = item.alt || name;
+        if (item.kind === 'image' || item.preview) {
+            const img = document.createElement('img');
+            img.src = item.kind === 'image' ? item.url + '?size=thumb' : item.preview;
+            img.alt = item.alt || name;
+            img.loading = 'lazy';
+            thumb.appendChild(img);
+        } else {
+            thumb.textContent = item.kind === 'video' ? '▶ Video' : '3D';
+        }
+        if (item.main) thumb.classList.add('selected');
+        thumb.addEventListener('click', () => {
+            if (item.kind === 'model') {
+                window.location.href = item.url;
+                return;
+            }
+            strip.querySelectorAll('.product-gallery-thumb').forEach(t => t.classList.remove('selected'));
+            thumb.classList.add('selected');
+            showGalleryItem(stage, item, name);
+        });
+        strip.appendChild(thumb);
+    });
+}
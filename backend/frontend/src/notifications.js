@@ -0,0 +1,283 @@
+// Notification Center Script
+// Adds a bell with the unread count and a dropdown feed kept up to date over
+// /ws/notifications. Store pages pass their store with data-store-id on the
+// script tag so customers are authenticated with the store's cookie.
+
+(function () {
+    const script = document.currentScript;
+    const storeId = script ? script.dataset.storeId : '';
+    const query = storeId ? `?store_id=${encodeURIComponent(storeId)}` : '';
+
+    let notifications = [];
+    let unread = 0;
+    let ws = null;
+    let reconnectDelay = 1000;
+
+    const style = document.createElement('style');
+    style.textContent = `
+        .notif-bell {
+            position: fixed;
+            bottom: 24px;
+            right: 24px;
+            width: 52px;
+            height: 52px;
+            border-radius: 50%;
+            border: none;
+            background: #2563eb;
+            color: white;
+            font-size: 22px;
+            cursor: pointer;
+            box-shadow: 0 4px 12px rgba(0, 0, 0, 0.2);
+            z-index: 9998;
+        }
+        .notif-badge {
+            position: absolute;
+            top: -4px;
+            right: -4px;
+            min-width: 20px;
+            height: 20px;
+            padding: 0 5px;
+            border-radius: 10px;
+            background: #ef4444;
+            font-size: 12px;
+            line-height: 20px;
+            display: none;
+        }
+        .notif-panel {
+            position: fixed;
+            bottom: 88px;
+            right: 24px;
+            width: 340px;
+            max-height: 460px;
+            overflow-y: auto;
+            background: white;
+            color: #333;
+            border-radius: 12px;
+            box-shadow: 0 8px 24px rgba(0, 0, 0, 0.15);
+            z-index: 9999;
+            display: none;
+            font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+        }
+        .notif-panel.active { display: block; }
+        .notif-header {
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            padding: 14px 16px;
+            border-bottom: 1px solid #eee;
+            font-weight: 600;
+        }
+        .notif-header button {
+            background: none;
+            border: none;
+            color: #2563eb;
+            cursor: pointer;
+            font-size: 0.85rem;
+        }
+        .notif-item {
+            padding: 12px 16px;
+            border-bottom: 1px solid #f1f1f1;
+            cursor: pointer;
+        }
+        .notif-item.unread { background: #eff6ff; }
+        .notif-item .title { font-weight: 600; font-size: 0.95rem; }
+        .notif-item .body { font-size: 0.85rem; color: #555; }
+        .notif-item .time { font-size: 0.75rem; color: #999; margin-top: 4px; }
+        .notif-empty { padding: 20px 16px; color: #888; text-align: center; }
+        .notif-settings { padding: 12px 16px; border-bottom: 1px solid #eee; display: none; }
+        .notif-settings.active { display: block; }
+        .notif-settings label {
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            font-size: 0.85rem;
+            margin-bottom: 8px;
+        }
+    `;
+    document.head.appendChild(style);
+
+    const bell = document.createElement('button');
+    bell.className = 'notif-bell';
+    bell.title = 'Notifications';
+    bell.innerHTML = '&#128276;<span class="notif-badge"></span>';
+    const badge = bell.querySelector('.notif-badge');
+
+    const panel = document.createElement('div');
+    panel.className = 'notif-panel';
+    panel.innerHTML = `
+        <div class="notif-header">
+            <span>Notifications</span>
+            <span>
+                <button type="button" data-action="settings">Settings</button>
+                <button type="button" data-action="read-all">Mark all read</button>
+            </span>
+        </div>
+        <div class="notif-settings"></div>
+        <div class="notif-list"></div>
+    `;
+    const list = panel.querySelector('.notif-list');
+    const settings = panel.querySelector('.notif-settings');
+
+    document.body.appendChild(bell);
+    document.body.appendChild(panel);
+
+    function escapeHTML(text) {
+        const div = document.createElement('div');
+        div.textContent = text || '';
+        return div.innerHTML;
+    }
+
+    function formatTime(dateString) {
+        const date = new Date(dateString.replace(' ', 'T') + 'Z');
+        return isNaN(date) ? dateString : date.toLocaleString();
+    }
+
+    function render() {
+        badge.textContent = unread > 99 ? '99+' : unread;
+        badge.style.display = unread > 0 ? 'block' : 'none';
+
+        if (notifications.length === 0) {
+            list.innerHTML = '<div class="notif-empty">No notifications yet</div>';
+            return;
+        }
+        list.innerHTML = notifications.map(n => `
+            <div class="notif-item ${n.read ? '' : 'unread'}" data-id="${n.id}" data-link="${escapeHTML(n.link)}">
+                <div class="title">${escapeHTML(n.title)}</div>
+                ${n.body ? `<div class="body">${escapeHTML(n.body)}</div>` : ''}
+                <div class="time">${formatTime(n.created_at)}</div>
+            </div>
+        `).join('');
+    }
+
+    function send(message) {
+        if (ws && ws.readyState === WebSocket.OPEN) {
+            ws.send(JSON.stringify(message));
+            return true;
+        }
+        return false;
+    }
+
+    async function markRead(id) {
+        const message = id ? { action: 'mark_read', id: id } : { action: 'mark_all_read' };
+        if (send(message)) return;
+        try {
+            const response = await fetch(`/api/notifications/read${query}`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(id ? { id: id } : { all: true })
+            });
+            const data = await response.json();
+            if (response.ok) {
+                unread = data.unread;
+                render();
+            }
+        } catch (error) {
+            console.error('Error marking notifications read:', error);
+        }
+    }
+
+    async function loadSettings() {
+        try {
+            const response = await fetch(`/api/notifications/preferences${query}`);
+            if (!response.ok) return;
+            const data = await response.json();
+            const options = [['both', 'Email & in-app'], ['in_app', 'In-app only'], ['email', 'Email only'], ['none', 'Off']];
+            settings.innerHTML = data.preferences.map(p => `
+                <label>
+                    <span>${escapeHTML(p.label)}</span>
+                    <select data-event="${p.type}">
+                        ${options.map(([value, label]) => `<option value="${value}" ${p.channel === value ? 'selected' : ''}>${label}</option>`).join('')}
+                    </select>
+                </label>
+            `).join('');
+        } catch (error) {
+            console.error('Error loading notification settings:', error);
+        }
+    }
+
+    async function saveSetting(eventType, channel) {
+        try {
+            await fetch(`/api/notifications/preferences${query}`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ preferences: { [eventType]: channel } })
+            });
+        } catch (error) {
+            console.error('Error saving notification settings:', error);
+        }
+    }
+
+    function connect() {
+        const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+        ws = new WebSocket(`${protocol}//${window.location.host}/ws/notifications${query}`);
+
+        ws.onopen = () => { reconnectDelay = 1000; };
+        ws.onmessage = (event) => {
+            const data = JSON.parse(event.data);
+            if (data.type === 'init') {
+                notifications = data.notifications || [];
+            } else if (data.type === 'notification') {
+                notifications.unshift(data.notification);
+                notifications = notifications.slice(0, 50);
+            }
+            if (typeof data.unread === 'number') unread = data.unread;
+            render();
+        };
+        ws.onclose = () => {
+            setTimeout(connect, reconnectDelay);
+            reconnectDelay = Math.min(reconnectDelay * 2, 30000);
+        };
+    }
+
+    bell.addEventListener('click', () => panel.classList.toggle('active'));
+
+    panel.addEventListener('click', (e) => {
+        const action = e.target.dataset.action;
+        if (action === 'read-all') {
+            notifications.forEach(n => n.read = true);
+            markRead(0);
+            render();
+            return;
+        }
+        if (action === 'settings') {
+            settings.classList.toggle('active');
+            if (settings.classList.contains('active')) loadSettings();
+            return;
+        }
+        const item = e.target.closest('.notif-item');
+        if (!item) return;
+        const id = parseInt(item.dataset.id, 10);
+        const notification = notifications.find(n => n.id === id);
+        if (notification && !notification.read) {
+            notification.read = true;
+            markRead(id);
+            render();
+        }
+        if (item.dataset.link) window.location.href = item.dataset.link;
+    });
+
+    settings.addEventListener('change', (e) => {
+        if (e.target.dataset.event) saveSetting(e.target.dataset.event, e.target.value);
+    });
+
+    // only show the bell to signed-in users
+    async function init() {
+        try {
+            const response = await fetch(`/api/notifications${query}`);
+            if (!response.ok) {
+                bell.remove();
+                panel.remove();
+                return;
+            }
+            const data = await response.json();
+            notifications = data.notifications || [];
+            unread = data.unread || 0;
+            render();
+            connect();
+        } catch (error) {
+            console.error('Error loading notifications:', error);
+        }
+    }
+
+    init();
+})();
@@ -44,7 +44,7 @@ async function displayReviewableOrders(containerId = 'reviewable-orders-containe
                 <div class="order-products">
                     ${order.products.map(product => `
                         <div class="reviewable-product">
-                            <img src="/products_image/${product.product_image}" alt="${product.product_name}" class="product-thumb">
+                            <img src="/products_image/${product.product_image}?size=thumb" alt="${product.product_name}" class="product-thumb">
                             <div class="product-info">
                                 <h4>${product.product_name}</h4>
                                 ${product.has_reviewed ? 
@@ -0,0 +1,111 @@
+// Variant picker shared by the store templates. Each template fills
+// window.productVariants with {productId: {options, variants}} for products
+// that have options; products without options have a single variant and
+// need no picker.
+
+let variantSelection = {};
+
+function productHasVariants(productId) {
+    const data = (window.productVariants || {})[productId];
+    return !!(data && data.options && data.options.length);
+}
+
+// Returns the variant matching every chosen value, or null until the
+// customer has picked one value per option
+function selectedVariant(productId) {
+    const data = (window.productVariants || {})[productId];
+    if (!data) return null;
+    return (data.variants || []).find(variant =>
+        data.options.every(option => variant.options[option.name] === variantSelection[option.name])
+    ) || null;
+}
+
+// Whether picking value for option, keeping the other choices, leads to a
+// variant in stock
+function variantValueAvailable(data, optionName, value) {
+    return (data.variants || []).some(variant =>
+        variant.quantity > 0 &&
+        data.options.every(option => {
+            const wanted = option.name === optionName ? value : variantSelection[option.name];
+            return wanted === undefined || variant.options[option.name] === wanted;
+        })
+    );
+}
+
+function injectVariantStyles() {
+    if (document.getElementById('variantPickerStyles')) return;
+    const style = document.createElement('style');
+    style.id = 'variantPickerStyles';
+    style.textContent = `
+        .variant-picker { margin: 1rem 0; }
+        .variant-option { margin-bottom: 0.75rem; }
+        .variant-option-name { display: block; font-size: 0.85rem; margin-bottom: 0.4rem; opacity: 0.8; }
+        .variant-values { display: flex; flex-wrap: wrap; gap: 0.5rem; }
+        .variant-value {
+            padding: 0.4rem 0.9rem;
+            border: 1px solid var(--primary-color, #333);
+            background: transparent;
+            color: inherit;
+            border-radius: 4px;
+            cursor: pointer;
+            font: inherit;
+        }
+        .variant-value.selected { background: var(--primary-color, #333); color: #fff; }
+        .variant-value.unavailable { opacity: 0.4; text-decoration: line-through; }
+    `;
+    document.head.appendChild(style);
+}
+
+// Draws one row of value buttons per option into container and calls
+// onChange with the matching variant (or null) whenever the choice changes
+function renderVariantPicker(productId, container, onChange) {
+    variantSelection = {};
+    if (!container) return;
+    container.innerHTML = '';
+    const data = (window.productVariants || {})[productId];
+    if (!productHasVariants(productId)) {
+        container.style.display = 'none';
+        return;
+    }
+    injectVariantStyles();
+    container.style.display = '';
+    container.className = 'variant-picker';
+
+    // preselect options with a single value
+    data.options.forEach(option => {
+        if (option.values.length === 1) variantSelection[option.name] = option.values[0];
+    });
+
+    const draw = () => {
+        container.innerHTML = '';
+        data.options.forEach(option => {
+            const row = document.createElement('div');
+            row.className = 'variant-option';
+            const label = document.createElement('span');
+            label.className = 'variant-option-name';
+            label.textContent = option.name + (variantSelection[option.name] ? ': ' + variantSelection[option.name] : '');
+            row.appendChild(label);
+
+            const values = document.createElement('div');
+            values.className = 'variant-values';
+            option.values.forEach(value => {
+                const button = document.createElement('button');
+                button.type = 'button';
+                button.className = 'variant-value';
+                button.textContent = value;
+                if (variantSelection[option.name] === value) button.classList.add('selected');
+                if (!variantValueAvailable(data, option.name, value)) button.classList.add('unavailable');
+                button.addEventListener('click', () => {
+                    variantSelection[option.name] = value;
+                    draw();
+                    onChange(selectedVariant(productId));
+                });
+                values.appendChild(button);
+            });
+            row.appendChild(values);
+            container.appendChild(row);
+        });
+    };
+    draw();
+    onChange(selectedVariant(productId));
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"context"
 	"finalProj/api"
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
 )
 
 func main() {
 	api.LoadEnv()
+	api.InitLogger()
 	api.CreateDatabase()
+	if err := api.EnsureStorageDirs(); err != nil {
+		slog.Error("failed to prepare storage directories", "error", err)
+		os.Exit(1)
+	}
+	go func() {
+		if err := api.MigrateLocalUploads(context.Background()); err != nil {
+			slog.Error("failed to migrate local uploads", "error", err)
+		}
+	}()
 	http.HandleFunc("/loggout", api.LogoutHandler)
 	http.HandleFunc("/", api.HomePage)
 	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
@@ -32,13 +44,18 @@ func main() {
 		http.ServeFile(w, r, "./frontend/create_store.html")
 	})
 	http.HandleFunc("/admin_dashboard", api.AdminDashboard)
+	http.HandleFunc("/admin/diagnostics", api.AdminDiagnostics)
+	if api.DevMailPageEnabled() {
+		http.HandleFunc("/dev/mail", api.DevMailPage)
+	}
 	http.HandleFunc("/profile", api.ProfilePageHandler)
 	//handle the src, img, and data directories
-	http.Handle("/avatars/", http.StripPrefix("/avatars/", http.FileServer(http.Dir("./avatars"))))
-	http.Handle("/logos/", http.StripPrefix("/logos/", http.FileServer(http.Dir("./store_images/logos"))))
-	http.Handle("/banners/", http.StripPrefix("/banners/", http.FileServer(http.Dir("./store_images/banners"))))
-	http.Handle("/products_image/", http.StripPrefix("/products_image/", http.FileServer(http.Dir("./store_images/products"))))
-	http.Handle("/3d_images/", http.StripPrefix("/3d_images/", http.FileServer(http.Dir("./store_images/3d_images"))))
+	http.Handle("/avatars/", http.StripPrefix("/avatars/", api.ServeImages("./avatars")))
+	http.Handle("/logos/", http.StripPrefix("/logos/", api.ServeImages("./store_images/logos")))
+	http.Handle("/banners/", http.StripPrefix("/banners/", api.ServeImages("./store_images/banners")))
+	http.Handle("/products_image/", http.StripPrefix("/products_image/", api.ServeImages("./store_images/products")))
+	http.Handle("/3d_images/", http.StripPrefix("/3d_images/", api.ServeUploads("./store_images/3d_images")))
+	http.HandleFunc("/blobs/", api.ServeSignedBlob)
 
 	http.Handle("/src/", http.StripPrefix("/src/", http.FileServer(http.Dir("./frontend/src"))))
 	http.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir("./frontend/img"))))
@@ -51,76 +68,61 @@ func main() {
 
 	//======= APIs for the project =======//
 
-	// Registration-Login Hanlders //
-	http.HandleFunc("/api/login", api.LoginHandler)
-	http.HandleFunc("/api/store_login", api.StoreLoginHandler)
-	http.HandleFunc("/api/register", api.RegisterHandler)
-	http.HandleFunc("/api/store_register", api.StoreRegisterHandler)
-	http.HandleFunc("/api/store_verify", api.StoreVerifyCodeHandler)
-	http.HandleFunc("/api/verify_2fa", api.TwoFactorAuth)
-	http.HandleFunc("/api/resend_2fa", api.Resend2FAHandler)
-	// Profile Handlers //
-	http.HandleFunc("/api/profile/update", api.UpdateProfileHandler)
-	http.HandleFunc("/api/profile/picture", api.UpdateProfilePictureHandler)
-	// Store-Product Handlers //
-	http.HandleFunc("/api/create_store", api.CreateStoreHandler)
-	http.HandleFunc("/api/create_product", api.CreateProductAPI)
-	http.HandleFunc("/api/favorite_product", api.FavoriteProduct)
-	http.HandleFunc("/api/unfavorite_product", api.UnfavoriteProduct)
-	http.HandleFunc("/api/products", api.GetProductsAPI)
-	http.HandleFunc("/api/products/update", api.UpdateProductAPI)
-	http.HandleFunc("/api/products/delete", api.DeleteProductAPI)
-	// Review routes //
-	http.HandleFunc("/api/reviews/create", api.CreateReview)
-	http.HandleFunc("/api/reviews", api.GetProductReviews)
-	http.HandleFunc("/api/reviews/reviewable-orders", api.GetUserReviewableOrders)
-	// Cart and Checkout routes //
-	http.HandleFunc("/api/add-to-cart", api.AddToCart)
-	http.HandleFunc("/api/get-cart", api.GetCartTotal)
-	http.HandleFunc("/api/update-cart", api.UpdateCartItem)
-	http.HandleFunc("/api/remove-from-cart", api.RemoveFromCart)
-	http.HandleFunc("/api/create-order", api.CreateOrder)
-	// Payment routes
-	http.HandleFunc("/api/pending-order", api.GetPendingOrder)
-	http.HandleFunc("/api/process-payment", api.ProcessPayment)
-	// Store Orders routes
-	http.HandleFunc("/api/orders", api.GetStoreOrders)
-	http.HandleFunc("/api/orders/update-status", api.UpdateOrderStatus)
-	http.HandleFunc("/api/orders/", api.GetOrderProducts)
-	http.HandleFunc("/api/my-orders", api.GetOrders)
-	http.HandleFunc("/api/customer/orders", api.GetCustomerOrders)
-	http.HandleFunc("/api/customer/orders/complete", api.MarkOrderAsCompleted)
+	// Every /api/v1 route and its deprecated pre-v1 alias; see api/routes.go
+	if err := api.RegisterAPIRoutes(http.DefaultServeMux); err != nil {
+		slog.Error("failed to register API routes", "error", err)
+		os.Exit(1)
+	}
+
+	// Order, shipment and return pages
+	http.HandleFunc("/orders/packing-slip", api.PackingSlip)
+	http.HandleFunc("/shipments/label", api.ShippingLabelPage)
+	http.HandleFunc("/returns/photo", api.ReturnPhoto)
+	http.HandleFunc("/notifications/unsubscribe", api.UnsubscribeNotifications)
 	// WebSocket routes
 	http.HandleFunc("/ws/dashboard", api.DashboardWebSocketHandler)
+	http.HandleFunc("/ws/notifications", api.NotificationsWebSocketHandler)
+	http.HandleFunc("/ws/orders", api.OrdersWebSocketHandler)
+	http.HandleFunc("/ws/customer/orders", api.CustomerOrdersWebSocketHandler)
 
-	// Admin API routes
-	http.HandleFunc("/api/admin/stats", api.AdminStats)
-	http.HandleFunc("/api/admin/stores", api.AdminStores)
-	http.HandleFunc("/api/admin/users", api.AdminUsers)
-	http.HandleFunc("/api/admin/orders", api.AdminOrders)
-	http.HandleFunc("/api/admin/products", api.AdminProducts)
-
-	// 3D Model API routes
-	http.HandleFunc("/api/check-3d-model", api.Check3DModel)
-	http.HandleFunc("/api/get-3d-model", api.Get3DModel)
-	http.HandleFunc("/api/list-3d-models", api.ListProducts3DModels)
+	// Observability routes
+	http.HandleFunc("/metrics", api.MetricsHandler)
+	http.HandleFunc("/healthz", api.HealthzHandler)
+	http.HandleFunc("/readyz", api.ReadyzHandler)
 
 	// Generate SSL certificates if needed
 	if err := generateCert(); err != nil {
-		log.Fatal("Failed to generate certificates:", err)
+		slog.Error("failed to generate certificates", "error", err)
+		os.Exit(1)
 	}
 
 	ip, err := api.GetIPv4()
 	if err != nil {
-		log.Fatal("Failed to start server:", err)
+		slog.Error("failed to start server", "error", err)
+		os.Exit(1)
 	}
 
-	fmt.Println("Server running on:")
-	fmt.Println("  Local:   https://localhost:443")
-	fmt.Println("  Network: https://" + ip + ":443")
+	slog.Info("server running", "local", "https://localhost:443", "network", "https://"+ip+":443")
+
+	workers, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = 2
+	}
+	api.StartJobWorkers(context.Background(), workers)
+	api.StartSearchIndex(context.Background())
+	api.StartWebhooks(context.Background())
+	if err := api.StartEventBroker(context.Background()); err != nil {
+		slog.Error("failed to configure event broker", "error", err)
+		os.Exit(1)
+	}
+
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go api.ServeMetrics(addr)
+	}
 
-	if err := http.ListenAndServeTLS(":443", "cert.pem", "key.pem", nil); err != nil {
-		log.Fatal("Failed to start server:", err)
+	if err := http.ListenAndServeTLS(":443", api.CertFile, api.KeyFile, api.RequestLogger(api.InstrumentHandler(http.DefaultServeMux))); err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
 	}
 
 	// if err := http.ListenAndServe("0.0.0.0:80", nil); err != nil {